@@ -0,0 +1,353 @@
+package apiserver
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"cni/utils/rest"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"k8s.io/klog"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// NetworkResp is a network of the datastore together with its usage.
+type NetworkResp struct {
+	Network *etcd.NetworkCrd  `json:"network"`
+	Usage   ipam.NetworkUsage `json:"usage"`
+}
+
+type NetworkRespList struct {
+	Items []NetworkResp `json:"items"`
+}
+
+type AllocatedIpList struct {
+	Items []etcd.AllocatedIp `json:"items"`
+}
+
+type BlockList struct {
+	Items []etcd.Block `json:"items"`
+}
+
+// SubnetResp is a subnet of a network together with its usage.
+type SubnetResp struct {
+	Subnet etcd.Subnet      `json:"subnet"`
+	Usage  ipam.SubnetUsage `json:"usage"`
+}
+
+type SubnetRespList struct {
+	Items []SubnetResp `json:"items"`
+}
+
+// writeError answers err with the status of its ipam error code, anything
+// else is a 500.
+func writeError(req *restful.Request, resp *restful.Response, err error) {
+	switch {
+	case ipam.IsNetworkNotFound(err), ipam.IsSubnetNotFound(err):
+		rest.WriteError(resp, http.StatusNotFound, rest.StatusNotFound, err.Error())
+		return
+	case ipam.IsInvalidNetwork(err):
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, err.Error())
+		return
+	case ipam.IsNetworkExists(err), ipam.IsSubnetExists(err), ipam.IsNetworkInUse(err):
+		rest.WriteError(resp, http.StatusConflict, rest.StatusConflict, err.Error())
+		return
+	}
+	klog.Errorf("failed to answer %s, err is %v", req.Request.URL.Path, err)
+	rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
+}
+
+func (s *Server) networkResp(network *etcd.NetworkCrd) (NetworkResp, error) {
+	usage, err := ipam.GetNetworkUsage(s.store, network)
+	if err != nil {
+		return NetworkResp{}, err
+	}
+	return NetworkResp{Network: network, Usage: usage}, nil
+}
+
+func (s *Server) listNetworks(req *restful.Request, resp *restful.Response) {
+	networks, err := ipam.ListNetworks(s.store)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := NetworkRespList{Items: []NetworkResp{}}
+	for _, name := range names {
+		network := networks[name]
+		item, err := s.networkResp(&network)
+		if err != nil {
+			writeError(req, resp, err)
+			return
+		}
+		list.Items = append(list.Items, item)
+	}
+	_ = resp.WriteAsJson(list)
+}
+
+func (s *Server) getNetwork(req *restful.Request, resp *restful.Response) {
+	network, err := ipam.GetNetwork(s.store, req.PathParameter("network"))
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	item, err := s.networkResp(network)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	_ = resp.WriteAsJson(item)
+}
+
+func (s *Server) listIps(req *restful.Request, resp *restful.Response) {
+	name := req.PathParameter("network")
+	if _, err := ipam.GetNetwork(s.store, name); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	ips, err := ipam.ListAllocatedIps(s.store, name)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if ips[i].Subnet != ips[j].Subnet {
+			return ips[i].Subnet < ips[j].Subnet
+		}
+		return ips[i].Ip < ips[j].Ip
+	})
+	_ = resp.WriteAsJson(AllocatedIpList{Items: append([]etcd.AllocatedIp{}, ips...)})
+}
+
+func (s *Server) listBlocks(req *restful.Request, resp *restful.Response) {
+	name := req.PathParameter("network")
+	if _, err := ipam.GetNetwork(s.store, name); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	blocks, err := ipam.ListBlocks(s.store, etcd.BlocksKey()+name+"/")
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Subnet != blocks[j].Subnet {
+			return blocks[i].Subnet < blocks[j].Subnet
+		}
+		return blocks[i].CIDR < blocks[j].CIDR
+	})
+	_ = resp.WriteAsJson(BlockList{Items: append([]etcd.Block{}, blocks...)})
+}
+
+func (s *Server) getPodNetwork(req *restful.Request, resp *restful.Response) {
+	namespace, name := req.PathParameter("namespace"), req.PathParameter("pod")
+	pod, err := datastore.GetPod(s.store, namespace, name)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	if pod == nil {
+		rest.WriteError(resp, http.StatusNotFound, rest.StatusNotFound, fmt.Sprintf("pod %s/%s has no network record", namespace, name))
+		return
+	}
+	_ = resp.WriteAsJson(pod)
+}
+
+// forceParameter reads the force query parameter, false when it is missing.
+func forceParameter(req *restful.Request, resp *restful.Response) (bool, bool) {
+	value := req.QueryParameter("force")
+	if value == "" {
+		return false, true
+	}
+	force, err := strconv.ParseBool(value)
+	if err != nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("invalid force %q, expected true or false", value))
+		return false, false
+	}
+	return force, true
+}
+
+// writeNetwork answers the network name as it is now in the datastore.
+func (s *Server) writeNetwork(req *restful.Request, resp *restful.Response, statusCode int, name string) {
+	network, err := ipam.GetNetwork(s.store, name)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	item, err := s.networkResp(network)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	_ = resp.WriteHeaderAndJson(statusCode, item, restful.MIME_JSON)
+}
+
+func (s *Server) createNetwork(req *restful.Request, resp *restful.Response) {
+	network := &etcd.NetworkCrd{}
+	if err := req.ReadEntity(network); err != nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("failed to decode the network: %v", err))
+		return
+	}
+	if err := ipam.CreateNetworkCrd(s.store, network); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("created network %s for %s", network.Name, clientName(req))
+	s.writeNetwork(req, resp, http.StatusCreated, network.Name)
+}
+
+func (s *Server) updateNetwork(req *restful.Request, resp *restful.Response) {
+	name := req.PathParameter("network")
+	network := &etcd.NetworkCrd{}
+	if err := req.ReadEntity(network); err != nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("failed to decode the network: %v", err))
+		return
+	}
+	if network.Name == "" {
+		network.Name = name
+	}
+	if network.Name != name {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("network %s cannot be renamed to %s", name, network.Name))
+		return
+	}
+	if err := ipam.UpdateNetworkCrd(s.store, network); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("updated network %s for %s", name, clientName(req))
+	s.writeNetwork(req, resp, http.StatusOK, name)
+}
+
+func (s *Server) deleteNetwork(req *restful.Request, resp *restful.Response) {
+	name := req.PathParameter("network")
+	force, ok := forceParameter(req, resp)
+	if !ok {
+		return
+	}
+	deleteNetwork := ipam.DeleteNetworkCrd
+	if force {
+		deleteNetwork = ipam.ForceDeleteNetworkCrd
+	}
+	if err := deleteNetwork(s.store, name); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("deleted network %s for %s, force is %v", name, clientName(req), force)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// subnetResps pairs the subnets of network with their usage.
+func (s *Server) subnetResps(network *etcd.NetworkCrd) ([]SubnetResp, error) {
+	usage, err := ipam.GetNetworkUsage(s.store, network)
+	if err != nil {
+		return nil, err
+	}
+	usages := make(map[string]ipam.SubnetUsage, len(usage.Subnets))
+	for _, subnetUsage := range usage.Subnets {
+		usages[subnetUsage.Name] = subnetUsage
+	}
+	items := []SubnetResp{}
+	for _, subnet := range network.Subnets {
+		items = append(items, SubnetResp{Subnet: subnet, Usage: usages[subnet.Name]})
+	}
+	return items, nil
+}
+
+func (s *Server) listSubnets(req *restful.Request, resp *restful.Response) {
+	network, err := ipam.GetNetwork(s.store, req.PathParameter("network"))
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	items, err := s.subnetResps(network)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	_ = resp.WriteAsJson(SubnetRespList{Items: items})
+}
+
+// writeSubnet answers the subnet name of network as it is now in the
+// datastore.
+func (s *Server) writeSubnet(req *restful.Request, resp *restful.Response, statusCode int, networkName, name string) {
+	network, err := ipam.GetNetwork(s.store, networkName)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	items, err := s.subnetResps(network)
+	if err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	for _, item := range items {
+		if item.Subnet.Name == name {
+			_ = resp.WriteHeaderAndJson(statusCode, item, restful.MIME_JSON)
+			return
+		}
+	}
+	writeError(req, resp, ipam.NewSubnetNotFoundError(networkName, name))
+}
+
+func (s *Server) getSubnet(req *restful.Request, resp *restful.Response) {
+	s.writeSubnet(req, resp, http.StatusOK, req.PathParameter("network"), req.PathParameter("subnet"))
+}
+
+func (s *Server) createSubnet(req *restful.Request, resp *restful.Response) {
+	networkName := req.PathParameter("network")
+	subnet := etcd.Subnet{}
+	if err := req.ReadEntity(&subnet); err != nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("failed to decode the subnet: %v", err))
+		return
+	}
+	if err := ipam.AddSubnet(s.store, networkName, subnet); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("added subnet %s (%s) to network %s for %s", subnet.Name, subnet.CIDR, networkName, clientName(req))
+	s.writeSubnet(req, resp, http.StatusCreated, networkName, subnet.Name)
+}
+
+// updateSubnet replaces a subnet, shrinking or moving it is refused while
+// addresses it drops are in use.
+func (s *Server) updateSubnet(req *restful.Request, resp *restful.Response) {
+	networkName, name := req.PathParameter("network"), req.PathParameter("subnet")
+	subnet := etcd.Subnet{}
+	if err := req.ReadEntity(&subnet); err != nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("failed to decode the subnet: %v", err))
+		return
+	}
+	if subnet.Name == "" {
+		subnet.Name = name
+	}
+	if subnet.Name != name {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("subnet %s cannot be renamed to %s", name, subnet.Name))
+		return
+	}
+	if err := ipam.UpdateSubnet(s.store, networkName, subnet); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("updated subnet %s (%s) of network %s for %s", name, subnet.CIDR, networkName, clientName(req))
+	s.writeSubnet(req, resp, http.StatusOK, networkName, name)
+}
+
+func (s *Server) deleteSubnet(req *restful.Request, resp *restful.Response) {
+	networkName, name := req.PathParameter("network"), req.PathParameter("subnet")
+	force, ok := forceParameter(req, resp)
+	if !ok {
+		return
+	}
+	if err := ipam.DeleteSubnet(s.store, networkName, name, force); err != nil {
+		writeError(req, resp, err)
+		return
+	}
+	klog.Infof("deleted subnet %s of network %s for %s, force is %v", name, networkName, clientName(req), force)
+	resp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package apiserver
+
+import (
+	"cni/consts"
+	"cni/datastore"
+	"cni/utils/k8s"
+	"cni/utils/rest"
+	"crypto/x509"
+	"github.com/emicklei/go-restful"
+	"k8s.io/klog"
+	"net/http"
+)
+
+// Server answers the tinycni api under consts.DEFAULT_TEST_CNI_API, the
+// kubernetes views go to the api server, the tinycni ones to the datastore.
+type Server struct {
+	store     datastore.Datastore
+	k8sClient *k8s.Client
+	// clientCAs signs the certificates clients must present
+	clientCAs *x509.CertPool
+}
+
+func NewServer(store datastore.Datastore, k8sClient *k8s.Client, clientCAs *x509.CertPool) *Server {
+	return &Server{store: store, k8sClient: k8sClient, clientCAs: clientCAs}
+}
+
+// NewContainer mounts the routes of s, the tls.Config serving it must ask
+// for client certificates with tls.RequestClientCert so that a missing or
+// invalid one is answered with ErrCertIsNeeded or ErrCertInvalid instead of a
+// failed handshake.
+func NewContainer(s *Server) *restful.Container {
+	container := restful.NewContainer()
+	ws := new(restful.WebService)
+	ws.Path(consts.DEFAULT_TEST_CNI_API).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Filter(s.authenticate)
+
+	ws.Route(ws.GET("/nodes").To(s.k8sClient.GetNodeList).Doc("the k8s nodes with their Ready condition"))
+	ws.Route(ws.GET("/pods").To(s.k8sClient.GetPodList).Doc("the running k8s pods"))
+	ws.Route(ws.GET("/services").To(s.k8sClient.GetServiceList).Doc("the k8s services with their endpoints"))
+	ws.Route(ws.GET("/endpoints").To(s.k8sClient.GetEndPointList).Doc("the k8s endpoints"))
+	ws.Route(ws.GET("/networkcrds").To(s.k8sClient.GetNetworkCrdList).Doc("the network-attachment-definitions"))
+
+	ws.Route(ws.GET("/networks").To(s.listNetworks).Doc("the networks of the datastore with their usage"))
+	ws.Route(ws.POST("/networks").To(s.createNetwork).Doc("create a network, answers 409 when it exists"))
+	ws.Route(ws.GET("/networks/{network}").To(s.getNetwork).
+		Param(ws.PathParameter("network", "the name of the network")))
+	ws.Route(ws.PUT("/networks/{network}").To(s.updateNetwork).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Doc("replace a network, answers 409 when addresses in use would be dropped"))
+	ws.Route(ws.DELETE("/networks/{network}").To(s.deleteNetwork).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Param(ws.QueryParameter("force", "drop the address records too instead of answering 409")))
+	ws.Route(ws.GET("/networks/{network}/subnets").To(s.listSubnets).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Doc("the subnets of the network with their usage"))
+	ws.Route(ws.POST("/networks/{network}/subnets").To(s.createSubnet).
+		Param(ws.PathParameter("network", "the name of the network")))
+	ws.Route(ws.GET("/networks/{network}/subnets/{subnet}").To(s.getSubnet).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Param(ws.PathParameter("subnet", "the name of the subnet")))
+	ws.Route(ws.PUT("/networks/{network}/subnets/{subnet}").To(s.updateSubnet).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Param(ws.PathParameter("subnet", "the name of the subnet")).
+		Doc("replace a subnet, answers 409 when addresses in use would be dropped"))
+	ws.Route(ws.DELETE("/networks/{network}/subnets/{subnet}").To(s.deleteSubnet).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Param(ws.PathParameter("subnet", "the name of the subnet")).
+		Param(ws.QueryParameter("force", "drop the address records too instead of answering 409")))
+	ws.Route(ws.GET("/networks/{network}/ips").To(s.listIps).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Doc("the address records of the network"))
+	ws.Route(ws.GET("/networks/{network}/blocks").To(s.listBlocks).
+		Param(ws.PathParameter("network", "the name of the network")).
+		Doc("the node blocks of the network"))
+	ws.Route(ws.GET("/namespaces/{namespace}/pods/{pod}/network").To(s.getPodNetwork).
+		Param(ws.PathParameter("namespace", "the namespace of the pod")).
+		Param(ws.PathParameter("pod", "the name of the pod")).
+		Doc("the interfaces tinycni wired into the pod"))
+	container.Add(ws)
+	return container
+}
+
+// authenticate lets through requests with a client certificate signed by
+// clientCAs.
+func (s *Server) authenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	state := req.Request.TLS
+	if state == nil || len(state.PeerCertificates) == 0 {
+		rest.WriteError(resp, http.StatusUnauthorized, rest.StatusUnauthorized, rest.ErrCertIsNeeded)
+		return
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         s.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		klog.Warningf("refused client %q from %s, err is %v", state.PeerCertificates[0].Subject.CommonName, req.Request.RemoteAddr, err)
+		rest.WriteError(resp, http.StatusUnauthorized, rest.StatusUnauthorized, rest.ErrCertInvalid)
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// clientName is the common name of the certificate authenticate accepted.
+func clientName(req *restful.Request) string {
+	return req.Request.TLS.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,296 @@
+package apiserver
+
+import (
+	"bytes"
+	"cni/consts"
+	"cni/datastore"
+	"cni/etcd"
+	"cni/etcd/etcdtest"
+	"cni/ipam"
+	"cni/utils/rest"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA signs client certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tinycni-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) clientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestServer serves the api over tls like tinycni-apiserver, the client
+// presents a certificate of the trusted CA.
+func newTestServer(t *testing.T) (*httptest.Server, *http.Client, datastore.Datastore) {
+	t.Helper()
+	ds, _, err := etcdtest.NewDatastore()
+	if err != nil {
+		t.Fatalf("failed to start the etcd datastore: %v", err)
+	}
+	t.Cleanup(func() { _ = ds.Close() })
+	ca := newTestCA(t)
+	server := httptest.NewUnstartedServer(NewContainer(NewServer(ds, nil, ca.pool())))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, clientWith(server, ca.clientCert(t, "admin")), ds
+}
+
+func clientWith(server *httptest.Server, certs ...tls.Certificate) *http.Client {
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+	return &http.Client{Transport: transport}
+}
+
+// call sends body as json and decodes the answer into out when it is not
+// nil, it returns the status code.
+func call(t *testing.T, client *http.Client, server *httptest.Server, method, path string, body, out interface{}) int {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, server.URL+consts.DEFAULT_TEST_CNI_API+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("failed to decode the answer of %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func testNetwork(name, cidr string) *etcd.NetworkCrd {
+	return &etcd.NetworkCrd{Name: name, Subnets: []etcd.Subnet{{Name: "subnet1", CIDR: cidr}}}
+}
+
+func TestAuthenticate(t *testing.T) {
+	server, client, _ := newTestServer(t)
+	tests := []struct {
+		name    string
+		client  *http.Client
+		code    int
+		message string
+	}{
+		{"no certificate", clientWith(server), http.StatusUnauthorized, rest.ErrCertIsNeeded},
+		{"certificate of another CA", clientWith(server, newTestCA(t).clientCert(t, "admin")), http.StatusUnauthorized, rest.ErrCertInvalid},
+		{"trusted certificate", client, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var answer rest.ErrorResp
+			code := call(t, test.client, server, http.MethodGet, "/networks", nil, &answer)
+			if code != test.code || answer.Error.Message != test.message {
+				t.Errorf("GET /networks = %d %q, want %d %q", code, answer.Error.Message, test.code, test.message)
+			}
+		})
+	}
+}
+
+func TestNetworkCrud(t *testing.T) {
+	server, client, _ := newTestServer(t)
+	var created NetworkResp
+	if code := call(t, client, server, http.MethodPost, "/networks", testNetwork("net1", "10.10.0.0/24"), &created); code != http.StatusCreated {
+		t.Fatalf("POST /networks = %d, want %d", code, http.StatusCreated)
+	}
+	if created.Network == nil || created.Network.Name != "net1" {
+		t.Errorf("created network = %+v", created)
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"create existing", http.MethodPost, "/networks", testNetwork("net1", "10.10.0.0/24"), http.StatusConflict},
+		{"create overlapping", http.MethodPost, "/networks", testNetwork("net2", "10.10.0.128/25"), http.StatusBadRequest},
+		{"get", http.MethodGet, "/networks/net1", nil, http.StatusOK},
+		{"get missing", http.MethodGet, "/networks/missing", nil, http.StatusNotFound},
+		{"update missing", http.MethodPut, "/networks/missing", testNetwork("missing", "10.20.0.0/24"), http.StatusNotFound},
+		{"rename", http.MethodPut, "/networks/net1", testNetwork("net2", "10.10.0.0/24"), http.StatusBadRequest},
+		{"grow", http.MethodPut, "/networks/net1", testNetwork("net1", "10.10.0.0/23"), http.StatusOK},
+		{"delete missing", http.MethodDelete, "/networks/missing", nil, http.StatusNotFound},
+		{"invalid force", http.MethodDelete, "/networks/net1?force=maybe", nil, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := call(t, client, server, test.method, test.path, test.body, nil); code != test.code {
+				t.Errorf("%s %s = %d, want %d", test.method, test.path, code, test.code)
+			}
+		})
+	}
+}
+
+func TestDeleteNetworkInUse(t *testing.T) {
+	server, client, ds := newTestServer(t)
+	if code := call(t, client, server, http.MethodPost, "/networks", testNetwork("net1", "10.10.0.0/24"), nil); code != http.StatusCreated {
+		t.Fatalf("POST /networks = %d", code)
+	}
+	args := &ipam.AllocateArgs{Network: "net1", NameSpace: "default", PodName: "web-0", ContainerId: "c1", Node: "node-1"}
+	if _, err := ipam.AllocationIpFromNetwork(ds, args); err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	if code := call(t, client, server, http.MethodDelete, "/networks/net1", nil, nil); code != http.StatusConflict {
+		t.Errorf("DELETE of a network in use = %d, want %d", code, http.StatusConflict)
+	}
+	if code := call(t, client, server, http.MethodDelete, "/networks/net1?force=true", nil, nil); code != http.StatusNoContent {
+		t.Errorf("forced DELETE = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := call(t, client, server, http.MethodGet, "/networks/net1", nil, nil); code != http.StatusNotFound {
+		t.Errorf("GET after the forced DELETE = %d, want %d", code, http.StatusNotFound)
+	}
+	if records, err := ipam.ListAllocatedIps(ds, "net1"); err != nil || len(records) != 0 {
+		t.Errorf("records left = %v, %v", records, err)
+	}
+}
+
+func TestSubnetCrud(t *testing.T) {
+	server, client, ds := newTestServer(t)
+	if code := call(t, client, server, http.MethodPost, "/networks", testNetwork("net1", "10.10.0.0/24"), nil); code != http.StatusCreated {
+		t.Fatalf("POST /networks = %d", code)
+	}
+	var created SubnetResp
+	subnet2 := etcd.Subnet{Name: "subnet2", CIDR: "10.10.1.0/24"}
+	if code := call(t, client, server, http.MethodPost, "/networks/net1/subnets", subnet2, &created); code != http.StatusCreated {
+		t.Fatalf("POST /networks/net1/subnets = %d, want %d", code, http.StatusCreated)
+	}
+	if created.Subnet.Name != "subnet2" || created.Subnet.CIDR != "10.10.1.0/24" {
+		t.Errorf("created subnet = %+v", created)
+	}
+	args := &ipam.AllocateArgs{Network: "net1", NameSpace: "default", PodName: "web-0", ContainerId: "c1", Node: "node-1", IP: "10.10.1.200"}
+	if _, err := ipam.AllocationIpFromNetwork(ds, args); err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"create existing", http.MethodPost, "/networks/net1/subnets", subnet2, http.StatusConflict},
+		{"create in missing network", http.MethodPost, "/networks/missing/subnets", etcd.Subnet{Name: "subnet3", CIDR: "10.30.0.0/24"}, http.StatusNotFound},
+		{"create overlapping", http.MethodPost, "/networks/net1/subnets", etcd.Subnet{Name: "subnet3", CIDR: "10.10.1.128/25"}, http.StatusBadRequest},
+		{"get", http.MethodGet, "/networks/net1/subnets/subnet2", nil, http.StatusOK},
+		{"get missing", http.MethodGet, "/networks/net1/subnets/missing", nil, http.StatusNotFound},
+		{"update missing", http.MethodPut, "/networks/net1/subnets/missing", etcd.Subnet{CIDR: "10.30.0.0/24"}, http.StatusNotFound},
+		{"shrink past an address in use", http.MethodPut, "/networks/net1/subnets/subnet2", etcd.Subnet{CIDR: "10.10.1.0/25"}, http.StatusConflict},
+		{"grow", http.MethodPut, "/networks/net1/subnets/subnet2", etcd.Subnet{CIDR: "10.10.0.0/23"}, http.StatusBadRequest},
+		{"rename", http.MethodPut, "/networks/net1/subnets/subnet2", etcd.Subnet{Name: "subnet3", CIDR: "10.10.1.0/24"}, http.StatusBadRequest},
+		{"delete in use", http.MethodDelete, "/networks/net1/subnets/subnet2", nil, http.StatusConflict},
+		{"force delete", http.MethodDelete, "/networks/net1/subnets/subnet2?force=true", nil, http.StatusNoContent},
+		{"get deleted", http.MethodGet, "/networks/net1/subnets/subnet2", nil, http.StatusNotFound},
+		{"delete last", http.MethodDelete, "/networks/net1/subnets/subnet1", nil, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := call(t, client, server, test.method, test.path, test.body, nil); code != test.code {
+				t.Errorf("%s %s = %d, want %d", test.method, test.path, code, test.code)
+			}
+		})
+	}
+}
+
+func TestConcurrentSubnetCreates(t *testing.T) {
+	server, client, ds := newTestServer(t)
+	if code := call(t, client, server, http.MethodPost, "/networks", testNetwork("net1", "10.10.0.0/24"), nil); code != http.StatusCreated {
+		t.Fatalf("POST /networks = %d", code)
+	}
+	const subnets = 8
+	var wg sync.WaitGroup
+	for i := 0; i < subnets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			subnet := etcd.Subnet{Name: fmt.Sprintf("extra%d", i), CIDR: fmt.Sprintf("10.11.%d.0/24", i)}
+			if code := call(t, client, server, http.MethodPost, "/networks/net1/subnets", subnet, nil); code != http.StatusCreated {
+				t.Errorf("POST of %s = %d, want %d", subnet.Name, code, http.StatusCreated)
+			}
+		}(i)
+	}
+	wg.Wait()
+	network, err := ipam.GetNetwork(ds, "net1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(network.Subnets) != subnets+1 {
+		t.Errorf("network has %d subnets, want %d: %+v", len(network.Subnets), subnets+1, network.Subnets)
+	}
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ArchiveAPIVersion = "tinycni.io/v1"
+	ArchiveKind       = "Backup"
+
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// Archive is a snapshot of everything under a tinycni prefix. Keys are kept
+// relative to Prefix, so an archive restores under any prefix.
+type Archive struct {
+	APIVersion    string   `json:"apiVersion" yaml:"apiVersion"`
+	Kind          string   `json:"kind" yaml:"kind"`
+	SchemaVersion int      `json:"schemaVersion" yaml:"schemaVersion"`
+	Prefix        string   `json:"prefix" yaml:"prefix"`
+	ClusterID     string   `json:"clusterId,omitempty" yaml:"clusterId,omitempty"`
+	CreatedAt     string   `json:"createdAt" yaml:"createdAt"`
+	Records       []Record `json:"records" yaml:"records"`
+}
+
+type Record struct {
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// Export snapshots ds, the schema and cluster keys are kept as the version and
+// the cluster id of the archive.
+func Export(ds datastore.Datastore) (*Archive, error) {
+	version, err := datastore.LoadSchema(ds)
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := ds.List(etcd.Prefix())
+	if err != nil {
+		return nil, err
+	}
+	delete(kvs, etcd.SchemaKey())
+	delete(kvs, etcd.ClusterKey())
+	archive := &Archive{
+		APIVersion:    ArchiveAPIVersion,
+		Kind:          ArchiveKind,
+		SchemaVersion: version,
+		Prefix:        etcd.Prefix(),
+		ClusterID:     etcd.ClusterID(),
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range kvs {
+		archive.Records = append(archive.Records, Record{Key: strings.TrimPrefix(key, etcd.Prefix()), Value: value})
+	}
+	sort.Slice(archive.Records, func(i, j int) bool {
+		return archive.Records[i].Key < archive.Records[j].Key
+	})
+	return archive, nil
+}
+
+func Write(w io.Writer, archive *Archive, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "", FormatJSON:
+		data, err = json.MarshalIndent(archive, "", "  ")
+		data = append(data, '\n')
+	case FormatYAML:
+		data, err = yaml.Marshal(archive)
+	default:
+		return fmt.Errorf("unknown archive format %q, expected %s or %s", format, FormatJSON, FormatYAML)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Read decodes an archive of either format, json is told apart by its
+// leading brace.
+func Read(r io.Reader) (*Archive, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	archive := &Archive{}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		err = json.Unmarshal(data, archive)
+	} else {
+		err = yaml.Unmarshal(data, archive)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode archive: %v", err)
+	}
+	if archive.APIVersion != ArchiveAPIVersion || archive.Kind != ArchiveKind {
+		return nil, fmt.Errorf("not a tinycni archive: apiVersion %q, kind %q", archive.APIVersion, archive.Kind)
+	}
+	if archive.SchemaVersion < etcd.SchemaVersionLegacy || archive.SchemaVersion > etcd.SchemaVersion {
+		return nil, fmt.Errorf("archive has schema version %d, this tinycni knows %d to %d", archive.SchemaVersion, etcd.SchemaVersionLegacy, etcd.SchemaVersion)
+	}
+	return archive, nil
+}
@@ -0,0 +1,486 @@
+package backup
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restoreBatch keeps a restore transaction below the default etcd limit of
+// operations per txn.
+const restoreBatch = 100
+
+type RestoreOptions struct {
+	// Prefix the records are restored under, the tinycni prefix when empty.
+	Prefix string
+	// ClusterID the records are stamped with. When empty it is the cluster
+	// that claimed Prefix, else the one of this process for its own prefix
+	// and the one of the archive for any other.
+	ClusterID string
+	// Overwrite replaces records that differ instead of failing.
+	Overwrite bool
+	DryRun    bool
+}
+
+// Report lists the keys of a restore relative to its prefix.
+type Report struct {
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Skipped   []string
+	Conflicts []string
+}
+
+type restoreRecord struct {
+	rel   string
+	value string
+	// the value as seen under etcd.Prefix(), where it is validated
+	canonical string
+}
+
+// Restore writes archive into ds under opts.Prefix. The archive is merged
+// with what ds already holds and the result is validated before anything is
+// written, a record that differs from the stored one is a conflict unless
+// opts.Overwrite is set. Node records are skipped, their lease lives with the
+// node that registers them, and so is the usage of the archive, it is counted
+// again from the merged addresses. The others are stamped with the cluster
+// id of the prefix, which is claimed when no cluster did yet.
+//
+// Restore is not atomic: the records are written in transactions of
+// restoreBatch, a failure leaves the batches before it written and others
+// may read a partly restored prefix meanwhile. The usage of every network is
+// counted last, in the transaction that writes it.
+func Restore(ds datastore.Datastore, archive *Archive, opts RestoreOptions) (*Report, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = etcd.Prefix()
+	}
+	if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return nil, fmt.Errorf("prefix %q must start and end with /", prefix)
+	}
+	schemaKey := prefix + etcd.SchemaKeyName
+	clusterKey := prefix + etcd.ClusterKeyName
+	schema, err := ds.Get(schemaKey)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := ds.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	clusterID, claimed, err := restoreCluster(stored[clusterKey], prefix, archive, opts)
+	if err != nil {
+		return nil, err
+	}
+	delete(stored, schemaKey)
+	delete(stored, clusterKey)
+	if schema != "" || len(stored) > 0 {
+		version, err := datastore.ParseSchemaVersion(schema)
+		if err != nil {
+			return nil, err
+		}
+		if version != archive.SchemaVersion {
+			return nil, fmt.Errorf("datastore is at schema version %d but the archive at %d, migrate the older one first", version, archive.SchemaVersion)
+		}
+	}
+
+	// the view decodes with the cluster id of this process
+	view := datastore.NewMemoryDatastore()
+	for key, value := range stored {
+		rel := strings.TrimPrefix(key, prefix)
+		if restamped, err := etcd.Restamp(etcd.Prefix()+rel, value, etcd.ClusterID()); err == nil {
+			value = restamped
+		}
+		_ = view.Put(etcd.Prefix()+rel, rebase(rel, value, prefix, etcd.Prefix()))
+	}
+	report := &Report{}
+	var records []restoreRecord
+	for _, record := range archive.Records {
+		if strings.HasPrefix(record.Key, "/") || strings.Contains(record.Key, "..") {
+			return nil, fmt.Errorf("invalid key %q in archive", record.Key)
+		}
+		key := etcd.Prefix() + record.Key
+		if strings.HasPrefix(key, etcd.NodesKey()) || strings.HasPrefix(key, etcd.Prefix()+etcd.UsageKeyName+"/") ||
+			key == etcd.SchemaKey() || key == etcd.ClusterKey() {
+			report.Skipped = append(report.Skipped, record.Key)
+			continue
+		}
+		value, err := etcd.Restamp(key, record.Value, clusterID)
+		if err != nil {
+			return nil, err
+		}
+		canonical, err := etcd.Restamp(key, record.Value, etcd.ClusterID())
+		if err != nil {
+			return nil, err
+		}
+		r := restoreRecord{
+			rel:       record.Key,
+			value:     rebase(record.Key, value, archive.Prefix, prefix),
+			canonical: rebase(record.Key, canonical, archive.Prefix, etcd.Prefix()),
+		}
+		current, ok := stored[prefix+record.Key]
+		switch {
+		case !ok:
+			report.Created = append(report.Created, record.Key)
+		case current == r.value:
+			report.Unchanged = append(report.Unchanged, record.Key)
+			continue
+		default:
+			report.Conflicts = append(report.Conflicts, record.Key)
+			report.Updated = append(report.Updated, record.Key)
+		}
+		_ = view.Put(key, r.canonical)
+		records = append(records, r)
+	}
+	if len(report.Conflicts) > 0 && !opts.Overwrite {
+		report.Updated = nil
+		return report, fmt.Errorf("%d records differ from the datastore, first %s, restore with overwrite to replace them", len(report.Conflicts), report.Conflicts[0])
+	}
+	var problems []string
+	for _, r := range records {
+		if err := validate(view, etcd.Prefix()+r.rel, r.canonical); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", r.rel, err))
+		}
+	}
+	if len(problems) > 0 {
+		return report, fmt.Errorf("archive does not validate:\n  %s", strings.Join(problems, "\n  "))
+	}
+	usage, err := countUsage(view)
+	if err != nil {
+		return report, err
+	}
+	networks := make(map[string]bool)
+	for _, rel := range usageKeys(usage, stored, prefix) {
+		networks[strings.Split(rel, "/")[1]] = true
+		value, current := usage[rel], stored[prefix+rel]
+		switch {
+		case value == current:
+			report.Unchanged = append(report.Unchanged, rel)
+		case current == "":
+			report.Created = append(report.Created, rel)
+		default:
+			report.Updated = append(report.Updated, rel)
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := claimCluster(ds, prefix, clusterID, claimed); err != nil {
+		return report, err
+	}
+	for start := 0; start < len(records); start += restoreBatch {
+		end := start + restoreBatch
+		if end > len(records) {
+			end = len(records)
+		}
+		err := ds.Update(func(tx datastore.Txn) error {
+			for _, r := range records[start:end] {
+				key := prefix + r.rel
+				if current := tx.Get(key); current != "" && current != r.value && !opts.Overwrite {
+					return fmt.Errorf("%s changed while restoring", r.rel)
+				}
+				tx.Put(key, r.value)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("restored %d of %d records: %v", start, len(records), err)
+		}
+	}
+	sorted := make([]string, 0, len(networks))
+	for network := range networks {
+		sorted = append(sorted, network)
+	}
+	sort.Strings(sorted)
+	for _, network := range sorted {
+		if err := recountUsage(ds, prefix, network); err != nil {
+			return report, fmt.Errorf("failed to count the usage of network %s: %v", network, err)
+		}
+	}
+	if schema == "" {
+		value, err := json.Marshal(etcd.Schema{Version: archive.SchemaVersion})
+		if err != nil {
+			return report, err
+		}
+		if err := ds.Put(schemaKey, string(value)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// restoreCluster picks the cluster id records restored under prefix are
+// stamped with, claimed tells that prefix has to be claimed for it first.
+func restoreCluster(stored, prefix string, archive *Archive, opts RestoreOptions) (string, bool, error) {
+	if stored != "" {
+		var cluster etcd.Cluster
+		if err := json.Unmarshal([]byte(stored), &cluster); err != nil {
+			return "", false, fmt.Errorf("failed to decode the cluster of %s: %v", prefix, err)
+		}
+		if opts.ClusterID != "" && opts.ClusterID != cluster.ClusterID {
+			return "", false, fmt.Errorf("prefix %s belongs to cluster %s, not %s", prefix, cluster.ClusterID, opts.ClusterID)
+		}
+		return cluster.ClusterID, false, nil
+	}
+	id := opts.ClusterID
+	if id == "" && prefix == etcd.Prefix() {
+		id = etcd.ClusterID()
+	} else if id == "" {
+		id = archive.ClusterID
+	}
+	return id, id != "", nil
+}
+
+// claimCluster registers prefix for clusterID and, with claim, claims it
+// unless another cluster did in the meantime.
+func claimCluster(ds datastore.Datastore, prefix, clusterID string, claim bool) error {
+	clusterKey := prefix + etcd.ClusterKeyName
+	value, err := json.Marshal(etcd.Cluster{ClusterID: clusterID, CreatedAt: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	return ds.Update(func(tx datastore.Txn) error {
+		if err := datastore.RegisterPrefix(tx, prefix, clusterID); err != nil {
+			return err
+		}
+		if !claim {
+			return nil
+		}
+		stored := tx.Get(clusterKey)
+		if stored == "" {
+			tx.Put(clusterKey, string(value))
+			return nil
+		}
+		var cluster etcd.Cluster
+		if err := json.Unmarshal([]byte(stored), &cluster); err != nil || cluster.ClusterID != clusterID {
+			return fmt.Errorf("%s was claimed by another cluster while restoring", clusterKey)
+		}
+		return nil
+	})
+}
+
+// countUsage counts the allocated addresses of view per namespace and tenant,
+// keyed like the usage records relative to the prefix.
+func countUsage(view datastore.Datastore) (map[string]string, error) {
+	records, err := ipam.ListAllocatedIps(view, "")
+	if err != nil {
+		return nil, err
+	}
+	return tally(records), nil
+}
+
+// recountUsage replaces the usage of network under prefix with the count of
+// its addresses, read in the same transaction so that no allocation or
+// release in between is lost.
+func recountUsage(ds datastore.Datastore, prefix, network string) error {
+	rel := func(key string) string {
+		return strings.TrimPrefix(key, etcd.Prefix())
+	}
+	return ds.Update(func(tx datastore.Txn) error {
+		var records []etcd.AllocatedIp
+		for key, value := range tx.List(prefix + rel(etcd.IpamKey(network))) {
+			// decode with the cluster id of this process like the view
+			var record etcd.AllocatedIp
+			value, err := etcd.Restamp(etcd.Prefix()+strings.TrimPrefix(key, prefix), value, etcd.ClusterID())
+			if err != nil || etcd.Decode(value, &record) != nil {
+				continue
+			}
+			records = append(records, record)
+		}
+		usage := tally(records)
+		for key, current := range tx.List(prefix + rel(etcd.UsagesKey(network))) {
+			if value, ok := usage[strings.TrimPrefix(key, prefix)]; !ok {
+				tx.Del(key)
+			} else if value == current {
+				delete(usage, strings.TrimPrefix(key, prefix))
+			}
+		}
+		for r, value := range usage {
+			tx.Put(prefix+r, value)
+		}
+		return nil
+	})
+}
+
+// tally counts the allocated records per namespace and tenant, keyed like
+// the usage records relative to the prefix.
+func tally(records []etcd.AllocatedIp) map[string]string {
+	counts := make(map[string]int)
+	for _, record := range records {
+		if record.State != "" && record.State != etcd.IpStateAllocated {
+			continue
+		}
+		counts[etcd.UsageKey(record.Network, etcd.UsageNamespaces, record.NameSpace)]++
+		if record.Tenant != "" {
+			counts[etcd.UsageKey(record.Network, etcd.UsageTenants, record.Tenant)]++
+		}
+	}
+	usage := make(map[string]string, len(counts))
+	for key, count := range counts {
+		usage[strings.TrimPrefix(key, etcd.Prefix())] = strconv.Itoa(count)
+	}
+	return usage
+}
+
+// usageKeys returns the usage keys relative to prefix that are counted or
+// stored, sorted.
+func usageKeys(usage, stored map[string]string, prefix string) []string {
+	keys := make(map[string]bool, len(usage))
+	for rel := range usage {
+		keys[rel] = true
+	}
+	for key := range stored {
+		if rel := strings.TrimPrefix(key, prefix); strings.HasPrefix(rel, etcd.UsageKeyName+"/") {
+			keys[rel] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for rel := range keys {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// rebase moves the values that hold keys, the container and allocation
+// indexes, from one prefix to another.
+func rebase(rel, value, from, to string) string {
+	indexed := strings.HasPrefix(rel, etcd.ContainersKeyName+"/") || strings.HasPrefix(rel, etcd.AllocationsKeyName+"/")
+	if indexed && strings.HasPrefix(value, from) {
+		return to + strings.TrimPrefix(value, from)
+	}
+	return value
+}
+
+// validate checks one record against the merged view of the datastore and
+// the archive.
+func validate(view datastore.Datastore, key, value string) error {
+	switch etcd.RecordKind(key) {
+	case "NetworkCrd":
+		var network etcd.NetworkCrd
+		if err := etcd.Decode(value, &network); err != nil {
+			return err
+		}
+		if etcd.NetworkKey(network.Name) != key {
+			return fmt.Errorf("holds network %s", network.Name)
+		}
+		return ipam.ValidateNetwork(view, &network)
+	case "AllocatedIp":
+		var record etcd.AllocatedIp
+		if err := etcd.Decode(value, &record); err != nil {
+			return err
+		}
+		if etcd.IpKey(record.Network, record.Subnet, record.Ip) != key {
+			return fmt.Errorf("holds %s of subnet %s of network %s", record.Ip, record.Subnet, record.Network)
+		}
+		ipNet, err := subnetOf(view, record.Network, record.Subnet)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(record.Ip); ip == nil || !ipNet.Contains(ip) {
+			return fmt.Errorf("%s is outside of subnet %s (%s)", record.Ip, record.Subnet, ipNet)
+		}
+		return nil
+	case "Block":
+		var block etcd.Block
+		if err := etcd.Decode(value, &block); err != nil {
+			return err
+		}
+		if etcd.BlockKey(block.Network, block.Subnet, block.CIDR) != key {
+			return fmt.Errorf("holds block %s of subnet %s of network %s", block.CIDR, block.Subnet, block.Network)
+		}
+		ipNet, err := subnetOf(view, block.Network, block.Subnet)
+		if err != nil {
+			return err
+		}
+		_, blockNet, err := net.ParseCIDR(block.CIDR)
+		if err != nil {
+			return err
+		}
+		if blockOnes, _ := blockNet.Mask.Size(); !ipNet.Contains(blockNet.IP) || blockOnes < prefixLen(ipNet) {
+			return fmt.Errorf("block %s is outside of subnet %s (%s)", block.CIDR, block.Subnet, ipNet)
+		}
+		blocks, err := ipam.ListBlocks(view, etcd.SubnetBlocksKey(block.Network, block.Subnet))
+		if err != nil {
+			return err
+		}
+		for _, other := range blocks {
+			_, otherNet, err := net.ParseCIDR(other.CIDR)
+			if err == nil && other.CIDR != block.CIDR && (otherNet.Contains(blockNet.IP) || blockNet.Contains(otherNet.IP)) {
+				return fmt.Errorf("block %s of %s overlaps block %s of %s", block.CIDR, block.Node, other.CIDR, other.Node)
+			}
+		}
+		return nil
+	case "Pod":
+		var pod etcd.Pod
+		if err := etcd.Decode(value, &pod); err != nil {
+			return err
+		}
+		for _, eth := range pod.PodEths {
+			if eth.NetworkCrd == "" {
+				continue
+			}
+			if _, err := ipam.GetNetwork(view, eth.NetworkCrd); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Quota":
+		var quota etcd.Quota
+		if err := etcd.Decode(value, &quota); err != nil {
+			return err
+		}
+		_, err := ipam.GetNetwork(view, quota.Network)
+		return err
+	case "ClusterConfig":
+		var config etcd.ClusterConfig
+		if err := etcd.Decode(value, &config); err != nil {
+			return err
+		}
+		for _, cidr := range append(append([]string{}, config.ServiceCIDRs...), config.NodeCIDRs...) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(key, etcd.ContainersKey()):
+		if pod, _ := view.Get(value); pod == "" {
+			return fmt.Errorf("indexes the missing pod %s", value)
+		}
+		return nil
+	case strings.HasPrefix(key, etcd.Prefix()+etcd.AllocationsKeyName+"/"):
+		if record, _ := view.Get(value); record == "" {
+			return fmt.Errorf("indexes the missing address %s", value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown key")
+}
+
+func subnetOf(view datastore.Datastore, networkName, subnetName string) (*net.IPNet, error) {
+	network, err := ipam.GetNetwork(view, networkName)
+	if err != nil {
+		return nil, err
+	}
+	for _, subnet := range network.Subnets {
+		if subnet.Name == subnetName {
+			_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+			return ipNet, err
+		}
+	}
+	return nil, fmt.Errorf("network %s has no subnet %s", networkName, subnetName)
+}
+
+func prefixLen(ipNet *net.IPNet) int {
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cni/apiserver"
+	"cni/consts"
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/k8s"
+	"cni/utils/log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"k8s.io/klog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// tinycni-apiserver serves the tinycni api to clients holding a certificate
+// of the client ca.
+type Options struct {
+	BindAddress  string
+	Port         int
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	Datastore    string
+	Scope        etcd.Scope
+	Etcd         *etcd.Flags
+	K8s          *k8s.Flags
+}
+
+func NewOptions() *Options {
+	port, _ := strconv.Atoi(consts.DEFAULT_TMP_PORT)
+	return &Options{
+		BindAddress:  "0.0.0.0",
+		Port:         port,
+		CertFile:     "/etc/tinycni/apiserver/tls.crt",
+		KeyFile:      "/etc/tinycni/apiserver/tls.key",
+		ClientCAFile: "/etc/tinycni/apiserver/client-ca.crt",
+		Datastore:    datastore.TypeEtcd,
+		Etcd:         etcd.NewEtcdFlags(),
+		K8s:          k8s.NewK8sFlags(),
+	}
+}
+
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.BindAddress, "bind-address", o.BindAddress, "the address the api server listens on")
+	fs.IntVar(&o.Port, "port", o.Port, "the https port the api server listens on")
+	fs.StringVar(&o.CertFile, "tls-cert-file", o.CertFile, "the serving certificate")
+	fs.StringVar(&o.KeyFile, "tls-private-key-file", o.KeyFile, "the key of the serving certificate")
+	fs.StringVar(&o.ClientCAFile, "client-ca-file", o.ClientCAFile, "the ca that signs the certificates of the clients, requests without one are refused")
+	fs.StringVar(&o.Datastore, "datastore", o.Datastore, "where tinycni keeps its records: etcd or kubernetes, must match the datastore of the netconf")
+	fs.StringVar(&o.Scope.Prefix, "prefix", o.Scope.Prefix, "the key prefix of this cluster in a shared datastore, "+etcd.TinyCniPrefix+" when unset in flags, config file and environment")
+	fs.StringVar(&o.Scope.ClusterID, "cluster-id", o.Scope.ClusterID, "the id stamped on the records of this cluster")
+	o.Etcd.AddFlags(fs)
+	o.K8s.AddFlags(fs)
+}
+
+func (o *Options) ValidateFlags() error {
+	if o.Port <= 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid port %d", o.Port)
+	}
+	if o.CertFile == "" || o.KeyFile == "" || o.ClientCAFile == "" {
+		return fmt.Errorf("the api server is served over https with client certificates, --tls-cert-file, --tls-private-key-file and --client-ca-file are needed")
+	}
+	switch o.Datastore {
+	case datastore.TypeEtcd:
+		if err := o.Etcd.ValidateFlags(); err != nil {
+			return err
+		}
+	case datastore.TypeKubernetes:
+	default:
+		return fmt.Errorf("datastore must be %s or %s, got %q", datastore.TypeEtcd, datastore.TypeKubernetes, o.Datastore)
+	}
+	return o.K8s.ValidateFlags()
+}
+
+func run(ctx context.Context, o *Options) error {
+	caData, err := ioutil.ReadFile(o.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the client ca: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return fmt.Errorf("no certificate found in the client ca %s", o.ClientCAFile)
+	}
+	if _, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); err != nil {
+		return fmt.Errorf("failed to load the serving certificate: %v", err)
+	}
+	k8sClient, err := k8s.NewClient(o.K8s)
+	if err != nil {
+		return err
+	}
+	store, err := datastore.New(datastore.Config{Type: o.Datastore, Scope: o.Scope}, datastore.Clients{
+		Etcd: func() (*etcd.EtcdClient, error) {
+			return etcd.GetEtcdClient(o.Etcd.EtcdConfig())
+		},
+		K8s: func() (*k8s.Client, error) {
+			return k8sClient, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// follow a migration of the datastore while serving
+	datastore.FollowSchema(ctx, store)
+	server := &http.Server{
+		Addr:    net.JoinHostPort(o.BindAddress, strconv.Itoa(o.Port)),
+		Handler: apiserver.NewContainer(apiserver.NewServer(store, k8sClient, clientCAs)),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// verified by the api server, so that a missing or invalid
+			// certificate gets an answer
+			ClientAuth: tls.RequestClientCert,
+			// read on every handshake to pick up a renewed certificate
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+				return &cert, err
+			},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	klog.Infof("tinycni-apiserver listens on %s%s", server.Addr, consts.DEFAULT_TEST_CNI_API)
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	if err := log.InitLogs(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer log.FlushLogs()
+	o := NewOptions()
+	fs := pflag.NewFlagSet("tinycni-apiserver", pflag.ExitOnError)
+	o.AddFlags(fs)
+	_ = fs.Parse(os.Args[1:])
+	if err := o.ValidateFlags(); err != nil {
+		klog.Errorf("invalid flags: %v", err)
+		log.FlushLogs()
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, o); err != nil {
+		klog.Errorf("tinycni-apiserver exited: %v", err)
+		log.FlushLogs()
+		os.Exit(1)
+	}
+}
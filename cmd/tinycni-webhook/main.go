@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/k8s"
+	"cni/utils/log"
+	"cni/webhook"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// tinycni-webhook validates the network annotations of pods on admission.
+type Options struct {
+	BindAddress string
+	Port        int
+	CertFile    string
+	KeyFile     string
+	Datastore   string
+	Scope       etcd.Scope
+	Etcd        *etcd.Flags
+	K8s         *k8s.Flags
+}
+
+func NewOptions() *Options {
+	return &Options{
+		BindAddress: "0.0.0.0",
+		Port:        8443,
+		CertFile:    "/etc/tinycni/webhook/tls.crt",
+		KeyFile:     "/etc/tinycni/webhook/tls.key",
+		Datastore:   datastore.TypeEtcd,
+		Etcd:        etcd.NewEtcdFlags(),
+		K8s:         k8s.NewK8sFlags(),
+	}
+}
+
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.BindAddress, "bind-address", o.BindAddress, "the address the webhook listens on")
+	fs.IntVar(&o.Port, "port", o.Port, "the https port the webhook listens on")
+	fs.StringVar(&o.CertFile, "tls-cert-file", o.CertFile, "the serving certificate, signed by the caBundle of the webhook configuration")
+	fs.StringVar(&o.KeyFile, "tls-private-key-file", o.KeyFile, "the key of the serving certificate")
+	fs.StringVar(&o.Datastore, "datastore", o.Datastore, "where tinycni keeps its records: etcd or kubernetes, must match the datastore of the netconf")
+	fs.StringVar(&o.Scope.Prefix, "prefix", o.Scope.Prefix, "the key prefix of this cluster in a shared datastore, "+etcd.TinyCniPrefix+" when unset in flags, config file and environment")
+	fs.StringVar(&o.Scope.ClusterID, "cluster-id", o.Scope.ClusterID, "the id stamped on the records of this cluster")
+	o.Etcd.AddFlags(fs)
+	o.K8s.AddFlags(fs)
+}
+
+func (o *Options) ValidateFlags() error {
+	if o.Port <= 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid port %d", o.Port)
+	}
+	if o.CertFile == "" || o.KeyFile == "" {
+		return fmt.Errorf("the webhook is served over https, both --tls-cert-file and --tls-private-key-file are needed")
+	}
+	switch o.Datastore {
+	case datastore.TypeEtcd:
+		if err := o.Etcd.ValidateFlags(); err != nil {
+			return err
+		}
+	case datastore.TypeKubernetes:
+	default:
+		return fmt.Errorf("datastore must be %s or %s, got %q", datastore.TypeEtcd, datastore.TypeKubernetes, o.Datastore)
+	}
+	return o.K8s.ValidateFlags()
+}
+
+func run(ctx context.Context, o *Options) error {
+	store, err := datastore.New(datastore.Config{Type: o.Datastore, Scope: o.Scope}, datastore.Clients{
+		Etcd: func() (*etcd.EtcdClient, error) {
+			return etcd.GetEtcdClient(o.Etcd.EtcdConfig())
+		},
+		K8s: func() (*k8s.Client, error) {
+			return k8s.NewClient(o.K8s)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// follow a migration of the datastore while serving
+	datastore.FollowSchema(ctx, store)
+	// the certificate is read on every handshake so that a renewed secret is
+	// picked up without a restart
+	if _, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); err != nil {
+		return fmt.Errorf("failed to load the serving certificate: %v", err)
+	}
+	server := &http.Server{
+		Addr:    net.JoinHostPort(o.BindAddress, strconv.Itoa(o.Port)),
+		Handler: webhook.NewContainer(webhook.NewValidator(store)),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+				return &cert, err
+			},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	klog.Infof("tinycni-webhook listens on %s", server.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	if err := log.InitLogs(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer log.FlushLogs()
+	o := NewOptions()
+	fs := pflag.NewFlagSet("tinycni-webhook", pflag.ExitOnError)
+	o.AddFlags(fs)
+	_ = fs.Parse(os.Args[1:])
+	if err := o.ValidateFlags(); err != nil {
+		klog.Errorf("invalid flags: %v", err)
+		log.FlushLogs()
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, o); err != nil {
+		klog.Errorf("tinycni-webhook exited: %v", err)
+		log.FlushLogs()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"cni/backup"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"io"
+	"os"
+)
+
+func init() {
+	register("backup", "export every record of tinycni to a json or yaml archive", runBackup)
+	register("restore", "restore an archive of backup into an empty or existing datastore, in batches that are not atomic as a whole", runRestore)
+}
+
+func runBackup(args []string) error {
+	fs := pflag.NewFlagSet("backup", pflag.ContinueOnError)
+	output := fs.StringP("output", "o", "-", "the archive to write, - for stdout")
+	format := fs.String("format", backup.FormatJSON, "the format of the archive: json or yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	archive, err := backup.Export(client)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := backup.Write(w, archive, *format); err != nil {
+		return err
+	}
+	if *output != "-" {
+		fmt.Printf("wrote %d records of schema version %d to %s\n", len(archive.Records), archive.SchemaVersion, *output)
+	}
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+	file := fs.StringP("filename", "f", "", "the archive to restore, - for stdin")
+	prefix := fs.String("prefix", "", "restore under this key prefix instead of the one of this tinycni")
+	clusterID := fs.String("cluster-id", "", "stamp the records with this cluster id, by default the one that claimed the prefix")
+	overwrite := fs.Bool("overwrite", false, "replace records that differ from the archive instead of failing")
+	dryRun := fs.Bool("dry-run", false, "validate the archive and print what would change without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("--filename is required")
+	}
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	archive, err := backup.Read(r)
+	if err != nil {
+		return err
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	report, err := backup.Restore(client, archive, backup.RestoreOptions{Prefix: *prefix, ClusterID: *clusterID, Overwrite: *overwrite, DryRun: *dryRun})
+	if report != nil {
+		for _, key := range report.Conflicts {
+			fmt.Printf("conflict  %s\n", key)
+		}
+		verb := "restored"
+		if *dryRun || err != nil {
+			verb = "would restore"
+		}
+		fmt.Printf("%s: %d created, %d updated, %d unchanged, %d skipped\n", verb, len(report.Created), len(report.Updated), len(report.Unchanged), len(report.Skipped))
+	}
+	return err
+}
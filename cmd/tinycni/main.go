@@ -0,0 +1,67 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/k8s"
+	"cni/utils/log"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{}
+
+func register(name, usage string, run func(args []string) error) {
+	commands[name] = command{usage: usage, run: run}
+}
+
+// openDatastore opens the datastore named by $TINYCNI_DATASTORE, the same
+// backend the netconf of the cluster uses, etcd when unset.
+func openDatastore() (datastore.Datastore, error) {
+	return datastore.New(datastore.Config{Type: os.Getenv("TINYCNI_DATASTORE")}, datastore.Clients{
+		Etcd: func() (*etcd.EtcdClient, error) {
+			return etcd.GetEtcdClient(nil)
+		},
+		K8s: k8s.NewHostClient,
+	})
+}
+
+func printUsage() {
+	_, _ = fmt.Fprintf(os.Stderr, "usage: tinycni <command> [flags]\n\nthe datastore is chosen by $TINYCNI_DATASTORE: etcd (default) or kubernetes,\netcd is reached with $TINYCNI_CONFIG (default /etc/tinycni/tinycni.conf) and $APIV1_ETCD_*,\nthe records of one cluster are chosen by $TINYCNI_PREFIX and $TINYCNI_CLUSTER_ID,\nkubernetes is reached with the service account in a pod, else with $KUBECONFIG or the kubeconfig of the node\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if err := log.InitLogs(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer log.FlushLogs()
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		log.FlushLogs()
+		os.Exit(1)
+	}
+}
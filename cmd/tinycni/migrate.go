@@ -0,0 +1,47 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"fmt"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	register("migrate", "upgrade the records of the datastore to the schema of this tinycni", runMigrate)
+}
+
+// runMigrate should run once every node runs a tinycni that knows the new
+// schema, older binaries cannot read the records it rewrites.
+func runMigrate(args []string) error {
+	fs := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the records that would be rewritten")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	from, err := datastore.LoadSchema(client)
+	if err != nil {
+		return err
+	}
+	count := 0
+	to, err := datastore.Migrate(client, *dryRun, func(r datastore.Rewrite) {
+		count++
+		fmt.Println(r)
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case from == etcd.SchemaVersion:
+		fmt.Printf("datastore is already at schema version %d\n", from)
+	case *dryRun:
+		fmt.Printf("would rewrite %d records from schema version %d to %d\n", count, from, to)
+	default:
+		fmt.Printf("rewrote %d records from schema version %d to %d\n", count, from, to)
+	}
+	return nil
+}
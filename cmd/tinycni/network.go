@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+)
+
+func init() {
+	register("network", "apply or resize networks, set the cluster ranges networks must not overlap", runNetwork)
+}
+
+func runNetwork(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: tinycni network apply|resize|cluster-ranges [flags]")
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "apply":
+		return runNetworkApply(client, args[1:])
+	case "resize":
+		return runNetworkResize(client, args[1:])
+	case "cluster-ranges":
+		return runClusterRanges(client, args[1:])
+	}
+	return fmt.Errorf("unknown network command %s", args[0])
+}
+
+// runNetworkApply creates the network of a json file, or updates it in place
+// when it already exists.
+func runNetworkApply(client datastore.Datastore, args []string) error {
+	fs := pflag.NewFlagSet("network apply", pflag.ContinueOnError)
+	file := fs.StringP("filename", "f", "", "the json file of the network")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	network := &etcd.NetworkCrd{}
+	if err := json.Unmarshal(data, network); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", *file, err)
+	}
+	networks, err := ipam.ListNetworks(client)
+	if err != nil {
+		return err
+	}
+	if _, ok := networks[network.Name]; ok {
+		if err := ipam.UpdateNetworkCrd(client, network); err != nil {
+			return err
+		}
+		fmt.Printf("network %s updated\n", network.Name)
+		return nil
+	}
+	if err := ipam.CreateNetworkCrd(client, network); err != nil {
+		return err
+	}
+	fmt.Printf("network %s created\n", network.Name)
+	return nil
+}
+
+func runNetworkResize(client datastore.Datastore, args []string) error {
+	fs := pflag.NewFlagSet("network resize", pflag.ContinueOnError)
+	network := fs.String("network", "", "the network of the subnet")
+	subnet := fs.String("subnet", "", "the subnet to resize")
+	cidr := fs.String("cidr", "", "the new cidr of the subnet")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *subnet == "" || *cidr == "" {
+		return errors.New("--network, --subnet and --cidr are required")
+	}
+	if err := ipam.ResizeSubnet(client, *network, *subnet, *cidr); err != nil {
+		return err
+	}
+	fmt.Printf("subnet %s of network %s resized to %s\n", *subnet, *network, *cidr)
+	return nil
+}
+
+func runClusterRanges(client datastore.Datastore, args []string) error {
+	config, err := ipam.GetClusterConfig(client)
+	if err != nil {
+		return err
+	}
+	fs := pflag.NewFlagSet("network cluster-ranges", pflag.ContinueOnError)
+	fs.StringSliceVar(&config.ServiceCIDRs, "service-cidr", config.ServiceCIDRs, "the service cidrs of the cluster")
+	fs.StringSliceVar(&config.NodeCIDRs, "node-cidr", config.NodeCIDRs, "the cidrs the node addresses are in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NFlag() > 0 {
+		if err := ipam.SetClusterConfig(client, config); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("service cidrs: %v\nnode cidrs: %v\n", config.ServiceCIDRs, config.NodeCIDRs)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cni/etcd"
+	"cni/ipam"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+func init() {
+	register("quota", "show or set per namespace and tenant ip quotas of a network", runQuota)
+}
+
+func runQuota(args []string) error {
+	fs := pflag.NewFlagSet("quota", pflag.ContinueOnError)
+	network := fs.String("network", "", "the network the quota belongs to")
+	namespace := fs.String("namespace", "", "the namespace to set the quota of")
+	tenant := fs.String("tenant", "", "the tenant to set the quota of")
+	limit := fs.Int("limit", -1, "the max addresses, 0 removes the quota, omit it to only show usage")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" {
+		return errors.New("--network is required")
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	if *limit >= 0 {
+		switch {
+		case *namespace != "" && *tenant == "":
+			err = ipam.SetQuota(client, *network, etcd.UsageNamespaces, *namespace, *limit)
+		case *tenant != "" && *namespace == "":
+			err = ipam.SetQuota(client, *network, etcd.UsageTenants, *tenant, *limit)
+		default:
+			return errors.New("--limit needs exactly one of --namespace or --tenant")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	quota, err := ipam.GetQuota(client, *network)
+	if err != nil {
+		return err
+	}
+	usage, err := ipam.GetUsage(client, *network)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KIND\tNAME\tUSED\tLIMIT")
+	printUsageRows(w, "namespace", usage.Namespaces, quota.Namespaces)
+	printUsageRows(w, "tenant", usage.Tenants, quota.Tenants)
+	return w.Flush()
+}
+
+func printUsageRows(w *tabwriter.Writer, kind string, used, limits map[string]int) {
+	names := make(map[string]bool)
+	for name := range used {
+		names[name] = true
+	}
+	for name := range limits {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		limit := "-"
+		if l, ok := limits[name]; ok {
+			limit = fmt.Sprintf("%d", l)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", kind, name, used[name], limit)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"cni/etcd"
+	"cni/ipam"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+func init() {
+	register("status", "show address usage and conflicts found by duplicate address detection", runStatus)
+}
+
+func runStatus(args []string) error {
+	fs := pflag.NewFlagSet("status", pflag.ContinueOnError)
+	network := fs.String("network", "", "only show this network")
+	clear := fs.String("clear-conflict", "", "make this conflict address of --network allocatable again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client, err := openDatastore()
+	if err != nil {
+		return err
+	}
+	if *clear != "" {
+		if *network == "" {
+			return errors.New("--clear-conflict needs --network")
+		}
+		if err := ipam.ClearConflict(client, *network, *clear); err != nil {
+			return err
+		}
+	}
+	records, err := ipam.ListAllocatedIps(client, *network)
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Network != records[j].Network {
+			return records[i].Network < records[j].Network
+		}
+		return records[i].Ip < records[j].Ip
+	})
+
+	counts := make(map[string]map[string]int)
+	var networks []string
+	var conflicts []etcd.AllocatedIp
+	for _, record := range records {
+		if counts[record.Network] == nil {
+			counts[record.Network] = make(map[string]int)
+			networks = append(networks, record.Network)
+		}
+		state := record.State
+		if state == "" {
+			state = etcd.IpStateAllocated
+		}
+		counts[record.Network][state]++
+		if state == etcd.IpStateConflict {
+			conflicts = append(conflicts, record)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NETWORK\tALLOCATED\tRESERVED\tCONFLICT")
+	for _, name := range networks {
+		c := counts[name]
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, c[etcd.IpStateAllocated], c[etcd.IpStateReserved], c[etcd.IpStateConflict])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	_, _ = fmt.Fprintln(os.Stdout)
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NETWORK\tSUBNET\tIP\tNODE\tIN USE BY\tDETECTED")
+	for _, record := range conflicts {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Network, record.Subnet, record.Ip, record.Node, record.ConflictMac, record.ConflictAt)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/k8s"
+	"cni/utils/log"
+	"context"
+	"fmt"
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// tinycnid is the long running per node companion of the cni plugin.
+type Options struct {
+	NodeName  string
+	Datastore string
+	Scope     etcd.Scope
+	Etcd      *etcd.Flags
+	K8s       *k8s.Flags
+	Node      *NodeFlags
+	WarmPool  *WarmPoolFlags
+	Networks  *NetworkControllerFlags
+}
+
+func NewOptions() *Options {
+	nodeName, _ := os.Hostname()
+	return &Options{
+		NodeName:  nodeName,
+		Datastore: datastore.TypeEtcd,
+		Etcd:      etcd.NewEtcdFlags(),
+		K8s:       k8s.NewK8sFlags(),
+		Node:      NewNodeFlags(),
+		WarmPool:  NewWarmPoolFlags(),
+		Networks:  NewNetworkControllerFlags(),
+	}
+}
+
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.NodeName, "node-name", o.NodeName, "the name of the node this daemon runs on")
+	fs.StringVar(&o.Datastore, "datastore", o.Datastore, "where tinycni keeps its records: etcd or kubernetes, must match the datastore of the netconf")
+	fs.StringVar(&o.Scope.Prefix, "prefix", o.Scope.Prefix, "the key prefix of this cluster in a shared datastore, "+etcd.TinyCniPrefix+" when unset in flags, config file and environment")
+	fs.StringVar(&o.Scope.ClusterID, "cluster-id", o.Scope.ClusterID, "the id stamped on the records of this cluster, the daemon refuses a prefix claimed by another id")
+	o.Etcd.AddFlags(fs)
+	o.K8s.AddFlags(fs)
+	o.Node.AddFlags(fs)
+	o.WarmPool.AddFlags(fs)
+	o.Networks.AddFlags(fs)
+}
+
+func (o *Options) ValidateFlags() error {
+	if o.NodeName == "" {
+		return fmt.Errorf("empty node name")
+	}
+	switch o.Datastore {
+	case datastore.TypeEtcd:
+		if err := o.Etcd.ValidateFlags(); err != nil {
+			return err
+		}
+	case datastore.TypeKubernetes:
+	default:
+		return fmt.Errorf("datastore must be %s or %s, got %q", datastore.TypeEtcd, datastore.TypeKubernetes, o.Datastore)
+	}
+	if err := o.K8s.ValidateFlags(); err != nil {
+		return err
+	}
+	if err := o.Node.ValidateFlags(); err != nil {
+		return err
+	}
+	if err := o.WarmPool.ValidateFlags(); err != nil {
+		return err
+	}
+	return o.Networks.ValidateFlags()
+}
+
+func run(ctx context.Context, o *Options) error {
+	k8sClient, err := k8s.NewClient(o.K8s)
+	if err != nil {
+		return err
+	}
+	store, err := datastore.New(datastore.Config{Type: o.Datastore, Scope: o.Scope}, datastore.Clients{
+		Etcd: func() (*etcd.EtcdClient, error) {
+			return etcd.GetEtcdClient(o.Etcd.EtcdConfig())
+		},
+		K8s: func() (*k8s.Client, error) {
+			return k8sClient, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// the network controller and the warm pools write in the schema the
+	// datastore is migrated to
+	datastore.FollowSchema(ctx, store)
+	if err := ensurePodCIDRNetwork(o, store); err != nil {
+		return err
+	}
+	if err := newNodeRoutes(o, store).start(ctx); err != nil {
+		return err
+	}
+	go runNodeRegistration(ctx, o, store, k8sClient)
+	go runNetworkController(ctx, o, store, k8sClient)
+	runWarmPools(ctx, o, store, k8sClient)
+	return nil
+}
+
+func main() {
+	if err := log.InitLogs(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer log.FlushLogs()
+	o := NewOptions()
+	fs := pflag.NewFlagSet("tinycnid", pflag.ExitOnError)
+	o.AddFlags(fs)
+	_ = fs.Parse(os.Args[1:])
+	if err := o.ValidateFlags(); err != nil {
+		klog.Errorf("invalid flags: %v", err)
+		log.FlushLogs()
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, o); err != nil {
+		klog.Errorf("tinycnid exited: %v", err)
+		log.FlushLogs()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"cni/utils/rest"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type NetworkControllerFlags struct {
+	Run      bool
+	Interval time.Duration
+}
+
+func NewNetworkControllerFlags() *NetworkControllerFlags {
+	return &NetworkControllerFlags{
+		Interval: 10 * time.Second,
+	}
+}
+
+func (f *NetworkControllerFlags) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&f.Run, "run-network-controller", f.Run, "sync the Network custom resources with the datastore, enable it on a single tinycnid of the cluster")
+	fs.DurationVar(&f.Interval, "network-controller-interval", f.Interval, "how often every Network custom resource is synced to recount its status, changes are synced at once")
+}
+
+func (f *NetworkControllerFlags) ValidateFlags() error {
+	if f.Interval <= 0 {
+		return fmt.Errorf("network controller interval must be positive, got %v", f.Interval)
+	}
+	return nil
+}
+
+// networkController writes the spec of every Network custom resource to the
+// datastore and reports back the use of its addresses. The custom resource
+// wins over edits of the datastore, networks without one are left alone.
+type networkController struct {
+	store  datastore.Datastore
+	client *k8s.Client
+}
+
+// runNetworkController syncs a Network as soon as the informer sees it change
+// and all of them every interval, the counts of their status follow the
+// datastore.
+func runNetworkController(ctx context.Context, o *Options, store datastore.Datastore, k8sClient *k8s.Client) {
+	if !o.Networks.Run {
+		return
+	}
+	c := &networkController{store: store, client: k8sClient}
+	informer := k8sClient.NewNetworkInformer()
+	var lock sync.Mutex
+	dirty := make(map[string]bool)
+	wake := make(chan struct{}, 1)
+	enqueue := func(obj interface{}) {
+		lock.Lock()
+		dirty[obj.(*k8s.Network).MetaData.Name] = true
+		lock.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	informer.AddHandler(k8s.ResourceEventHandler{
+		OnAdd:    enqueue,
+		OnUpdate: func(_, obj interface{}) { enqueue(obj) },
+	})
+	go informer.Run(ctx)
+	if !informer.WaitForSync(ctx) {
+		return
+	}
+	ticker := time.NewTicker(o.Networks.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+			for _, obj := range informer.List() {
+				enqueue(obj)
+			}
+		}
+		lock.Lock()
+		names := dirty
+		dirty = make(map[string]bool)
+		lock.Unlock()
+		for name := range names {
+			obj, ok := informer.Get(name)
+			if !ok {
+				continue
+			}
+			// the cached object is shared, sync writes to its own copy
+			network, err := copyNetwork(obj.(*k8s.Network))
+			if err == nil {
+				err = c.sync(network)
+			}
+			if err != nil {
+				klog.Errorf("failed to sync Network %s, err is %v", name, err)
+			}
+		}
+	}
+}
+
+func copyNetwork(network *k8s.Network) (*k8s.Network, error) {
+	data, err := json.Marshal(network)
+	if err != nil {
+		return nil, err
+	}
+	copied := &k8s.Network{}
+	return copied, json.Unmarshal(data, copied)
+}
+
+func hasFinalizer(network *k8s.Network) bool {
+	for _, finalizer := range network.MetaData.Finalizers {
+		if finalizer == k8s.NetworkFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// networkFromSpec turns the spec of a custom resource into a datastore
+// network, the subnet ids of current are kept.
+func networkFromSpec(network *k8s.Network, current *etcd.NetworkCrd) *etcd.NetworkCrd {
+	ids := make(map[string]string)
+	if current != nil {
+		for _, subnet := range current.Subnets {
+			ids[subnet.Name] = subnet.ID
+		}
+	}
+	spec := network.Spec
+	result := &etcd.NetworkCrd{Name: network.MetaData.Name, Mode: spec.Mode, MTU: spec.MTU, PodSelector: spec.PodSelector}
+	for _, subnet := range spec.Subnets {
+		result.Subnets = append(result.Subnets, etcd.Subnet{
+			Name:        subnet.Name,
+			ID:          ids[subnet.Name],
+			CIDR:        subnet.CIDR,
+			Gateway:     subnet.Gateway,
+			BlockSize:   subnet.BlockSize,
+			BlockSource: subnet.BlockSource,
+			Reserved:    subnet.Reserved,
+		})
+	}
+	if spec.Isolation != nil {
+		result.Isolation = &etcd.Isolation{Namespaces: spec.Isolation.Namespaces, Tenants: spec.Isolation.Tenants}
+	}
+	return result
+}
+
+// statusOf copies the status of network, conditions are changed in place.
+func statusOf(network *k8s.Network) k8s.NetworkResourceStatus {
+	status := network.Status
+	status.Conditions = append([]k8s.NetworkCondition(nil), network.Status.Conditions...)
+	return status
+}
+
+func setCondition(status *k8s.NetworkResourceStatus, conditionType, value, reason, message string) {
+	condition := k8s.NetworkCondition{Type: conditionType, Status: value, Reason: reason, Message: message}
+	for i := range status.Conditions {
+		if status.Conditions[i].Type != conditionType {
+			continue
+		}
+		condition.LastTransitionTime = status.Conditions[i].LastTransitionTime
+		if status.Conditions[i].Status != value {
+			condition.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+		}
+		status.Conditions[i] = condition
+		return
+	}
+	condition.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+	status.Conditions = append(status.Conditions, condition)
+}
+
+func (c *networkController) sync(network *k8s.Network) error {
+	name := network.MetaData.Name
+	if network.MetaData.DeletionTimestamp != "" {
+		return c.finalize(network)
+	}
+	if !hasFinalizer(network) {
+		network.MetaData.Finalizers = append(network.MetaData.Finalizers, k8s.NetworkFinalizer)
+		if _, err := c.client.UpdateNetwork(network); err != nil {
+			return fmt.Errorf("failed to add the finalizer: %v", err)
+		}
+	}
+	status := statusOf(network)
+	status.ObservedGeneration = network.MetaData.Generation
+	current, err := ipam.GetNetwork(c.store, name)
+	if err != nil && !ipam.IsNetworkNotFound(err) {
+		return err
+	}
+	if ipam.IsNetworkNotFound(err) {
+		current = nil
+	}
+	wanted := networkFromSpec(network, current)
+	if err := ipam.ValidateNetwork(c.store, wanted); err != nil {
+		setCondition(&status, k8s.NetworkConditionValid, k8s.ConditionFalse, "Invalid", err.Error())
+		setCondition(&status, k8s.NetworkConditionReady, k8s.ConditionFalse, "Invalid", "the spec is not written to the datastore")
+	} else {
+		setCondition(&status, k8s.NetworkConditionValid, k8s.ConditionTrue, "Valid", "")
+		switch {
+		case current == nil:
+			err = ipam.CreateNetworkCrd(c.store, wanted)
+		case !reflect.DeepEqual(current, wanted):
+			err = ipam.UpdateNetworkCrd(c.store, wanted)
+		}
+		if err != nil {
+			setCondition(&status, k8s.NetworkConditionReady, k8s.ConditionFalse, "SyncFailed", err.Error())
+		} else {
+			if current == nil || !reflect.DeepEqual(current, wanted) {
+				klog.Infof("wrote generation %d of Network %s to the datastore", network.MetaData.Generation, name)
+			}
+			current = wanted
+			setCondition(&status, k8s.NetworkConditionReady, k8s.ConditionTrue, "Synced", "")
+		}
+	}
+	// the counts follow what is in the datastore, which is the previous spec
+	// while the current one is refused
+	if current != nil {
+		if err := c.count(&status, current); err != nil {
+			return err
+		}
+	}
+	return c.updateStatus(network, status)
+}
+
+func (c *networkController) count(status *k8s.NetworkResourceStatus, network *etcd.NetworkCrd) error {
+	usage, err := ipam.GetNetworkUsage(c.store, network)
+	if err != nil {
+		return err
+	}
+	status.Size = usage.Size
+	status.Allocated = usage.Allocated
+	status.Reserved = usage.Reserved
+	status.Conflict = usage.Conflict
+	status.Free = usage.Free
+	status.Subnets = nil
+	for _, subnet := range usage.Subnets {
+		status.Subnets = append(status.Subnets, k8s.NetworkSubnetStatus{
+			Name:      subnet.Name,
+			CIDR:      subnet.CIDR,
+			Size:      subnet.Size,
+			Allocated: subnet.Allocated,
+			Reserved:  subnet.Reserved,
+			Conflict:  subnet.Conflict,
+			Free:      subnet.Free,
+		})
+	}
+	return nil
+}
+
+// updateStatus writes status when it changed, a conflict is picked up by the
+// next sync.
+func (c *networkController) updateStatus(network *k8s.Network, status k8s.NetworkResourceStatus) error {
+	if reflect.DeepEqual(network.Status, status) {
+		return nil
+	}
+	network.Status = status
+	_, err := c.client.UpdateNetworkStatus(network)
+	if err != nil && !rest.IsConflict(err) {
+		return fmt.Errorf("failed to update the status: %v", err)
+	}
+	return nil
+}
+
+// finalize drops the network from the datastore and releases the custom
+// resource, while addresses are allocated it stays and tells why.
+func (c *networkController) finalize(network *k8s.Network) error {
+	if !hasFinalizer(network) {
+		return nil
+	}
+	name := network.MetaData.Name
+	if err := ipam.DeleteNetworkCrd(c.store, name); err != nil && !ipam.IsNetworkNotFound(err) {
+		status := statusOf(network)
+		setCondition(&status, k8s.NetworkConditionReady, k8s.ConditionFalse, "DeleteBlocked", err.Error())
+		return c.updateStatus(network, status)
+	}
+	var finalizers []string
+	for _, finalizer := range network.MetaData.Finalizers {
+		if finalizer != k8s.NetworkFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	network.MetaData.Finalizers = finalizers
+	if _, err := c.client.UpdateNetwork(network); err != nil {
+		return fmt.Errorf("failed to remove the finalizer: %v", err)
+	}
+	klog.Infof("deleted Network %s from the datastore", name)
+	return nil
+}
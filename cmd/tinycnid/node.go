@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cni/consts"
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"context"
+	"fmt"
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	"time"
+)
+
+type NodeFlags struct {
+	NodeIps         []string
+	TunnelEndpoint  string
+	Capabilities    []string
+	LeaseTTL        int64
+	RefreshInterval time.Duration
+	ReclaimGrace    time.Duration
+	PodCIDRNetwork  string
+	ClusterCIDRs    []string
+}
+
+func NewNodeFlags() *NodeFlags {
+	return &NodeFlags{
+		Capabilities:    []string{consts.MODE_HOST_GW},
+		LeaseTTL:        30,
+		RefreshInterval: 10 * time.Second,
+		ReclaimGrace:    10 * time.Minute,
+	}
+}
+
+func (f *NodeFlags) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&f.NodeIps, "node-ip", f.NodeIps, "the addresses of this node, the InternalIPs of the k8s node when empty")
+	fs.StringVar(&f.TunnelEndpoint, "tunnel-endpoint", f.TunnelEndpoint, "the address other nodes tunnel to, the first node ip when empty")
+	fs.StringSliceVar(&f.Capabilities, "capabilities", f.Capabilities, "the data plane modes this node supports")
+	fs.Int64Var(&f.LeaseTTL, "node-lease-ttl", f.LeaseTTL, "seconds without heartbeat after which the node counts as gone")
+	fs.DurationVar(&f.RefreshInterval, "node-refresh-interval", f.RefreshInterval, "how often the node record is refreshed")
+	fs.DurationVar(&f.ReclaimGrace, "node-reclaim-grace", f.ReclaimGrace, "how long a gone node keeps its blocks before they are reclaimed")
+	fs.StringVar(&f.PodCIDRNetwork, "pod-cidr-network", f.PodCIDRNetwork, "create this network over --cluster-cidr with the podCIDRs of the k8s nodes as blocks when it does not exist")
+	fs.StringSliceVar(&f.ClusterCIDRs, "cluster-cidr", f.ClusterCIDRs, "the --cluster-cidr of the controller manager, the subnets of --pod-cidr-network")
+}
+
+func (f *NodeFlags) ValidateFlags() error {
+	if f.LeaseTTL < 5 {
+		return fmt.Errorf("node lease ttl must be at least 5 seconds, got %d", f.LeaseTTL)
+	}
+	if f.RefreshInterval <= 0 || f.RefreshInterval >= time.Duration(f.LeaseTTL)*time.Second {
+		return fmt.Errorf("node refresh interval must be positive and shorter than the lease ttl, got %v", f.RefreshInterval)
+	}
+	if (f.PodCIDRNetwork == "") != (len(f.ClusterCIDRs) == 0) {
+		return fmt.Errorf("--pod-cidr-network and --cluster-cidr go together")
+	}
+	return nil
+}
+
+// ensurePodCIDRNetwork creates the network of --pod-cidr-network, every node
+// tries and the first one wins.
+func ensurePodCIDRNetwork(o *Options, store datastore.Datastore) error {
+	if o.Node.PodCIDRNetwork == "" {
+		return nil
+	}
+	network := &etcd.NetworkCrd{Name: o.Node.PodCIDRNetwork}
+	for i, cidr := range o.Node.ClusterCIDRs {
+		network.Subnets = append(network.Subnets, etcd.Subnet{
+			Name:        fmt.Sprintf("%s-%d", o.Node.PodCIDRNetwork, i),
+			CIDR:        cidr,
+			BlockSource: etcd.BlockSourcePodCIDR,
+		})
+	}
+	if _, err := ipam.GetNetwork(store, network.Name); err == nil {
+		return nil
+	}
+	if err := ipam.CreateNetworkCrd(store, network); err != nil {
+		if _, getErr := ipam.GetNetwork(store, network.Name); getErr == nil {
+			return nil
+		}
+		return err
+	}
+	klog.Infof("created network %s over the cluster cidrs %v", network.Name, o.Node.ClusterCIDRs)
+	return nil
+}
+
+// syncPodCIDRs takes the podCIDRs of the k8s node as blocks and reports where
+// the datastore disagrees with them.
+func syncPodCIDRs(o *Options, store datastore.Datastore, node *k8s.Node) {
+	podCIDRs := node.Spec.PodCIDRs
+	if len(podCIDRs) == 0 && node.Spec.PodCIDR != "" {
+		podCIDRs = []string{node.Spec.PodCIDR}
+	}
+	divergences, err := ipam.SyncPodCIDRBlocks(store, o.NodeName, podCIDRs)
+	if err != nil {
+		klog.Errorf("failed to sync the podCIDRs of node %s, err is %v", o.NodeName, err)
+		return
+	}
+	for _, divergence := range divergences {
+		klog.Warningf("podCIDR diverges from the datastore: %s", divergence)
+	}
+}
+
+func nodeIps(o *Options, node *k8s.Node) ([]string, error) {
+	if len(o.Node.NodeIps) > 0 {
+		return o.Node.NodeIps, nil
+	}
+	var ips []string
+	for _, address := range node.Status.Address {
+		if address.Type == "InternalIP" {
+			ips = append(ips, address.Address)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("node %s has no InternalIP", o.NodeName)
+	}
+	return ips, nil
+}
+
+func nodeRecord(o *Options, store datastore.Datastore, ips []string) (*etcd.Node, error) {
+	blocks, err := ipam.ListNodeBlocks(store, o.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	tunnelEndpoint := o.Node.TunnelEndpoint
+	if tunnelEndpoint == "" {
+		tunnelEndpoint = ips[0]
+	}
+	return &etcd.Node{
+		Name:           o.NodeName,
+		NodeIp:         ips[0],
+		NodeIps:        ips,
+		PodBlocks:      blocks,
+		TunnelEndpoint: tunnelEndpoint,
+		Capabilities:   o.Node.Capabilities,
+		Heartbeat:      time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// runNodeRegistration keeps the record of this node alive, every refresh
+// renews its ttl and picks up the blocks claimed by ADD or taken from the
+// podCIDRs of the k8s node since. The record is left to expire on shutdown,
+// so a restart within the ttl does not make other nodes drop our routes.
+func runNodeRegistration(ctx context.Context, o *Options, store datastore.Datastore, k8sClient *k8s.Client) {
+	ttl := time.Duration(o.Node.LeaseTTL) * time.Second
+	ticker := time.NewTicker(o.Node.RefreshInterval)
+	defer ticker.Stop()
+	ips := o.Node.NodeIps
+	for {
+		err := func() error {
+			// the podCIDRs may be assigned after the node started, the
+			// heartbeat must not wait on the api server once ips are known
+			k8sNode, err := k8sClient.GetNode(o.NodeName)
+			if err == nil {
+				syncPodCIDRs(o, store, &k8sNode)
+				if len(ips) == 0 {
+					if ips, err = nodeIps(o, &k8sNode); err != nil {
+						return err
+					}
+				}
+			} else if len(ips) == 0 {
+				return err
+			} else {
+				klog.Warningf("failed to get k8s node %s, keep registering with %v, err is %v", o.NodeName, ips, err)
+			}
+			node, err := nodeRecord(o, store, ips)
+			if err != nil {
+				return err
+			}
+			// follow a migration of the datastore, the record is rewritten in
+			// the new schema on this registration
+			if _, err := datastore.LoadSchema(store); err != nil {
+				return err
+			}
+			return datastore.RegisterNode(store, node, ttl)
+		}()
+		if err != nil {
+			klog.Errorf("failed to register node %s, err is %v", o.NodeName, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"context"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeRoutes routes the blocks of every other registered node to it, and
+// reclaims the blocks of a node that stayed gone for the reclaim grace.
+type nodeRoutes struct {
+	sync.Mutex
+	self     string
+	grace    time.Duration
+	store    datastore.Datastore
+	routes   map[string][]*net.IPNet
+	reclaims map[string]*time.Timer
+}
+
+func newNodeRoutes(o *Options, store datastore.Datastore) *nodeRoutes {
+	return &nodeRoutes{
+		self:     o.NodeName,
+		grace:    o.Node.ReclaimGrace,
+		store:    store,
+		routes:   make(map[string][]*net.IPNet),
+		reclaims: make(map[string]*time.Timer),
+	}
+}
+
+func (r *nodeRoutes) start(ctx context.Context) error {
+	nodes, err := datastore.ListNodes(r.store)
+	if err != nil {
+		return err
+	}
+	// blocks of nodes that were already gone when we started
+	blocks, err := ipam.ListBlocks(r.store, etcd.BlocksKey())
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if _, ok := nodes[block.Node]; !ok {
+			r.Lock()
+			r.scheduleReclaim(block.Node)
+			r.Unlock()
+		}
+	}
+	r.store.Watch(ctx, etcd.NodesKey(), r.onNode)
+	return nil
+}
+
+func (r *nodeRoutes) onNode(event datastore.Event) {
+	name := strings.TrimPrefix(event.Key, etcd.NodesKey())
+	if name == r.self {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	switch event.Type {
+	case datastore.EventPut:
+		var node etcd.Node
+		if err := etcd.Decode(event.Value, &node); err != nil {
+			klog.Errorf("failed to decode node %s, err is %v", name, err)
+			return
+		}
+		if timer, ok := r.reclaims[name]; ok {
+			timer.Stop()
+			delete(r.reclaims, name)
+		}
+		r.syncRoutes(name, &node)
+	case datastore.EventDelete:
+		klog.Infof("node %s is gone, drop its routes", name)
+		r.syncRoutes(name, nil)
+		r.scheduleReclaim(name)
+	}
+}
+
+func (r *nodeRoutes) scheduleReclaim(name string) {
+	if _, ok := r.reclaims[name]; ok {
+		return
+	}
+	r.reclaims[name] = time.AfterFunc(r.grace, func() {
+		r.Lock()
+		delete(r.reclaims, name)
+		r.Unlock()
+		if node, err := datastore.GetNode(r.store, name); err != nil || node != nil {
+			return
+		}
+		if err := ipam.ReclaimNode(r.store, name); err != nil {
+			klog.Errorf("failed to reclaim node %s, err is %v", name, err)
+		}
+	})
+}
+
+// syncRoutes replaces the routes of node name, a nil node removes them all.
+func (r *nodeRoutes) syncRoutes(name string, node *etcd.Node) {
+	var wanted []*net.IPNet
+	var gw net.IP
+	if node != nil {
+		gw = net.ParseIP(node.NodeIp)
+		for _, cidr := range node.PodBlocks {
+			if _, block, err := net.ParseCIDR(cidr); err == nil && gw != nil && (block.IP.To4() == nil) == (gw.To4() == nil) {
+				wanted = append(wanted, block)
+			}
+		}
+	}
+	keep := make(map[string]bool, len(wanted))
+	for _, block := range wanted {
+		keep[block.String()] = true
+		if err := netlink.RouteReplace(&netlink.Route{Dst: block, Gw: gw}); err != nil {
+			klog.Errorf("failed to route %s via node %s (%s), err is %v", block, name, gw, err)
+		}
+	}
+	for _, block := range r.routes[name] {
+		if keep[block.String()] {
+			continue
+		}
+		if err := netlink.RouteDel(&netlink.Route{Dst: block}); err != nil {
+			klog.Warningf("failed to delete route %s of node %s, err is %v", block, name, err)
+		}
+	}
+	if len(wanted) == 0 {
+		delete(r.routes, name)
+	} else {
+		r.routes[name] = wanted
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cni/datastore"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"context"
+	"fmt"
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+	"time"
+)
+
+type WarmPoolFlags struct {
+	Networks []string
+	Dir      string
+	Low      int
+	High     int
+	Interval time.Duration
+}
+
+func NewWarmPoolFlags() *WarmPoolFlags {
+	return &WarmPoolFlags{
+		Low:      4,
+		High:     16,
+		Interval: 2 * time.Second,
+	}
+}
+
+func (f *WarmPoolFlags) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&f.Networks, "warm-pool-networks", f.Networks, "the networks to keep a warm pool of reserved addresses for")
+	fs.StringVar(&f.Dir, "warm-pool-dir", f.Dir, "the directory of the warm pool files, must match the warmPool.dir of the netconf")
+	fs.IntVar(&f.Low, "warm-pool-low", f.Low, "refill the warm pool once it holds fewer addresses")
+	fs.IntVar(&f.High, "warm-pool-high", f.High, "the number of addresses a refill tops the warm pool up to")
+	fs.DurationVar(&f.Interval, "warm-pool-interval", f.Interval, "how often the warm pool is checked")
+}
+
+func (f *WarmPoolFlags) ValidateFlags() error {
+	if f.Low < 0 || f.High < f.Low {
+		return fmt.Errorf("warm pool watermarks need 0 <= low <= high, got low %d high %d", f.Low, f.High)
+	}
+	if f.Interval <= 0 {
+		return fmt.Errorf("warm pool interval must be positive, got %v", f.Interval)
+	}
+	return nil
+}
+
+// runWarmPools refills the pools of this node until ctx is done, a cordoned
+// node or a stopping daemon hands all its reservations back.
+func runWarmPools(ctx context.Context, o *Options, store datastore.Datastore, k8sClient *k8s.Client) {
+	if len(o.WarmPool.Networks) == 0 {
+		<-ctx.Done()
+		return
+	}
+	var pools []*ipam.WarmPool
+	for _, network := range o.WarmPool.Networks {
+		pool := ipam.NewWarmPool(store, network, o.NodeName, o.WarmPool.Dir)
+		pool.Low = o.WarmPool.Low
+		pool.High = o.WarmPool.High
+		pools = append(pools, pool)
+	}
+	drain := func() {
+		for _, pool := range pools {
+			if err := pool.Drain(); err != nil {
+				klog.Errorf("failed to drain warm pool of network %s, err is %v", pool.Network, err)
+			}
+		}
+	}
+	defer drain()
+
+	drained := false
+	ticker := time.NewTicker(o.WarmPool.Interval)
+	defer ticker.Stop()
+	for {
+		node, err := k8sClient.GetNode(o.NodeName)
+		if err != nil {
+			klog.Errorf("failed to get node %s, err is %v", o.NodeName, err)
+		}
+		if err == nil && node.Spec.Unschedulable {
+			if !drained {
+				klog.Infof("node %s is cordoned, hand the warm pools back", o.NodeName)
+				drain()
+				drained = true
+			}
+		} else {
+			drained = false
+			for _, pool := range pools {
+				if err := pool.Refill(); err != nil {
+					klog.Errorf("failed to refill warm pool of network %s, err is %v", pool.Network, err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package cni
 
 import (
+	"cni/etcd"
 	"cni/skel"
 	"errors"
 	"fmt"
 	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"k8s.io/klog"
+	"time"
 )
 
 type IPAM struct {
@@ -19,15 +21,85 @@ type IPAM struct {
 	Routes     interface{}                `json:"routes"`
 }
 
+// WarmPoolConf lets ADD take addresses the node daemon reserved ahead of time,
+// the watermarks are owned by the daemon that refills the pool.
+type WarmPoolConf struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+}
+
+// DADConf probes every ipv4 address with ARP before ADD wires it. The probe
+// goes out the uplink of the node, the pod veth only reaches the host, so it
+// finds hosts of the node's segment using an address of the pod network.
+// There is no duplicate detection for ipv6 addresses, they are handed out
+// unprobed.
+type DADConf struct {
+	Enabled   bool `json:"enabled"`
+	TimeoutMs int  `json:"timeoutMs"`
+	Retries   int  `json:"retries"`
+}
+
+func (c *DADConf) GetTimeout() time.Duration {
+	if c == nil || c.TimeoutMs <= 0 {
+		return 600 * time.Millisecond
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+func (c *DADConf) GetRetries() int {
+	if c == nil || c.Retries <= 0 {
+		return 3
+	}
+	return c.Retries
+}
+
+// DatastoreConf picks where the records of tinycni are kept: etcd, the
+// kubernetes api server or, for tests, the memory of the plugin process.
+// Etcd, Prefix and ClusterID override the settings of the tinycni config file
+// and environment.
+type DatastoreConf struct {
+	Type      string           `json:"type"`
+	Etcd      *etcd.EtcdConfig `json:"etcd"`
+	Prefix    string           `json:"prefix"`
+	ClusterID string           `json:"clusterId"`
+}
+
+func (c *DatastoreConf) GetType() string {
+	if c == nil {
+		return ""
+	}
+	return c.Type
+}
+
+func (c *DatastoreConf) GetScope() etcd.Scope {
+	if c == nil {
+		return etcd.Scope{}
+	}
+	return etcd.Scope{Prefix: c.Prefix, ClusterID: c.ClusterID}
+}
+
+func (c *DatastoreConf) GetEtcd() *etcd.EtcdConfig {
+	if c == nil {
+		return nil
+	}
+	return c.Etcd
+}
+
 type PluginConf struct {
 	cniTypes.NetConf
 	RuntimeConfig *struct {
 		TestConfig map[string]interface{} `json:"testConfig"`
 	} `json:"runtimeConfig"`
-	IPAM   *IPAM  `json:"ipam"`
-	Bridge string `json:"bridge"`
-	Subnet string `json:"subnet"`
-	Mode   string `json:"mode" default:"host-gw"`
+	IPAM      *IPAM          `json:"ipam"`
+	Bridge    string         `json:"bridge"`
+	Subnet    string         `json:"subnet"`
+	Mode      string         `json:"mode" default:"host-gw"`
+	WarmPool  *WarmPoolConf  `json:"warmPool"`
+	DAD       *DADConf       `json:"dad"`
+	Datastore *DatastoreConf `json:"datastore"`
+	// DefaultNetwork is joined by pods that no annotation, label or network
+	// pod selector assigns a network
+	DefaultNetwork string `json:"defaultNetwork"`
 }
 
 var manager *CNIManager
@@ -178,9 +250,9 @@ func (manager *CNIManager) BootStrapCNI() error {
 }
 
 func (manager *CNIManager) UnmountCNI() error {
-	mode := manager.getBootstrapMode()
-	args := manager.getBootStrapArgs()
-	configs := manager.getBootstrapConfigs()
+	mode := manager.getUnmountMode()
+	args := manager.getUnmountArgs()
+	configs := manager.getUnmountConfigs()
 	if mode == "" || args == nil || configs == nil {
 		return errors.New("unmount cni need set mode,args and configs")
 	}
@@ -193,11 +265,11 @@ func (manager *CNIManager) UnmountCNI() error {
 }
 
 func (manager *CNIManager) CheckCNI() error {
-	mode := manager.getBootstrapMode()
-	args := manager.getBootStrapArgs()
-	configs := manager.getBootstrapConfigs()
+	mode := manager.getCheckMode()
+	args := manager.getCheckArgs()
+	configs := manager.getCheckConfigs()
 	if mode == "" || args == nil || configs == nil {
-		return errors.New("unmount cni need set mode,args and configs")
+		return errors.New("check cni need set mode,args and configs")
 	}
 	cni := manager.getCNI(mode)
 	if cni == nil {
@@ -18,15 +18,19 @@ const (
 const (
 	KUBE_API                               = "/api/v1"
 	KUBE_DEFAULT_PATH                      = "/etc/kubernetes"
-	KUBE_LOCAL_DEFAULT_PATH                = "~/.kube/conf"
-	KUBE_DEFAULT_CA_PATH                   = KUBE_DEFAULT_PATH + "/pki/ca.crt"
+	KUBE_LOCAL_DEFAULT_PATH                = "~/.kube/config"
+	KUBE_SERVICE_ACCOUNT_PATH              = "/var/run/secrets/kubernetes.io/serviceaccount"
+	KUBECONFIG_ENV                         = "KUBECONFIG"
 	KUBELET_CONFIG_DEFAULT_PATH            = KUBE_DEFAULT_PATH + "/kubelet.conf"
 	KUBE_CONF_ADMIN_DEFAULT_PATH           = KUBE_DEFAULT_PATH + "/admin.conf"
 	KUBE_TEST_CNI_DEFAULT_PATH             = "/opt/testcni"
 	KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH  = KUBE_TEST_CNI_DEFAULT_PATH + "/deamon"
-	KUBE_TEST_CNI_TMP_CA_DEFAULT_PATH      = KUBE_TEST_CNI_DEFAULT_PATH + "/ca.crt"
-	KUBE_TEST_CNI_TMP_CERT_DEFAULT_PATH    = KUBE_TEST_CNI_DEFAULT_PATH + "/cert.crt"
-	KUBE_TEST_CNI_TMP_KEY_DEFAULT_PATH     = KUBE_TEST_CNI_DEFAULT_PATH + "/key.key"
 	KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird.cfg"
 	KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird_deamon"
+	KUBE_TEST_CNI_WARM_POOL_DEFAULT_PATH   = KUBE_TEST_CNI_DEFAULT_PATH + "/warmpool"
+)
+
+const (
+	TINYCNI_CONFIG_ENV          = "TINYCNI_CONFIG"
+	TINYCNI_CONFIG_DEFAULT_PATH = "/etc/tinycni/tinycni.conf"
 )
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CheckCluster registers the prefix of ds under etcd.ClustersKey and claims
+// it for the cluster id of this process. It fails when the prefix nests in or
+// holds the prefix of another cluster, or when another cluster already
+// claimed it. Without a cluster id only the prefix is registered.
+func CheckCluster(ds Datastore) error {
+	id := etcd.ClusterID()
+	if id == "" {
+		klog.Warningf("no cluster id configured, records under %s are not checked to belong to this cluster", etcd.Prefix())
+	}
+	value, err := json.Marshal(etcd.Cluster{ClusterID: id, CreatedAt: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	return ds.Update(func(tx Txn) error {
+		if err := RegisterPrefix(tx, etcd.Prefix(), id); err != nil {
+			return err
+		}
+		if id == "" {
+			return nil
+		}
+		stored := tx.Get(etcd.ClusterKey())
+		if stored == "" {
+			tx.Put(etcd.ClusterKey(), string(value))
+			return nil
+		}
+		var cluster etcd.Cluster
+		if err := json.Unmarshal([]byte(stored), &cluster); err != nil {
+			return fmt.Errorf("failed to decode the cluster of %s: %v", etcd.Prefix(), err)
+		}
+		if cluster.ClusterID != id {
+			return etcd.NewConfigError(fmt.Sprintf("prefix %s belongs to cluster %s, not %s", etcd.Prefix(), cluster.ClusterID, id), nil)
+		}
+		return nil
+	})
+}
+
+// RegisterPrefix records prefix for clusterID under etcd.ClustersKey in tx,
+// a prefix holding or nested in a registered one is refused since listing
+// the outer prefix would return the records of the inner cluster.
+func RegisterPrefix(tx Txn, prefix, clusterID string) error {
+	clusters := make(map[string]etcd.Cluster)
+	if stored := tx.Get(etcd.ClustersKey); stored != "" {
+		if err := json.Unmarshal([]byte(stored), &clusters); err != nil {
+			return fmt.Errorf("failed to decode %s: %v", etcd.ClustersKey, err)
+		}
+	}
+	prefixes := make([]string, 0, len(clusters))
+	for p := range clusters {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		if p != prefix && (strings.HasPrefix(prefix, p) || strings.HasPrefix(p, prefix)) {
+			return etcd.NewConfigError(fmt.Sprintf("prefix %s overlaps prefix %s of cluster %q, remove it from %s if that cluster is gone",
+				prefix, p, clusters[p].ClusterID, etcd.ClustersKey), nil)
+		}
+	}
+	cluster, ok := clusters[prefix]
+	if ok && (cluster.ClusterID == clusterID || clusterID == "") {
+		return nil
+	}
+	if !ok {
+		cluster.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	cluster.ClusterID = clusterID
+	clusters[prefix] = cluster
+	value, err := json.Marshal(clusters)
+	if err != nil {
+		return err
+	}
+	tx.Put(etcd.ClustersKey, string(value))
+	return nil
+}
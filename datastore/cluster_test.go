@@ -0,0 +1,35 @@
+package datastore_test
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"testing"
+)
+
+func TestCheckClusterRefusesNestedPrefixes(t *testing.T) {
+	ds := newDatastore(t)
+	t.Cleanup(func() { etcd.UseScope(etcd.Scope{Prefix: etcd.TinyCniPrefix}) })
+	tests := []struct {
+		name  string
+		scope etcd.Scope
+		ok    bool
+	}{
+		{"first cluster", etcd.Scope{Prefix: "/tinycni/", ClusterID: "a"}, true},
+		{"nested prefix", etcd.Scope{Prefix: "/tinycni/b/", ClusterID: "b"}, false},
+		{"prefix sharing letters", etcd.Scope{Prefix: "/tiny/", ClusterID: "b"}, true},
+		{"holding prefix", etcd.Scope{Prefix: "/", ClusterID: "c"}, false},
+		{"sibling prefix", etcd.Scope{Prefix: "/tinycni-b/", ClusterID: "b"}, true},
+		{"same cluster again", etcd.Scope{Prefix: "/tinycni/", ClusterID: "a"}, true},
+		{"same prefix without id", etcd.Scope{Prefix: "/tinycni/"}, true},
+		{"prefix of another cluster", etcd.Scope{Prefix: "/tinycni/", ClusterID: "b"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			etcd.UseScope(test.scope)
+			err := datastore.CheckCluster(ds)
+			if (err == nil) != test.ok {
+				t.Errorf("CheckCluster(%s) = %v, want ok %v", test.scope.Prefix, err, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"cni/utils/k8s"
+	"context"
+	"fmt"
+	"time"
+)
+
+// the backends a netconf or a daemon can choose from
+const (
+	TypeEtcd       = "etcd"
+	TypeKubernetes = "kubernetes"
+	TypeMemory     = "memory"
+)
+
+// Datastore keeps the tinycni records: nodes, networks, pods, node blocks and
+// ip allocations. Keys are the paths built by the etcd key builders, every
+// backend stores them its own way.
+type Datastore interface {
+	// Get returns "" when key does not exist
+	Get(key string) (string, error)
+	List(prefix string) (map[string]string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	// Update runs apply as one serializable transaction, apply is run again
+	// when what it read changed before its writes could be committed.
+	Update(apply func(tx Txn) error) error
+	// PutTTL puts key until no PutTTL renewed it for ttl, used for records
+	// that must go away together with their writer.
+	PutTTL(key, value string, ttl time.Duration) error
+	// Watch first calls handler with a put for every key already under
+	// prefix, then with every change until ctx is done. A watch that fell
+	// behind reports what changed in between once it caught up.
+	Watch(ctx context.Context, prefix string, handler WatchHandler)
+	Close() error
+}
+
+// Txn is the view apply has of the store inside Update, reads see the writes
+// apply already made.
+type Txn interface {
+	Get(key string) string
+	List(prefix string) map[string]string
+	Put(key, value string)
+	Del(key string)
+}
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+type Event struct {
+	Type  EventType
+	Key   string
+	Value string
+}
+
+type WatchHandler func(event Event)
+
+// txnWrites is the write buffer shared by the Txn implementations, a nil
+// value marks a delete.
+type txnWrites struct {
+	order  []string
+	values map[string]*string
+}
+
+func newTxnWrites() *txnWrites {
+	return &txnWrites{values: make(map[string]*string)}
+}
+
+func (w *txnWrites) put(key string, value *string) {
+	if _, ok := w.values[key]; !ok {
+		w.order = append(w.order, key)
+	}
+	w.values[key] = value
+}
+
+func (w *txnWrites) get(key string) (string, bool) {
+	value, ok := w.values[key]
+	if !ok {
+		return "", false
+	}
+	if value == nil {
+		return "", true
+	}
+	return *value, true
+}
+
+// overlay applies the buffered writes under prefix to kvs.
+func (w *txnWrites) overlay(prefix string, kvs map[string]string) map[string]string {
+	for _, key := range w.order {
+		if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+			continue
+		}
+		if value := w.values[key]; value == nil {
+			delete(kvs, key)
+		} else {
+			kvs[key] = *value
+		}
+	}
+	return kvs
+}
+
+// Clients opens the connection a backend needs, only the one of the chosen
+// backend is called.
+type Clients struct {
+	Etcd func() (*etcd.EtcdClient, error)
+	K8s  func() (*k8s.Client, error)
+}
+
+// Config picks the backend of New, an empty Type means etcd, and the scope
+// of the records in it.
+type Config struct {
+	Type string
+	etcd.Scope
+}
+
+// New opens the datastore of conf under the scope merged by etcd.LoadScope,
+// loads the schema version its records are written in and makes sure it
+// belongs to the cluster of this process.
+func New(conf Config, clients Clients) (Datastore, error) {
+	scope, err := etcd.LoadScope(conf.Scope)
+	if err != nil {
+		return nil, err
+	}
+	etcd.UseScope(scope)
+	store, err := open(conf.Type, clients)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := LoadSchema(store); err != nil {
+		return nil, err
+	}
+	if err := CheckCluster(store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func open(kind string, clients Clients) (Datastore, error) {
+	switch kind {
+	case "", TypeEtcd:
+		if clients.Etcd == nil {
+			return nil, fmt.Errorf("no etcd client for the %s datastore", TypeEtcd)
+		}
+		client, err := clients.Etcd()
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			return nil, fmt.Errorf("etcd client is not initialized")
+		}
+		return NewEtcdDatastore(client), nil
+	case TypeKubernetes:
+		if clients.K8s == nil {
+			return nil, fmt.Errorf("no kubernetes client for the %s datastore", TypeKubernetes)
+		}
+		client, err := clients.K8s()
+		if err != nil {
+			return nil, err
+		}
+		return NewKubernetesDatastore(client), nil
+	case TypeMemory:
+		return NewMemoryDatastore(), nil
+	}
+	return nil, fmt.Errorf("unknown datastore type %q, expected one of %s, %s or %s", kind, TypeEtcd, TypeKubernetes, TypeMemory)
+}
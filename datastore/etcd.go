@@ -0,0 +1,215 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"context"
+	"fmt"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+const etcdTxnTimeout = 30 * time.Second
+
+// etcdDatastore keeps every key as it is in etcd, this is the layout tinycni
+// always had.
+type etcdDatastore struct {
+	client *etcd.EtcdClient
+	kv     *clientv3.Client
+
+	leaseLock sync.Mutex
+	leases    map[string]clientv3.LeaseID
+}
+
+func NewEtcdDatastore(client *etcd.EtcdClient) Datastore {
+	return &etcdDatastore{
+		client: client,
+		kv:     client.Client().Client,
+		leases: make(map[string]clientv3.LeaseID),
+	}
+}
+
+func (s *etcdDatastore) Get(key string) (string, error) {
+	return s.client.Get(key)
+}
+
+func (s *etcdDatastore) List(prefix string) (map[string]string, error) {
+	return s.client.GetAllKeyValue(prefix, clientv3.WithPrefix())
+}
+
+func (s *etcdDatastore) Put(key, value string) error {
+	return s.client.Set(key, value)
+}
+
+func (s *etcdDatastore) Delete(key string) error {
+	return s.client.Del(key)
+}
+
+// etcdTxn reads at one revision and remembers what it read, its writes are
+// committed by a Txn that compares the mod revisions of the reads.
+type etcdTxn struct {
+	ctx      context.Context
+	kv       *clientv3.Client
+	rev      int64
+	reads    map[string]int64
+	prefixes []string
+	writes   *txnWrites
+	err      error
+}
+
+func (t *etcdTxn) get(key string, opts ...clientv3.OpOption) *clientv3.GetResponse {
+	if t.err != nil {
+		return nil
+	}
+	if t.rev > 0 {
+		opts = append(opts, clientv3.WithRev(t.rev))
+	}
+	resp, err := t.kv.Get(t.ctx, key, opts...)
+	if err != nil {
+		t.err = err
+		return nil
+	}
+	if t.rev == 0 {
+		t.rev = resp.Header.Revision
+	}
+	return resp
+}
+
+func (t *etcdTxn) Get(key string) string {
+	if value, ok := t.writes.get(key); ok {
+		return value
+	}
+	resp := t.get(key)
+	if resp == nil {
+		return ""
+	}
+	t.reads[key] = 0
+	if len(resp.Kvs) == 0 {
+		return ""
+	}
+	t.reads[key] = resp.Kvs[0].ModRevision
+	return string(resp.Kvs[0].Value)
+}
+
+func (t *etcdTxn) List(prefix string) map[string]string {
+	kvs := make(map[string]string)
+	resp := t.get(prefix, clientv3.WithPrefix())
+	if resp == nil {
+		return kvs
+	}
+	t.prefixes = append(t.prefixes, prefix)
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+	return t.writes.overlay(prefix, kvs)
+}
+
+func (t *etcdTxn) Put(key, value string) {
+	t.writes.put(key, &value)
+}
+
+func (t *etcdTxn) Del(key string) {
+	t.writes.put(key, nil)
+}
+
+func (t *etcdTxn) commit() (bool, error) {
+	var cmps []clientv3.Cmp
+	for key, modRev := range t.reads {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", modRev))
+	}
+	for _, prefix := range t.prefixes {
+		// catches keys put under prefix after it was read, deletes are not
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(prefix), "<", t.rev+1).WithPrefix())
+	}
+	var ops []clientv3.Op
+	for _, key := range t.writes.order {
+		if value := t.writes.values[key]; value == nil {
+			ops = append(ops, clientv3.OpDelete(key))
+		} else {
+			ops = append(ops, clientv3.OpPut(key, *value))
+		}
+	}
+	if len(ops) == 0 {
+		return true, nil
+	}
+	resp, err := t.kv.Txn(t.ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *etcdDatastore) Update(apply func(tx Txn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTxnTimeout)
+	defer cancel()
+	for {
+		tx := &etcdTxn{ctx: ctx, kv: s.kv, reads: make(map[string]int64), writes: newTxnWrites()}
+		if err := apply(tx); err != nil {
+			return err
+		}
+		if tx.err != nil {
+			return tx.err
+		}
+		ok, err := tx.commit()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("transaction kept conflicting: %v", ctx.Err())
+		}
+	}
+}
+
+// PutTTL keeps one lease per key and renews it on every call, a lease that
+// expired in between is replaced by a new one.
+func (s *etcdDatastore) PutTTL(key, value string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTxnTimeout)
+	defer cancel()
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+	lease, ok := s.leases[key]
+	if ok {
+		if _, err := s.kv.KeepAliveOnce(ctx, lease); err != nil {
+			klog.Warningf("lease of %s is gone, grant a new one, err is %v", key, err)
+			ok = false
+		}
+	}
+	if !ok {
+		seconds := int64(ttl / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		resp, err := s.kv.Grant(ctx, seconds)
+		if err != nil {
+			return err
+		}
+		lease = resp.ID
+		s.leases[key] = lease
+	}
+	_, err := s.kv.Put(ctx, key, value, clientv3.WithLease(lease))
+	return err
+}
+
+func (s *etcdDatastore) Watch(ctx context.Context, prefix string, handler WatchHandler) {
+	informer := s.client.NewInformer(prefix)
+	informer.AddHandler(etcd.EventHandler{
+		OnAdd: func(key, value string) {
+			handler(Event{Type: EventPut, Key: key, Value: value})
+		},
+		OnUpdate: func(key, _, value string) {
+			handler(Event{Type: EventPut, Key: key, Value: value})
+		},
+		OnDelete: func(key, _ string) {
+			handler(Event{Type: EventDelete, Key: key})
+		},
+	})
+	go informer.Run(ctx)
+}
+
+func (s *etcdDatastore) Close() error {
+	return s.client.Close()
+}
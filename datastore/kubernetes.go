@@ -0,0 +1,607 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"cni/utils/k8s"
+	"cni/utils/rest"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"k8s.io/klog"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	shardKindNetwork    = "network"
+	shardKindIpam       = "ipam"
+	shardKindBlocks     = "blocks"
+	shardKindUsage      = "usage"
+	shardKindNode       = "node"
+	shardKindPods       = "pods"
+	shardKindContainers = "containers"
+	shardKindCluster    = "cluster"
+	shardKindCommit     = "commit"
+
+	// commitShardName must never be deleted, shards skip the commits
+	// numbered below the last one they applied
+	commitShardName = "commit"
+
+	// the address records of one /24, or /120 for ipv6, share a shard
+	ipamShardBitsV4 = 24
+	ipamShardBitsV6 = 120
+	podShards       = 16
+
+	kubernetesPollInterval  = 2 * time.Second
+	kubernetesTxnTimeout    = 30 * time.Second
+	kubernetesTxnBackoff    = 10 * time.Millisecond
+	kubernetesTxnMaxBackoff = time.Second
+)
+
+var (
+	shardNameRegexp  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	labelValueRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`)
+)
+
+// kubernetesDatastore keeps the keys in DatastoreShard custom resources, so
+// tinycni only needs the api server. Shards are small: an address record
+// shares its shard with the records of the same /24, a block, a usage
+// counter, a node and a network with its quota each get their own, pods are
+// spread over a few shards per namespace.
+//
+// Every transaction commits with one write: it puts its writes into the
+// journal of the commit shard, guarded by the resourceVersion the commit shard
+// had before apply read anything, and only then copies them to the shards
+// they belong to. Whoever finds a journal left there copies it first, so a
+// writer dying halfway leaves nothing half done. A shard records the commit
+// it applied last, a transaction reading one newer than the commit it started
+// from runs again, and so does one whose commit lost the race. This
+// serializes the writers of the whole cluster, the backend suits clusters
+// with a moderate pod churn, large ones should use etcd.
+type kubernetesDatastore struct {
+	client *k8s.Client
+}
+
+func NewKubernetesDatastore(client *k8s.Client) Datastore {
+	return &kubernetesDatastore{client: client}
+}
+
+// shardRef locates the shard of a key. For a prefix the name is empty, it
+// spans every shard of its kind and group, or of every kind when the prefix
+// lies above them.
+type shardRef struct {
+	kind  string
+	group string
+	name  string
+}
+
+// shardOf maps a key, or a prefix ending in "/", to its shard.
+func shardOf(key string) shardRef {
+	if key == etcd.ClustersKey {
+		return shardRef{kind: shardKindCluster, name: shardName(shardKindCluster, "registry")}
+	}
+	levels := strings.Split(strings.TrimPrefix(key, etcd.Prefix()), "/")
+	level := func(i int) string {
+		if i < len(levels) {
+			return levels[i]
+		}
+		return ""
+	}
+	named := func(kind, group string, ids ...string) shardRef {
+		ref := shardRef{kind: kind, group: group}
+		for _, id := range ids {
+			if id == "" {
+				return ref
+			}
+		}
+		ref.name = shardName(kind, ids...)
+		return ref
+	}
+	switch level(0) {
+	case "":
+		return shardRef{}
+	case etcd.NetworksKeyName, etcd.QuotasKeyName:
+		return named(shardKindNetwork, level(1), level(1))
+	case etcd.IpamKeyName:
+		return named(shardKindIpam, level(1), level(1), level(2), ipamBucket(level(3)))
+	case etcd.BlocksKeyName:
+		return named(shardKindBlocks, level(1), level(1), level(2), level(3))
+	case etcd.UsageKeyName:
+		return named(shardKindUsage, level(1), level(1), level(2), level(3))
+	case etcd.NodesKeyName:
+		return named(shardKindNode, "", level(1))
+	case etcd.PodsKeyName:
+		bucket := ""
+		if name := level(2); name != "" {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(name))
+			bucket = fmt.Sprintf("%x", h.Sum32()%podShards)
+		}
+		return named(shardKindPods, level(1), level(1), bucket)
+	case etcd.ContainersKeyName, etcd.AllocationsKeyName:
+		id := level(1)
+		if len(id) > 2 {
+			id = id[:2]
+		}
+		return named(shardKindContainers, "", id)
+	}
+	return shardRef{kind: shardKindCluster, name: shardKindCluster}
+}
+
+// ipamBucket returns the network of the records sharing a shard with ip.
+func ipamBucket(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(ipamShardBitsV4, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(ipamShardBitsV6, 128)).String()
+}
+
+// shardName joins kind and ids, ids that do not make a valid resource name
+// are hashed. Two ids may share a shard, entries keep their whole key.
+func shardName(kind string, ids ...string) string {
+	name := kind + "." + strings.ToLower(strings.Join(ids, "."))
+	if len(name) <= 253 && shardNameRegexp.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("%s.x%x", kind, hashId(strings.Join(ids, "/")))
+}
+
+func shardGroupLabel(group string) string {
+	if len(group) <= 63 && labelValueRegexp.MatchString(group) {
+		return group
+	}
+	return fmt.Sprintf("x%x", hashId(group))
+}
+
+func hashId(id string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return h.Sum64()
+}
+
+func entryAlive(entry k8s.DatastoreEntry, now time.Time) bool {
+	if entry.ExpiresAt == "" {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, entry.ExpiresAt)
+	return err != nil || now.Before(expiresAt)
+}
+
+func shardEntries(shard *k8s.DatastoreShard, prefix string, kvs map[string]string) {
+	now := time.Now()
+	for key, entry := range shard.Spec.Entries {
+		if strings.HasPrefix(key, prefix) && entryAlive(entry, now) {
+			kvs[key] = entry.Value
+		}
+	}
+}
+
+func newShard(ref shardRef) *k8s.DatastoreShard {
+	labels := map[string]string{k8s.DatastoreShardLabel: ref.kind}
+	if ref.group != "" {
+		labels[k8s.DatastoreShardGroupLabel] = shardGroupLabel(ref.group)
+	}
+	return &k8s.DatastoreShard{MetaData: k8s.DatastoreShardMeta{Name: ref.name, Labels: labels}}
+}
+
+// getShard returns nil when the shard does not exist yet.
+func (s *kubernetesDatastore) getShard(name string) (*k8s.DatastoreShard, error) {
+	shard, _, err := s.client.GetDatastoreShard(name)
+	if rest.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get datastore shard %s: %v", name, err)
+	}
+	return &shard, nil
+}
+
+// listShards lists the shards of ref, every shard when it has no kind.
+func (s *kubernetesDatastore) listShards(ref shardRef) ([]k8s.DatastoreShard, error) {
+	group := ""
+	if ref.group != "" {
+		group = shardGroupLabel(ref.group)
+	}
+	list, err := s.client.ListDatastoreShards(ref.kind, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list datastore shards of kind %q group %q: %v", ref.kind, ref.group, err)
+	}
+	return list.Items, nil
+}
+
+func (s *kubernetesDatastore) Get(key string) (string, error) {
+	value := ""
+	err := s.Update(func(tx Txn) error {
+		value = tx.Get(key)
+		return nil
+	})
+	return value, err
+}
+
+func (s *kubernetesDatastore) List(prefix string) (map[string]string, error) {
+	var kvs map[string]string
+	err := s.Update(func(tx Txn) error {
+		kvs = tx.List(prefix)
+		return nil
+	})
+	return kvs, err
+}
+
+func (s *kubernetesDatastore) Put(key, value string) error {
+	return s.Update(func(tx Txn) error {
+		tx.Put(key, value)
+		return nil
+	})
+}
+
+func (s *kubernetesDatastore) Delete(key string) error {
+	return s.Update(func(tx Txn) error {
+		tx.Del(key)
+		return nil
+	})
+}
+
+// kubernetesTxn reads the shards as they were after commit seq, it loads
+// every shard it reads once and keeps the writes aside until the commit.
+type kubernetesTxn struct {
+	store  *kubernetesDatastore
+	seq    int64
+	shards map[string]*k8s.DatastoreShard
+	writes *txnWrites
+	// expiries holds the expiry of the keys put by PutTTL
+	expiries map[string]string
+	// stale is set when a shard read already applied a later commit
+	stale bool
+	err   error
+}
+
+func newKubernetesTxn(store *kubernetesDatastore, seq int64) *kubernetesTxn {
+	return &kubernetesTxn{
+		store:    store,
+		seq:      seq,
+		shards:   make(map[string]*k8s.DatastoreShard),
+		writes:   newTxnWrites(),
+		expiries: make(map[string]string),
+	}
+}
+
+func (t *kubernetesTxn) check(shard *k8s.DatastoreShard) {
+	if shard != nil && shard.Spec.Seq > t.seq {
+		t.stale = true
+	}
+}
+
+func (t *kubernetesTxn) shard(name string) *k8s.DatastoreShard {
+	if shard, ok := t.shards[name]; ok || t.err != nil {
+		return shard
+	}
+	shard, err := t.store.getShard(name)
+	if err != nil {
+		t.err = err
+		return nil
+	}
+	t.check(shard)
+	t.shards[name] = shard
+	return shard
+}
+
+func (t *kubernetesTxn) Get(key string) string {
+	if value, ok := t.writes.get(key); ok {
+		return value
+	}
+	ref := shardOf(key)
+	if ref.name == "" {
+		return ""
+	}
+	shard := t.shard(ref.name)
+	if shard == nil {
+		return ""
+	}
+	entry, ok := shard.Spec.Entries[key]
+	if !ok || !entryAlive(entry, time.Now()) {
+		return ""
+	}
+	return entry.Value
+}
+
+func (t *kubernetesTxn) List(prefix string) map[string]string {
+	kvs := make(map[string]string)
+	// a prefix may end inside a key level, only the levels before it count
+	ref := shardOf(prefix[:strings.LastIndex(prefix, "/")+1])
+	if ref.name != "" {
+		if shard := t.shard(ref.name); shard != nil {
+			shardEntries(shard, prefix, kvs)
+		}
+		return t.writes.overlay(prefix, kvs)
+	}
+	if t.err != nil {
+		return kvs
+	}
+	shards, err := t.store.listShards(ref)
+	if err != nil {
+		t.err = err
+		return kvs
+	}
+	for i := range shards {
+		name := shards[i].MetaData.Name
+		if _, ok := t.shards[name]; !ok {
+			t.check(&shards[i])
+			t.shards[name] = &shards[i]
+		}
+		if shard := t.shards[name]; shard != nil {
+			shardEntries(shard, prefix, kvs)
+		}
+	}
+	return t.writes.overlay(prefix, kvs)
+}
+
+func (t *kubernetesTxn) write(key string, value *string, expiresAt string) {
+	if shardOf(key).name == "" {
+		if t.err == nil {
+			t.err = fmt.Errorf("key %s belongs to no datastore shard", key)
+		}
+		return
+	}
+	t.writes.put(key, value)
+	if expiresAt == "" {
+		delete(t.expiries, key)
+	} else {
+		t.expiries[key] = expiresAt
+	}
+}
+
+func (t *kubernetesTxn) Put(key, value string) {
+	t.write(key, &value, "")
+}
+
+func (t *kubernetesTxn) Del(key string) {
+	t.write(key, nil, "")
+}
+
+// commit puts the writes into the journal of head, the commit shard apply
+// started from. It reports false when another transaction committed since.
+func (t *kubernetesTxn) commit(head *k8s.DatastoreShard) (bool, error) {
+	if len(t.writes.order) == 0 {
+		return true, nil
+	}
+	next := *head
+	next.Spec.Seq = head.Spec.Seq + 1
+	next.Spec.Journal = make(map[string]*k8s.DatastoreEntry)
+	for _, key := range t.writes.order {
+		var entry *k8s.DatastoreEntry
+		if value := t.writes.values[key]; value != nil {
+			entry = &k8s.DatastoreEntry{Value: *value, ExpiresAt: t.expiries[key]}
+		}
+		next.Spec.Journal[key] = entry
+	}
+	var err error
+	if head.MetaData.ResourceVersion == "" {
+		_, err = t.store.client.CreateDatastoreShard(&next)
+	} else {
+		_, err = t.store.client.UpdateDatastoreShard(&next)
+	}
+	if rest.IsConflict(err) || rest.IsAlreadyExists(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to commit to datastore shard %s: %v", commitShardName, err)
+	}
+	// committed, when copying the journal fails the next transaction of any
+	// writer finishes it
+	if err := t.store.rollForward(&next, t.shards); err != nil {
+		klog.Errorf("failed to apply commit %d of the datastore, err is %v", next.Spec.Seq, err)
+	}
+	return true, nil
+}
+
+// head returns the commit shard, an empty one before the first commit.
+func (s *kubernetesDatastore) head() (*k8s.DatastoreShard, error) {
+	shard, err := s.getShard(commitShardName)
+	if err != nil || shard != nil {
+		return shard, err
+	}
+	return newShard(shardRef{kind: shardKindCommit, name: commitShardName}), nil
+}
+
+// rollForward copies the journal of head to the shards it touches and clears
+// it. Several writers may do so at once: a shard records the last commit it
+// applied and skips older ones. loaded holds shards already read, a nil one
+// did not exist.
+func (s *kubernetesDatastore) rollForward(head *k8s.DatastoreShard, loaded map[string]*k8s.DatastoreShard) error {
+	refs := make(map[string]shardRef)
+	writes := make(map[string]map[string]*k8s.DatastoreEntry)
+	for key, entry := range head.Spec.Journal {
+		ref := shardOf(key)
+		if writes[ref.name] == nil {
+			refs[ref.name] = ref
+			writes[ref.name] = make(map[string]*k8s.DatastoreEntry)
+		}
+		writes[ref.name][key] = entry
+	}
+	var names []string
+	for name := range writes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		shard, ok := loaded[name]
+		if err := s.applyShard(refs[name], head.Spec.Seq, writes[name], shard, ok); err != nil {
+			return err
+		}
+	}
+	cleared := *head
+	cleared.Spec.Journal = nil
+	_, err := s.client.UpdateDatastoreShard(&cleared)
+	// another writer cleared it first, only then can the next commit follow
+	if rest.IsConflict(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clear the journal of datastore shard %s: %v", commitShardName, err)
+	}
+	return nil
+}
+
+// applyShard writes the entries of commit seq to the shard of ref, shard is
+// its last known state when loaded.
+func (s *kubernetesDatastore) applyShard(ref shardRef, seq int64, entries map[string]*k8s.DatastoreEntry, shard *k8s.DatastoreShard, loaded bool) error {
+	deadline := time.Now().Add(kubernetesTxnTimeout)
+	for {
+		if !loaded {
+			var err error
+			if shard, err = s.getShard(ref.name); err != nil {
+				return err
+			}
+		}
+		loaded = false
+		if shard == nil {
+			shard = newShard(ref)
+		} else if shard.Spec.Seq >= seq {
+			return nil
+		}
+		now := time.Now()
+		if shard.Spec.Entries == nil {
+			shard.Spec.Entries = make(map[string]k8s.DatastoreEntry)
+		}
+		for key, entry := range shard.Spec.Entries {
+			if !entryAlive(entry, now) {
+				delete(shard.Spec.Entries, key)
+			}
+		}
+		for key, entry := range entries {
+			if entry == nil {
+				delete(shard.Spec.Entries, key)
+			} else {
+				shard.Spec.Entries[key] = *entry
+			}
+		}
+		shard.Spec.Seq = seq
+		var err error
+		if shard.MetaData.ResourceVersion == "" {
+			_, err = s.client.CreateDatastoreShard(shard)
+		} else {
+			_, err = s.client.UpdateDatastoreShard(shard)
+		}
+		// another writer copying the same journal got there first
+		if (rest.IsConflict(err) || rest.IsAlreadyExists(err)) && time.Now().Before(deadline) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write datastore shard %s: %v", ref.name, err)
+		}
+		return nil
+	}
+}
+
+func (s *kubernetesDatastore) Update(apply func(tx Txn) error) error {
+	return s.update(func(tx *kubernetesTxn) error {
+		return apply(tx)
+	})
+}
+
+// update runs apply until its transaction commits, backing off exponentially
+// with jitter while other transactions keep committing first.
+func (s *kubernetesDatastore) update(apply func(tx *kubernetesTxn) error) error {
+	deadline := time.Now().Add(kubernetesTxnTimeout)
+	backoff := kubernetesTxnBackoff
+	for attempt := 1; ; attempt++ {
+		head, err := s.head()
+		if err != nil {
+			return err
+		}
+		if len(head.Spec.Journal) > 0 {
+			// the shards are only consistent once the last commit is copied,
+			// its writer may be gone
+			if err := s.rollForward(head, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		tx := newKubernetesTxn(s, head.Spec.Seq)
+		err = apply(tx)
+		// apply saw a mix of two commits, what it decided on does not count
+		if !tx.stale {
+			if err != nil {
+				return err
+			}
+			if tx.err != nil {
+				return tx.err
+			}
+			ok, err := tx.commit(head)
+			if err != nil || ok {
+				return err
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("datastore kept changing, gave up after %d attempts in %v", attempt, kubernetesTxnTimeout)
+		}
+		sleepBackoff(&backoff)
+	}
+}
+
+// sleepBackoff waits about backoff and doubles it up to
+// kubernetesTxnMaxBackoff, the jitter keeps retrying writers apart.
+func sleepBackoff(backoff *time.Duration) {
+	time.Sleep(*backoff/2 + time.Duration(rand.Int63n(int64(*backoff/2)+1)))
+	if *backoff *= 2; *backoff > kubernetesTxnMaxBackoff {
+		*backoff = kubernetesTxnMaxBackoff
+	}
+}
+
+// PutTTL stamps the entry with its expiry, readers skip it once it passed and
+// the next write of the shard drops it.
+func (s *kubernetesDatastore) PutTTL(key, value string, ttl time.Duration) error {
+	return s.update(func(tx *kubernetesTxn) error {
+		tx.write(key, &value, time.Now().Add(ttl).UTC().Format(time.RFC3339))
+		return nil
+	})
+}
+
+// Watch polls the shards of prefix and reports what changed in between,
+// expired entries show up as deletes.
+func (s *kubernetesDatastore) Watch(ctx context.Context, prefix string, handler WatchHandler) {
+	seen := make(map[string]string)
+	poll := func() {
+		kvs, err := s.List(prefix)
+		if err != nil {
+			klog.Errorf("failed to poll %s, err is %v", prefix, err)
+			return
+		}
+		for key, value := range kvs {
+			if old, ok := seen[key]; !ok || old != value {
+				handler(Event{Type: EventPut, Key: key, Value: value})
+			}
+		}
+		for key := range seen {
+			if _, ok := kvs[key]; !ok {
+				handler(Event{Type: EventDelete, Key: key})
+			}
+		}
+		seen = kvs
+	}
+	go func() {
+		poll()
+		ticker := time.NewTicker(kubernetesPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				poll()
+			}
+		}
+	}()
+}
+
+func (s *kubernetesDatastore) Close() error {
+	return nil
+}
@@ -0,0 +1,356 @@
+package datastore_test
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/k8s"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeApiServer serves the DatastoreShard resources with the
+// resourceVersion checks of the real api server.
+type fakeApiServer struct {
+	lock   sync.Mutex
+	rv     int
+	shards map[string]k8s.DatastoreShard
+	// hook runs before each request with the name of the shard, a status
+	// other than 0 answers it
+	hook func(r *http.Request, name string) int
+}
+
+func newFakeApiServer(t *testing.T) (*fakeApiServer, *httptest.Server) {
+	t.Helper()
+	fake := &fakeApiServer{shards: make(map[string]k8s.DatastoreShard)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newKubernetesDatastore(t *testing.T, server *httptest.Server) datastore.Datastore {
+	t.Helper()
+	client, err := k8s.NewClientFromConfig(&k8s.RestConfig{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datastore.NewKubernetesDatastore(client)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "reason": reason, "code": code})
+}
+
+func (f *fakeApiServer) setHook(hook func(r *http.Request, name string) int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hook = hook
+}
+
+func (f *fakeApiServer) shard(name string) (k8s.DatastoreShard, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	shard, ok := f.shards[name]
+	return shard, ok
+}
+
+func (f *fakeApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, k8s.DatastoreShardsPath), "/")
+	var shard k8s.DatastoreShard
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&shard); err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest")
+			return
+		}
+		name = shard.MetaData.Name
+	}
+	f.lock.Lock()
+	hook := f.hook
+	f.lock.Unlock()
+	if hook != nil {
+		if code := hook(r, name); code != 0 {
+			writeStatus(w, code, http.StatusText(code))
+			return
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		list := k8s.DatastoreShardList{}
+		for _, shard := range f.shards {
+			if matchLabels(shard.MetaData.Labels, r.URL.Query().Get("labelSelector")) {
+				list.Items = append(list.Items, shard)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	case r.Method == http.MethodGet:
+		current, ok := f.shards[name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		shard = current
+	case r.Method == http.MethodPost:
+		if _, ok := f.shards[name]; ok {
+			writeStatus(w, http.StatusConflict, "AlreadyExists")
+			return
+		}
+		shard = f.store(shard)
+	case r.Method == http.MethodPut:
+		current, ok := f.shards[name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		if current.MetaData.ResourceVersion != shard.MetaData.ResourceVersion {
+			writeStatus(w, http.StatusConflict, "Conflict")
+			return
+		}
+		shard = f.store(shard)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(shard)
+}
+
+func (f *fakeApiServer) store(shard k8s.DatastoreShard) k8s.DatastoreShard {
+	f.rv++
+	shard.MetaData.ResourceVersion = strconv.Itoa(f.rv)
+	f.shards[shard.MetaData.Name] = shard
+	return shard
+}
+
+func matchLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, term := range strings.Split(selector, ",") {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKubernetesDatastoreReadsWrites(t *testing.T) {
+	_, server := newFakeApiServer(t)
+	ds := newKubernetesDatastore(t, server)
+	keys := map[string]string{
+		etcd.NetworkKey("net1"):                                "network",
+		etcd.IpKey("net1", "subnet1", "10.10.0.2"):             "a",
+		etcd.IpKey("net1", "subnet1", "10.10.1.2"):             "b",
+		etcd.UsageKey("net1", etcd.UsageNamespaces, "default"): "1",
+	}
+	err := ds.Update(func(tx datastore.Txn) error {
+		for key, value := range keys {
+			tx.Put(key, value)
+		}
+		if got := tx.Get(etcd.NetworkKey("net1")); got != "network" {
+			t.Errorf("transaction reads %q, want its own write", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	for key, value := range keys {
+		if got, err := ds.Get(key); err != nil || got != value {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+	ips, err := ds.List(etcd.IpamKey("net1"))
+	if err != nil || len(ips) != 2 {
+		t.Errorf("List of the addresses spread over two shards = %v, %v", ips, err)
+	}
+	all, err := ds.List(etcd.Prefix())
+	if err != nil || len(all) != len(keys) {
+		t.Errorf("List(%s) = %v, %v, want every key", etcd.Prefix(), all, err)
+	}
+	if err := ds.Delete(etcd.IpKey("net1", "subnet1", "10.10.0.2")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, err := ds.Get(etcd.IpKey("net1", "subnet1", "10.10.0.2")); err != nil || got != "" {
+		t.Errorf("Get after Delete = %q, %v", got, err)
+	}
+}
+
+func TestKubernetesDatastoreRetriesConflicts(t *testing.T) {
+	fake, server := newFakeApiServer(t)
+	ds := newKubernetesDatastore(t, server)
+	if err := ds.Put(etcd.NodeKey("node-1"), "1"); err != nil {
+		t.Fatal(err)
+	}
+	// two other writers commit first
+	conflicts := 2
+	fake.setHook(func(r *http.Request, name string) int {
+		if r.Method == http.MethodPut && name == "commit" && conflicts > 0 {
+			conflicts--
+			return http.StatusConflict
+		}
+		return 0
+	})
+	runs := 0
+	err := ds.Update(func(tx datastore.Txn) error {
+		runs++
+		tx.Put(etcd.NodeKey("node-1"), "2")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if runs != 3 {
+		t.Errorf("apply ran %d times, want 3", runs)
+	}
+	if got, _ := ds.Get(etcd.NodeKey("node-1")); got != "2" {
+		t.Errorf("Get = %q, want 2", got)
+	}
+}
+
+// TestKubernetesDatastoreIsSerializable moves units between two keys of
+// different shards while readers check that none is lost.
+func TestKubernetesDatastoreIsSerializable(t *testing.T) {
+	_, server := newFakeApiServer(t)
+	ds := newKubernetesDatastore(t, server)
+	from, to := etcd.UsageKey("net1", etcd.UsageNamespaces, "a"), etcd.UsageKey("net2", etcd.UsageNamespaces, "b")
+	const total, writers, moves = 100, 4, 5
+	if err := ds.Update(func(tx datastore.Txn) error {
+		tx.Put(from, strconv.Itoa(total))
+		tx.Put(to, "0")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	atoi := func(value string) int {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			t.Errorf("bad counter %q", value)
+		}
+		return n
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < moves; j++ {
+				err := ds.Update(func(tx datastore.Txn) error {
+					tx.Put(from, strconv.Itoa(atoi(tx.Get(from))-1))
+					tx.Put(to, strconv.Itoa(atoi(tx.Get(to))+1))
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Update: %v", err)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		err := ds.Update(func(tx datastore.Txn) error {
+			if sum := atoi(tx.Get(from)) + atoi(tx.Get(to)); sum != total {
+				return fmt.Errorf("read %d units, want %d", sum, total)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("reader: %v", err)
+		}
+	}
+	if got, _ := ds.Get(to); got != strconv.Itoa(writers*moves) {
+		t.Errorf("moved %s units, want %d", got, writers*moves)
+	}
+}
+
+// TestKubernetesDatastoreRollsForward has a writer fail after its commit,
+// the next transaction of another writer finishes it.
+func TestKubernetesDatastoreRollsForward(t *testing.T) {
+	fake, server := newFakeApiServer(t)
+	dying := newKubernetesDatastore(t, server)
+	key, other := etcd.NodeKey("node-1"), etcd.NodeKey("node-2")
+	fake.setHook(func(r *http.Request, name string) int {
+		if r.Method != http.MethodGet && strings.HasPrefix(name, "node.node-2") {
+			return http.StatusForbidden
+		}
+		return 0
+	})
+	err := dying.Update(func(tx datastore.Txn) error {
+		tx.Put(key, "1")
+		tx.Put(other, "1")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update of the committed writes: %v", err)
+	}
+	head, _ := fake.shard("commit")
+	if len(head.Spec.Journal) != 2 {
+		t.Fatalf("journal = %v, want both writes left", head.Spec.Journal)
+	}
+	fake.setHook(nil)
+
+	ds := newKubernetesDatastore(t, server)
+	kvs, err := ds.List(etcd.NodesKey())
+	if err != nil || kvs[key] != "1" || kvs[other] != "1" {
+		t.Errorf("List = %v, %v, want both writes", kvs, err)
+	}
+	if head, _ := fake.shard("commit"); len(head.Spec.Journal) != 0 {
+		t.Errorf("journal = %v, want it cleared", head.Spec.Journal)
+	}
+}
+
+// TestKubernetesDatastoreSkipsStaleCommits has a writer copy its journal
+// after another writer finished it and committed again.
+func TestKubernetesDatastoreSkipsStaleCommits(t *testing.T) {
+	fake, server := newFakeApiServer(t)
+	slow := newKubernetesDatastore(t, server)
+	key := etcd.NodeKey("node-1")
+	if err := slow.Put(key, "0"); err != nil {
+		t.Fatal(err)
+	}
+	blocked, release := make(chan struct{}), make(chan struct{})
+	fake.setHook(func(r *http.Request, name string) int {
+		if r.Method == http.MethodPut && strings.HasPrefix(name, "node.") {
+			// only the first write waits
+			fake.setHook(nil)
+			close(blocked)
+			<-release
+		}
+		return 0
+	})
+	errs := make(chan error)
+	go func() {
+		errs <- slow.Put(key, "1")
+	}()
+	<-blocked
+
+	ds := newKubernetesDatastore(t, server)
+	if err := ds.Put(key, "2"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatalf("Put of the slow writer: %v", err)
+	}
+	if got, err := ds.Get(key); err != nil || got != "2" {
+		t.Errorf("Get = %q, %v, want the later commit kept", got, err)
+	}
+}
@@ -0,0 +1,199 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDatastore keeps everything in the process, it is meant for tests and
+// for trying the plugin out on a single node.
+type memoryDatastore struct {
+	sync.Mutex
+	kvs      map[string]string
+	expiries map[string]*time.Timer
+	watchers map[*memoryWatcher]struct{}
+}
+
+type memoryWatcher struct {
+	// held while the watcher is called, so the replay of Watch comes first
+	sync.Mutex
+	prefix  string
+	handler WatchHandler
+}
+
+func NewMemoryDatastore() Datastore {
+	return &memoryDatastore{
+		kvs:      make(map[string]string),
+		expiries: make(map[string]*time.Timer),
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+}
+
+func (s *memoryDatastore) Get(key string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.kvs[key], nil
+}
+
+func (s *memoryDatastore) list(prefix string) map[string]string {
+	kvs := make(map[string]string)
+	for key, value := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			kvs[key] = value
+		}
+	}
+	return kvs
+}
+
+func (s *memoryDatastore) List(prefix string) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.list(prefix), nil
+}
+
+// set changes key with the lock held and returns the events to deliver once
+// it is released.
+func (s *memoryDatastore) set(key string, value *string) []Event {
+	if timer, ok := s.expiries[key]; ok {
+		timer.Stop()
+		delete(s.expiries, key)
+	}
+	event := Event{Type: EventPut, Key: key}
+	if value == nil {
+		if _, ok := s.kvs[key]; !ok {
+			return nil
+		}
+		delete(s.kvs, key)
+		event.Type = EventDelete
+	} else {
+		s.kvs[key] = *value
+		event.Value = *value
+	}
+	return []Event{event}
+}
+
+func (s *memoryDatastore) notify(events []Event) {
+	s.Lock()
+	var watchers []*memoryWatcher
+	for watcher := range s.watchers {
+		watchers = append(watchers, watcher)
+	}
+	s.Unlock()
+	for _, event := range events {
+		for _, watcher := range watchers {
+			if strings.HasPrefix(event.Key, watcher.prefix) {
+				watcher.Lock()
+				watcher.handler(event)
+				watcher.Unlock()
+			}
+		}
+	}
+}
+
+func (s *memoryDatastore) Put(key, value string) error {
+	s.Lock()
+	events := s.set(key, &value)
+	s.Unlock()
+	s.notify(events)
+	return nil
+}
+
+func (s *memoryDatastore) Delete(key string) error {
+	s.Lock()
+	events := s.set(key, nil)
+	s.Unlock()
+	s.notify(events)
+	return nil
+}
+
+type memoryTxn struct {
+	store  *memoryDatastore
+	writes *txnWrites
+}
+
+func (t *memoryTxn) Get(key string) string {
+	if value, ok := t.writes.get(key); ok {
+		return value
+	}
+	return t.store.kvs[key]
+}
+
+func (t *memoryTxn) List(prefix string) map[string]string {
+	return t.writes.overlay(prefix, t.store.list(prefix))
+}
+
+func (t *memoryTxn) Put(key, value string) {
+	t.writes.put(key, &value)
+}
+
+func (t *memoryTxn) Del(key string) {
+	t.writes.put(key, nil)
+}
+
+// Update holds the store lock while apply runs, so it never has to retry.
+func (s *memoryDatastore) Update(apply func(tx Txn) error) error {
+	s.Lock()
+	tx := &memoryTxn{store: s, writes: newTxnWrites()}
+	if err := apply(tx); err != nil {
+		s.Unlock()
+		return err
+	}
+	var events []Event
+	for _, key := range tx.writes.order {
+		events = append(events, s.set(key, tx.writes.values[key])...)
+	}
+	s.Unlock()
+	s.notify(events)
+	return nil
+}
+
+func (s *memoryDatastore) PutTTL(key, value string, ttl time.Duration) error {
+	s.Lock()
+	events := s.set(key, &value)
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		s.Lock()
+		if s.expiries[key] != timer {
+			s.Unlock()
+			return
+		}
+		events := s.set(key, nil)
+		s.Unlock()
+		s.notify(events)
+	})
+	s.expiries[key] = timer
+	s.Unlock()
+	s.notify(events)
+	return nil
+}
+
+func (s *memoryDatastore) Watch(ctx context.Context, prefix string, handler WatchHandler) {
+	watcher := &memoryWatcher{prefix: prefix, handler: handler}
+	s.Lock()
+	kvs := s.list(prefix)
+	s.watchers[watcher] = struct{}{}
+	watcher.Lock()
+	s.Unlock()
+	for key, value := range kvs {
+		handler(Event{Type: EventPut, Key: key, Value: value})
+	}
+	watcher.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.Lock()
+		delete(s.watchers, watcher)
+		s.Unlock()
+	}()
+}
+
+func (s *memoryDatastore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	for key, timer := range s.expiries {
+		timer.Stop()
+		delete(s.expiries, key)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"fmt"
+	"k8s.io/klog"
+	"strings"
+	"time"
+)
+
+func ListNodes(ds Datastore) (map[string]etcd.Node, error) {
+	nodes := make(map[string]etcd.Node)
+	kvs, err := ds.List(etcd.NodesKey())
+	if err != nil {
+		return nodes, err
+	}
+	for key, value := range kvs {
+		var node etcd.Node
+		if err := etcd.Decode(value, &node); err != nil {
+			klog.Errorf("failed to decode node %s, err is %v", key, err)
+			continue
+		}
+		nodes[strings.TrimPrefix(key, etcd.NodesKey())] = node
+	}
+	return nodes, nil
+}
+
+// GetNode returns nil when the node is not registered.
+func GetNode(ds Datastore, name string) (*etcd.Node, error) {
+	value, err := ds.Get(etcd.NodeKey(name))
+	if err != nil || value == "" {
+		return nil, err
+	}
+	node := &etcd.Node{}
+	if err := etcd.Decode(value, node); err != nil {
+		return nil, fmt.Errorf("failed to decode node %s: %v", name, err)
+	}
+	return node, nil
+}
+
+// RegisterNode puts the record of node, it is gone once it was not
+// registered again for ttl.
+func RegisterNode(ds Datastore, node *etcd.Node, ttl time.Duration) error {
+	value, err := etcd.Encode(node)
+	if err != nil {
+		return err
+	}
+	return ds.PutTTL(etcd.NodeKey(node.Name), string(value), ttl)
+}
+
+func ListPods(ds Datastore) (map[string]etcd.Pod, error) {
+	pods := make(map[string]etcd.Pod)
+	kvs, err := ds.List(etcd.PodsKey())
+	if err != nil {
+		return pods, err
+	}
+	for key, value := range kvs {
+		var pod etcd.Pod
+		if err := etcd.Decode(value, &pod); err != nil {
+			klog.Errorf("failed to decode pod %s, err is %v", key, err)
+			continue
+		}
+		pods[strings.TrimPrefix(key, etcd.PodsKey())] = pod
+	}
+	return pods, nil
+}
+
+// GetPod returns nil when the pod has no record.
+func GetPod(ds Datastore, nameSpace, name string) (*etcd.Pod, error) {
+	value, err := ds.Get(etcd.PodKey(nameSpace, name))
+	if err != nil || value == "" {
+		return nil, err
+	}
+	pod := &etcd.Pod{}
+	if err := etcd.Decode(value, pod); err != nil {
+		return nil, fmt.Errorf("failed to decode pod %s/%s: %v", nameSpace, name, err)
+	}
+	return pod, nil
+}
+
+// PutPod stores the record of a pod together with its container index, the
+// index of a replaced sandbox container is dropped in the same transaction.
+func PutPod(ds Datastore, pod etcd.Pod) error {
+	key := etcd.PodKey(pod.NameSpace, pod.Name)
+	value, err := etcd.Encode(pod)
+	if err != nil {
+		return err
+	}
+	err = ds.Update(func(tx Txn) error {
+		var old etcd.Pod
+		if oldValue := tx.Get(key); oldValue != "" && etcd.Decode(oldValue, &old) == nil {
+			if old.ContainerId != "" && old.ContainerId != pod.ContainerId {
+				tx.Del(etcd.ContainerKey(old.ContainerId))
+			}
+		}
+		tx.Put(key, string(value))
+		tx.Put(etcd.ContainerKey(pod.ContainerId), key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put pod %s/%s, err [%s]", pod.NameSpace, pod.Name, err.Error())
+	}
+	return nil
+}
+
+func GetPodByContainerId(ds Datastore, containerId string) (etcd.Pod, error) {
+	var pod etcd.Pod
+	podKey, err := ds.Get(etcd.ContainerKey(containerId))
+	if err != nil {
+		return pod, err
+	}
+	if podKey == "" {
+		return pod, fmt.Errorf("container %s not found", containerId)
+	}
+	value, err := ds.Get(podKey)
+	if err != nil {
+		return pod, err
+	}
+	if value == "" || etcd.Decode(value, &pod) != nil || pod.ContainerId != containerId {
+		return pod, fmt.Errorf("pod of container %s not found", containerId)
+	}
+	return pod, nil
+}
+
+// DeletePodByContainerId removes the pod record of containerId, a record that
+// already belongs to a newer sandbox of the same pod is kept.
+func DeletePodByContainerId(ds Datastore, containerId string) error {
+	return ds.Update(func(tx Txn) error {
+		indexKey := etcd.ContainerKey(containerId)
+		podKey := tx.Get(indexKey)
+		if podKey == "" {
+			return nil
+		}
+		tx.Del(indexKey)
+		var pod etcd.Pod
+		if value := tx.Get(podKey); value != "" && etcd.Decode(value, &pod) == nil && pod.ContainerId == containerId {
+			tx.Del(podKey)
+		}
+		return nil
+	})
+}
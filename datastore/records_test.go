@@ -0,0 +1,146 @@
+package datastore_test
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/etcd/etcdtest"
+	"testing"
+)
+
+func newDatastore(t *testing.T) datastore.Datastore {
+	t.Helper()
+	ds, _, err := etcdtest.NewDatastore()
+	if err != nil {
+		t.Fatalf("failed to start the etcd datastore: %v", err)
+	}
+	t.Cleanup(func() { _ = ds.Close() })
+	return ds
+}
+
+// getPod looks the pod up in ListPods, nil when it is not stored.
+func getPod(t *testing.T, ds datastore.Datastore, nameSpace, name string) *etcd.Pod {
+	t.Helper()
+	pods, err := datastore.ListPods(ds)
+	if err != nil {
+		t.Fatalf("ListPods: %v", err)
+	}
+	pod, ok := pods[nameSpace+"/"+name]
+	if !ok {
+		return nil
+	}
+	return &pod
+}
+
+func testPod(containerId string) etcd.Pod {
+	return etcd.Pod{
+		Name:        "web-0",
+		NameSpace:   "default",
+		ContainerId: containerId,
+		Node:        "node-1",
+		PodEths: []etcd.PodEth{{
+			NetworkCrd: "net1",
+			SubnetName: "subnet1",
+			IfName:     "eth0",
+			FixedIps:   []etcd.FixedIp{{SubnetId: "subnet1", Ipaddress: "10.0.0.2"}},
+		}},
+	}
+}
+
+func TestPutPod(t *testing.T) {
+	ds := newDatastore(t)
+	if err := datastore.PutPod(ds, testPod("sandbox-1")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	pod := getPod(t, ds, "default", "web-0")
+	if pod == nil {
+		t.Fatal("pod not stored")
+	}
+	if pod.ContainerId != "sandbox-1" || pod.Node != "node-1" || len(pod.PodEths) != 1 || pod.PodEths[0].FixedIps[0].Ipaddress != "10.0.0.2" {
+		t.Errorf("stored pod = %+v", pod)
+	}
+	byContainer, err := datastore.GetPodByContainerId(ds, "sandbox-1")
+	if err != nil || byContainer.Name != "web-0" || byContainer.NameSpace != "default" {
+		t.Errorf("GetPodByContainerId = %+v, %v", byContainer, err)
+	}
+	pods, err := datastore.ListPods(ds)
+	if err != nil || len(pods) != 1 {
+		t.Fatalf("ListPods = %v, %v", pods, err)
+	}
+	if _, ok := pods["default/web-0"]; !ok {
+		t.Errorf("ListPods keys = %v, want default/web-0", pods)
+	}
+}
+
+func TestGetMissingPod(t *testing.T) {
+	ds := newDatastore(t)
+	if pod := getPod(t, ds, "default", "web-0"); pod != nil {
+		t.Errorf("stored pod = %+v, want none", pod)
+	}
+	if _, err := datastore.GetPodByContainerId(ds, "sandbox-1"); err == nil {
+		t.Error("GetPodByContainerId of an unknown container succeeded")
+	}
+}
+
+func TestPutPodReplacesSandbox(t *testing.T) {
+	ds := newDatastore(t)
+	if err := datastore.PutPod(ds, testPod("sandbox-1")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	if err := datastore.PutPod(ds, testPod("sandbox-2")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	if index, err := ds.Get(etcd.ContainerKey("sandbox-1")); err != nil || index != "" {
+		t.Errorf("index of the replaced sandbox = %q, %v, want it dropped", index, err)
+	}
+	if _, err := datastore.GetPodByContainerId(ds, "sandbox-1"); err == nil {
+		t.Error("GetPodByContainerId of the replaced sandbox succeeded")
+	}
+	pod, err := datastore.GetPodByContainerId(ds, "sandbox-2")
+	if err != nil || pod.ContainerId != "sandbox-2" {
+		t.Errorf("GetPodByContainerId = %+v, %v", pod, err)
+	}
+}
+
+func TestDeletePodByContainerId(t *testing.T) {
+	ds := newDatastore(t)
+	if err := datastore.PutPod(ds, testPod("sandbox-1")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	if err := datastore.DeletePodByContainerId(ds, "sandbox-1"); err != nil {
+		t.Fatalf("DeletePodByContainerId: %v", err)
+	}
+	if pod := getPod(t, ds, "default", "web-0"); pod != nil {
+		t.Errorf("pod after delete = %+v, want none", pod)
+	}
+	if index, err := ds.Get(etcd.ContainerKey("sandbox-1")); err != nil || index != "" {
+		t.Errorf("index after delete = %q, %v", index, err)
+	}
+	// a DEL retried by the runtime finds nothing left
+	if err := datastore.DeletePodByContainerId(ds, "sandbox-1"); err != nil {
+		t.Errorf("second DeletePodByContainerId: %v", err)
+	}
+}
+
+func TestDeletePodByContainerIdKeepsNewerSandbox(t *testing.T) {
+	ds := newDatastore(t)
+	if err := datastore.PutPod(ds, testPod("sandbox-1")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	if err := datastore.PutPod(ds, testPod("sandbox-2")); err != nil {
+		t.Fatalf("PutPod: %v", err)
+	}
+	// the DEL of the old sandbox raced the ADD of the new one and still finds
+	// its index
+	if err := ds.Put(etcd.ContainerKey("sandbox-1"), etcd.PodKey("default", "web-0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := datastore.DeletePodByContainerId(ds, "sandbox-1"); err != nil {
+		t.Fatalf("DeletePodByContainerId: %v", err)
+	}
+	if pod := getPod(t, ds, "default", "web-0"); pod == nil || pod.ContainerId != "sandbox-2" {
+		t.Errorf("stored pod = %+v, want the record of sandbox-2", pod)
+	}
+	if _, err := datastore.GetPodByContainerId(ds, "sandbox-2"); err != nil {
+		t.Errorf("GetPodByContainerId of the newer sandbox: %v", err)
+	}
+}
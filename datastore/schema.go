@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"cni/etcd"
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration rewrites the records of schema version From into From+1.
+type Migration struct {
+	From        int
+	Description string
+	Rewrite     func(key, value string) (string, bool, error)
+}
+
+var migrations = []Migration{
+	{
+		From:        etcd.SchemaVersionLegacy,
+		Description: "wrap records in versioned envelopes and rename the snake_case fields",
+		Rewrite:     etcd.UpgradeRecordV1,
+	},
+}
+
+// Rewrite is one record a migration changes.
+type Rewrite struct {
+	Key   string
+	From  int
+	Value string
+}
+
+// ParseSchemaVersion reads the value of the schema key, an empty one is
+// etcd.SchemaVersionLegacy.
+func ParseSchemaVersion(value string) (int, error) {
+	if value == "" {
+		return etcd.SchemaVersionLegacy, nil
+	}
+	var schema etcd.Schema
+	if err := json.Unmarshal([]byte(value), &schema); err != nil {
+		return 0, fmt.Errorf("failed to decode the schema of the datastore: %v", err)
+	}
+	return schema.Version, nil
+}
+
+// LoadSchema makes this process write the schema version of ds, it refuses a
+// datastore migrated past what this binary knows.
+func LoadSchema(ds Datastore) (int, error) {
+	value, err := ds.Get(etcd.SchemaKey())
+	if err != nil {
+		return 0, err
+	}
+	version, err := ParseSchemaVersion(value)
+	if err != nil {
+		return 0, err
+	}
+	if version > etcd.SchemaVersion {
+		return 0, fmt.Errorf("datastore is at schema version %d but this tinycni only knows up to %d, upgrade it", version, etcd.SchemaVersion)
+	}
+	return version, etcd.UseSchemaVersion(version)
+}
+
+// FollowSchema keeps the schema version this process writes at the one of ds
+// until ctx is done, so that a long running binary writes the new layout once
+// the datastore is migrated.
+func FollowSchema(ctx context.Context, ds Datastore) {
+	ds.Watch(ctx, etcd.SchemaKey(), func(event Event) {
+		if event.Key != etcd.SchemaKey() {
+			return
+		}
+		version, err := ParseSchemaVersion(event.Value)
+		if err == nil {
+			err = etcd.UseSchemaVersion(version)
+		}
+		if err != nil {
+			klog.Errorf("failed to follow the schema of the datastore, keep writing version %d, err is %v", etcd.WriteSchemaVersion(), err)
+			return
+		}
+		klog.Infof("datastore is at schema version %d", version)
+	})
+}
+
+// Migrate brings ds up to etcd.SchemaVersion one migration at a time, report
+// is told about every rewrite before it is written. With dryRun nothing is
+// written. Node records are left to their next registration, rewriting them
+// here would drop their lease.
+//
+// Migrate only once every binary of the cluster knows etcd.SchemaVersion,
+// until then old and new binaries share the records of the current version.
+func Migrate(ds Datastore, dryRun bool, report func(Rewrite)) (int, error) {
+	version, err := LoadSchema(ds)
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := ds.List(etcd.Prefix())
+	if err != nil {
+		return version, err
+	}
+	delete(kvs, etcd.SchemaKey())
+	var keys []string
+	for key := range kvs {
+		if !strings.HasPrefix(key, etcd.NodesKey()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for ; version < etcd.SchemaVersion; version++ {
+		m := migrations[version-etcd.SchemaVersionLegacy]
+		for _, key := range keys {
+			value, changed, err := m.Rewrite(key, kvs[key])
+			if err != nil {
+				return version, err
+			}
+			if !changed {
+				continue
+			}
+			report(Rewrite{Key: key, From: version, Value: value})
+			kvs[key] = value
+			if dryRun {
+				continue
+			}
+			err = ds.Update(func(tx Txn) error {
+				current := tx.Get(key)
+				if current == "" {
+					return nil
+				}
+				value, changed, err := m.Rewrite(key, current)
+				if err != nil || !changed {
+					return err
+				}
+				tx.Put(key, value)
+				return nil
+			})
+			if err != nil {
+				return version, fmt.Errorf("failed to migrate %s: %v", key, err)
+			}
+		}
+		if dryRun {
+			continue
+		}
+		if err := setSchemaVersion(ds, version, version+1); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// setSchemaVersion moves the schema from one version to the next, it fails
+// when somebody else moved it in between.
+func setSchemaVersion(ds Datastore, from, to int) error {
+	value, err := json.Marshal(etcd.Schema{Version: to})
+	if err != nil {
+		return err
+	}
+	err = ds.Update(func(tx Txn) error {
+		current, err := ParseSchemaVersion(tx.Get(etcd.SchemaKey()))
+		if err != nil {
+			return err
+		}
+		if current != from {
+			return fmt.Errorf("schema moved to version %d while migrating from %d", current, from)
+		}
+		tx.Put(etcd.SchemaKey(), string(value))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return etcd.UseSchemaVersion(to)
+}
+
+func (r Rewrite) String() string {
+	return r.Key + " (v" + strconv.Itoa(r.From) + "): " + r.Value
+}
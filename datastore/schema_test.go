@@ -0,0 +1,43 @@
+package datastore_test
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFollowSchema(t *testing.T) {
+	ds := datastore.NewMemoryDatastore()
+	if err := etcd.UseSchemaVersion(etcd.SchemaVersionLegacy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = etcd.UseSchemaVersion(etcd.SchemaVersionLegacy) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	datastore.FollowSchema(ctx, ds)
+	follows := func(version int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); etcd.WriteSchemaVersion() != version; {
+			if time.Now().After(deadline) {
+				t.Fatalf("writes schema version %d, want %d", etcd.WriteSchemaVersion(), version)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// a migration moves the schema
+	if err := ds.Put(etcd.SchemaKey(), `{"version": 2}`); err != nil {
+		t.Fatal(err)
+	}
+	follows(etcd.SchemaVersionEnvelope)
+	// a schema this binary does not know keeps the version it writes
+	if err := ds.Put(etcd.SchemaKey(), `{"version": 99}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put(etcd.SchemaKey()+"-other", `{"version": 1}`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	follows(etcd.SchemaVersionEnvelope)
+}
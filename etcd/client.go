@@ -1,17 +1,15 @@
 package etcd
 
 import (
-	"cni/helper"
 	"context"
-	"errors"
 	"fmt"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 	etcd "go.etcd.io/etcd/client/v3"
-	"io/ioutil"
+	"go.etcd.io/etcd/client/v3/concurrency"
 	"k8s.io/klog"
-	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,7 +33,6 @@ type EtcdConfig struct {
 
 type Watcher struct {
 	client        *EtcdClient
-	watcher       etcd.Watcher
 	cancelWatcher context.CancelFunc
 	ctx           context.Context
 }
@@ -52,108 +49,92 @@ const (
 )
 
 func newEtcdClient(config *EtcdConfig) (*etcd.Client, error) {
-	var etcdLocation []string
-	if config.EtcdAuthority != "" {
-		etcdLocation = []string{config.EtcdScheme + "://" + config.EtcdAuthority}
+	endpoints, err := config.endpoints()
+	if err != nil {
+		return nil, err
 	}
-	if config.EtcdEndpoints != "" {
-		etcdLocation = strings.Split(config.EtcdEndpoints, ",")
+	if len(endpoints) == 0 {
+		return nil, NewConfigError("no etcd endpoints", nil)
 	}
-	if len(etcdLocation) == 0 {
-		return nil, errors.New("cannot find etcd")
+	etcdConfig := etcd.Config{
+		Endpoints:   endpoints,
+		Username:    config.EtcdUsername,
+		Password:    config.EtcdPassword,
+		DialTimeout: clientTimeout,
 	}
-	tlsInfo := transport.TLSInfo{
-		CertFile:      config.EtcdCertFile,
-		KeyFile:       config.EtcdKeyFile,
-		TrustedCAFile: config.EtcdCACertFile,
+	if config.secure() || strings.HasPrefix(endpoints[0], "https://") {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      config.EtcdCertFile,
+			KeyFile:       config.EtcdKeyFile,
+			TrustedCAFile: config.EtcdCACertFile,
+		}
+		etcdConfig.TLS, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, NewConfigError("failed to load the etcd tls files", err)
+		}
 	}
-	tlsConfig, err := tlsInfo.ClientConfig()
+	client, err := etcd.New(etcdConfig)
 	if err != nil {
-		klog.Errorf("failed to init etcd ,err is %v", err)
-		return nil, err
+		return nil, NewUnavailableError(fmt.Sprintf("failed to connect etcd %s", strings.Join(endpoints, ",")), err)
 	}
-	client, err := etcd.New(etcd.Config{Endpoints: etcdLocation, TLS: tlsConfig, DialTimeout: clientTimeout})
+	return client, nil
+}
+
+func NewEtcdClient(config *EtcdConfig) (*EtcdClient, error) {
+	client, err := newEtcdClient(config)
 	if err != nil {
-		klog.Errorf("failed to init etcd ,err is %v", err)
 		return nil, err
 	}
-	return client, nil
+	return &EtcdClient{client: client}, nil
 }
 
-var __GetEtcdClient func() (*EtcdClient, error)
+// NewEtcdClientFromClient wraps a client that is already set up, like one of
+// etcdtest.
+func NewEtcdClientFromClient(client *etcd.Client) *EtcdClient {
+	return &EtcdClient{client: client}
+}
 
-func GetEtcdClient() (*EtcdClient, error) {
-	if __GetEtcdClient == nil {
-		return nil, nil
-	}
-	return __GetEtcdClient()
-}
-
-func _GetEtcdClient() func() (*EtcdClient, error) {
-	var _client *EtcdClient
-	return func() (*EtcdClient, error) {
-		if _client != nil {
-			return _client, nil
-		} else {
-			configPath := helper.GetClientConfigPath()
-			confByte, err := ioutil.ReadFile(configPath)
-			if err != nil {
-				panic(fmt.Sprintf("读取 path: %s 失败: %s", configPath, err.Error()))
-			}
-			master, err := helper.GetLineFromYaml(string(confByte), "server")
-			if err != nil {
-				panic(fmt.Sprintf("在 etcd 初始化时尝试获取 master 节点失败: %s", err.Error()))
-			}
-			etcdEp := ""
-			if master != "" {
-				masteIp := strings.Split(master, ":")
-				if len(masteIp) == 3 {
-					etcdEp = fmt.Sprintf("%s:%s:2379", masteIp[0], masteIp[1])
-				}
-			}
-			if os.Getenv("ETCD_ENDPOINT") != "" {
-				etcdEp = os.Getenv("ETCD_ENDPOINT")
-			}
-			if etcdEp == "" {
-				panic("get etcd endpoint failed from env")
-			}
-			client, err := newEtcdClient(&EtcdConfig{
-				EtcdEndpoints:  etcdEp,
-				EtcdCertFile:   "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
-				EtcdKeyFile:    "/etc/kubernetes/pki/etcd/healthcheck-client.key",
-				EtcdCACertFile: "/etc/kubernetes/pki/etcd/ca.crt",
-			})
-
-			if err != nil {
-				return nil, err
-			}
-
-			status, err := client.Status(context.TODO(), etcdEp)
-
-			if err != nil {
-				klog.Errorf("无法获取到 etcd 版本")
-				return nil, err
-			}
-			if client != nil {
-				_client = &EtcdClient{
-					client: client,
-				}
-
-				if status != nil && status.Version != "" {
-					_client.Version = status.Version
-				}
-				// fmt.Println("etcd 客户端初始化成功")
-				return _client, nil
-			}
-		}
-		return nil, errors.New("init etcd client failed")
-	}
+// Client gives the typed accessors of methods.go on the same connection.
+func (c *EtcdClient) Client() *Client {
+	return &Client{Client: c.client}
 }
 
-func init() {
-	if __GetEtcdClient == nil {
-		__GetEtcdClient = _GetEtcdClient()
+func (c *EtcdClient) Close() error {
+	return c.client.Close()
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = make(map[EtcdConfig]*EtcdClient)
+)
+
+// GetEtcdClient connects with the settings of LoadEtcdConfig, clients are
+// shared by everyone asking with the same settings.
+func GetEtcdClient(override *EtcdConfig) (*EtcdClient, error) {
+	config, err := LoadEtcdConfig(override)
+	if err != nil {
+		return nil, err
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	if client, ok := clients[*config]; ok {
+		return client, nil
+	}
+	client, err := newEtcdClient(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	endpoint := client.Endpoints()[0]
+	status, err := client.Status(ctx, endpoint)
+	if err != nil {
+		_ = client.Close()
+		return nil, NewUnavailableError(fmt.Sprintf("etcd %s is not reachable", endpoint), err)
 	}
+	_client := &EtcdClient{client: client, Version: status.Version}
+	clients[*config] = _client
+	return _client, nil
 }
 
 func (c *EtcdClient) Set(key, value string) error {
@@ -249,17 +230,100 @@ func (c *EtcdClient) GetAllKey(key string, opts ...etcd.OpOption) ([]string, err
 	return res, nil
 }
 
-func (c *EtcdClient) Watch(key string, cb WatchCallback) {
-	go func() {
-		for {
-			change := c.client.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
+func (c *EtcdClient) GetAllKeyValue(key string, opts ...etcd.OpOption) (map[string]string, error) {
+	resp, err := c.client.Get(context.TODO(), key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, ev := range resp.Kvs {
+		res[string(ev.Key)] = string(ev.Value)
+	}
+	return res, nil
+}
+
+// GetAllKeyValueWithRevision is GetAllKeyValue plus the store revision the
+// result was read at, to guard a later Txn against changes in between.
+func (c *EtcdClient) GetAllKeyValueWithRevision(key string, opts ...etcd.OpOption) (map[string]string, int64, error) {
+	resp, err := c.client.Get(context.TODO(), key, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := make(map[string]string)
+	for _, ev := range resp.Kvs {
+		res[string(ev.Key)] = string(ev.Value)
+	}
+	return res, resp.Header.Revision, nil
+}
+
+func (c *EtcdClient) Txn(cmps []etcd.Cmp, ops []etcd.Op) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	resp, err := c.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// STM runs apply in a serializable software transaction, apply is retried
+// until its reads are still valid at commit time.
+func (c *EtcdClient) STM(apply func(stm concurrency.STM) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	_, err := concurrency.NewSTM(c.client, apply, concurrency.WithAbortContext(ctx))
+	return err
+}
+
+// SetWithLease puts key under a new lease of ttl seconds, the key is removed
+// by etcd once the lease is neither kept alive nor renewed.
+func (c *EtcdClient) SetWithLease(key, value string, ttl int64) (etcd.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	lease, err := c.client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.client.Put(ctx, key, value, etcd.WithLease(lease.ID)); err != nil {
+		return 0, err
+	}
+	return lease.ID, nil
+}
+
+func (c *EtcdClient) SetOnLease(key, value string, lease etcd.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := c.client.Put(ctx, key, value, etcd.WithLease(lease))
+	return err
+}
+
+// KeepAlive renews lease until ctx is done, the channel is closed when the
+// lease is lost.
+func (c *EtcdClient) KeepAlive(ctx context.Context, lease etcd.LeaseID) (<-chan *etcd.LeaseKeepAliveResponse, error) {
+	return c.client.KeepAlive(ctx, lease)
+}
+
+// Watch calls cb with every key under key, first with the ones already there
+// and then with every change, see Informer.
+func (c *EtcdClient) Watch(key string, cb WatchCallback) *Informer {
+	informer := c.NewInformer(key)
+	informer.AddHandler(callbackHandler(cb))
+	go informer.Run(context.Background())
+	return informer
+}
+
+func callbackHandler(cb WatchCallback) EventHandler {
+	return EventHandler{
+		OnAdd: func(key, value string) {
+			cb(mvccpb.PUT, []byte(key), []byte(value))
+		},
+		OnUpdate: func(key, _, value string) {
+			cb(mvccpb.PUT, []byte(key), []byte(value))
+		},
+		OnDelete: func(key, _ string) {
+			cb(mvccpb.DELETE, []byte(key), nil)
+		},
+	}
 }
 
 func (w *Watcher) Done() <-chan struct{} {
@@ -278,23 +342,13 @@ func (w *Watcher) Cancel() {
 	w.cancelWatcher()
 }
 
+// Watch is EtcdClient.Watch bound to the watcher, it stops on Cancel and
+// returns once the keys already there were reported.
 func (w *Watcher) Watch(key string, cb WatchCallback) {
-	go func() {
-		defer func() {
-			w.Cancel()
-			time.Sleep(2 * time.Second)
-		}()
-		for {
-			change := w.watcher.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
-	// TODO: sleep change to sync
-	time.Sleep(1 * time.Second)
+	informer := w.client.NewInformer(key)
+	informer.AddHandler(callbackHandler(cb))
+	go informer.Run(w.ctx)
+	informer.WaitForSync(w.ctx)
 }
 
 func (c *EtcdClient) GetWatcher() (*Watcher, error) {
@@ -302,11 +356,9 @@ func (c *EtcdClient) GetWatcher() (*Watcher, error) {
 		return c.watcher, nil
 	}
 	watcher := &Watcher{client: c}
-	_watcher := etcd.NewWatcher(c.client)
-	watcher.watcher = _watcher
 	ctx, cancelFunc := context.WithCancel(context.TODO())
 	watcher.cancelWatcher = cancelFunc
 	watcher.ctx = ctx
-
+	c.watcher = watcher
 	return watcher, nil
 }
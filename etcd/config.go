@@ -0,0 +1,151 @@
+package etcd
+
+import (
+	"cni/consts"
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ConfigFile is what tinycni reads from $TINYCNI_CONFIG, or from
+// /etc/tinycni/tinycni.conf when that is unset.
+type ConfigFile struct {
+	Scope
+	Etcd *EtcdConfig `json:"etcd"`
+}
+
+func NewConfigError(msg string, err error) *types.Error {
+	details := ""
+	if err != nil {
+		details = err.Error()
+	}
+	return types.NewError(types.ErrInvalidNetworkConfig, msg, details)
+}
+
+func NewUnavailableError(msg string, err error) *types.Error {
+	details := ""
+	if err != nil {
+		details = err.Error()
+	}
+	return types.NewError(types.ErrTryAgainLater, msg, details)
+}
+
+// LoadEtcdConfig merges the tinycni config file, the APIV1_ETCD_* environment
+// and override, a field set by a later one wins over an earlier one.
+func LoadEtcdConfig(override *EtcdConfig) (*EtcdConfig, error) {
+	config := &EtcdConfig{}
+	file, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if file != nil && file.Etcd != nil {
+		mergeStrings(config, file.Etcd)
+	}
+	env := &EtcdConfig{EtcdEndpoints: os.Getenv("ETCD_ENDPOINT")}
+	loadEnv(env)
+	mergeStrings(config, env)
+	if override != nil {
+		mergeStrings(config, override)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func readConfigFile() (*ConfigFile, error) {
+	path := os.Getenv(consts.TINYCNI_CONFIG_ENV)
+	explicit := path != ""
+	if !explicit {
+		path = consts.TINYCNI_CONFIG_DEFAULT_PATH
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, NewConfigError(fmt.Sprintf("failed to read tinycni config %s", path), err)
+	}
+	file := &ConfigFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, NewConfigError(fmt.Sprintf("failed to decode tinycni config %s", path), err)
+	}
+	return file, nil
+}
+
+// loadEnv fills the string fields of obj from the variables named by their
+// envconfig tags.
+func loadEnv(obj interface{}) {
+	v := reflect.ValueOf(obj).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("envconfig")
+		if value := os.Getenv(name); name != "" && value != "" {
+			v.Field(i).SetString(value)
+		}
+	}
+}
+
+// mergeStrings copies the string fields set in from over those of to, both
+// point to the same struct type.
+func mergeStrings(to, from interface{}) {
+	v, f := reflect.ValueOf(to).Elem(), reflect.ValueOf(from).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if value := f.Field(i).String(); value != "" {
+			v.Field(i).SetString(value)
+		}
+	}
+}
+
+func (c *EtcdConfig) validate() error {
+	if c.EtcdEndpoints == "" && c.EtcdAuthority == "" && c.EtcdDiscoverySrv == "" {
+		return NewConfigError("no etcd endpoints, set etcdEndpoints, etcdAuthority or etcdDiscoverySrv", nil)
+	}
+	if (c.EtcdCertFile == "") != (c.EtcdKeyFile == "") {
+		return NewConfigError("etcdCertFile and etcdKeyFile must be set together", nil)
+	}
+	if c.EtcdPassword != "" && c.EtcdUsername == "" {
+		return NewConfigError("etcdPassword is set without etcdUsername", nil)
+	}
+	return nil
+}
+
+// endpoints prefers the listed endpoints, then the authority and last the
+// clients published under the discovery domain.
+func (c *EtcdConfig) endpoints() ([]string, error) {
+	if c.EtcdEndpoints != "" {
+		var endpoints []string
+		for _, endpoint := range strings.Split(c.EtcdEndpoints, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		return endpoints, nil
+	}
+	if c.EtcdAuthority != "" {
+		scheme := c.EtcdScheme
+		if scheme == "" {
+			scheme = "http"
+			if c.secure() {
+				scheme = "https"
+			}
+		}
+		return []string{scheme + "://" + c.EtcdAuthority}, nil
+	}
+	clients, err := srv.GetClient("etcd-client", c.EtcdDiscoverySrv, "")
+	if err != nil {
+		return nil, NewUnavailableError(fmt.Sprintf("failed to discover etcd under %s", c.EtcdDiscoverySrv), err)
+	}
+	if len(clients.Endpoints) == 0 {
+		return nil, NewUnavailableError(fmt.Sprintf("no etcd published under %s", c.EtcdDiscoverySrv), nil)
+	}
+	return clients.Endpoints, nil
+}
+
+func (c *EtcdConfig) secure() bool {
+	return c.EtcdCACertFile != "" || c.EtcdCertFile != ""
+}
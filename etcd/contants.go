@@ -1,8 +1,29 @@
 package etcd
 
 const (
-	TinyCniPrefix   = "/tinycni/"
+	// TinyCniPrefix is the key prefix when the scope of tinycni sets none
+	TinyCniPrefix = "/tinycni/"
+	// ClustersKey holds the prefix of every cluster sharing the etcd, it
+	// lies outside all of them since a prefix is never the root
+	ClustersKey     = "/tinycni-clusters"
 	NodesKeyName    = "nodes"
 	NetworksKeyName = "networks"
 	PodsKeyName     = "pods"
+	IpamKeyName     = "ipam"
+	QuotasKeyName   = "quotas"
+	UsageKeyName    = "usage"
+	ConfigKeyName   = "config"
+	SchemaKeyName   = "schema"
+	ClusterKeyName  = "cluster"
+	// containers indexes pod records by the id of their sandbox container
+	ContainersKeyName = "containers"
+	// allocations indexes address records by the id of the container
+	// holding them, one key per network
+	AllocationsKeyName = "allocations"
+	BlocksKeyName      = "blocks"
+)
+
+const (
+	UsageNamespaces = "namespaces"
+	UsageTenants    = "tenants"
 )
@@ -0,0 +1,47 @@
+// Package etcdtest runs the etcd code of tinycni without an etcd cluster.
+// Store keeps revisions, transactions, watches, compaction and leases in
+// memory, close enough to etcd for ipam, pod records and informers to be
+// exercised offline. An embedded etcd server would need go.etcd.io/etcd/server,
+// which tinycni does not depend on; set TINYCNI_TEST_ETCD_ENDPOINTS to run
+// against a real etcd instead.
+package etcdtest
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"context"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"os"
+)
+
+const EndpointsEnv = "TINYCNI_TEST_ETCD_ENDPOINTS"
+
+// Client mounts s on a clientv3 client without a connection, every client
+// of one store sees the same keys.
+func (s *Store) Client() *clientv3.Client {
+	client := clientv3.NewCtxClient(context.Background())
+	client.KV = s
+	client.Watcher = s.newWatcher()
+	client.Lease = s
+	return client
+}
+
+// NewEtcdClient returns an etcd.EtcdClient on a new store, or on the etcd of
+// $TINYCNI_TEST_ETCD_ENDPOINTS with a nil store when that is set.
+func NewEtcdClient() (*etcd.EtcdClient, *Store, error) {
+	if endpoints := os.Getenv(EndpointsEnv); endpoints != "" {
+		client, err := etcd.NewEtcdClient(&etcd.EtcdConfig{EtcdEndpoints: endpoints})
+		return client, nil, err
+	}
+	s := NewStore()
+	return etcd.NewEtcdClientFromClient(s.Client()), s, nil
+}
+
+// NewDatastore is NewEtcdClient behind the etcd datastore.
+func NewDatastore() (datastore.Datastore, *Store, error) {
+	client, s, err := NewEtcdClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	return datastore.NewEtcdDatastore(client), s, nil
+}
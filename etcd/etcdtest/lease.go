@@ -0,0 +1,157 @@
+package etcdtest
+
+import (
+	"context"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"time"
+)
+
+type lease struct {
+	ttl    int64
+	expiry time.Time
+	timer  *time.Timer
+	keys   map[string]struct{}
+}
+
+func (s *Store) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextLease++
+	id := s.nextLease
+	l := &lease{ttl: ttl, keys: make(map[string]struct{})}
+	l.timer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		_ = s.ExpireLease(id)
+	})
+	l.expiry = time.Now().Add(time.Duration(ttl) * time.Second)
+	s.leases[id] = l
+	return &clientv3.LeaseGrantResponse{ResponseHeader: s.header(), ID: id, TTL: ttl}, nil
+}
+
+// ExpireLease ends lease id now instead of at the end of its ttl, its keys
+// are deleted in one revision.
+func (s *Store) ExpireLease(id clientv3.LeaseID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return rpctypes.ErrLeaseNotFound
+	}
+	l.timer.Stop()
+	delete(s.leases, id)
+	rev := s.rev + 1
+	var events []*mvccpb.Event
+	for key := range l.keys {
+		_, evs := s.del(clientv3.OpDelete(key), rev)
+		events = append(events, evs...)
+	}
+	s.commit(events)
+	return nil
+}
+
+func (s *Store) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.ExpireLease(id); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &clientv3.LeaseRevokeResponse{Header: s.header()}, nil
+}
+
+func (s *Store) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return &clientv3.LeaseTimeToLiveResponse{ResponseHeader: s.header(), ID: id, TTL: -1}, nil
+	}
+	resp := &clientv3.LeaseTimeToLiveResponse{
+		ResponseHeader: s.header(),
+		ID:             id,
+		TTL:            int64(time.Until(l.expiry).Seconds()),
+		GrantedTTL:     l.ttl,
+	}
+	for key := range l.keys {
+		resp.Keys = append(resp.Keys, []byte(key))
+	}
+	return resp, nil
+}
+
+func (s *Store) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	resp := &clientv3.LeaseLeasesResponse{ResponseHeader: s.header()}
+	for id := range s.leases {
+		resp.Leases = append(resp.Leases, clientv3.LeaseStatus{ID: id})
+	}
+	return resp, nil
+}
+
+func (s *Store) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	l.timer.Reset(time.Duration(l.ttl) * time.Second)
+	l.expiry = time.Now().Add(time.Duration(l.ttl) * time.Second)
+	return &clientv3.LeaseKeepAliveResponse{ResponseHeader: s.header(), ID: id, TTL: l.ttl}, nil
+}
+
+// KeepAlive renews id at a third of its ttl until ctx is done or the lease
+// is gone.
+func (s *Store) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	resp, err := s.KeepAliveOnce(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *clientv3.LeaseKeepAliveResponse, 1)
+	ch <- resp
+	go func() {
+		defer close(ch)
+		interval := time.Duration(resp.TTL) * time.Second / 3
+		if interval <= 0 {
+			interval = 100 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			resp, err := s.KeepAliveOnce(ctx, id)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- resp:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Close is part of clientv3.Lease, the store outlives its clients.
+func (s *Store) Close() error {
+	return nil
+}
@@ -0,0 +1,309 @@
+package etcdtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Store keeps keys the way etcd does: every write makes a revision, old
+// revisions stay readable until they are compacted, and watches replay from
+// any revision that is still there. It implements the KV and Lease api of
+// clientv3, Client mounts it on a client without a connection.
+type Store struct {
+	lock      sync.Mutex
+	rev       int64
+	compacted int64
+	keys      map[string][]version
+	history   []*mvccpb.Event
+	leases    map[clientv3.LeaseID]*lease
+	nextLease clientv3.LeaseID
+	watches   map[*watch]struct{}
+}
+
+// version is one revision of a key, a nil kv is a delete.
+type version struct {
+	rev int64
+	kv  *mvccpb.KeyValue
+}
+
+func NewStore() *Store {
+	return &Store{
+		rev:     1,
+		keys:    make(map[string][]version),
+		leases:  make(map[clientv3.LeaseID]*lease),
+		watches: make(map[*watch]struct{}),
+	}
+}
+
+// opField reads an option clientv3 keeps unexported in Op.
+func opField(op clientv3.Op, name string) reflect.Value {
+	return reflect.ValueOf(op).FieldByName(name)
+}
+
+func (s *Store) header() *etcdserverpb.ResponseHeader {
+	return &etcdserverpb.ResponseHeader{ClusterId: 1, MemberId: 1, Revision: s.rev, RaftTerm: 1}
+}
+
+// Revision is the revision of the last write.
+func (s *Store) Revision() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rev
+}
+
+func inRange(key, start, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, start) >= 0
+	}
+	return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+}
+
+func (s *Store) kvAt(key string, rev int64) *mvccpb.KeyValue {
+	versions := s.keys[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].rev <= rev {
+			return versions[i].kv
+		}
+	}
+	return nil
+}
+
+func (s *Store) rangeAt(start, end []byte, rev int64) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	if len(end) == 0 {
+		if kv := s.kvAt(string(start), rev); kv != nil {
+			kvs = append(kvs, kv)
+		}
+		return kvs
+	}
+	for key := range s.keys {
+		if inRange([]byte(key), start, end) {
+			if kv := s.kvAt(key, rev); kv != nil {
+				kvs = append(kvs, kv)
+			}
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs
+}
+
+func (s *Store) get(op clientv3.Op) (*clientv3.GetResponse, error) {
+	rev := op.Rev()
+	if rev <= 0 {
+		rev = s.rev
+	}
+	if rev < s.compacted {
+		return nil, rpctypes.ErrCompacted
+	}
+	if rev > s.rev {
+		return nil, rpctypes.ErrFutureRev
+	}
+	var kvs []*mvccpb.KeyValue
+	for _, kv := range s.rangeAt(op.KeyBytes(), op.RangeBytes(), rev) {
+		switch {
+		case op.MinModRev() > 0 && kv.ModRevision < op.MinModRev(),
+			op.MaxModRev() > 0 && kv.ModRevision > op.MaxModRev(),
+			op.MinCreateRev() > 0 && kv.CreateRevision < op.MinCreateRev(),
+			op.MaxCreateRev() > 0 && kv.CreateRevision > op.MaxCreateRev():
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	resp := &clientv3.GetResponse{Header: s.header(), Count: int64(len(kvs))}
+	if op.IsCountOnly() {
+		return resp, nil
+	}
+	if limit := opField(op, "limit").Int(); limit > 0 && int64(len(kvs)) > limit {
+		kvs, resp.More = kvs[:limit], true
+	}
+	for _, kv := range kvs {
+		kv := *kv
+		if op.IsKeysOnly() {
+			kv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+	return resp, nil
+}
+
+// put writes at rev, the revision of the write or txn being applied.
+func (s *Store) put(op clientv3.Op, rev int64) (*clientv3.PutResponse, []*mvccpb.Event, error) {
+	key := string(op.KeyBytes())
+	prev := s.kvAt(key, s.rev)
+	kv := &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), CreateRevision: rev, ModRevision: rev, Version: 1}
+	kv.Lease = opField(op, "leaseID").Int()
+	if prev != nil {
+		kv.CreateRevision, kv.Version = prev.CreateRevision, prev.Version+1
+		if opField(op, "ignoreValue").Bool() {
+			kv.Value = prev.Value
+		}
+		if opField(op, "ignoreLease").Bool() {
+			kv.Lease = prev.Lease
+		}
+	} else if opField(op, "ignoreValue").Bool() || opField(op, "ignoreLease").Bool() {
+		return nil, nil, rpctypes.ErrKeyNotFound
+	}
+	if kv.Lease != 0 {
+		l, ok := s.leases[clientv3.LeaseID(kv.Lease)]
+		if !ok {
+			return nil, nil, rpctypes.ErrLeaseNotFound
+		}
+		l.keys[key] = struct{}{}
+	}
+	if prev != nil && prev.Lease != 0 && prev.Lease != kv.Lease {
+		if l, ok := s.leases[clientv3.LeaseID(prev.Lease)]; ok {
+			delete(l.keys, key)
+		}
+	}
+	s.keys[key] = append(s.keys[key], version{rev: rev, kv: kv})
+	resp := &clientv3.PutResponse{Header: s.header()}
+	if opField(op, "prevKV").Bool() {
+		resp.PrevKv = prev
+	}
+	return resp, []*mvccpb.Event{{Type: mvccpb.PUT, Kv: kv, PrevKv: prev}}, nil
+}
+
+func (s *Store) del(op clientv3.Op, rev int64) (*clientv3.DeleteResponse, []*mvccpb.Event) {
+	resp := &clientv3.DeleteResponse{Header: s.header()}
+	var events []*mvccpb.Event
+	for _, prev := range s.rangeAt(op.KeyBytes(), op.RangeBytes(), s.rev) {
+		key := string(prev.Key)
+		s.keys[key] = append(s.keys[key], version{rev: rev})
+		if l, ok := s.leases[clientv3.LeaseID(prev.Lease)]; ok {
+			delete(l.keys, key)
+		}
+		resp.Deleted++
+		if opField(op, "prevKV").Bool() {
+			resp.PrevKvs = append(resp.PrevKvs, prev)
+		}
+		events = append(events, &mvccpb.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: prev.Key, ModRevision: rev}, PrevKv: prev})
+	}
+	return resp, events
+}
+
+// commit makes the events of one write or txn visible under its revision.
+func (s *Store) commit(events []*mvccpb.Event) {
+	if len(events) == 0 {
+		return
+	}
+	s.rev++
+	s.history = append(s.history, events...)
+	for w := range s.watches {
+		w.send(s.rev, events)
+	}
+}
+
+func (s *Store) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpPut(key, val, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Put(), nil
+}
+
+func (s *Store) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpGet(key, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Get(), nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpDelete(key, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Del(), nil
+}
+
+// Compact drops the revisions before rev, reads and watches from them fail
+// with ErrCompacted afterwards.
+func (s *Store) Compact(ctx context.Context, rev int64, _ ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rev <= s.compacted {
+		return nil, rpctypes.ErrCompacted
+	}
+	if rev > s.rev {
+		return nil, rpctypes.ErrFutureRev
+	}
+	for key, versions := range s.keys {
+		kept := versions[:0]
+		for i, v := range versions {
+			if v.rev >= rev || (i+1 < len(versions) && versions[i+1].rev > rev) || i == len(versions)-1 {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 1 && kept[0].kv == nil && kept[0].rev <= rev {
+			delete(s.keys, key)
+			continue
+		}
+		s.keys[key] = kept
+	}
+	history := s.history[:0]
+	for _, ev := range s.history {
+		if ev.Kv.ModRevision >= rev {
+			history = append(history, ev)
+		}
+	}
+	s.history = history
+	// watches are always caught up, only new ones from before rev fail
+	s.compacted = rev
+	return &clientv3.CompactResponse{Header: s.header()}, nil
+}
+
+func (s *Store) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return clientv3.OpResponse{}, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case op.IsGet():
+		resp, err := s.get(op)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	case op.IsPut():
+		resp, events, err := s.put(op, s.rev+1)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		s.commit(events)
+		resp.Header = s.header()
+		return resp.OpResponse(), nil
+	case op.IsDelete():
+		resp, events := s.del(op, s.rev+1)
+		s.commit(events)
+		resp.Header = s.header()
+		return resp.OpResponse(), nil
+	case op.IsTxn():
+		cmps, thenOps, elseOps := op.Txn()
+		resp, err := s.txn(cmps, thenOps, elseOps)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	}
+	return clientv3.OpResponse{}, fmt.Errorf("unknown op")
+}
+
+func (s *Store) Txn(ctx context.Context) clientv3.Txn {
+	return &txn{store: s, ctx: ctx}
+}
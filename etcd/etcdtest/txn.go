@@ -0,0 +1,156 @@
+package etcdtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type txn struct {
+	store   *Store
+	ctx     context.Context
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+func (t *txn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *txn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+func (t *txn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+func (t *txn) Commit() (*clientv3.TxnResponse, error) {
+	resp, err := t.store.Do(t.ctx, clientv3.OpTxn(t.cmps, t.thenOps, t.elseOps))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Txn(), nil
+}
+
+// txn applies every op of the taken branch under one revision, like etcd.
+func (s *Store) txn(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (*clientv3.TxnResponse, error) {
+	succeeded := true
+	for _, cmp := range cmps {
+		if !s.compare(etcdserverpb.Compare(cmp)) {
+			succeeded = false
+			break
+		}
+	}
+	ops := thenOps
+	if !succeeded {
+		ops = elseOps
+	}
+	rev := s.rev + 1
+	var events []*mvccpb.Event
+	resp := &clientv3.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		switch {
+		case op.IsGet():
+			r, err := s.get(op)
+			if err != nil {
+				return nil, err
+			}
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: (*etcdserverpb.RangeResponse)(r)}})
+		case op.IsPut():
+			r, evs, err := s.put(op, rev)
+			if err != nil {
+				s.rollback(rev)
+				return nil, err
+			}
+			events = append(events, evs...)
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponsePut{ResponsePut: (*etcdserverpb.PutResponse)(r)}})
+		case op.IsDelete():
+			r, evs := s.del(op, rev)
+			events = append(events, evs...)
+			resp.Responses = append(resp.Responses, &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: (*etcdserverpb.DeleteRangeResponse)(r)}})
+		default:
+			s.rollback(rev)
+			return nil, fmt.Errorf("nested transactions are not supported")
+		}
+	}
+	s.commit(events)
+	resp.Header = s.header()
+	return resp, nil
+}
+
+// rollback drops the versions a failed txn already wrote at rev.
+func (s *Store) rollback(rev int64) {
+	for key, versions := range s.keys {
+		for len(versions) > 0 && versions[len(versions)-1].rev == rev {
+			versions = versions[:len(versions)-1]
+		}
+		if len(versions) == 0 {
+			delete(s.keys, key)
+		} else {
+			s.keys[key] = versions
+		}
+	}
+}
+
+// compare follows etcd: a missing key compares as zero, except for its value,
+// and a range compare holds for every key in it.
+func (s *Store) compare(cmp etcdserverpb.Compare) bool {
+	kvs := s.rangeAt(cmp.Key, cmp.RangeEnd, s.rev)
+	if len(kvs) == 0 {
+		if len(cmp.RangeEnd) > 0 {
+			return true
+		}
+		if cmp.Target == etcdserverpb.Compare_VALUE {
+			return false
+		}
+		kvs = []*mvccpb.KeyValue{{Key: cmp.Key}}
+	}
+	for _, kv := range kvs {
+		var result int
+		switch cmp.Target {
+		case etcdserverpb.Compare_VERSION:
+			result = compareInt(kv.Version, cmp.GetVersion())
+		case etcdserverpb.Compare_CREATE:
+			result = compareInt(kv.CreateRevision, cmp.GetCreateRevision())
+		case etcdserverpb.Compare_MOD:
+			result = compareInt(kv.ModRevision, cmp.GetModRevision())
+		case etcdserverpb.Compare_VALUE:
+			result = bytes.Compare(kv.Value, cmp.GetValue())
+		case etcdserverpb.Compare_LEASE:
+			result = compareInt(kv.Lease, cmp.GetLease())
+		}
+		ok := false
+		switch cmp.Result {
+		case etcdserverpb.Compare_EQUAL:
+			ok = result == 0
+		case etcdserverpb.Compare_NOT_EQUAL:
+			ok = result != 0
+		case etcdserverpb.Compare_GREATER:
+			ok = result > 0
+		case etcdserverpb.Compare_LESS:
+			ok = result < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,207 @@
+package etcdtest
+
+import (
+	"context"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sync"
+)
+
+// watch queues the responses of one Watch call, so a slow reader never holds
+// up the store.
+type watch struct {
+	watcher  *watcher
+	ctx      context.Context
+	key      []byte
+	end      []byte
+	prevKV   bool
+	noPut    bool
+	noDelete bool
+	progress bool
+	// next is the first revision not yet queued
+	next int64
+
+	lock    sync.Mutex
+	queue   []clientv3.WatchResponse
+	closed  bool
+	wake    chan struct{}
+	results chan clientv3.WatchResponse
+}
+
+// send queues the events of rev that match, the store lock is held.
+func (w *watch) send(rev int64, events []*mvccpb.Event) {
+	if rev < w.next {
+		return
+	}
+	w.next = rev + 1
+	resp := clientv3.WatchResponse{Header: *w.watcher.store.header()}
+	for _, ev := range events {
+		if !inRange(ev.Kv.Key, w.key, w.end) || (ev.Type == mvccpb.PUT && w.noPut) || (ev.Type == mvccpb.DELETE && w.noDelete) {
+			continue
+		}
+		e := clientv3.Event(*ev)
+		if !w.prevKV {
+			e.PrevKv = nil
+		}
+		resp.Events = append(resp.Events, &e)
+	}
+	if len(resp.Events) > 0 {
+		w.push(resp, false)
+	}
+}
+
+// compact cancels the watch, the reader sees rpctypes.ErrCompacted.
+func (w *watch) compact(rev int64) {
+	w.push(clientv3.WatchResponse{Header: *w.watcher.store.header(), CompactRevision: rev, Canceled: true}, true)
+}
+
+func (w *watch) push(resp clientv3.WatchResponse, last bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.queue = append(w.queue, resp)
+	w.closed = last
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the queue to the reader until the watch is closed or its context
+// is done.
+func (w *watch) run() {
+	defer func() {
+		w.watcher.store.removeWatch(w)
+		close(w.results)
+	}()
+	for {
+		w.lock.Lock()
+		queue, closed := w.queue, w.closed
+		w.queue = nil
+		w.lock.Unlock()
+		for _, resp := range queue {
+			select {
+			case w.results <- resp:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-w.wake:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Store) removeWatch(w *watch) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.watches, w)
+}
+
+// watcher is the Watcher of one client, closing it ends only its watches.
+type watcher struct {
+	store  *Store
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *Store) newWatcher() *watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{store: s, ctx: ctx, cancel: cancel}
+}
+
+func (c *watcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	w := &watch{
+		watcher:  c,
+		ctx:      ctx,
+		key:      op.KeyBytes(),
+		end:      op.RangeBytes(),
+		prevKV:   opField(op, "prevKV").Bool(),
+		noPut:    opField(op, "filterPut").Bool(),
+		noDelete: opField(op, "filterDelete").Bool(),
+		progress: opField(op, "progressNotify").Bool(),
+		wake:     make(chan struct{}, 1),
+		results:  make(chan clientv3.WatchResponse),
+	}
+	s := c.store
+	s.lock.Lock()
+	w.next = op.Rev()
+	if w.next <= 0 {
+		w.next = s.rev + 1
+	}
+	if w.next < s.compacted {
+		w.compact(s.compacted)
+	} else {
+		var events []*mvccpb.Event
+		for _, ev := range s.history {
+			if ev.Kv.ModRevision < w.next {
+				continue
+			}
+			if len(events) > 0 && events[0].Kv.ModRevision != ev.Kv.ModRevision {
+				w.send(events[0].Kv.ModRevision, events)
+				events = nil
+			}
+			events = append(events, ev)
+		}
+		if len(events) > 0 {
+			w.send(events[0].Kv.ModRevision, events)
+		}
+		w.next = s.rev + 1
+		s.watches[w] = struct{}{}
+	}
+	s.lock.Unlock()
+	go w.run()
+	return w.results
+}
+
+// RequestProgress tells the watches asking for progress notifications the
+// current revision.
+func (c *watcher) RequestProgress(ctx context.Context) error {
+	s := c.store
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for w := range s.watches {
+		if w.watcher == c && w.progress {
+			w.push(clientv3.WatchResponse{Header: *s.header()}, false)
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *watcher) Close() error {
+	c.cancel()
+	return nil
+}
+
+// DropWatches ends every watch as a lost connection would, readers see their
+// channel closed without an error and have to watch again.
+func (s *Store) DropWatches() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for w := range s.watches {
+		w.lock.Lock()
+		w.closed = true
+		w.lock.Unlock()
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+		delete(s.watches, w)
+	}
+}
@@ -3,6 +3,7 @@ package etcd
 import (
 	"fmt"
 	"github.com/spf13/pflag"
+	"strings"
 )
 
 type Flags struct {
@@ -13,20 +14,27 @@ type Flags struct {
 }
 
 func NewEtcdFlags() *Flags {
-	return &Flags{
-		EtcdServers: []string{"127.0.0.1:2379"},
-	}
+	return &Flags{}
 }
 
 func (s *Flags) AddFlags(fs *pflag.FlagSet) {
-	fs.StringSliceVar(&s.EtcdServers, "etcd-servers", s.EtcdServers, "the etcd server endpoints")
+	fs.StringSliceVar(&s.EtcdServers, "etcd-servers", s.EtcdServers, "the etcd server endpoints, unset ones come from the tinycni config file and the APIV1_ETCD_* environment")
 	fs.StringVar(&s.EtcdCertFile, "etcd-certfile", s.EtcdCertFile, "the etcd server Cert file")
 	fs.StringVar(&s.EtcdKeyFile, "etcd-keyfile", s.EtcdKeyFile, "the etcd server key file")
 	fs.StringVar(&s.EtcdCAFile, "etcd-cafile", s.EtcdCAFile, "the etcd server CA file")
 }
+func (s *Flags) EtcdConfig() *EtcdConfig {
+	return &EtcdConfig{
+		EtcdEndpoints:  strings.Join(s.EtcdServers, ","),
+		EtcdCertFile:   s.EtcdCertFile,
+		EtcdKeyFile:    s.EtcdKeyFile,
+		EtcdCACertFile: s.EtcdCAFile,
+	}
+}
+
 func (s *Flags) ValidateFlags() error {
-	if len(s.EtcdServers) == 0 {
-		return fmt.Errorf("empty etcd servers")
+	if (s.EtcdCertFile == "") != (s.EtcdKeyFile == "") {
+		return fmt.Errorf("etcd-certfile and etcd-keyfile must be set together")
 	}
 	return nil
 }
@@ -0,0 +1,227 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+const informerRetryInterval = 2 * time.Second
+
+// EventHandler is told about the keys of an informer, a nil func is skipped.
+type EventHandler struct {
+	OnAdd    func(key, value string)
+	OnUpdate func(key, oldValue, value string)
+	OnDelete func(key, oldValue string)
+}
+
+// Informer keeps a local copy of every key under a prefix. It lists first and
+// then watches from the listed revision, a broken watch resumes from the last
+// revision it saw and a compacted one lists again, reporting what changed in
+// between to the handlers.
+type Informer struct {
+	client *etcd.Client
+	prefix string
+
+	lock     sync.RWMutex
+	items    map[string]string
+	rev      int64
+	synced   bool
+	syncedCh chan struct{}
+	handlers []EventHandler
+}
+
+func (c *EtcdClient) NewInformer(prefix string) *Informer {
+	return &Informer{
+		client:   c.client,
+		prefix:   prefix,
+		items:    make(map[string]string),
+		syncedCh: make(chan struct{}),
+	}
+}
+
+// AddHandler registers h, it only sees the changes after it was added.
+func (i *Informer) AddHandler(h EventHandler) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.handlers = append(i.handlers, h)
+}
+
+func (i *Informer) HasSynced() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.synced
+}
+
+// WaitForSync blocks until the first list is in the cache, it returns false
+// when ctx is done first.
+func (i *Informer) WaitForSync(ctx context.Context) bool {
+	select {
+	case <-i.syncedCh:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Revision is the store revision the cache is up to date with.
+func (i *Informer) Revision() int64 {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.rev
+}
+
+func (i *Informer) Get(key string) (string, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	value, ok := i.items[key]
+	return value, ok
+}
+
+func (i *Informer) List() map[string]string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	items := make(map[string]string, len(i.items))
+	for key, value := range i.items {
+		items[key] = value
+	}
+	return items
+}
+
+// Run keeps the cache up to date until ctx is done.
+func (i *Informer) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := i.relist(ctx); err != nil {
+			klog.Errorf("failed to list %s, err is %v", i.prefix, err)
+			if !sleepCtx(ctx, informerRetryInterval) {
+				return
+			}
+			continue
+		}
+		for ctx.Err() == nil {
+			err := i.watch(ctx)
+			if errors.Is(err, rpctypes.ErrCompacted) {
+				klog.Warningf("watch of %s fell behind compaction at revision %d, list again", i.prefix, i.Revision())
+				break
+			}
+			if err != nil {
+				klog.Errorf("watch of %s broke at revision %d, err is %v", i.prefix, i.Revision(), err)
+			}
+			if !sleepCtx(ctx, informerRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// relist replaces the cache with a fresh list and reports the difference.
+func (i *Informer) relist(ctx context.Context) error {
+	listCtx, cancel := context.WithTimeout(ctx, clientTimeout)
+	defer cancel()
+	resp, err := i.client.Get(listCtx, i.prefix, etcd.WithPrefix())
+	if err != nil {
+		return err
+	}
+	items := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		items[string(kv.Key)] = string(kv.Value)
+	}
+	i.lock.Lock()
+	old := i.items
+	i.items = items
+	i.rev = resp.Header.Revision
+	handlers := i.handlers
+	first := !i.synced
+	i.synced = true
+	i.lock.Unlock()
+	for key, value := range items {
+		oldValue, ok := old[key]
+		if !ok {
+			dispatch(handlers, mvccpb.PUT, key, "", value, false)
+		} else if oldValue != value {
+			dispatch(handlers, mvccpb.PUT, key, oldValue, value, true)
+		}
+	}
+	for key, oldValue := range old {
+		if _, ok := items[key]; !ok {
+			dispatch(handlers, mvccpb.DELETE, key, oldValue, "", true)
+		}
+	}
+	if first {
+		close(i.syncedCh)
+	}
+	return nil
+}
+
+// watch applies events from the revision after the cache until the watch
+// breaks, progress notifications move the revision on while nothing changes.
+func (i *Informer) watch(ctx context.Context) error {
+	watchCtx, cancel := context.WithCancel(etcd.WithRequireLeader(ctx))
+	defer cancel()
+	changes := i.client.Watch(watchCtx, i.prefix, etcd.WithPrefix(), etcd.WithRev(i.Revision()+1), etcd.WithProgressNotify())
+	for wresp := range changes {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wresp.Events {
+			i.apply(ev)
+		}
+		i.lock.Lock()
+		if wresp.Header.Revision > i.rev {
+			i.rev = wresp.Header.Revision
+		}
+		i.lock.Unlock()
+	}
+	return ctx.Err()
+}
+
+func (i *Informer) apply(ev *etcd.Event) {
+	key := string(ev.Kv.Key)
+	i.lock.Lock()
+	oldValue, existed := i.items[key]
+	if ev.Type == mvccpb.DELETE {
+		delete(i.items, key)
+	} else {
+		i.items[key] = string(ev.Kv.Value)
+	}
+	i.rev = ev.Kv.ModRevision
+	handlers := i.handlers
+	i.lock.Unlock()
+	if ev.Type == mvccpb.DELETE && !existed {
+		return
+	}
+	dispatch(handlers, ev.Type, key, oldValue, string(ev.Kv.Value), existed)
+}
+
+func dispatch(handlers []EventHandler, _type mvccpb.Event_EventType, key, oldValue, value string, existed bool) {
+	for _, h := range handlers {
+		switch {
+		case _type == mvccpb.DELETE:
+			if h.OnDelete != nil {
+				h.OnDelete(key, oldValue)
+			}
+		case existed:
+			if h.OnUpdate != nil {
+				h.OnUpdate(key, oldValue, value)
+			}
+		default:
+			if h.OnAdd != nil {
+				h.OnAdd(key, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package etcd_test
+
+import (
+	"cni/etcd"
+	"cni/etcd/etcdtest"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) handler() etcd.EventHandler {
+	record := func(event string) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.events = append(r.events, event)
+	}
+	return etcd.EventHandler{
+		OnAdd:    func(key, value string) { record("add " + key + "=" + value) },
+		OnUpdate: func(key, oldValue, value string) { record("update " + key + "=" + oldValue + "->" + value) },
+		OnDelete: func(key, oldValue string) { record("delete " + key + "=" + oldValue) },
+	}
+}
+
+func (r *recorder) list() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recorder) has(event string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range r.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInformerRelistsAfterCompaction(t *testing.T) {
+	client, store, err := etcdtest.NewEtcdClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store == nil {
+		t.Skip("needs the in-memory store to drop watches and compact")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	prefix := etcd.NodesKey()
+	mustPut := func(key, value string) {
+		if _, err := store.Put(ctx, prefix+key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustPut("a", "1")
+	mustPut("b", "1")
+
+	informer := client.NewInformer(prefix)
+	events := &recorder{}
+	informer.AddHandler(events.handler())
+	go informer.Run(ctx)
+	if !informer.WaitForSync(ctx) {
+		t.Fatal("informer never synced")
+	}
+	if !events.has("add "+prefix+"a=1") || !events.has("add "+prefix+"b=1") {
+		t.Errorf("events after the first list = %v", events.list())
+	}
+
+	// the informer misses these while it is disconnected, and the revisions
+	// it would resume from are compacted before it watches again
+	store.DropWatches()
+	mustPut("a", "2")
+	mustPut("c", "1")
+	if _, err := store.Delete(ctx, prefix+"b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Compact(ctx, store.Revision()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for !done() {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%s, cache is %v and events are %v", what, informer.List(), events.list())
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	want := map[string]string{prefix + "a": "2", prefix + "c": "1"}
+	waitFor("cache not relisted", func() bool {
+		return reflect.DeepEqual(informer.List(), want)
+	})
+	for _, event := range []string{"update " + prefix + "a=1->2", "add " + prefix + "c=1", "delete " + prefix + "b=1"} {
+		waitFor("relist did not report "+event, func() bool {
+			return events.has(event)
+		})
+	}
+	if rev := informer.Revision(); rev < store.Revision() {
+		t.Errorf("informer revision = %d, want at least %d", rev, store.Revision())
+	}
+
+	// and it watches again from the relisted revision
+	mustPut("d", "1")
+	waitFor("put after the relist not seen", func() bool {
+		return events.has("add " + prefix + "d=1")
+	})
+}
@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"context"
+	"k8s.io/klog"
+)
+
+type NodeHandler struct {
+	OnAdd    func(node Node)
+	OnUpdate func(old, node Node)
+	OnDelete func(node Node)
+}
+
+type NetworkHandler struct {
+	OnAdd    func(network NetworkCrd)
+	OnUpdate func(old, network NetworkCrd)
+	OnDelete func(network NetworkCrd)
+}
+
+type PodHandler struct {
+	OnAdd    func(pod Pod)
+	OnUpdate func(old, pod Pod)
+	OnDelete func(pod Pod)
+}
+
+// Informers caches the nodes, networks and pods of tinycni for long running
+// components, every record reaches the handlers decoded.
+type Informers struct {
+	Nodes    *Informer
+	Networks *Informer
+	Pods     *Informer
+}
+
+func (c *EtcdClient) NewInformers() *Informers {
+	return &Informers{
+		Nodes:    c.NewInformer(NodesKey()),
+		Networks: c.NewInformer(NetworksKey()),
+		Pods:     c.NewInformer(PodsKey()),
+	}
+}
+
+func (s *Informers) Run(ctx context.Context) {
+	go s.Nodes.Run(ctx)
+	go s.Networks.Run(ctx)
+	go s.Pods.Run(ctx)
+}
+
+func (s *Informers) WaitForSync(ctx context.Context) bool {
+	return s.Nodes.WaitForSync(ctx) && s.Networks.WaitForSync(ctx) && s.Pods.WaitForSync(ctx)
+}
+
+func decode(key, value string, obj interface{}) bool {
+	if err := Decode(value, obj); err != nil {
+		klog.Errorf("failed to decode %s, err is %v", key, err)
+		return false
+	}
+	return true
+}
+
+func (s *Informers) AddNodeHandler(h NodeHandler) {
+	s.Nodes.AddHandler(EventHandler{
+		OnAdd: func(key, value string) {
+			var node Node
+			if h.OnAdd != nil && decode(key, value, &node) {
+				h.OnAdd(node)
+			}
+		},
+		OnUpdate: func(key, oldValue, value string) {
+			var old, node Node
+			if h.OnUpdate != nil && decode(key, oldValue, &old) && decode(key, value, &node) {
+				h.OnUpdate(old, node)
+			}
+		},
+		OnDelete: func(key, oldValue string) {
+			var node Node
+			if h.OnDelete != nil && decode(key, oldValue, &node) {
+				h.OnDelete(node)
+			}
+		},
+	})
+}
+
+func (s *Informers) AddNetworkHandler(h NetworkHandler) {
+	s.Networks.AddHandler(EventHandler{
+		OnAdd: func(key, value string) {
+			var network NetworkCrd
+			if h.OnAdd != nil && decode(key, value, &network) {
+				h.OnAdd(network)
+			}
+		},
+		OnUpdate: func(key, oldValue, value string) {
+			var old, network NetworkCrd
+			if h.OnUpdate != nil && decode(key, oldValue, &old) && decode(key, value, &network) {
+				h.OnUpdate(old, network)
+			}
+		},
+		OnDelete: func(key, oldValue string) {
+			var network NetworkCrd
+			if h.OnDelete != nil && decode(key, oldValue, &network) {
+				h.OnDelete(network)
+			}
+		},
+	})
+}
+
+func (s *Informers) AddPodHandler(h PodHandler) {
+	s.Pods.AddHandler(EventHandler{
+		OnAdd: func(key, value string) {
+			var pod Pod
+			if h.OnAdd != nil && decode(key, value, &pod) {
+				h.OnAdd(pod)
+			}
+		},
+		OnUpdate: func(key, oldValue, value string) {
+			var old, pod Pod
+			if h.OnUpdate != nil && decode(key, oldValue, &old) && decode(key, value, &pod) {
+				h.OnUpdate(old, pod)
+			}
+		},
+		OnDelete: func(key, oldValue string) {
+			var pod Pod
+			if h.OnDelete != nil && decode(key, oldValue, &pod) {
+				h.OnDelete(pod)
+			}
+		},
+	})
+}
@@ -1,9 +1,12 @@
 package etcd
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func NodesKey() string {
-	return fmt.Sprintf("%s%s/", TinyCniPrefix, NodesKeyName)
+	return fmt.Sprintf("%s%s/", Prefix(), NodesKeyName)
 }
 
 func NodeKey(nodeName string) string {
@@ -11,7 +14,7 @@ func NodeKey(nodeName string) string {
 }
 
 func NetworksKey() string {
-	return fmt.Sprintf("%s%s/", TinyCniPrefix, NetworksKeyName)
+	return fmt.Sprintf("%s%s/", Prefix(), NetworksKeyName)
 }
 
 func NetworkKey(networkName string) string {
@@ -19,9 +22,82 @@ func NetworkKey(networkName string) string {
 }
 
 func PodsKey() string {
-	return fmt.Sprintf("%s%s/", TinyCniPrefix, PodsKeyName)
+	return fmt.Sprintf("%s%s/", Prefix(), PodsKeyName)
 }
 
 func PodKey(nameSpace, podName string) string {
-	return fmt.Sprintf("%s%s/%s", PodsKey, nameSpace, podName)
+	return fmt.Sprintf("%s%s/%s", PodsKey(), nameSpace, podName)
+}
+
+func ContainersKey() string {
+	return fmt.Sprintf("%s%s/", Prefix(), ContainersKeyName)
+}
+
+func ContainerKey(containerId string) string {
+	return fmt.Sprintf("%s%s", ContainersKey(), containerId)
+}
+
+func AllocationsKey(containerId string) string {
+	return fmt.Sprintf("%s%s/%s/", Prefix(), AllocationsKeyName, containerId)
+}
+
+func AllocationKey(containerId, networkName string) string {
+	return fmt.Sprintf("%s%s", AllocationsKey(containerId), networkName)
+}
+
+func BlocksKey() string {
+	return fmt.Sprintf("%s%s/", Prefix(), BlocksKeyName)
+}
+
+func SubnetBlocksKey(networkName, subnetName string) string {
+	return fmt.Sprintf("%s%s/%s/", BlocksKey(), networkName, subnetName)
+}
+
+// BlockKey escapes the prefix length of cidr, a "/" would add a key level.
+func BlockKey(networkName, subnetName, cidr string) string {
+	return fmt.Sprintf("%s%s", SubnetBlocksKey(networkName, subnetName), strings.Replace(cidr, "/", "-", 1))
+}
+
+func IpamsKey() string {
+	return fmt.Sprintf("%s%s/", Prefix(), IpamKeyName)
+}
+
+func IpamKey(networkName string) string {
+	return fmt.Sprintf("%s%s/", IpamsKey(), networkName)
+}
+
+func IpamSubnetKey(networkName, subnetName string) string {
+	return fmt.Sprintf("%s%s/", IpamKey(networkName), subnetName)
+}
+
+func IpKey(networkName, subnetName, ip string) string {
+	return fmt.Sprintf("%s%s", IpamSubnetKey(networkName, subnetName), ip)
+}
+
+func QuotasKey() string {
+	return fmt.Sprintf("%s%s/", Prefix(), QuotasKeyName)
+}
+
+func QuotaKey(networkName string) string {
+	return fmt.Sprintf("%s%s", QuotasKey(), networkName)
+}
+
+func UsagesKey(networkName string) string {
+	return fmt.Sprintf("%s%s/%s/", Prefix(), UsageKeyName, networkName)
+}
+
+func UsageKey(networkName, kind, name string) string {
+	return fmt.Sprintf("%s%s/%s", UsagesKey(networkName), kind, name)
+}
+
+func ClusterConfigKey() string {
+	return fmt.Sprintf("%s%s", Prefix(), ConfigKeyName)
+}
+
+func SchemaKey() string {
+	return fmt.Sprintf("%s%s", Prefix(), SchemaKeyName)
+}
+
+func ClusterKey() string {
+	return fmt.Sprintf("%s%s", Prefix(), ClusterKeyName)
 }
@@ -2,7 +2,6 @@ package etcd
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"k8s.io/klog"
@@ -11,7 +10,8 @@ import (
 )
 
 func (c *Client) GetObject(key string, obj interface{}, opts ...clientv3.OpOption) (int64, error) {
-	ctxt, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	resp, err := c.Client.Get(ctxt, key, opts...)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get key %s from etcd,err [%s]", key, err.Error())
@@ -19,7 +19,7 @@ func (c *Client) GetObject(key string, obj interface{}, opts ...clientv3.OpOptio
 	if resp.Count == 0 {
 		return 0, nil
 	}
-	if err := json.Unmarshal(resp.Kvs[0].Value, obj); err != nil {
+	if err := Decode(string(resp.Kvs[0].Value), obj); err != nil {
 		return resp.Count, err
 	}
 	return resp.Count, nil
@@ -28,14 +28,15 @@ func (c *Client) GetObject(key string, obj interface{}, opts ...clientv3.OpOptio
 func (c *Client) GetNodes() (map[string]Node, error) {
 	nodeMap := make(map[string]Node)
 	key := NodesKey()
-	ctxt, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	resp, err := c.Client.Get(ctxt, key, clientv3.WithPrefix())
 	if err != nil {
 		return nodeMap, err
 	}
 	for _, kv := range resp.Kvs {
 		var node Node
-		if err := json.Unmarshal(kv.Value, &node); err != nil {
+		if err := Decode(string(kv.Value), &node); err != nil {
 			klog.Error(err)
 		}
 		nodeName := strings.TrimPrefix(string(kv.Key), key)
@@ -60,14 +61,15 @@ func (c *Client) GetNode(name string) (Node, error) {
 func (c *Client) GetNetworks() (map[string]NetworkCrd, error) {
 	networkMap := make(map[string]NetworkCrd)
 	key := NetworksKey()
-	ctxt, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	resp, err := c.Client.Get(ctxt, key, clientv3.WithPrefix())
 	if err != nil {
 		return networkMap, err
 	}
 	for _, kv := range resp.Kvs {
 		var network NetworkCrd
-		if err := json.Unmarshal(kv.Value, &network); err != nil {
+		if err := Decode(string(kv.Value), &network); err != nil {
 			klog.Error(err)
 		}
 		networkName := strings.TrimPrefix(string(kv.Key), key)
@@ -92,14 +94,15 @@ func (c *Client) GetNetwork(name string) (NetworkCrd, error) {
 func (c *Client) GetPods() (map[string]Pod, error) {
 	pods := make(map[string]Pod)
 	key := PodsKey()
-	ctxt, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	resp, err := c.Client.Get(ctxt, key, clientv3.WithPrefix())
 	if err != nil {
 		return pods, err
 	}
 	for _, kv := range resp.Kvs {
 		var pod Pod
-		if err = json.Unmarshal(kv.Value, &pod); err != nil {
+		if err = Decode(string(kv.Value), &pod); err != nil {
 			klog.Error(err)
 		}
 		podName := strings.TrimPrefix(string(kv.Key), key)
@@ -2,24 +2,95 @@ package etcd
 
 import "net"
 
+// Node is registered by tinycnid under a lease, it disappears from etcd once
+// the node stops sending heartbeats.
 type Node struct {
-	Name   string `json:"name"`
-	NodeIp string `json:"nodeIp"`
+	Name           string   `json:"name"`
+	NodeIp         string   `json:"nodeIp"`
+	NodeIps        []string `json:"nodeIps"`
+	PodBlocks      []string `json:"podBlocks"`
+	TunnelEndpoint string   `json:"tunnelEndpoint"`
+	Capabilities   []string `json:"capabilities"`
+	Heartbeat      string   `json:"heartbeat"`
 }
 type NetworkCrd struct {
 	Name    string   `json:"name"`
 	Subnets []Subnet `json:"subnets"`
+	// Mode is the data plane the network needs, empty fits every mode
+	Mode string `json:"mode,omitempty"`
+	// MTU of the pod interfaces, 0 keeps the default of the plugin
+	MTU       int        `json:"mtu,omitempty"`
+	Isolation *Isolation `json:"isolation,omitempty"`
+	// PodSelector picks the network for pods that name none themselves, a
+	// pod matches when it carries every label of the selector
+	PodSelector map[string]string `json:"podSelector,omitempty"`
+}
+
+// Isolation limits which pods may join a network, a pod passes when its
+// namespace or its tenant is listed. Without lists every pod may join.
+type Isolation struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	Tenants    []string `json:"tenants,omitempty"`
+}
+
+// ClusterConfig holds the ranges of the cluster that no network may overlap.
+type ClusterConfig struct {
+	ServiceCIDRs []string `json:"serviceCIDRs"`
+	NodeCIDRs    []string `json:"nodeCIDRs"`
 }
 
 type Subnet struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
-	CIDR string `json:"cidr"`
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	CIDR    string `json:"cidr"`
+	Gateway string `json:"gateway"`
+	// BlockSize is the prefix length of the blocks nodes claim from the
+	// subnet, 0 lets every node allocate from the whole subnet
+	BlockSize int `json:"blockSize"`
+	// BlockSource BlockSourcePodCIDR gives every node the podCIDRs of its k8s
+	// node as blocks instead of letting it claim them
+	BlockSource string `json:"blockSource,omitempty"`
+	// Reserved addresses are never allocated, each entry is an address, a
+	// cidr or a first-last range
+	Reserved []string `json:"reserved,omitempty"`
+}
+
+// BlockSourcePodCIDR takes the blocks of a subnet from the podCIDRs the
+// controller manager assigns with --allocate-node-cidrs.
+const BlockSourcePodCIDR = "podCIDR"
+
+// Block is a part of a subnet claimed by one node, the node allocates its
+// pods from it and other nodes route the block to it.
+type Block struct {
+	Network string `json:"network"`
+	Subnet  string `json:"subnet"`
+	CIDR    string `json:"cidr"`
+	Node    string `json:"node"`
 }
 
 type AllocatedIp struct {
-	Ip string `json:"ip"`
+	Ip          string `json:"ip"`
+	Network     string `json:"network"`
+	Subnet      string `json:"subnet"`
+	NameSpace   string `json:"nameSpace"`
+	PodName     string `json:"podName"`
+	ContainerId string `json:"containerId"`
+	Tenant      string `json:"tenant"`
+	Node        string `json:"node"`
+	State       string `json:"state"`
+	ConflictMac string `json:"conflictMac,omitempty"`
+	ConflictAt  string `json:"conflictAt,omitempty"`
 }
+
+const (
+	IpStateAllocated = "allocated"
+	// reserved addresses sit in the warm pool of Node and belong to no pod yet
+	IpStateReserved = "reserved"
+	// conflict addresses answered an ARP probe or failed DAD, they are kept out
+	// of allocation until an operator clears them
+	IpStateConflict = "conflict"
+)
+
 type FreeIp struct {
 	Ip string `json:"ip"`
 }
@@ -27,8 +98,8 @@ type PoolData struct {
 	Name         string        `json:"name"`
 	Id           string        `json:"id"`
 	Pool         *net.IPNet    `json:"pool"`
-	FreeIps      []FreeIp      `json:"free_ips"`
-	AllocatedIps []AllocatedIp `json:"allocated_ips"`
+	FreeIps      []FreeIp      `json:"freeIps"`
+	AllocatedIps []AllocatedIp `json:"allocatedIps"`
 }
 
 type Pod struct {
@@ -36,16 +107,27 @@ type Pod struct {
 	NameSpace   string   `json:"nameSpace"`
 	PodEths     []PodEth `json:"podEths"`
 	ContainerId string   `json:"containerId"`
+	Node        string   `json:"node"`
 }
 
 type PodEth struct {
-	NetworkCrd string    `json:"network_crd"`
+	NetworkCrd string    `json:"network"`
 	SubnetName string    `json:"subnetName"`
 	Mac        string    `json:"mac"`
-	FixedIps   []FixedIp `json:"fixed_ips"`
+	FixedIps   []FixedIp `json:"fixedIps"`
+	IfName     string    `json:"ifName"`
+	HostVeth   string    `json:"hostVeth"`
 }
 type FixedIp struct {
-	SubnetId  string `json:"subnet_id"`
+	SubnetId  string `json:"subnetId"`
 	Ipaddress string `json:"ipaddress"`
-	GatewayIP string `json:"gateway_ip"`
+	GatewayIP string `json:"gatewayIp"`
+}
+
+// Quota caps how many addresses of one network a namespace or a tenant may hold,
+// a missing or zero entry means unlimited.
+type Quota struct {
+	Network    string         `json:"network"`
+	Namespaces map[string]int `json:"namespaces"`
+	Tenants    map[string]int `json:"tenants"`
 }
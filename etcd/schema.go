@@ -0,0 +1,265 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// SchemaVersionLegacy records are bare json, some fields in snake_case
+	SchemaVersionLegacy = 1
+	// SchemaVersionEnvelope records are wrapped in an Envelope
+	SchemaVersionEnvelope = 2
+	// SchemaVersion is the newest layout this binary reads and writes
+	SchemaVersion = SchemaVersionEnvelope
+)
+
+// Schema is kept under SchemaKey, a store without it is at SchemaVersionLegacy.
+type Schema struct {
+	Version int `json:"version"`
+}
+
+// Envelope wraps every record from SchemaVersionEnvelope on, Kind is the name
+// of the model in Spec. Legacy records carry their cluster id next to their
+// own fields, where it decodes into ClusterID as well.
+type Envelope struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Kind          string          `json:"kind"`
+	ClusterID     string          `json:"clusterId,omitempty"`
+	Spec          json.RawMessage `json:"spec"`
+}
+
+// legacyFields maps the field names of SchemaVersionLegacy to the current
+// ones, per kind of record.
+var legacyFields = map[string]map[string]string{
+	"Pod": {
+		"network_crd": "network",
+		"fixed_ips":   "fixedIps",
+		"subnet_id":   "subnetId",
+		"gateway_ip":  "gatewayIp",
+	},
+}
+
+// writeVersion is the layout Encode writes. It follows the schema of the
+// store, so binaries that only know older layouts keep reading what newer
+// ones write until the store is migrated.
+var writeVersion int32 = SchemaVersionLegacy
+
+func UseSchemaVersion(version int) error {
+	if version < SchemaVersionLegacy || version > SchemaVersion {
+		return fmt.Errorf("schema version %d is not supported, this tinycni knows %d to %d", version, SchemaVersionLegacy, SchemaVersion)
+	}
+	atomic.StoreInt32(&writeVersion, int32(version))
+	return nil
+}
+
+func WriteSchemaVersion() int {
+	return int(atomic.LoadInt32(&writeVersion))
+}
+
+func kindOf(obj interface{}) string {
+	t := reflect.TypeOf(obj)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// Encode turns a record into the value stored for it.
+func Encode(obj interface{}) (string, error) {
+	return EncodeVersion(obj, WriteSchemaVersion())
+}
+
+func EncodeVersion(obj interface{}, version int) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	if version < SchemaVersionEnvelope {
+		data, err = renameFields(data, invert(legacyFields[kindOf(obj)]))
+		if err != nil {
+			return "", err
+		}
+		data, err = stampLegacy(data, ClusterID())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	data, err = json.Marshal(Envelope{SchemaVersion: version, Kind: kindOf(obj), ClusterID: ClusterID(), Spec: data})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Decode reads a record of any layout up to SchemaVersion into obj, it
+// refuses records stamped by another cluster.
+func Decode(value string, obj interface{}) error {
+	envelope, err := unwrap(value, kindOf(obj))
+	if err != nil {
+		return err
+	}
+	if envelope.Kind != "" && envelope.Kind != kindOf(obj) {
+		return fmt.Errorf("record is a %s, not a %s", envelope.Kind, kindOf(obj))
+	}
+	if id := ClusterID(); id != "" && envelope.ClusterID != "" && envelope.ClusterID != id {
+		return fmt.Errorf("record belongs to cluster %s, not %s", envelope.ClusterID, id)
+	}
+	return json.Unmarshal(envelope.Spec, obj)
+}
+
+// unwrap returns value as an envelope with the spec in the current field
+// names, legacy records have no kind of their own and are read as legacyKind.
+func unwrap(value, legacyKind string) (*Envelope, error) {
+	envelope := &Envelope{}
+	if err := json.Unmarshal([]byte(value), envelope); err != nil {
+		return nil, err
+	}
+	if envelope.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("record of schema version %d is newer than this tinycni, which knows up to %d", envelope.SchemaVersion, SchemaVersion)
+	}
+	if envelope.SchemaVersion >= SchemaVersionEnvelope {
+		return envelope, nil
+	}
+	spec, err := renameFields([]byte(value), legacyFields[legacyKind])
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{SchemaVersion: SchemaVersionLegacy, ClusterID: envelope.ClusterID, Spec: spec}, nil
+}
+
+// Restamp puts clusterID on the record under key, keys holding no record are
+// returned as they are.
+func Restamp(key, value, clusterID string) (string, error) {
+	kind := RecordKind(key)
+	if kind == "" {
+		return value, nil
+	}
+	envelope, err := unwrap(value, kind)
+	if err != nil {
+		return value, fmt.Errorf("failed to decode %s: %v", key, err)
+	}
+	if envelope.SchemaVersion < SchemaVersionEnvelope {
+		data, err := stampLegacy([]byte(value), clusterID)
+		return string(data), err
+	}
+	envelope.ClusterID = clusterID
+	data, err := json.Marshal(envelope)
+	return string(data), err
+}
+
+// stampLegacy sets the clusterId field of a legacy record, older binaries
+// ignore it.
+func stampLegacy(data []byte, clusterID string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if clusterID == "" {
+		if _, ok := doc["clusterId"]; !ok {
+			return data, nil
+		}
+		delete(doc, "clusterId")
+	} else {
+		doc["clusterId"] = clusterID
+	}
+	return json.Marshal(doc)
+}
+
+// RecordKind names the model stored under key, keys holding anything but a
+// record, like the container index and the usage counters, have none.
+func RecordKind(key string) string {
+	kinds := []struct {
+		prefix string
+		kind   string
+	}{
+		{NodesKey(), kindOf(Node{})},
+		{NetworksKey(), kindOf(NetworkCrd{})},
+		{PodsKey(), kindOf(Pod{})},
+		{BlocksKey(), kindOf(Block{})},
+		{IpamsKey(), kindOf(AllocatedIp{})},
+		{QuotasKey(), kindOf(Quota{})},
+	}
+	if key == ClusterConfigKey() {
+		return kindOf(ClusterConfig{})
+	}
+	for _, k := range kinds {
+		if strings.HasPrefix(key, k.prefix) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// UpgradeRecordV1 rewrites a legacy record into an envelope, it reports false
+// for keys that hold no record or are already enveloped.
+func UpgradeRecordV1(key, value string) (string, bool, error) {
+	kind := RecordKind(key)
+	if kind == "" {
+		return value, false, nil
+	}
+	envelope, err := unwrap(value, kind)
+	if err != nil {
+		return value, false, fmt.Errorf("failed to decode %s: %v", key, err)
+	}
+	if envelope.SchemaVersion >= SchemaVersionEnvelope {
+		return value, false, nil
+	}
+	spec, err := stampLegacy(envelope.Spec, "")
+	if err != nil {
+		return value, false, err
+	}
+	data, err := json.Marshal(Envelope{SchemaVersion: SchemaVersionEnvelope, Kind: kind, ClusterID: envelope.ClusterID, Spec: spec})
+	if err != nil {
+		return value, false, err
+	}
+	return string(data), true, nil
+}
+
+func invert(m map[string]string) map[string]string {
+	inverted := make(map[string]string, len(m))
+	for k, v := range m {
+		inverted[v] = k
+	}
+	return inverted
+}
+
+// renameFields renames the object fields found in names at any depth.
+func renameFields(data []byte, names map[string]string) ([]byte, error) {
+	if len(names) == 0 {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rename(doc, names))
+}
+
+func rename(doc interface{}, names map[string]string) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if name, ok := names[key]; ok {
+				key = name
+			}
+			renamed[key] = rename(value, names)
+		}
+		return renamed
+	case []interface{}:
+		for i := range v {
+			v[i] = rename(v[i], names)
+		}
+	}
+	return doc
+}
@@ -0,0 +1,68 @@
+package etcd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Scope separates tinycni clusters sharing one etcd: every key is built under
+// Prefix and every record is stamped with ClusterID.
+type Scope struct {
+	Prefix    string `json:"prefix" envconfig:"TINYCNI_PREFIX"`
+	ClusterID string `json:"clusterId" envconfig:"TINYCNI_CLUSTER_ID"`
+}
+
+// Cluster is kept under ClusterKey by the first tinycni of a cluster, the
+// others refuse to run when their cluster id differs.
+type Cluster struct {
+	ClusterID string `json:"clusterId"`
+	CreatedAt string `json:"createdAt"`
+}
+
+var (
+	scopeLock sync.RWMutex
+	scope     = Scope{Prefix: TinyCniPrefix}
+)
+
+// LoadScope merges the tinycni config file, the TINYCNI_PREFIX and
+// TINYCNI_CLUSTER_ID environment and override, TinyCniPrefix is the prefix
+// when none of them sets one.
+func LoadScope(override Scope) (Scope, error) {
+	loaded := Scope{Prefix: TinyCniPrefix}
+	file, err := readConfigFile()
+	if err != nil {
+		return loaded, err
+	}
+	if file != nil {
+		mergeStrings(&loaded, &file.Scope)
+	}
+	env := Scope{}
+	loadEnv(&env)
+	mergeStrings(&loaded, &env)
+	mergeStrings(&loaded, &override)
+	if !strings.HasPrefix(loaded.Prefix, "/") || !strings.HasSuffix(loaded.Prefix, "/") || loaded.Prefix == "/" {
+		return loaded, NewConfigError(fmt.Sprintf("prefix %q must start and end with / and not be the root", loaded.Prefix), nil)
+	}
+	return loaded, nil
+}
+
+// UseScope makes the key builders and Encode of this process use s, it must
+// run before the first key is built.
+func UseScope(s Scope) {
+	scopeLock.Lock()
+	defer scopeLock.Unlock()
+	scope = s
+}
+
+func Prefix() string {
+	scopeLock.RLock()
+	defer scopeLock.RUnlock()
+	return scope.Prefix
+}
+
+func ClusterID() string {
+	scopeLock.RLock()
+	defer scopeLock.RUnlock()
+	return scope.ClusterID
+}
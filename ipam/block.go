@@ -0,0 +1,228 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"math/big"
+	"net"
+)
+
+var errNodeAlive = errors.New("node is registered again")
+
+func ListBlocks(client datastore.Datastore, prefix string) ([]etcd.Block, error) {
+	values, err := client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []etcd.Block
+	for _, value := range values {
+		var block etcd.Block
+		if err := etcd.Decode(value, &block); err != nil {
+			klog.Errorf("failed to decode block %s, err is %v", value, err)
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// ListNodeBlocks returns the cidrs of every block claimed by node.
+func ListNodeBlocks(client datastore.Datastore, node string) ([]string, error) {
+	blocks, err := ListBlocks(client, etcd.BlocksKey())
+	if err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, block := range blocks {
+		if block.Node == node {
+			cidrs = append(cidrs, block.CIDR)
+		}
+	}
+	return cidrs, nil
+}
+
+// nodeBlockHolds tells if addr lies in a block node holds in subnet.
+func nodeBlockHolds(client datastore.Datastore, network, subnet, node string, addr net.IP) (bool, error) {
+	blocks, err := ListBlocks(client, etcd.SubnetBlocksKey(network, subnet))
+	if err != nil {
+		return false, err
+	}
+	for _, block := range blocks {
+		if block.Node != node {
+			continue
+		}
+		if _, blockNet, err := net.ParseCIDR(block.CIDR); err == nil && blockNet.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func nextBlock(blockIp net.IP, blockSize, bits int) net.IP {
+	n := new(big.Int).SetBytes(blockIp)
+	n.Add(n, new(big.Int).Lsh(big.NewInt(1), uint(bits-blockSize)))
+	buf := n.Bytes()
+	next := make(net.IP, len(blockIp))
+	if len(buf) > len(next) {
+		// wrapped around the address space
+		return nil
+	}
+	copy(next[len(next)-len(buf):], buf)
+	return next
+}
+
+// claimBlock takes the first block of subnet no node claimed yet.
+func claimBlock(client datastore.Datastore, network string, subnet etcd.Subnet, ipNet *net.IPNet, node string, claimed map[string]bool) (*net.IPNet, error) {
+	ones, bits := ipNet.Mask.Size()
+	if subnet.BlockSize < ones || subnet.BlockSize > bits {
+		return nil, fmt.Errorf("block size %d does not fit subnet %s (%s)", subnet.BlockSize, subnet.Name, subnet.CIDR)
+	}
+	blockIp := ipNet.IP
+	if v4 := blockIp.To4(); v4 != nil {
+		blockIp = v4
+	}
+	for ; blockIp != nil && ipNet.Contains(blockIp); blockIp = nextBlock(blockIp, subnet.BlockSize, bits) {
+		blockNet := &net.IPNet{IP: blockIp, Mask: net.CIDRMask(subnet.BlockSize, bits)}
+		if claimed[blockNet.String()] {
+			continue
+		}
+		block := etcd.Block{Network: network, Subnet: subnet.Name, CIDR: blockNet.String(), Node: node}
+		value, err := etcd.Encode(block)
+		if err != nil {
+			return nil, err
+		}
+		key := etcd.BlockKey(network, subnet.Name, block.CIDR)
+		ok := false
+		err = client.Update(func(tx datastore.Txn) error {
+			ok = tx.Get(key) == ""
+			if ok {
+				tx.Put(key, string(value))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		claimed[block.CIDR] = true
+		if ok {
+			klog.Infof("node %s claimed block %s of subnet %s in network %s", node, block.CIDR, subnet.Name, network)
+			return blockNet, nil
+		}
+	}
+	return nil, nil
+}
+
+// walkNodeBlocks walks the blocks node already holds in subnet, then, with
+// claim, claims new ones until walk is done or the subnet has no unclaimed
+// block left.
+func walkNodeBlocks(client datastore.Datastore, network string, subnet etcd.Subnet, ipNet *net.IPNet, node string, claim bool, walk func(rangeNet *net.IPNet) (bool, error)) (bool, error) {
+	blocks, err := ListBlocks(client, etcd.SubnetBlocksKey(network, subnet.Name))
+	if err != nil {
+		return false, err
+	}
+	claimed := make(map[string]bool, len(blocks))
+	held := 0
+	for _, block := range blocks {
+		claimed[block.CIDR] = true
+		if block.Node != node {
+			continue
+		}
+		_, blockNet, err := net.ParseCIDR(block.CIDR)
+		if err != nil {
+			continue
+		}
+		held++
+		if done, err := walk(blockNet); err != nil || done {
+			return done, err
+		}
+	}
+	if !claim {
+		if held == 0 {
+			klog.Warningf("node %s holds no podCIDR of subnet %s in network %s, is tinycnid running and the node cidr assigned", node, subnet.Name, network)
+		}
+		return false, nil
+	}
+	for {
+		blockNet, err := claimBlock(client, network, subnet, ipNet, node, claimed)
+		if err != nil || blockNet == nil {
+			return false, err
+		}
+		if done, err := walk(blockNet); err != nil || done {
+			return done, err
+		}
+	}
+}
+
+// ReclaimNode frees everything a node that stopped sending heartbeats held:
+// its addresses, its pod records and its blocks. Every step first checks the
+// node did not register again in the meantime.
+func ReclaimNode(client datastore.Datastore, node string) error {
+	nodeKey := etcd.NodeKey(node)
+	records, err := ListAllocatedIps(client, "")
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Node != node {
+			continue
+		}
+		key := etcd.IpKey(record.Network, record.Subnet, record.Ip)
+		err := client.Update(func(tx datastore.Txn) error {
+			if tx.Get(nodeKey) != "" {
+				return errNodeAlive
+			}
+			var current etcd.AllocatedIp
+			value := tx.Get(key)
+			if value == "" || etcd.Decode(value, &current) != nil || current.Node != node {
+				return nil
+			}
+			tx.Del(key)
+			dropAllocationIndex(tx, &current, key)
+			if current.State == "" || current.State == etcd.IpStateAllocated {
+				chargeUsage(tx, &current, -1)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reclaim %s of node %s: %v", record.Ip, node, err)
+		}
+	}
+
+	pods, err := datastore.ListPods(client)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Node != node {
+			continue
+		}
+		if err := datastore.DeletePodByContainerId(client, pod.ContainerId); err != nil {
+			return err
+		}
+	}
+
+	blocks, err := ListBlocks(client, etcd.BlocksKey())
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if block.Node != node {
+			continue
+		}
+		err := client.Update(func(tx datastore.Txn) error {
+			if tx.Get(nodeKey) != "" {
+				return errNodeAlive
+			}
+			tx.Del(etcd.BlockKey(block.Network, block.Subnet, block.CIDR))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reclaim block %s of node %s: %v", block.CIDR, node, err)
+		}
+	}
+	klog.Infof("reclaimed the addresses and blocks of node %s", node)
+	return nil
+}
@@ -0,0 +1,89 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"fmt"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// ListAllocatedIps returns every address record of network, or of all
+// networks when network is empty.
+func ListAllocatedIps(client datastore.Datastore, network string) ([]etcd.AllocatedIp, error) {
+	prefix := etcd.IpamsKey()
+	if network != "" {
+		prefix = etcd.IpamKey(network)
+	}
+	return getAllocatedIps(client, prefix)
+}
+
+// MarkIpConflict takes the address of containerId away from it and parks it
+// as conflict, so that the next allocation picks another one.
+func MarkIpConflict(client datastore.Datastore, network, containerId, conflictMac string) error {
+	record, err := GetAllocatedIp(client, network, containerId)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("container %s holds no address in network %s", containerId, network)
+	}
+	key := etcd.IpKey(record.Network, record.Subnet, record.Ip)
+	err = client.Update(func(tx datastore.Txn) error {
+		var current etcd.AllocatedIp
+		value := tx.Get(key)
+		if value == "" || etcd.Decode(value, &current) != nil || current.ContainerId != containerId {
+			return nil
+		}
+		if current.State != etcd.IpStateReserved {
+			chargeUsage(tx, &current, -1)
+		}
+		dropAllocationIndex(tx, &current, key)
+		conflict := etcd.AllocatedIp{
+			Ip:          current.Ip,
+			Network:     current.Network,
+			Subnet:      current.Subnet,
+			Node:        current.Node,
+			State:       etcd.IpStateConflict,
+			ConflictMac: conflictMac,
+			ConflictAt:  time.Now().UTC().Format(time.RFC3339),
+		}
+		data, err := etcd.Encode(conflict)
+		if err != nil {
+			return err
+		}
+		tx.Put(key, string(data))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark %s of network %s as conflict: %v", record.Ip, record.Network, err)
+	}
+	klog.Warningf("address %s of network %s is in use by %s, marked as conflict", record.Ip, record.Network, conflictMac)
+	return nil
+}
+
+// ClearConflict makes a conflict address allocatable again.
+func ClearConflict(client datastore.Datastore, network, ip string) error {
+	records, err := ListAllocatedIps(client, network)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Ip != ip {
+			continue
+		}
+		if record.State != etcd.IpStateConflict {
+			return fmt.Errorf("address %s of network %s is %s, not conflict", ip, network, record.State)
+		}
+		key := etcd.IpKey(record.Network, record.Subnet, record.Ip)
+		return client.Update(func(tx datastore.Txn) error {
+			var current etcd.AllocatedIp
+			value := tx.Get(key)
+			if value != "" && etcd.Decode(value, &current) == nil && current.State == etcd.IpStateConflict {
+				tx.Del(key)
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("address %s not found in network %s", ip, network)
+}
@@ -0,0 +1,102 @@
+package ipam
+
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// plugin specific CNI error codes, the spec reserves 0-99 for itself
+const (
+	ErrQuotaExceeded uint = 100 + iota
+	ErrNoFreeAddress
+	ErrNetworkNotFound
+	ErrAddressConflict
+	ErrNetworkForbidden
+	ErrAddressUnavailable
+	ErrInvalidNetwork
+	ErrNetworkExists
+	ErrNetworkInUse
+	ErrSubnetNotFound
+	ErrSubnetExists
+)
+
+func NewQuotaExceededError(kind, name, network string, used, limit int) *types.Error {
+	return types.NewError(ErrQuotaExceeded,
+		fmt.Sprintf("ip quota exceeded for %s %s on network %s", kind, name, network),
+		fmt.Sprintf("%d of %d addresses in use", used, limit))
+}
+
+func NewNoFreeAddressError(network string) *types.Error {
+	return types.NewError(ErrNoFreeAddress, fmt.Sprintf("no free address left in network %s", network), "")
+}
+
+func NewNetworkNotFoundError(network string, err error) *types.Error {
+	details := ""
+	if err != nil {
+		details = err.Error()
+	}
+	return types.NewError(ErrNetworkNotFound, fmt.Sprintf("network %s does not exist", network), details)
+}
+
+func NewAddressConflictError(network, ip string, attempts int) *types.Error {
+	return types.NewError(ErrAddressConflict,
+		fmt.Sprintf("every address tried in network %s is already in use on the wire", network),
+		fmt.Sprintf("gave up after %d attempts, last tried %s", attempts, ip))
+}
+
+func NewNetworkForbiddenError(network, reason string) *types.Error {
+	return types.NewError(ErrNetworkForbidden, fmt.Sprintf("pod may not join network %s", network), reason)
+}
+
+func NewAddressUnavailableError(network, ip, reason string) *types.Error {
+	return types.NewError(ErrAddressUnavailable, fmt.Sprintf("address %s of network %s cannot be allocated", ip, network), reason)
+}
+
+func NewInvalidNetworkError(network, reason string) *types.Error {
+	return types.NewError(ErrInvalidNetwork, fmt.Sprintf("invalid network %s", network), reason)
+}
+
+func NewNetworkExistsError(network string) *types.Error {
+	return types.NewError(ErrNetworkExists, fmt.Sprintf("network %s already exists", network), "")
+}
+
+func NewNetworkInUseError(network, reason string) *types.Error {
+	return types.NewError(ErrNetworkInUse, fmt.Sprintf("network %s is in use", network), reason)
+}
+
+func NewSubnetNotFoundError(network, subnet string) *types.Error {
+	return types.NewError(ErrSubnetNotFound, fmt.Sprintf("subnet %s not found in network %s", subnet, network), "")
+}
+
+func NewSubnetExistsError(network, subnet string) *types.Error {
+	return types.NewError(ErrSubnetExists, fmt.Sprintf("subnet %s already exists in network %s", subnet, network), "")
+}
+
+func hasCode(err error, code uint) bool {
+	cniErr, ok := err.(*types.Error)
+	return ok && cniErr.Code == code
+}
+
+func IsNetworkNotFound(err error) bool {
+	return hasCode(err, ErrNetworkNotFound)
+}
+
+func IsSubnetNotFound(err error) bool {
+	return hasCode(err, ErrSubnetNotFound)
+}
+
+func IsSubnetExists(err error) bool {
+	return hasCode(err, ErrSubnetExists)
+}
+
+func IsInvalidNetwork(err error) bool {
+	return hasCode(err, ErrInvalidNetwork)
+}
+
+func IsNetworkExists(err error) bool {
+	return hasCode(err, ErrNetworkExists)
+}
+
+func IsNetworkInUse(err error) bool {
+	return hasCode(err, ErrNetworkInUse)
+}
@@ -1,11 +1,15 @@
 package ipam
 
 import (
-	"cni/client"
+	"cni/datastore"
 	"cni/etcd"
-	"cni/helper"
+	"cni/utils/k8s"
+	"errors"
+	"fmt"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"k8s.io/klog/v2"
+	"net"
+	"sort"
 	"sync"
 )
 
@@ -13,19 +17,19 @@ const prefix = "cni/ipam"
 
 type Get struct {
 	etcdClient  *etcd.EtcdClient
-	k8sClient   *client.LightK8sClient
+	k8sClient   *k8s.Client
 	nodeIpCache map[string]string
 	cidrCache   map[string]string
 }
 
 type Release struct {
 	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	k8sClient  *k8s.Client
 }
 
 type Set struct {
 	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	k8sClient  *k8s.Client
 }
 type operators struct {
 	Get     *Get
@@ -53,7 +57,7 @@ type IpamService struct {
 	PodMaskIP          string
 	CurrentHostNetwork string
 	EtcdClient         *etcd.EtcdClient
-	K8sClient          *client.LightK8sClient
+	K8sClient          *k8s.Client
 	*operator
 }
 
@@ -79,23 +83,453 @@ func lock() {
 		_isLocking = true
 	}
 }
-func GetLightK8sClient() *client.LightK8sClient {
-	paths, err := helper.GetHostAuthenticationInfoPath()
+
+type AllocateArgs struct {
+	Network     string
+	NameSpace   string
+	PodName     string
+	ContainerId string
+	Tenant      string
+	Node        string
+	// Mode is the data plane of the plugin, checked against the network
+	Mode string
+	// IP asks for this address instead of the next free one
+	IP string
+}
+
+// admit checks the mode and the isolation of network allow the pod of args.
+func admit(network *etcd.NetworkCrd, args *AllocateArgs) error {
+	if network.Mode != "" && args.Mode != "" && network.Mode != args.Mode {
+		return NewNetworkForbiddenError(network.Name, fmt.Sprintf("the network needs mode %s, the plugin runs %s", network.Mode, args.Mode))
+	}
+	isolation := network.Isolation
+	if isolation == nil || (len(isolation.Namespaces) == 0 && len(isolation.Tenants) == 0) {
+		return nil
+	}
+	for _, namespace := range isolation.Namespaces {
+		if namespace == args.NameSpace {
+			return nil
+		}
+	}
+	for _, tenant := range isolation.Tenants {
+		if tenant != "" && tenant == args.Tenant {
+			return nil
+		}
+	}
+	return NewNetworkForbiddenError(network.Name, fmt.Sprintf("namespace %s and tenant %q are not admitted by its isolation", args.NameSpace, args.Tenant))
+}
+
+func GetNetwork(client datastore.Datastore, name string) (*etcd.NetworkCrd, error) {
+	value, err := client.Get(etcd.NetworkKey(name))
 	if err != nil {
-		klog.Errorf("failed to GetHostAuthenticationInfoPath,err is %v", err)
+		return nil, err
+	}
+	if value == "" {
+		return nil, NewNetworkNotFoundError(name, nil)
 	}
-	client.Init(paths.CaPath, paths.CertPath, paths.KeyPath)
-	k8sClient, err := client.GetLightK8sClient()
+	network := &etcd.NetworkCrd{}
+	if err := etcd.Decode(value, network); err != nil {
+		return nil, NewNetworkNotFoundError(name, err)
+	}
+	return network, nil
+}
+
+func getAllocatedIps(client datastore.Datastore, prefix string) ([]etcd.AllocatedIp, error) {
+	values, err := client.List(prefix)
 	if err != nil {
+		return nil, err
+	}
+	var records []etcd.AllocatedIp
+	for _, value := range values {
+		var record etcd.AllocatedIp
+		if err := etcd.Decode(value, &record); err != nil {
+			klog.Errorf("failed to decode allocated ip %s, err is %v", value, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// allocationIndex maps the index keys of containerId to the keys of the
+// address records they point at, network may be empty for every network.
+func allocationIndex(client datastore.Datastore, network, containerId string) (map[string]string, error) {
+	if network != "" {
+		indexKey := etcd.AllocationKey(containerId, network)
+		key, err := client.Get(indexKey)
+		if err != nil || key == "" {
+			return nil, err
+		}
+		return map[string]string{indexKey: key}, nil
+	}
+	return client.List(etcd.AllocationsKey(containerId))
+}
+
+// putAllocationIndex points the index of the container holding record at key.
+func putAllocationIndex(tx datastore.Txn, record *etcd.AllocatedIp, key string) {
+	if record.ContainerId != "" {
+		tx.Put(etcd.AllocationKey(record.ContainerId, record.Network), key)
+	}
+}
+
+// dropAllocationIndex removes the index of the container holding record, an
+// index already pointing at another address is kept.
+func dropAllocationIndex(tx datastore.Txn, record *etcd.AllocatedIp, key string) {
+	if record.ContainerId == "" {
+		return
+	}
+	indexKey := etcd.AllocationKey(record.ContainerId, record.Network)
+	if tx.Get(indexKey) == key {
+		tx.Del(indexKey)
+	}
+}
+
+// GetAllocatedIp finds the address held by containerId through the
+// allocation index, network may be empty to search every network.
+func GetAllocatedIp(client datastore.Datastore, network, containerId string) (*etcd.AllocatedIp, error) {
+	index, err := allocationIndex(client, network, containerId)
+	if err != nil {
+		return nil, err
+	}
+	var indexKeys []string
+	for indexKey := range index {
+		indexKeys = append(indexKeys, indexKey)
+	}
+	sort.Strings(indexKeys)
+	for _, indexKey := range indexKeys {
+		value, err := client.Get(index[indexKey])
+		if err != nil {
+			return nil, err
+		}
+		var record etcd.AllocatedIp
+		// the record may have been released or marked as conflict since
+		if value != "" && etcd.Decode(value, &record) == nil && record.ContainerId == containerId {
+			return &record, nil
+		}
+	}
+	return nil, nil
+}
+
+func isReserved(candidate net.IP, ipNet *net.IPNet, gateway net.IP) bool {
+	if candidate.Equal(ipNet.IP) || candidate.Equal(gateway) {
+		return true
+	}
+	// the broadcast address of ipv4 subnets
+	if candidate.To4() != nil && !ipNet.Contains(ip.NextIP(candidate)) {
+		return true
+	}
+	return false
+}
+
+// tryAllocate writes record if its address is still free, for allocations the
+// namespace and tenant quotas are checked in the same transaction as the write.
+// Warm pool reservations belong to no pod and are not charged.
+func tryAllocate(client datastore.Datastore, record *etcd.AllocatedIp) (bool, error) {
+	var taken bool
+	key := etcd.IpKey(record.Network, record.Subnet, record.Ip)
+	value, err := etcd.Encode(record)
+	if err != nil {
+		return false, err
+	}
+	err = client.Update(func(tx datastore.Txn) error {
+		taken = false
+		if tx.Get(key) != "" || !subnetStillContains(tx, record) {
+			return nil
+		}
+		if record.State == etcd.IpStateAllocated {
+			if err := checkQuota(tx, record.Network, record.NameSpace, record.Tenant); err != nil {
+				return err
+			}
+			chargeUsage(tx, record, 1)
+		}
+		tx.Put(key, string(value))
+		putAllocationIndex(tx, record, key)
+		taken = true
 		return nil
+	})
+	return taken, err
+}
+
+// walkFreeIps calls fn with every address of network that is not allocated
+// yet, until fn returns true. Subnets split into blocks only hand out the
+// addresses of blocks claimed by node, claiming a new block when they are full,
+// podCIDR subnets only those of the podCIDRs of node.
+func walkFreeIps(client datastore.Datastore, network *etcd.NetworkCrd, node string, fn func(subnet etcd.Subnet, ipNet *net.IPNet, candidate net.IP) (bool, error)) error {
+	for _, subnet := range network.Subnets {
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			klog.Errorf("skip subnet %s of network %s with invalid cidr %s", subnet.Name, network.Name, subnet.CIDR)
+			continue
+		}
+		gateway := net.ParseIP(subnet.Gateway)
+		reserved, err := reservedRanges(subnet, ipNet)
+		if err != nil {
+			klog.Errorf("ignore the reserved ranges of subnet %s in network %s, err is %v", subnet.Name, network.Name, err)
+		}
+		records, err := getAllocatedIps(client, etcd.IpamSubnetKey(network.Name, subnet.Name))
+		if err != nil {
+			return err
+		}
+		used := make(map[string]bool, len(records))
+		for _, record := range records {
+			used[record.Ip] = true
+		}
+		walk := func(rangeNet *net.IPNet) (bool, error) {
+			for candidate := rangeNet.IP; rangeNet.Contains(candidate); candidate = ip.NextIP(candidate) {
+				if used[candidate.String()] || isReserved(candidate, ipNet, gateway) || inRanges(reserved, candidate) {
+					continue
+				}
+				if done, err := fn(subnet, ipNet, candidate); err != nil || done {
+					return done, err
+				}
+			}
+			return false, nil
+		}
+		var done bool
+		if subnet.BlockSource == etcd.BlockSourcePodCIDR && node != "" {
+			done, err = walkNodeBlocks(client, network.Name, subnet, ipNet, node, false, walk)
+		} else if subnet.BlockSize > 0 && node != "" {
+			done, err = walkNodeBlocks(client, network.Name, subnet, ipNet, node, true, walk)
+		} else {
+			done, err = walk(ipNet)
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+func subnetGateway(network *etcd.NetworkCrd, subnetName string) ip.IP {
+	gw := ip.IP{}
+	for _, subnet := range network.Subnets {
+		if subnet.Name == subnetName {
+			gw.IP = net.ParseIP(subnet.Gateway)
+		}
+	}
+	return gw
+}
+
+// Allocation is an address handed to a pod together with the subnet it was
+// taken from.
+type Allocation struct {
+	IP      ip.IP
+	Gateway ip.IP
+	Subnet  string
+	// MTU of the network, 0 when it leaves it to the plugin
+	MTU int
+}
+
+func AllocationIpFromNetwork(client datastore.Datastore, args *AllocateArgs) (*Allocation, error) {
+	if client == nil {
+		return nil, errors.New("ipam need etcd client")
+	}
+	network, err := GetNetwork(client, args.Network)
+	if err != nil {
+		return nil, err
+	}
+	if err := admit(network, args); err != nil {
+		return nil, err
+	}
+	// ADD is retried by the runtime, hand back what the container already holds
+	existing, err := GetAllocatedIp(client, args.Network, args.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		for _, subnet := range network.Subnets {
+			if _, ipNet, err := net.ParseCIDR(subnet.CIDR); err == nil && subnet.Name == existing.Subnet {
+				allocation := &Allocation{Gateway: subnetGateway(network, subnet.Name), Subnet: subnet.Name, MTU: network.MTU}
+				allocation.IP.IPNet = net.IPNet{IP: net.ParseIP(existing.Ip), Mask: ipNet.Mask}
+				return allocation, nil
+			}
+		}
+	}
+	if args.IP != "" {
+		return allocateRequested(client, network, args)
+	}
+	var allocation *Allocation
+	err = walkFreeIps(client, network, args.Node, func(subnet etcd.Subnet, ipNet *net.IPNet, candidate net.IP) (bool, error) {
+		taken, err := tryAllocate(client, &etcd.AllocatedIp{
+			Ip:          candidate.String(),
+			Network:     args.Network,
+			Subnet:      subnet.Name,
+			NameSpace:   args.NameSpace,
+			PodName:     args.PodName,
+			ContainerId: args.ContainerId,
+			Tenant:      args.Tenant,
+			Node:        args.Node,
+			State:       etcd.IpStateAllocated,
+		})
+		if err != nil || !taken {
+			return false, err
+		}
+		klog.Infof("allocated %s in subnet %s of network %s to pod %s/%s", candidate, subnet.Name, network.Name, args.NameSpace, args.PodName)
+		allocation = &Allocation{Gateway: subnetGateway(network, subnet.Name), Subnet: subnet.Name, MTU: network.MTU}
+		allocation.IP.IPNet = net.IPNet{IP: candidate, Mask: ipNet.Mask}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if allocation == nil {
+		return nil, NewNoFreeAddressError(args.Network)
 	}
-	return k8sClient
+	return allocation, nil
 }
 
-func CreateNetworkCrd() {}
+// requestedSubnet finds the subnet of network the requested ip is a host
+// address of.
+func requestedSubnet(network *etcd.NetworkCrd, ip string) (etcd.Subnet, *net.IPNet, net.IP, error) {
+	requested := net.ParseIP(ip)
+	if requested == nil {
+		return etcd.Subnet{}, nil, nil, NewAddressUnavailableError(network.Name, ip, "it is no ip address")
+	}
+	requested = normalizeIp(requested)
+	for _, subnet := range network.Subnets {
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil || !ipNet.Contains(requested) {
+			continue
+		}
+		reserved, _ := reservedRanges(subnet, ipNet)
+		if isReserved(requested, ipNet, net.ParseIP(subnet.Gateway)) || inRanges(reserved, requested) {
+			return etcd.Subnet{}, nil, nil, NewAddressUnavailableError(network.Name, ip, fmt.Sprintf("it is reserved in subnet %s", subnet.Name))
+		}
+		return subnet, ipNet, requested, nil
+	}
+	return etcd.Subnet{}, nil, nil, NewAddressUnavailableError(network.Name, ip, "it lies in no subnet of the network")
+}
 
-func AllocationIpFromNetwork(network string) (ipaddr, gw ip.IP, err error) {
-	ipaddr = ip.IP{}
-	gw = ip.IP{}
-	return ipaddr, gw, nil
+// CheckRequestedIp tells without allocating whether ip can be asked for in
+// network: a free host address of one of its subnets. The blocks of the node
+// are not looked at, the node is not known before the pod is scheduled.
+func CheckRequestedIp(client datastore.Datastore, network *etcd.NetworkCrd, ip string) error {
+	subnet, _, requested, err := requestedSubnet(network, ip)
+	if err != nil {
+		return err
+	}
+	value, err := client.Get(etcd.IpKey(network.Name, subnet.Name, requested.String()))
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		return NewAddressUnavailableError(network.Name, ip, "it is already in use")
+	}
+	return nil
+}
+
+// allocateRequested takes the address asked for in args, it has to be a free
+// host address of a subnet and, in subnets split into blocks, lie in a block
+// of the node so that the other nodes route it here.
+func allocateRequested(client datastore.Datastore, network *etcd.NetworkCrd, args *AllocateArgs) (*Allocation, error) {
+	subnet, ipNet, requested, err := requestedSubnet(network, args.IP)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.BlockSize > 0 || subnet.BlockSource == etcd.BlockSourcePodCIDR {
+		inBlock, err := nodeBlockHolds(client, network.Name, subnet.Name, args.Node, requested)
+		if err != nil {
+			return nil, err
+		}
+		if !inBlock {
+			return nil, NewAddressUnavailableError(network.Name, args.IP, fmt.Sprintf("it lies in no block of node %s in subnet %s", args.Node, subnet.Name))
+		}
+	}
+	taken, err := tryAllocate(client, &etcd.AllocatedIp{
+		Ip:          requested.String(),
+		Network:     network.Name,
+		Subnet:      subnet.Name,
+		NameSpace:   args.NameSpace,
+		PodName:     args.PodName,
+		ContainerId: args.ContainerId,
+		Tenant:      args.Tenant,
+		Node:        args.Node,
+		State:       etcd.IpStateAllocated,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !taken {
+		return nil, NewAddressUnavailableError(network.Name, args.IP, "it is already in use")
+	}
+	klog.Infof("allocated the requested %s in subnet %s of network %s to pod %s/%s", requested, subnet.Name, network.Name, args.NameSpace, args.PodName)
+	allocation := &Allocation{Gateway: subnetGateway(network, subnet.Name), Subnet: subnet.Name, MTU: network.MTU}
+	allocation.IP.IPNet = net.IPNet{IP: requested, Mask: ipNet.Mask}
+	return allocation, nil
+}
+
+// ReleaseIpFromNetwork gives back every address containerId holds in network,
+// network may be empty when DEL cannot resolve it any more. Each record is
+// read again in the transaction deleting it, so an address marked as conflict
+// or handed to another container in between is left alone.
+func ReleaseIpFromNetwork(client datastore.Datastore, network, containerId string) error {
+	if client == nil {
+		return errors.New("ipam need etcd client")
+	}
+	index, err := allocationIndex(client, network, containerId)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool, len(index))
+	for _, key := range index {
+		keys[key] = true
+	}
+	if len(keys) == 0 {
+		// records written before the allocation index have none
+		prefix := etcd.IpamsKey()
+		if network != "" {
+			prefix = etcd.IpamKey(network)
+		}
+		records, err := getAllocatedIps(client, prefix)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.ContainerId == containerId {
+				keys[etcd.IpKey(record.Network, record.Subnet, record.Ip)] = true
+			}
+		}
+	}
+	released := 0
+	for key := range keys {
+		var record etcd.AllocatedIp
+		var done bool
+		err = client.Update(func(tx datastore.Txn) error {
+			done = false
+			value := tx.Get(key)
+			if value == "" || etcd.Decode(value, &record) != nil || record.ContainerId != containerId {
+				return nil
+			}
+			tx.Del(key)
+			dropAllocationIndex(tx, &record, key)
+			if record.State == "" || record.State == etcd.IpStateAllocated {
+				chargeUsage(tx, &record, -1)
+			}
+			done = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to release %s of container %s: %v", key, containerId, err)
+		}
+		if done {
+			released++
+			klog.Infof("released %s in network %s of container %s", record.Ip, record.Network, containerId)
+		}
+	}
+	// stale entries of addresses the container lost, e.g. to a conflict
+	for indexKey, key := range index {
+		err := client.Update(func(tx datastore.Txn) error {
+			if tx.Get(indexKey) == key {
+				tx.Del(indexKey)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to drop the allocation index of container %s: %v", containerId, err)
+		}
+	}
+	if released == 0 {
+		klog.Infof("no address held by container %s, nothing to release", containerId)
+	}
+	return nil
 }
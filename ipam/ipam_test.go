@@ -0,0 +1,230 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/etcd/etcdtest"
+	"net"
+	"testing"
+)
+
+const testNetwork = "net1"
+
+// newTestDatastore returns an etcd datastore holding testNetwork with the
+// subnet cidr.
+func newTestDatastore(t *testing.T, cidr string) datastore.Datastore {
+	t.Helper()
+	ds, _, err := etcdtest.NewDatastore()
+	if err != nil {
+		t.Fatalf("failed to start the etcd datastore: %v", err)
+	}
+	t.Cleanup(func() { _ = ds.Close() })
+	network := &etcd.NetworkCrd{
+		Name:    testNetwork,
+		Subnets: []etcd.Subnet{{Name: "subnet1", CIDR: cidr}},
+	}
+	if err := CreateNetworkCrd(ds, network); err != nil {
+		t.Fatalf("CreateNetworkCrd: %v", err)
+	}
+	return ds
+}
+
+func allocateArgs(containerId string) *AllocateArgs {
+	return &AllocateArgs{
+		Network:     testNetwork,
+		NameSpace:   "default",
+		PodName:     "pod-" + containerId,
+		ContainerId: containerId,
+		Node:        "node-1",
+	}
+}
+
+func namespaceUsage(t *testing.T, ds datastore.Datastore, namespace string) int {
+	t.Helper()
+	usage, err := GetUsage(ds, testNetwork)
+	if err != nil {
+		t.Fatalf("GetUsage: %v", err)
+	}
+	return usage.Namespaces[namespace]
+}
+
+func TestAllocateAndRelease(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	allocation, err := AllocationIpFromNetwork(ds, allocateArgs("c1"))
+	if err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+	if !subnet.Contains(allocation.IP.IP) || allocation.IP.IP.Equal(subnet.IP) || allocation.Subnet != "subnet1" {
+		t.Errorf("allocated %s of %s, want a host address of %s", allocation.IP.String(), allocation.Subnet, subnet)
+	}
+	record, err := GetAllocatedIp(ds, testNetwork, "c1")
+	if err != nil || record == nil || record.Ip != allocation.IP.IP.String() || record.State != etcd.IpStateAllocated {
+		t.Fatalf("GetAllocatedIp = %+v, %v", record, err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 1 {
+		t.Errorf("usage after allocate = %d, want 1", used)
+	}
+
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Fatalf("ReleaseIpFromNetwork: %v", err)
+	}
+	if record, err := GetAllocatedIp(ds, testNetwork, "c1"); err != nil || record != nil {
+		t.Errorf("GetAllocatedIp after release = %+v, %v", record, err)
+	}
+	if index, err := ds.Get(etcd.AllocationKey("c1", testNetwork)); err != nil || index != "" {
+		t.Errorf("allocation index after release = %q, %v", index, err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 0 {
+		t.Errorf("usage after release = %d, want 0", used)
+	}
+	// DEL is retried by the runtime too
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Errorf("second ReleaseIpFromNetwork: %v", err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 0 {
+		t.Errorf("usage after the second release = %d, want 0", used)
+	}
+}
+
+func TestRetriedAddGetsSameAddress(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	first, err := AllocationIpFromNetwork(ds, allocateArgs("c1"))
+	if err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	second, err := AllocationIpFromNetwork(ds, allocateArgs("c1"))
+	if err != nil {
+		t.Fatalf("retried AllocationIpFromNetwork: %v", err)
+	}
+	if !first.IP.IP.Equal(second.IP.IP) {
+		t.Errorf("retried ADD got %s, first got %s", second.IP.String(), first.IP.String())
+	}
+	records, err := ListAllocatedIps(ds, testNetwork)
+	if err != nil || len(records) != 1 {
+		t.Errorf("ListAllocatedIps = %v, %v, want one record", records, err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 1 {
+		t.Errorf("usage = %d, want 1", used)
+	}
+}
+
+func TestAllocateUntilExhausted(t *testing.T) {
+	// 10.10.0.1 and 10.10.0.2 are the host addresses of a /30
+	ds := newTestDatastore(t, "10.10.0.0/30")
+	seen := make(map[string]bool)
+	for _, containerId := range []string{"c1", "c2"} {
+		allocation, err := AllocationIpFromNetwork(ds, allocateArgs(containerId))
+		if err != nil {
+			t.Fatalf("AllocationIpFromNetwork(%s): %v", containerId, err)
+		}
+		if seen[allocation.IP.IP.String()] {
+			t.Errorf("%s handed out twice", allocation.IP.IP)
+		}
+		seen[allocation.IP.IP.String()] = true
+	}
+	if _, err := AllocationIpFromNetwork(ds, allocateArgs("c3")); !hasCode(err, ErrNoFreeAddress) {
+		t.Errorf("allocating from a full subnet = %v, want code %d", err, ErrNoFreeAddress)
+	}
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Fatalf("ReleaseIpFromNetwork: %v", err)
+	}
+	if _, err := AllocationIpFromNetwork(ds, allocateArgs("c3")); err != nil {
+		t.Errorf("allocating the released address: %v", err)
+	}
+}
+
+func TestAllocateRequestedIp(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	args := allocateArgs("c1")
+	args.IP = "10.10.0.7"
+	allocation, err := AllocationIpFromNetwork(ds, args)
+	if err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	if allocation.IP.IP.String() != "10.10.0.7" {
+		t.Errorf("allocated %s, want the requested 10.10.0.7", allocation.IP.IP)
+	}
+	args = allocateArgs("c2")
+	args.IP = "10.10.0.7"
+	if _, err := AllocationIpFromNetwork(ds, args); !hasCode(err, ErrAddressUnavailable) {
+		t.Errorf("requesting an address in use = %v, want code %d", err, ErrAddressUnavailable)
+	}
+	args.IP = "10.20.0.7"
+	if _, err := AllocationIpFromNetwork(ds, args); !hasCode(err, ErrAddressUnavailable) {
+		t.Errorf("requesting an address outside the subnets = %v, want code %d", err, ErrAddressUnavailable)
+	}
+}
+
+func TestAllocateUnknownNetwork(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	args := allocateArgs("c1")
+	args.Network = "missing"
+	if _, err := AllocationIpFromNetwork(ds, args); !IsNetworkNotFound(err) {
+		t.Errorf("allocating from an unknown network = %v, want code %d", err, ErrNetworkNotFound)
+	}
+}
+
+func TestReleaseLeavesConflictAlone(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	allocation, err := AllocationIpFromNetwork(ds, allocateArgs("c1"))
+	if err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	if err := MarkIpConflict(ds, testNetwork, "c1", "02:00:00:00:00:01"); err != nil {
+		t.Fatalf("MarkIpConflict: %v", err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 0 {
+		t.Errorf("usage after the conflict = %d, want 0", used)
+	}
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Fatalf("ReleaseIpFromNetwork: %v", err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 0 {
+		t.Errorf("usage after releasing a conflict = %d, want 0", used)
+	}
+	records, err := ListAllocatedIps(ds, testNetwork)
+	if err != nil || len(records) != 1 || records[0].Ip != allocation.IP.IP.String() || records[0].State != etcd.IpStateConflict {
+		t.Errorf("records after release = %+v, %v, want the conflict kept", records, err)
+	}
+}
+
+func TestReleaseLeavesReassignedAddressAlone(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	allocation, err := AllocationIpFromNetwork(ds, allocateArgs("c1"))
+	if err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	// the record moved on to another container, the index of c1 is stale
+	key := etcd.IpKey(testNetwork, allocation.Subnet, allocation.IP.IP.String())
+	err = ds.Update(func(tx datastore.Txn) error {
+		var record etcd.AllocatedIp
+		if err := etcd.Decode(tx.Get(key), &record); err != nil {
+			return err
+		}
+		record.ContainerId, record.PodName = "c2", "pod-c2"
+		value, err := etcd.Encode(record)
+		if err != nil {
+			return err
+		}
+		tx.Put(key, value)
+		putAllocationIndex(tx, &record, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Fatalf("ReleaseIpFromNetwork: %v", err)
+	}
+	record, err := GetAllocatedIp(ds, testNetwork, "c2")
+	if err != nil || record == nil || record.Ip != allocation.IP.IP.String() {
+		t.Errorf("GetAllocatedIp(c2) = %+v, %v, want the address kept", record, err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 1 {
+		t.Errorf("usage = %d, want 1", used)
+	}
+	if index, err := ds.Get(etcd.AllocationKey("c1", testNetwork)); err != nil || index != "" {
+		t.Errorf("stale index of c1 = %q, %v, want it dropped", index, err)
+	}
+}
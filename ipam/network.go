@@ -0,0 +1,555 @@
+package ipam
+
+import (
+	"cni/consts"
+	"cni/datastore"
+	"cni/etcd"
+	"fmt"
+	"k8s.io/klog/v2"
+	"net"
+	"sort"
+	"strings"
+)
+
+func GetClusterConfig(client datastore.Datastore) (etcd.ClusterConfig, error) {
+	var config etcd.ClusterConfig
+	value, err := client.Get(etcd.ClusterConfigKey())
+	if err != nil || value == "" {
+		return config, err
+	}
+	if err := etcd.Decode(value, &config); err != nil {
+		return config, fmt.Errorf("failed to decode cluster config: %v", err)
+	}
+	return config, nil
+}
+
+func SetClusterConfig(client datastore.Datastore, config etcd.ClusterConfig) error {
+	for _, cidr := range append(append([]string{}, config.ServiceCIDRs...), config.NodeCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid cidr %s: %v", cidr, err)
+		}
+	}
+	value, err := etcd.Encode(config)
+	if err != nil {
+		return err
+	}
+	return client.Put(etcd.ClusterConfigKey(), string(value))
+}
+
+func ListNetworks(client datastore.Datastore) (map[string]etcd.NetworkCrd, error) {
+	networks := make(map[string]etcd.NetworkCrd)
+	kvs, err := client.List(etcd.NetworksKey())
+	if err != nil {
+		return networks, err
+	}
+	for key, value := range kvs {
+		var network etcd.NetworkCrd
+		if err := etcd.Decode(value, &network); err != nil {
+			return networks, fmt.Errorf("failed to decode network %s: %v", key, err)
+		}
+		networks[strings.TrimPrefix(key, etcd.NetworksKey())] = network
+	}
+	return networks, nil
+}
+
+// SelectNetworks returns the sorted names of the networks whose pod selector
+// matches labels, networks without a selector match no pod.
+func SelectNetworks(client datastore.Datastore, labels map[string]string) ([]string, error) {
+	networks, err := ListNetworks(client)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, network := range networks {
+		if len(network.PodSelector) == 0 {
+			continue
+		}
+		matches := true
+		for key, value := range network.PodSelector {
+			if got, ok := labels[key]; !ok || got != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// the mtu bounds of a network, 576 is the smallest datagram ipv4 hosts must
+// take and 9216 the largest jumbo frame switches commonly pass
+const (
+	MinMTU = 576
+	MaxMTU = 9216
+)
+
+// validateSubnets checks a network on its own: mode, mtu, isolation, names,
+// cidrs, gateways, reserved ranges and overlaps between its own subnets.
+func validateSubnets(network *etcd.NetworkCrd) (map[string]*net.IPNet, error) {
+	if network.Name == "" {
+		return nil, fmt.Errorf("network name is required")
+	}
+	if len(network.Subnets) == 0 {
+		return nil, fmt.Errorf("network %s has no subnet", network.Name)
+	}
+	switch network.Mode {
+	case "", consts.MODE_HOST_GW, consts.MODE_VXLAN, consts.MODE_IPIP, consts.MODE_IPVLAN, consts.MODE_MACVLAN:
+	default:
+		return nil, fmt.Errorf("unknown mode %q of network %s", network.Mode, network.Name)
+	}
+	if network.MTU != 0 && (network.MTU < MinMTU || network.MTU > MaxMTU) {
+		return nil, fmt.Errorf("mtu %d of network %s must be between %d and %d", network.MTU, network.Name, MinMTU, MaxMTU)
+	}
+	if isolation := network.Isolation; isolation != nil {
+		for _, name := range append(append([]string{}, isolation.Namespaces...), isolation.Tenants...) {
+			if name == "" {
+				return nil, fmt.Errorf("empty namespace or tenant in the isolation of network %s", network.Name)
+			}
+		}
+	}
+	for key := range network.PodSelector {
+		if key == "" {
+			return nil, fmt.Errorf("empty label in the pod selector of network %s", network.Name)
+		}
+	}
+	ipNets := make(map[string]*net.IPNet, len(network.Subnets))
+	for _, subnet := range network.Subnets {
+		if subnet.Name == "" {
+			return nil, fmt.Errorf("subnet of network %s without name", network.Name)
+		}
+		if _, ok := ipNets[subnet.Name]; ok {
+			return nil, fmt.Errorf("duplicate subnet %s in network %s", subnet.Name, network.Name)
+		}
+		ipAddr, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s of subnet %s: %v", subnet.CIDR, subnet.Name, err)
+		}
+		if !ipAddr.Equal(ipNet.IP) {
+			return nil, fmt.Errorf("cidr %s of subnet %s has host bits set, did you mean %s", subnet.CIDR, subnet.Name, ipNet)
+		}
+		switch subnet.BlockSource {
+		case "":
+		case etcd.BlockSourcePodCIDR:
+			if subnet.BlockSize != 0 {
+				return nil, fmt.Errorf("subnet %s takes its blocks from node podCIDRs, it cannot have a block size", subnet.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown block source %q of subnet %s, only %q is supported", subnet.BlockSource, subnet.Name, etcd.BlockSourcePodCIDR)
+		}
+		if _, err := reservedRanges(subnet, ipNet); err != nil {
+			return nil, err
+		}
+		if ones, bits := ipNet.Mask.Size(); subnet.BlockSize != 0 && (subnet.BlockSize < ones || subnet.BlockSize > bits) {
+			return nil, fmt.Errorf("block size %d of subnet %s must be between %d and %d", subnet.BlockSize, subnet.Name, ones, bits)
+		}
+		if subnet.Gateway != "" {
+			gateway := net.ParseIP(subnet.Gateway)
+			if gateway == nil {
+				return nil, fmt.Errorf("invalid gateway %s of subnet %s", subnet.Gateway, subnet.Name)
+			}
+			if !ipNet.Contains(gateway) || gateway.Equal(ipNet.IP) {
+				return nil, fmt.Errorf("gateway %s is not a host address of subnet %s (%s)", subnet.Gateway, subnet.Name, subnet.CIDR)
+			}
+		}
+		for name, other := range ipNets {
+			if cidrsOverlap(ipNet, other) {
+				return nil, fmt.Errorf("subnet %s (%s) overlaps subnet %s (%s) of network %s", subnet.Name, ipNet, name, other, network.Name)
+			}
+		}
+		ipNets[subnet.Name] = ipNet
+	}
+	return ipNets, nil
+}
+
+// ValidateNetwork checks network against the other networks, the node network
+// and the service cidrs before it is written.
+func ValidateNetwork(client datastore.Datastore, network *etcd.NetworkCrd) error {
+	return client.Update(func(tx datastore.Txn) error {
+		return validateNetwork(tx, network)
+	})
+}
+
+// validateNetwork is ValidateNetwork inside the transaction writing network,
+// so that a network created concurrently is part of its read set.
+func validateNetwork(tx datastore.Txn, network *etcd.NetworkCrd) error {
+	ipNets, err := validateSubnets(network)
+	if err != nil {
+		return NewInvalidNetworkError(network.Name, err.Error())
+	}
+	var config etcd.ClusterConfig
+	if value := tx.Get(etcd.ClusterConfigKey()); value != "" {
+		if err := etcd.Decode(value, &config); err != nil {
+			return fmt.Errorf("failed to decode cluster config: %v", err)
+		}
+	}
+	networks := tx.List(etcd.NetworksKey())
+	nodes := tx.List(etcd.NodesKey())
+	for name, ipNet := range ipNets {
+		for key, value := range networks {
+			var other etcd.NetworkCrd
+			if err := etcd.Decode(value, &other); err != nil {
+				return fmt.Errorf("failed to decode network %s: %v", key, err)
+			}
+			if other.Name == network.Name {
+				continue
+			}
+			for _, otherSubnet := range other.Subnets {
+				_, otherNet, err := net.ParseCIDR(otherSubnet.CIDR)
+				if err == nil && cidrsOverlap(ipNet, otherNet) {
+					return NewInvalidNetworkError(network.Name, fmt.Sprintf("subnet %s (%s) overlaps subnet %s (%s) of network %s", name, ipNet, otherSubnet.Name, otherNet, other.Name))
+				}
+			}
+		}
+		for _, cidr := range config.ServiceCIDRs {
+			if _, serviceNet, err := net.ParseCIDR(cidr); err == nil && cidrsOverlap(ipNet, serviceNet) {
+				return NewInvalidNetworkError(network.Name, fmt.Sprintf("subnet %s (%s) overlaps the service cidr %s", name, ipNet, cidr))
+			}
+		}
+		for _, cidr := range config.NodeCIDRs {
+			if _, nodeNet, err := net.ParseCIDR(cidr); err == nil && cidrsOverlap(ipNet, nodeNet) {
+				return NewInvalidNetworkError(network.Name, fmt.Sprintf("subnet %s (%s) overlaps the node network %s", name, ipNet, cidr))
+			}
+		}
+		for _, value := range nodes {
+			var node etcd.Node
+			if etcd.Decode(value, &node) != nil {
+				continue
+			}
+			if nodeIp := net.ParseIP(node.NodeIp); nodeIp != nil && ipNet.Contains(nodeIp) {
+				return NewInvalidNetworkError(network.Name, fmt.Sprintf("subnet %s (%s) contains the address %s of node %s", name, ipNet, node.NodeIp, node.Name))
+			}
+		}
+	}
+	return nil
+}
+
+func CreateNetworkCrd(client datastore.Datastore, network *etcd.NetworkCrd) error {
+	value, err := etcd.Encode(network)
+	if err != nil {
+		return err
+	}
+	key := etcd.NetworkKey(network.Name)
+	return client.Update(func(tx datastore.Txn) error {
+		if tx.Get(key) != "" {
+			return NewNetworkExistsError(network.Name)
+		}
+		if err := validateNetwork(tx, network); err != nil {
+			return err
+		}
+		tx.Put(key, string(value))
+		return nil
+	})
+}
+
+// checkResize makes sure every allocated address of old still fits into the
+// subnets of network: growing a subnet always passes, shrinking or removing
+// one only when the addresses dropped are free.
+func checkResize(old, network *etcd.NetworkCrd, records []etcd.AllocatedIp) error {
+	subnets := make(map[string]etcd.Subnet, len(network.Subnets))
+	for _, subnet := range network.Subnets {
+		subnets[subnet.Name] = subnet
+	}
+	for _, oldSubnet := range old.Subnets {
+		subnet, ok := subnets[oldSubnet.Name]
+		if ok && subnet.CIDR == oldSubnet.CIDR && subnet.Gateway == oldSubnet.Gateway {
+			continue
+		}
+		var ipNet *net.IPNet
+		if ok {
+			_, ipNet, _ = net.ParseCIDR(subnet.CIDR)
+		}
+		for _, record := range records {
+			if record.Subnet != oldSubnet.Name {
+				continue
+			}
+			if !ok {
+				return NewNetworkInUseError(network.Name, fmt.Sprintf("cannot remove subnet %s, %s is still %s", oldSubnet.Name, record.Ip, record.State))
+			}
+			addr := net.ParseIP(record.Ip)
+			if !ipNet.Contains(addr) || isReserved(addr, ipNet, net.ParseIP(subnet.Gateway)) {
+				return NewNetworkInUseError(network.Name, fmt.Sprintf("cannot change subnet %s to %s, %s is still %s", subnet.Name, subnet.CIDR, record.Ip, record.State))
+			}
+		}
+	}
+	return nil
+}
+
+// outsideBlocks returns the keys of the node blocks of network that no longer
+// fit into their subnet, it fails when one of them still holds an address.
+func outsideBlocks(tx datastore.Txn, network *etcd.NetworkCrd, records []etcd.AllocatedIp) ([]string, error) {
+	subnets := make(map[string]*net.IPNet, len(network.Subnets))
+	for _, subnet := range network.Subnets {
+		if _, ipNet, err := net.ParseCIDR(subnet.CIDR); err == nil {
+			subnets[subnet.Name] = ipNet
+		}
+	}
+	var keys []string
+	for key, value := range tx.List(etcd.BlocksKey() + network.Name + "/") {
+		var block etcd.Block
+		if err := etcd.Decode(value, &block); err != nil {
+			return nil, fmt.Errorf("failed to decode block %s: %v", key, err)
+		}
+		_, blockNet, err := net.ParseCIDR(block.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s of block %s: %v", block.CIDR, key, err)
+		}
+		if ipNet, ok := subnets[block.Subnet]; ok {
+			blockOnes, _ := blockNet.Mask.Size()
+			subnetOnes, _ := ipNet.Mask.Size()
+			if ipNet.Contains(blockNet.IP) && blockOnes >= subnetOnes {
+				continue
+			}
+		}
+		for _, record := range records {
+			if record.Subnet == block.Subnet && blockNet.Contains(net.ParseIP(record.Ip)) {
+				return nil, NewNetworkInUseError(network.Name, fmt.Sprintf("block %s of node %s no longer fits into subnet %s, %s is still %s", block.CIDR, block.Node, block.Subnet, record.Ip, record.State))
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// UpdateNetworkCrd replaces a network in place, the allocations of its
+// subnets are kept. Free node blocks a shrunk or removed subnet leaves
+// outside are released.
+func UpdateNetworkCrd(client datastore.Datastore, network *etcd.NetworkCrd) error {
+	return updateNetwork(client, network.Name, func(current *etcd.NetworkCrd) error {
+		*current = *network
+		return nil
+	})
+}
+
+// updateNetwork is UpdateNetworkCrd with the network name as change leaves
+// the copy read in the same transaction, so concurrent changes are not lost.
+func updateNetwork(client datastore.Datastore, name string, change func(network *etcd.NetworkCrd) error) error {
+	key := etcd.NetworkKey(name)
+	var released []string
+	// reading the addresses makes the update fail over to a retry when one is
+	// allocated while the resize is checked
+	err := client.Update(func(tx datastore.Txn) error {
+		oldValue := tx.Get(key)
+		if oldValue == "" {
+			return NewNetworkNotFoundError(name, nil)
+		}
+		old, network := &etcd.NetworkCrd{}, &etcd.NetworkCrd{}
+		if err := etcd.Decode(oldValue, old); err != nil {
+			return fmt.Errorf("failed to decode network %s: %v", name, err)
+		}
+		if err := etcd.Decode(oldValue, network); err != nil {
+			return fmt.Errorf("failed to decode network %s: %v", name, err)
+		}
+		if err := change(network); err != nil {
+			return err
+		}
+		if err := validateNetwork(tx, network); err != nil {
+			return err
+		}
+		var records []etcd.AllocatedIp
+		for _, value := range tx.List(etcd.IpamKey(name)) {
+			var record etcd.AllocatedIp
+			if etcd.Decode(value, &record) == nil {
+				records = append(records, record)
+			}
+		}
+		if err := checkResize(old, network, records); err != nil {
+			return err
+		}
+		var err error
+		released, err = outsideBlocks(tx, network, records)
+		if err != nil {
+			return err
+		}
+		for _, blockKey := range released {
+			tx.Del(blockKey)
+		}
+		value, err := etcd.Encode(network)
+		if err != nil {
+			return err
+		}
+		tx.Put(key, string(value))
+		return nil
+	})
+	if err == nil && len(released) > 0 {
+		klog.Infof("released %d blocks outside the subnets of network %s", len(released), name)
+	}
+	return err
+}
+
+// AddSubnet appends subnet to a network, its name must be new.
+func AddSubnet(client datastore.Datastore, networkName string, subnet etcd.Subnet) error {
+	return updateNetwork(client, networkName, func(network *etcd.NetworkCrd) error {
+		for _, other := range network.Subnets {
+			if other.Name == subnet.Name {
+				return NewSubnetExistsError(networkName, subnet.Name)
+			}
+		}
+		network.Subnets = append(network.Subnets, subnet)
+		return nil
+	})
+}
+
+// UpdateSubnet replaces the subnet of a network with the name of subnet, an
+// empty ID keeps the one it has.
+func UpdateSubnet(client datastore.Datastore, networkName string, subnet etcd.Subnet) error {
+	return updateSubnet(client, networkName, subnet.Name, func(current *etcd.Subnet) {
+		if subnet.ID == "" {
+			subnet.ID = current.ID
+		}
+		*current = subnet
+	})
+}
+
+// ResizeSubnet grows or shrinks one subnet of a network to cidr.
+func ResizeSubnet(client datastore.Datastore, networkName, subnetName, cidr string) error {
+	return updateSubnet(client, networkName, subnetName, func(current *etcd.Subnet) {
+		current.CIDR = cidr
+	})
+}
+
+func updateSubnet(client datastore.Datastore, networkName, subnetName string, change func(subnet *etcd.Subnet)) error {
+	return updateNetwork(client, networkName, func(network *etcd.NetworkCrd) error {
+		for i := range network.Subnets {
+			if network.Subnets[i].Name == subnetName {
+				change(&network.Subnets[i])
+				return nil
+			}
+		}
+		return NewSubnetNotFoundError(networkName, subnetName)
+	})
+}
+
+// subnetStillContains guards an allocation against a concurrent shrink, the
+// network key becomes part of the read set of the transaction.
+func subnetStillContains(tx datastore.Txn, record *etcd.AllocatedIp) bool {
+	var network etcd.NetworkCrd
+	value := tx.Get(etcd.NetworkKey(record.Network))
+	if value == "" || etcd.Decode(value, &network) != nil {
+		return false
+	}
+	for _, subnet := range network.Subnets {
+		if subnet.Name != record.Subnet {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		return err == nil && ipNet.Contains(net.ParseIP(record.Ip))
+	}
+	return false
+}
+
+// DeleteNetworkCrd removes a network with its blocks, quota and usage, it is
+// refused while any address of the network is allocated, reserved or in
+// conflict.
+func DeleteNetworkCrd(client datastore.Datastore, name string) error {
+	return deleteNetwork(client, name, false)
+}
+
+// ForceDeleteNetworkCrd removes a network like DeleteNetworkCrd together with
+// its address records, the pods holding them keep their interfaces until
+// they are deleted.
+func ForceDeleteNetworkCrd(client datastore.Datastore, name string) error {
+	return deleteNetwork(client, name, true)
+}
+
+func deleteNetwork(client datastore.Datastore, name string, force bool) error {
+	key := etcd.NetworkKey(name)
+	dropped := 0
+	err := client.Update(func(tx datastore.Txn) error {
+		if tx.Get(key) == "" {
+			return NewNetworkNotFoundError(name, nil)
+		}
+		records := tx.List(etcd.IpamKey(name))
+		if len(records) > 0 && !force {
+			return NewNetworkInUseError(name, fmt.Sprintf("%d addresses are still allocated, reserved or in conflict", len(records)))
+		}
+		for recordKey, recordValue := range records {
+			var record etcd.AllocatedIp
+			if etcd.Decode(recordValue, &record) == nil {
+				dropAllocationIndex(tx, &record, recordKey)
+			}
+			tx.Del(recordKey)
+		}
+		dropped = len(records)
+		tx.Del(key)
+		tx.Del(etcd.QuotaKey(name))
+		for blockKey := range tx.List(etcd.BlocksKey() + name + "/") {
+			tx.Del(blockKey)
+		}
+		for usageKey := range tx.List(etcd.UsagesKey(name)) {
+			tx.Del(usageKey)
+		}
+		return nil
+	})
+	if err == nil && dropped > 0 {
+		klog.Warningf("deleted network %s with %d address records", name, dropped)
+	}
+	return err
+}
+
+// DeleteSubnet removes one subnet of a network with its blocks, it is refused
+// while an address of the subnet is allocated, reserved or in conflict unless
+// force drops their records too. The last subnet cannot go, the network is
+// deleted instead.
+func DeleteSubnet(client datastore.Datastore, networkName, subnetName string, force bool) error {
+	key := etcd.NetworkKey(networkName)
+	dropped := 0
+	err := client.Update(func(tx datastore.Txn) error {
+		value := tx.Get(key)
+		if value == "" {
+			return NewNetworkNotFoundError(networkName, nil)
+		}
+		network := &etcd.NetworkCrd{}
+		if err := etcd.Decode(value, network); err != nil {
+			return fmt.Errorf("failed to decode network %s: %v", networkName, err)
+		}
+		var subnets []etcd.Subnet
+		for _, subnet := range network.Subnets {
+			if subnet.Name != subnetName {
+				subnets = append(subnets, subnet)
+			}
+		}
+		if len(subnets) == len(network.Subnets) {
+			return NewSubnetNotFoundError(networkName, subnetName)
+		}
+		if len(subnets) == 0 {
+			return NewInvalidNetworkError(networkName, fmt.Sprintf("subnet %s is the last one, delete the network instead", subnetName))
+		}
+		records := tx.List(etcd.IpamSubnetKey(networkName, subnetName))
+		if len(records) > 0 && !force {
+			return NewNetworkInUseError(networkName, fmt.Sprintf("subnet %s still holds %d addresses", subnetName, len(records)))
+		}
+		for recordKey, recordValue := range records {
+			var record etcd.AllocatedIp
+			if etcd.Decode(recordValue, &record) == nil {
+				if record.State == "" || record.State == etcd.IpStateAllocated {
+					chargeUsage(tx, &record, -1)
+				}
+				dropAllocationIndex(tx, &record, recordKey)
+			}
+			tx.Del(recordKey)
+		}
+		dropped = len(records)
+		for blockKey := range tx.List(etcd.SubnetBlocksKey(networkName, subnetName)) {
+			tx.Del(blockKey)
+		}
+		network.Subnets = subnets
+		newValue, err := etcd.Encode(network)
+		if err != nil {
+			return err
+		}
+		tx.Put(key, string(newValue))
+		return nil
+	})
+	if err == nil && dropped > 0 {
+		klog.Warningf("deleted subnet %s of network %s with %d address records", subnetName, networkName, dropped)
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"fmt"
+	"k8s.io/klog/v2"
+	"net"
+)
+
+// BlockDivergence is a podCIDR of a k8s node that the blocks in the datastore
+// disagree with.
+type BlockDivergence struct {
+	Network string
+	Subnet  string
+	CIDR    string
+	Node    string
+	Reason  string
+}
+
+func (d BlockDivergence) String() string {
+	if d.Network == "" {
+		return fmt.Sprintf("%s of node %s: %s", d.CIDR, d.Node, d.Reason)
+	}
+	return fmt.Sprintf("%s of node %s in subnet %s of network %s: %s", d.CIDR, d.Node, d.Subnet, d.Network, d.Reason)
+}
+
+// SyncPodCIDRBlocks makes the podCIDRs of node its blocks in every subnet that
+// takes blocks from podCIDRs. Blocks are only ever claimed, never taken away
+// or dropped, anything that does not match is returned for an operator to
+// resolve: a podCIDR held by another node or overlapping another block, a
+// block of node that is none of its podCIDRs, a podCIDR outside every such
+// subnet.
+func SyncPodCIDRBlocks(client datastore.Datastore, node string, podCIDRs []string) ([]BlockDivergence, error) {
+	networks, err := ListNetworks(client)
+	if err != nil {
+		return nil, err
+	}
+	var divergences []BlockDivergence
+	placed := make(map[string]bool, len(podCIDRs))
+	sources := 0
+	for _, network := range networks {
+		for _, subnet := range network.Subnets {
+			if subnet.BlockSource != etcd.BlockSourcePodCIDR {
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+			if err != nil {
+				continue
+			}
+			sources++
+			found, err := syncSubnetPodCIDRs(client, network.Name, subnet, ipNet, node, podCIDRs)
+			if err != nil {
+				return nil, err
+			}
+			divergences = append(divergences, found...)
+			for _, cidr := range podCIDRs {
+				if _, podNet, err := net.ParseCIDR(cidr); err == nil && subnetHolds(ipNet, podNet) {
+					placed[cidr] = true
+				}
+			}
+		}
+	}
+	if sources == 0 {
+		return divergences, nil
+	}
+	for _, cidr := range podCIDRs {
+		if !placed[cidr] {
+			divergences = append(divergences, BlockDivergence{CIDR: cidr, Node: node, Reason: "outside every subnet that takes its blocks from podCIDRs"})
+		}
+	}
+	return divergences, nil
+}
+
+// subnetHolds tells if podNet lies entirely within ipNet.
+func subnetHolds(ipNet, podNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	podOnes, podBits := podNet.Mask.Size()
+	return bits == podBits && podOnes >= ones && ipNet.Contains(podNet.IP)
+}
+
+func syncSubnetPodCIDRs(client datastore.Datastore, network string, subnet etcd.Subnet, ipNet *net.IPNet, node string, podCIDRs []string) ([]BlockDivergence, error) {
+	blocks, err := ListBlocks(client, etcd.SubnetBlocksKey(network, subnet.Name))
+	if err != nil {
+		return nil, err
+	}
+	diverge := func(cidr, reason string) BlockDivergence {
+		return BlockDivergence{Network: network, Subnet: subnet.Name, CIDR: cidr, Node: node, Reason: reason}
+	}
+	var divergences []BlockDivergence
+	wanted := make(map[string]bool)
+	for _, cidr := range podCIDRs {
+		_, podNet, err := net.ParseCIDR(cidr)
+		if err != nil || !subnetHolds(ipNet, podNet) {
+			continue
+		}
+		cidr = podNet.String()
+		wanted[cidr] = true
+		clash := false
+		for _, block := range blocks {
+			_, blockNet, err := net.ParseCIDR(block.CIDR)
+			if err != nil || !cidrsOverlap(podNet, blockNet) {
+				continue
+			}
+			switch {
+			case block.CIDR != cidr:
+				divergences = append(divergences, diverge(cidr, fmt.Sprintf("overlaps block %s held by node %s", block.CIDR, block.Node)))
+				clash = true
+			case block.Node != node:
+				divergences = append(divergences, diverge(cidr, fmt.Sprintf("is held by node %s in the datastore", block.Node)))
+				clash = true
+			}
+		}
+		if clash {
+			continue
+		}
+		block := etcd.Block{Network: network, Subnet: subnet.Name, CIDR: cidr, Node: node}
+		value, err := etcd.Encode(block)
+		if err != nil {
+			return nil, err
+		}
+		key := etcd.BlockKey(network, subnet.Name, cidr)
+		holder := ""
+		err = client.Update(func(tx datastore.Txn) error {
+			holder = ""
+			current := tx.Get(key)
+			if current == "" {
+				tx.Put(key, string(value))
+				return nil
+			}
+			var claimed etcd.Block
+			if err := etcd.Decode(current, &claimed); err != nil {
+				return err
+			}
+			holder = claimed.Node
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch holder {
+		case "":
+			klog.Infof("node %s took its podCIDR %s as block of subnet %s in network %s", node, cidr, subnet.Name, network)
+		case node:
+		default:
+			divergences = append(divergences, diverge(cidr, fmt.Sprintf("is held by node %s in the datastore", holder)))
+		}
+	}
+	for _, block := range blocks {
+		if block.Node == node && !wanted[block.CIDR] {
+			divergences = append(divergences, diverge(block.CIDR, "is held by the node but is none of its podCIDRs"))
+		}
+	}
+	return divergences, nil
+}
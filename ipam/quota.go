@@ -0,0 +1,155 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Usage struct {
+	Network    string         `json:"network"`
+	Namespaces map[string]int `json:"namespaces"`
+	Tenants    map[string]int `json:"tenants"`
+}
+
+func getQuota(tx datastore.Txn, network string) (etcd.Quota, error) {
+	quota := etcd.Quota{Network: network}
+	value := tx.Get(etcd.QuotaKey(network))
+	if value == "" {
+		return quota, nil
+	}
+	if err := etcd.Decode(value, &quota); err != nil {
+		return quota, fmt.Errorf("failed to decode quota of network %s: %v", network, err)
+	}
+	return quota, nil
+}
+
+func getUsage(tx datastore.Txn, key string) int {
+	used, _ := strconv.Atoi(tx.Get(key))
+	return used
+}
+
+func addUsage(tx datastore.Txn, key string, delta int) {
+	used := getUsage(tx, key) + delta
+	if used <= 0 {
+		tx.Del(key)
+		return
+	}
+	tx.Put(key, strconv.Itoa(used))
+}
+
+// checkQuota must run inside the same transaction that takes the address, so that two
+// concurrent ADDs of one namespace cannot both pass the last free slot.
+func checkQuota(tx datastore.Txn, network, namespace, tenant string) error {
+	quota, err := getQuota(tx, network)
+	if err != nil {
+		return err
+	}
+	if limit := quota.Namespaces[namespace]; limit > 0 {
+		used := getUsage(tx, etcd.UsageKey(network, etcd.UsageNamespaces, namespace))
+		if used >= limit {
+			return NewQuotaExceededError("namespace", namespace, network, used, limit)
+		}
+	}
+	if limit := quota.Tenants[tenant]; tenant != "" && limit > 0 {
+		used := getUsage(tx, etcd.UsageKey(network, etcd.UsageTenants, tenant))
+		if used >= limit {
+			return NewQuotaExceededError("tenant", tenant, network, used, limit)
+		}
+	}
+	return nil
+}
+
+func chargeUsage(tx datastore.Txn, record *etcd.AllocatedIp, delta int) {
+	addUsage(tx, etcd.UsageKey(record.Network, etcd.UsageNamespaces, record.NameSpace), delta)
+	if record.Tenant != "" {
+		addUsage(tx, etcd.UsageKey(record.Network, etcd.UsageTenants, record.Tenant), delta)
+	}
+}
+
+func GetQuota(client datastore.Datastore, network string) (etcd.Quota, error) {
+	quota := etcd.Quota{Network: network}
+	value, err := client.Get(etcd.QuotaKey(network))
+	if err != nil {
+		return quota, err
+	}
+	if value == "" {
+		return quota, nil
+	}
+	if err := etcd.Decode(value, &quota); err != nil {
+		return quota, fmt.Errorf("failed to decode quota of network %s: %v", network, err)
+	}
+	return quota, nil
+}
+
+// SetQuota sets the limit of one namespace or tenant on network, a limit of 0
+// removes it.
+func SetQuota(client datastore.Datastore, network, kind, name string, limit int) error {
+	if kind != etcd.UsageNamespaces && kind != etcd.UsageTenants {
+		return fmt.Errorf("unknown quota kind %s", kind)
+	}
+	if limit < 0 {
+		return fmt.Errorf("quota limit cannot be negative, got %d", limit)
+	}
+	return client.Update(func(tx datastore.Txn) error {
+		quota, err := getQuota(tx, network)
+		if err != nil {
+			return err
+		}
+		limits := quota.Namespaces
+		if kind == etcd.UsageTenants {
+			limits = quota.Tenants
+		}
+		if limits == nil {
+			limits = make(map[string]int)
+		}
+		if limit == 0 {
+			delete(limits, name)
+		} else {
+			limits[name] = limit
+		}
+		if kind == etcd.UsageTenants {
+			quota.Tenants = limits
+		} else {
+			quota.Namespaces = limits
+		}
+		value, err := etcd.Encode(quota)
+		if err != nil {
+			return err
+		}
+		tx.Put(etcd.QuotaKey(network), string(value))
+		return nil
+	})
+}
+
+func GetUsage(client datastore.Datastore, network string) (Usage, error) {
+	usage := Usage{
+		Network:    network,
+		Namespaces: make(map[string]int),
+		Tenants:    make(map[string]int),
+	}
+	prefix := etcd.UsagesKey(network)
+	kvs, err := client.List(prefix)
+	if err != nil {
+		return usage, err
+	}
+	for key, value := range kvs {
+		kindAndName := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+		if len(kindAndName) != 2 {
+			continue
+		}
+		used, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		switch kindAndName[0] {
+		case etcd.UsageNamespaces:
+			usage.Namespaces[kindAndName[1]] = used
+		case etcd.UsageTenants:
+			usage.Tenants[kindAndName[1]] = used
+		}
+	}
+	return usage, nil
+}
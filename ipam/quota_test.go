@@ -0,0 +1,109 @@
+package ipam
+
+import (
+	"cni/etcd"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	if err := SetQuota(ds, testNetwork, etcd.UsageNamespaces, "default", 2); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	for _, containerId := range []string{"c1", "c2"} {
+		if _, err := AllocationIpFromNetwork(ds, allocateArgs(containerId)); err != nil {
+			t.Fatalf("AllocationIpFromNetwork(%s): %v", containerId, err)
+		}
+	}
+	if _, err := AllocationIpFromNetwork(ds, allocateArgs("c3")); !hasCode(err, ErrQuotaExceeded) {
+		t.Fatalf("allocating past the quota = %v, want code %d", err, ErrQuotaExceeded)
+	}
+	// a retried ADD of a container within the quota still gets its address
+	if _, err := AllocationIpFromNetwork(ds, allocateArgs("c1")); err != nil {
+		t.Errorf("retried AllocationIpFromNetwork(c1): %v", err)
+	}
+	other := allocateArgs("c4")
+	other.NameSpace = "other"
+	if _, err := AllocationIpFromNetwork(ds, other); err != nil {
+		t.Errorf("allocating in a namespace without quota: %v", err)
+	}
+	if err := ReleaseIpFromNetwork(ds, testNetwork, "c1"); err != nil {
+		t.Fatalf("ReleaseIpFromNetwork: %v", err)
+	}
+	if _, err := AllocationIpFromNetwork(ds, allocateArgs("c3")); err != nil {
+		t.Errorf("allocating after a release freed the quota: %v", err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 2 {
+		t.Errorf("usage = %d, want 2", used)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	if err := SetQuota(ds, testNetwork, etcd.UsageTenants, "team-a", 1); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	first := allocateArgs("c1")
+	first.Tenant = "team-a"
+	if _, err := AllocationIpFromNetwork(ds, first); err != nil {
+		t.Fatalf("AllocationIpFromNetwork: %v", err)
+	}
+	// the tenant spans namespaces
+	second := allocateArgs("c2")
+	second.NameSpace, second.Tenant = "other", "team-a"
+	if _, err := AllocationIpFromNetwork(ds, second); !hasCode(err, ErrQuotaExceeded) {
+		t.Errorf("allocating past the tenant quota = %v, want code %d", err, ErrQuotaExceeded)
+	}
+	usage, err := GetUsage(ds, testNetwork)
+	if err != nil || usage.Tenants["team-a"] != 1 {
+		t.Errorf("GetUsage = %+v, %v, want team-a at 1", usage, err)
+	}
+}
+
+func TestConcurrentAllocationsRespectQuota(t *testing.T) {
+	const limit, pods = 5, 20
+	ds := newTestDatastore(t, "10.10.0.0/24")
+	if err := SetQuota(ds, testNetwork, etcd.UsageNamespaces, "default", limit); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, pods)
+	addrs := make([]string, pods)
+	for i := 0; i < pods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			allocation, err := AllocationIpFromNetwork(ds, allocateArgs(fmt.Sprintf("c%d", i)))
+			errs[i] = err
+			if err == nil {
+				addrs[i] = allocation.IP.IP.String()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[string]bool)
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if allocated[addrs[i]] {
+				t.Errorf("%s handed out twice", addrs[i])
+			}
+			allocated[addrs[i]] = true
+		case !hasCode(err, ErrQuotaExceeded):
+			t.Errorf("AllocationIpFromNetwork(c%d) = %v, want success or code %d", i, err, ErrQuotaExceeded)
+		}
+	}
+	if len(allocated) != limit {
+		t.Errorf("%d concurrent ADDs succeeded, want exactly %d", len(allocated), limit)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != limit {
+		t.Errorf("usage = %d, want %d", used, limit)
+	}
+	records, err := ListAllocatedIps(ds, testNetwork)
+	if err != nil || len(records) != limit {
+		t.Errorf("ListAllocatedIps = %d records, %v, want %d", len(records), err, limit)
+	}
+}
@@ -0,0 +1,82 @@
+package ipam
+
+import (
+	"bytes"
+	"cni/etcd"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipRange is an inclusive range of addresses of one family.
+type ipRange struct {
+	first, last net.IP
+}
+
+func (r ipRange) contains(addr net.IP) bool {
+	addr = normalizeIp(addr)
+	return len(addr) == len(r.first) && bytes.Compare(addr, r.first) >= 0 && bytes.Compare(addr, r.last) <= 0
+}
+
+func normalizeIp(addr net.IP) net.IP {
+	if v4 := addr.To4(); v4 != nil {
+		return v4
+	}
+	return addr
+}
+
+// parseRange reads an address, a cidr or a first-last range.
+func parseRange(entry string) (ipRange, error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return ipRange{}, err
+		}
+		first := normalizeIp(ipNet.IP)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipNet.Mask[len(ipNet.Mask)-len(first)+i]
+		}
+		return ipRange{first: first, last: last}, nil
+	}
+	bounds := strings.SplitN(entry, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := first
+	if len(bounds) == 2 {
+		last = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("%q is no address, cidr or first-last range", entry)
+	}
+	first, last = normalizeIp(first), normalizeIp(last)
+	if len(first) != len(last) || bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("range %q is empty or mixes address families", entry)
+	}
+	return ipRange{first: first, last: last}, nil
+}
+
+// reservedRanges parses the reserved entries of subnet and checks they lie
+// within ipNet.
+func reservedRanges(subnet etcd.Subnet, ipNet *net.IPNet) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, entry := range subnet.Reserved {
+		r, err := parseRange(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved range of subnet %s: %v", subnet.Name, err)
+		}
+		if !ipNet.Contains(r.first) || !ipNet.Contains(r.last) {
+			return nil, fmt.Errorf("reserved range %s is outside subnet %s (%s)", entry, subnet.Name, subnet.CIDR)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []ipRange, addr net.IP) bool {
+	for _, r := range ranges {
+		if r.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"math"
+	"math/big"
+	"net"
+)
+
+// SubnetUsage counts the addresses of one subnet, Size leaves out the
+// network, broadcast, gateway and reserved addresses. Counts of subnets
+// larger than an int64 saturate.
+type SubnetUsage struct {
+	Name      string `json:"name"`
+	CIDR      string `json:"cidr"`
+	Size      int64  `json:"size"`
+	Allocated int64  `json:"allocated"`
+	Reserved  int64  `json:"reserved"`
+	Conflict  int64  `json:"conflict"`
+	Free      int64  `json:"free"`
+}
+
+type NetworkUsage struct {
+	Network   string        `json:"network"`
+	Size      int64         `json:"size"`
+	Allocated int64         `json:"allocated"`
+	Reserved  int64         `json:"reserved"`
+	Conflict  int64         `json:"conflict"`
+	Free      int64         `json:"free"`
+	Subnets   []SubnetUsage `json:"subnets"`
+}
+
+func saturate(n *big.Int) int64 {
+	if !n.IsInt64() {
+		return math.MaxInt64
+	}
+	return n.Int64()
+}
+
+func addSaturated(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// subnetSize counts the addresses walkFreeIps may hand out of subnet.
+func subnetSize(subnet etcd.Subnet, ipNet *net.IPNet) int64 {
+	ones, bits := ipNet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	// the network address, and the broadcast address of ipv4 subnets
+	excluded := big.NewInt(1)
+	if bits == 32 && ones < 32 {
+		excluded.Add(excluded, big.NewInt(1))
+	}
+	gateway := net.ParseIP(subnet.Gateway)
+	if gateway != nil && ipNet.Contains(gateway) {
+		excluded.Add(excluded, big.NewInt(1))
+	}
+	ranges, _ := reservedRanges(subnet, ipNet)
+	for _, r := range ranges {
+		n := new(big.Int).Sub(new(big.Int).SetBytes(r.last), new(big.Int).SetBytes(r.first))
+		excluded.Add(excluded, n.Add(n, big.NewInt(1)))
+		if gateway != nil && r.contains(gateway) {
+			excluded.Sub(excluded, big.NewInt(1))
+		}
+	}
+	size.Sub(size, excluded)
+	if size.Sign() < 0 {
+		return 0
+	}
+	return saturate(size)
+}
+
+// GetNetworkUsage counts the addresses of every subnet of network by state.
+// Overlapping reserved ranges are counted twice and make Free too small.
+func GetNetworkUsage(client datastore.Datastore, network *etcd.NetworkCrd) (NetworkUsage, error) {
+	usage := NetworkUsage{Network: network.Name}
+	records, err := getAllocatedIps(client, etcd.IpamKey(network.Name))
+	if err != nil {
+		return usage, err
+	}
+	counts := make(map[string]map[string]int64)
+	for _, record := range records {
+		if counts[record.Subnet] == nil {
+			counts[record.Subnet] = make(map[string]int64)
+		}
+		state := record.State
+		if state == "" {
+			state = etcd.IpStateAllocated
+		}
+		counts[record.Subnet][state]++
+	}
+	for _, subnet := range network.Subnets {
+		subnetUsage := SubnetUsage{Name: subnet.Name, CIDR: subnet.CIDR}
+		if _, ipNet, err := net.ParseCIDR(subnet.CIDR); err == nil {
+			subnetUsage.Size = subnetSize(subnet, ipNet)
+		}
+		c := counts[subnet.Name]
+		subnetUsage.Allocated = c[etcd.IpStateAllocated]
+		subnetUsage.Reserved = c[etcd.IpStateReserved]
+		subnetUsage.Conflict = c[etcd.IpStateConflict]
+		subnetUsage.Free = subnetUsage.Size - subnetUsage.Allocated - subnetUsage.Reserved - subnetUsage.Conflict
+		if subnetUsage.Free < 0 {
+			subnetUsage.Free = 0
+		}
+		usage.Size = addSaturated(usage.Size, subnetUsage.Size)
+		usage.Allocated += subnetUsage.Allocated
+		usage.Reserved += subnetUsage.Reserved
+		usage.Conflict += subnetUsage.Conflict
+		usage.Free = addSaturated(usage.Free, subnetUsage.Free)
+		usage.Subnets = append(usage.Subnets, subnetUsage)
+	}
+	return usage, nil
+}
@@ -0,0 +1,396 @@
+package ipam
+
+import (
+	"cni/consts"
+	"cni/datastore"
+	"cni/etcd"
+	"cni/utils/path"
+	"encoding/json"
+	"fmt"
+	"io"
+	"k8s.io/klog/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// WarmPoolEntry is an address reserved in etcd for this node, it carries what
+// ADD needs so that taking it does not have to read the network again.
+type WarmPoolEntry struct {
+	Ip        string `json:"ip"`
+	Subnet    string `json:"subnet"`
+	PrefixLen int    `json:"prefixLen"`
+	Gateway   string `json:"gateway"`
+	// Network is nil in pools written before it was cached
+	Network *WarmPoolNetwork `json:"network,omitempty"`
+}
+
+// WarmPoolNetwork is what ADD needs of the network besides the address, Refill
+// keeps it up to date.
+type WarmPoolNetwork struct {
+	MTU       int             `json:"mtu,omitempty"`
+	Mode      string          `json:"mode,omitempty"`
+	Isolation *etcd.Isolation `json:"isolation,omitempty"`
+}
+
+func newWarmPoolNetwork(network *etcd.NetworkCrd) *WarmPoolNetwork {
+	return &WarmPoolNetwork{MTU: network.MTU, Mode: network.Mode, Isolation: network.Isolation}
+}
+
+// admit checks args against the network cached with entry, or the one in
+// the datastore when there is none.
+func (p *WarmPool) admit(entry *WarmPoolEntry, args *AllocateArgs) (*WarmPoolNetwork, error) {
+	cached := entry.Network
+	if cached == nil {
+		network, err := GetNetwork(p.client, p.Network)
+		if err != nil {
+			return nil, err
+		}
+		cached = newWarmPoolNetwork(network)
+	}
+	network := &etcd.NetworkCrd{Name: p.Network, Mode: cached.Mode, Isolation: cached.Isolation}
+	return cached, admit(network, args)
+}
+
+// WarmPool keeps between Low and High addresses of one network reserved for
+// one node. The entries live in a node local file guarded by flock, so the
+// short lived CNI processes and the refilling daemon can share it.
+type WarmPool struct {
+	client  datastore.Datastore
+	Network string
+	Node    string
+	Dir     string
+	Low     int
+	High    int
+}
+
+func NewWarmPool(client datastore.Datastore, network, node, dir string) *WarmPool {
+	if dir == "" {
+		dir = consts.KUBE_TEST_CNI_WARM_POOL_DEFAULT_PATH
+	}
+	return &WarmPool{
+		client:  client,
+		Network: network,
+		Node:    node,
+		Dir:     dir,
+	}
+}
+
+func (p *WarmPool) path() string {
+	return filepath.Join(p.Dir, p.Network+".json")
+}
+
+func (p *WarmPool) withLock(fn func(entries []WarmPoolEntry) ([]WarmPoolEntry, error)) error {
+	if !path.PathExists(p.Dir) {
+		if err := os.MkdirAll(p.Dir, 0700); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(p.path(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock warm pool %s: %v", p.path(), err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var entries []WarmPoolEntry
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			klog.Errorf("drop corrupted warm pool %s, err is %v", p.path(), err)
+			entries = nil
+		}
+	}
+	entries, err = fn(entries)
+	if err != nil {
+		return err
+	}
+	if data, err = json.Marshal(entries); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+func (p *WarmPool) Size() (int, error) {
+	var size int
+	err := p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		size = len(entries)
+		return entries, nil
+	})
+	return size, err
+}
+
+func (p *WarmPool) pop() (*WarmPoolEntry, error) {
+	var entry *WarmPoolEntry
+	err := p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		if len(entries) == 0 {
+			return entries, nil
+		}
+		entry = &entries[0]
+		return entries[1:], nil
+	})
+	return entry, err
+}
+
+func (p *WarmPool) push(entry WarmPoolEntry) error {
+	return p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		// Refill may have adopted it meanwhile
+		for _, e := range entries {
+			if e.Ip == entry.Ip {
+				return entries, nil
+			}
+		}
+		return append([]WarmPoolEntry{entry}, entries...), nil
+	})
+}
+
+// claim turns the reservation of entry into an allocation of args. It fails
+// softly when the reservation was taken back, e.g. by a drain on another run.
+func (p *WarmPool) claim(entry *WarmPoolEntry, args *AllocateArgs) (bool, error) {
+	var claimed bool
+	key := etcd.IpKey(p.Network, entry.Subnet, entry.Ip)
+	err := p.client.Update(func(tx datastore.Txn) error {
+		claimed = false
+		var record etcd.AllocatedIp
+		value := tx.Get(key)
+		if value == "" || etcd.Decode(value, &record) != nil {
+			return nil
+		}
+		if record.State != etcd.IpStateReserved || record.Node != p.Node {
+			return nil
+		}
+		if err := checkQuota(tx, p.Network, args.NameSpace, args.Tenant); err != nil {
+			return err
+		}
+		record.NameSpace = args.NameSpace
+		record.PodName = args.PodName
+		record.ContainerId = args.ContainerId
+		record.Tenant = args.Tenant
+		record.State = etcd.IpStateAllocated
+		data, err := etcd.Encode(record)
+		if err != nil {
+			return err
+		}
+		tx.Put(key, string(data))
+		putAllocationIndex(tx, &record, key)
+		chargeUsage(tx, &record, 1)
+		claimed = true
+		return nil
+	})
+	return claimed, err
+}
+
+// Take hands out an address of the pool to args, it returns nil when the pool
+// is empty or the container already holds an address of the network, the
+// caller has to fall back to AllocationIpFromNetwork then. The network is not
+// read, the entries carry what ADD needs of it.
+func (p *WarmPool) Take(args *AllocateArgs) (*Allocation, error) {
+	// ADD is retried by the runtime, AllocationIpFromNetwork hands back what
+	// the container already holds
+	existing, err := GetAllocatedIp(p.client, p.Network, args.ContainerId)
+	if err != nil || existing != nil {
+		return nil, err
+	}
+	for {
+		entry, err := p.pop()
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		network, err := p.admit(entry, args)
+		if err == nil {
+			var claimed bool
+			claimed, err = p.claim(entry, args)
+			if err == nil && !claimed {
+				klog.Warningf("reservation of %s in network %s is gone, drop it from warm pool", entry.Ip, p.Network)
+				continue
+			}
+		}
+		if err != nil {
+			if pushErr := p.push(*entry); pushErr != nil {
+				klog.Errorf("failed to put %s back to warm pool, err is %v", entry.Ip, pushErr)
+			}
+			return nil, err
+		}
+		addr, bits := net.ParseIP(entry.Ip), 128
+		if v4 := addr.To4(); v4 != nil {
+			addr, bits = v4, 32
+		}
+		allocation := &Allocation{Subnet: entry.Subnet, MTU: network.MTU}
+		allocation.IP.IPNet = net.IPNet{IP: addr, Mask: net.CIDRMask(entry.PrefixLen, bits)}
+		allocation.Gateway.IP = net.ParseIP(entry.Gateway)
+		klog.Infof("took %s of network %s from warm pool for pod %s/%s", entry.Ip, p.Network, args.NameSpace, args.PodName)
+		return allocation, nil
+	}
+}
+
+// reconcile matches entries with the reservations of this node in the
+// datastore. A crash between reserving and pushing in Refill, or between pop
+// and claim in Take, leaves reservations without an entry, they are adopted
+// while their subnet still holds them and released otherwise. Entries whose
+// reservation is gone are dropped.
+func (p *WarmPool) reconcile(network *etcd.NetworkCrd, entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+	records, err := getAllocatedIps(p.client, etcd.IpamKey(p.Network))
+	if err != nil {
+		return entries, err
+	}
+	reserved := make(map[string]bool)
+	for _, record := range records {
+		if record.State == etcd.IpStateReserved && record.Node == p.Node {
+			reserved[record.Ip] = true
+		}
+	}
+	var kept []WarmPoolEntry
+	for _, entry := range entries {
+		if !reserved[entry.Ip] {
+			klog.Warningf("reservation of %s in network %s is gone, drop it from warm pool", entry.Ip, p.Network)
+			continue
+		}
+		delete(reserved, entry.Ip)
+		kept = append(kept, entry)
+	}
+	for _, record := range records {
+		if !reserved[record.Ip] {
+			continue
+		}
+		if entry, ok := warmPoolEntryOf(network, record); ok {
+			klog.Infof("adopt orphaned reservation of %s in network %s into warm pool", record.Ip, p.Network)
+			kept = append(kept, entry)
+			continue
+		}
+		if err := p.release(record); err != nil {
+			return entries, err
+		}
+		klog.Infof("released orphaned reservation of %s in network %s, its subnet is gone", record.Ip, p.Network)
+	}
+	return kept, nil
+}
+
+// warmPoolEntryOf returns the entry of the reservation record, false when the
+// subnet of the record no longer holds its address.
+func warmPoolEntryOf(network *etcd.NetworkCrd, record etcd.AllocatedIp) (WarmPoolEntry, bool) {
+	for _, subnet := range network.Subnets {
+		if subnet.Name != record.Subnet {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil || !ipNet.Contains(net.ParseIP(record.Ip)) {
+			return WarmPoolEntry{}, false
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		return WarmPoolEntry{Ip: record.Ip, Subnet: subnet.Name, PrefixLen: prefixLen, Gateway: subnet.Gateway}, true
+	}
+	return WarmPoolEntry{}, false
+}
+
+// release deletes the reservation record unless it was claimed meanwhile.
+func (p *WarmPool) release(record etcd.AllocatedIp) error {
+	key := etcd.IpKey(record.Network, record.Subnet, record.Ip)
+	err := p.client.Update(func(tx datastore.Txn) error {
+		var current etcd.AllocatedIp
+		value := tx.Get(key)
+		if value == "" || etcd.Decode(value, &current) != nil {
+			return nil
+		}
+		if current.State == etcd.IpStateReserved && current.Node == p.Node {
+			tx.Del(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release reservation %s: %v", record.Ip, err)
+	}
+	return nil
+}
+
+// Refill reconciles the pool with the reservations of this node, brings the
+// network cached with the entries up to date and reserves addresses up to
+// High once the pool fell below Low.
+func (p *WarmPool) Refill() error {
+	network, err := GetNetwork(p.client, p.Network)
+	if err != nil {
+		return err
+	}
+	cached := newWarmPoolNetwork(network)
+	size := 0
+	err = p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		entries, err := p.reconcile(network, entries)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			entries[i].Network = cached
+		}
+		size = len(entries)
+		return entries, nil
+	})
+	if err != nil {
+		return err
+	}
+	if size >= p.Low || size >= p.High {
+		return nil
+	}
+	want := p.High - size
+	var reserved []WarmPoolEntry
+	err = walkFreeIps(p.client, network, p.Node, func(subnet etcd.Subnet, ipNet *net.IPNet, candidate net.IP) (bool, error) {
+		taken, err := tryAllocate(p.client, &etcd.AllocatedIp{
+			Ip:      candidate.String(),
+			Network: p.Network,
+			Subnet:  subnet.Name,
+			Node:    p.Node,
+			State:   etcd.IpStateReserved,
+		})
+		if err != nil || !taken {
+			return false, err
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		reserved = append(reserved, WarmPoolEntry{
+			Ip:        candidate.String(),
+			Subnet:    subnet.Name,
+			PrefixLen: prefixLen,
+			Gateway:   subnet.Gateway,
+			Network:   cached,
+		})
+		return len(reserved) >= want, nil
+	})
+	if len(reserved) > 0 {
+		if pushErr := p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+			return append(entries, reserved...), nil
+		}); pushErr != nil {
+			return pushErr
+		}
+		klog.Infof("reserved %d addresses of network %s into warm pool of %s", len(reserved), p.Network, p.Node)
+	}
+	return err
+}
+
+// Drain gives every reservation of this node in the network back to the
+// cluster and empties the local pool.
+func (p *WarmPool) Drain() error {
+	return p.withLock(func(entries []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		records, err := getAllocatedIps(p.client, etcd.IpamKey(p.Network))
+		if err != nil {
+			return entries, err
+		}
+		for _, record := range records {
+			if record.State != etcd.IpStateReserved || record.Node != p.Node {
+				continue
+			}
+			if err := p.release(record); err != nil {
+				return entries, err
+			}
+		}
+		klog.Infof("drained warm pool of network %s on %s", p.Network, p.Node)
+		return nil, nil
+	})
+}
@@ -0,0 +1,170 @@
+package ipam
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"testing"
+)
+
+// newTestWarmPool returns a pool between 2 and 4 addresses of testNetwork,
+// with the subnet cidr, on the memory datastore.
+func newTestWarmPool(t *testing.T, cidr string) (*WarmPool, datastore.Datastore) {
+	t.Helper()
+	ds := datastore.NewMemoryDatastore()
+	network := &etcd.NetworkCrd{
+		Name:    testNetwork,
+		Subnets: []etcd.Subnet{{Name: "subnet1", CIDR: cidr}},
+	}
+	if err := CreateNetworkCrd(ds, network); err != nil {
+		t.Fatalf("CreateNetworkCrd: %v", err)
+	}
+	pool := NewWarmPool(ds, testNetwork, "node-1", t.TempDir())
+	pool.Low, pool.High = 2, 4
+	return pool, ds
+}
+
+func poolSize(t *testing.T, pool *WarmPool) int {
+	t.Helper()
+	size, err := pool.Size()
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	return size
+}
+
+// reservations returns the addresses reserved for node-1.
+func reservations(t *testing.T, ds datastore.Datastore) map[string]etcd.AllocatedIp {
+	t.Helper()
+	records, err := ListAllocatedIps(ds, testNetwork)
+	if err != nil {
+		t.Fatalf("ListAllocatedIps: %v", err)
+	}
+	reserved := make(map[string]etcd.AllocatedIp)
+	for _, record := range records {
+		if record.State == etcd.IpStateReserved && record.Node == "node-1" {
+			reserved[record.Ip] = record
+		}
+	}
+	return reserved
+}
+
+func TestWarmPoolTakeRefillDrain(t *testing.T) {
+	pool, ds := newTestWarmPool(t, "10.10.0.0/24")
+	if allocation, err := pool.Take(allocateArgs("c0")); err != nil || allocation != nil {
+		t.Fatalf("Take from the empty pool = %v, %v, want nothing", allocation, err)
+	}
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill: %v", err)
+	}
+	if size, reserved := poolSize(t, pool), len(reservations(t, ds)); size != 4 || reserved != 4 {
+		t.Fatalf("pool holds %d entries and %d reservations, want 4", size, reserved)
+	}
+
+	taken := make(map[string]bool)
+	for _, containerId := range []string{"c1", "c2", "c3"} {
+		allocation, err := pool.Take(allocateArgs(containerId))
+		if err != nil || allocation == nil {
+			t.Fatalf("Take(%s) = %v, %v", containerId, allocation, err)
+		}
+		ip := allocation.IP.IP.String()
+		if taken[ip] {
+			t.Fatalf("%s taken twice", ip)
+		}
+		taken[ip] = true
+		record, err := GetAllocatedIp(ds, testNetwork, containerId)
+		if err != nil || record == nil || record.Ip != ip || record.State != etcd.IpStateAllocated {
+			t.Errorf("record of %s = %+v, %v, want %s allocated", containerId, record, err, ip)
+		}
+		if ones, _ := allocation.IP.Mask.Size(); ones != 24 {
+			t.Errorf("prefix length of %s = %d, want 24", ip, ones)
+		}
+	}
+	// a retried ADD falls back to AllocationIpFromNetwork
+	if allocation, err := pool.Take(allocateArgs("c1")); err != nil || allocation != nil {
+		t.Errorf("retried Take = %v, %v, want nothing", allocation, err)
+	}
+	if used := namespaceUsage(t, ds, "default"); used != 3 {
+		t.Errorf("usage = %d, want 3", used)
+	}
+
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill: %v", err)
+	}
+	if size := poolSize(t, pool); size != 4 {
+		t.Errorf("pool below Low refilled to %d, want 4", size)
+	}
+	if err := pool.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if size, reserved := poolSize(t, pool), len(reservations(t, ds)); size != 0 || reserved != 0 {
+		t.Errorf("drained pool holds %d entries and %d reservations, want none", size, reserved)
+	}
+	records, err := ListAllocatedIps(ds, testNetwork)
+	if err != nil || len(records) != 3 {
+		t.Errorf("ListAllocatedIps after Drain = %d records, %v, want the 3 taken", len(records), err)
+	}
+}
+
+func TestWarmPoolRefillAdoptsOrphans(t *testing.T) {
+	pool, ds := newTestWarmPool(t, "10.10.0.0/24")
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill: %v", err)
+	}
+	// Take died between pop and claim
+	popped, err := pool.pop()
+	if err != nil || popped == nil {
+		t.Fatalf("pop = %v, %v", popped, err)
+	}
+	// Refill died between reserving and pushing
+	orphan := &etcd.AllocatedIp{Ip: "10.10.0.200", Network: testNetwork, Subnet: "subnet1", Node: "node-1", State: etcd.IpStateReserved}
+	if taken, err := tryAllocate(ds, orphan); err != nil || !taken {
+		t.Fatalf("tryAllocate = %v, %v", taken, err)
+	}
+	// the subnet of a reservation is gone
+	gone := etcd.AllocatedIp{Ip: "10.20.0.2", Network: testNetwork, Subnet: "subnet2", Node: "node-1", State: etcd.IpStateReserved}
+	value, err := etcd.Encode(gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put(etcd.IpKey(testNetwork, gone.Subnet, gone.Ip), string(value)); err != nil {
+		t.Fatal(err)
+	}
+	// the reservation of an entry was released
+	if err := pool.push(WarmPoolEntry{Ip: "10.10.0.201", Subnet: "subnet1", PrefixLen: 24}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.Refill(); err != nil {
+		t.Fatalf("Refill: %v", err)
+	}
+	reserved := reservations(t, ds)
+	if _, ok := reserved[gone.Ip]; ok {
+		t.Errorf("reservation %s of the removed subnet is kept", gone.Ip)
+	}
+	if len(reserved) != 5 {
+		t.Errorf("%d reservations, want 5", len(reserved))
+	}
+	var entries []WarmPoolEntry
+	if err := pool.withLock(func(stored []WarmPoolEntry) ([]WarmPoolEntry, error) {
+		entries = stored
+		return stored, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(reserved) {
+		t.Errorf("pool holds %d entries, want one per reservation", len(entries))
+	}
+	for _, entry := range entries {
+		if _, ok := reserved[entry.Ip]; !ok {
+			t.Errorf("entry %s has no reservation", entry.Ip)
+		}
+		if entry.PrefixLen != 24 || entry.Network == nil {
+			t.Errorf("entry %+v lacks what ADD needs", entry)
+		}
+	}
+	for _, ip := range []string{popped.Ip, orphan.Ip} {
+		if _, ok := reserved[ip]; !ok {
+			t.Errorf("orphaned reservation %s is not adopted", ip)
+		}
+	}
+}
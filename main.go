@@ -3,6 +3,7 @@ package main
 import (
 	"cni/cni"
 	"cni/helper"
+	_ "cni/plugins/hostgw"
 	"cni/skel"
 	"cni/utils/log"
 	"errors"
@@ -0,0 +1,73 @@
+package hostgw
+
+import (
+	"cni/etcd"
+	"cni/utils/k8s"
+	"encoding/json"
+	"k8s.io/klog"
+)
+
+// podAnnotations renders the interfaces of pod as network-status and as the
+// tinycni network info.
+func podAnnotations(pod etcd.Pod) (map[string]string, error) {
+	var statuses []k8s.NetworkStatus
+	info := k8s.PodNetworkInfo{ContainerId: pod.ContainerId, Node: pod.Node}
+	for i, eth := range pod.PodEths {
+		status := k8s.NetworkStatus{Name: eth.NetworkCrd, Interface: eth.IfName, Mac: eth.Mac, Default: i == 0}
+		iface := k8s.PodInterfaceInfo{IfName: eth.IfName, HostVeth: eth.HostVeth, Mac: eth.Mac, Network: eth.NetworkCrd, Subnet: eth.SubnetName}
+		for _, fixedIp := range eth.FixedIps {
+			status.IPs = append(status.IPs, fixedIp.Ipaddress)
+			iface.IPs = append(iface.IPs, fixedIp.Ipaddress)
+			if fixedIp.GatewayIP != "" {
+				status.Gateway = append(status.Gateway, fixedIp.GatewayIP)
+				iface.Gateway = fixedIp.GatewayIP
+			}
+		}
+		statuses = append(statuses, status)
+		info.Interfaces = append(info.Interfaces, iface)
+	}
+	statusJson, err := json.Marshal(statuses)
+	if err != nil {
+		return nil, err
+	}
+	infoJson, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		k8s.NetworkStatusAnnotation: string(statusJson),
+		k8s.NetworkInfoAnnotation:   string(infoJson),
+	}, nil
+}
+
+// annotatePod publishes the networking of pod on the pod object. The pod is
+// already wired when this runs, so a failure is logged and ADD still succeeds.
+func (hostgw *HostGatewayCNI) annotatePod(pod etcd.Pod) {
+	annotations, err := podAnnotations(pod)
+	if err == nil {
+		err = hostgw.k8sClient.UpdatePodAnnotations(pod.NameSpace, pod.Name, annotations, nil)
+	}
+	if err != nil {
+		klog.Errorf("failed to annotate pod %s/%s with its networks, err is %v", pod.NameSpace, pod.Name, err)
+	}
+}
+
+// unannotatePod removes the annotations written for containerId, those of a
+// newer sandbox of the same pod are left alone.
+func (hostgw *HostGatewayCNI) unannotatePod(ns, name, containerId string) {
+	annotations := map[string]string{k8s.NetworkStatusAnnotation: "", k8s.NetworkInfoAnnotation: ""}
+	err := hostgw.k8sClient.UpdatePodAnnotations(ns, name, annotations, func(pod *k8s.Pod) bool {
+		value, ok := pod.MetaData.Annotations[k8s.NetworkInfoAnnotation]
+		if !ok {
+			return false
+		}
+		var info k8s.PodNetworkInfo
+		if err := json.Unmarshal([]byte(value), &info); err != nil {
+			return true
+		}
+		return info.ContainerId == containerId
+	})
+	if err != nil {
+		klog.Errorf("failed to remove the network annotations of pod %s/%s, err is %v", ns, name, err)
+	}
+}
@@ -0,0 +1,79 @@
+package hostgw
+
+import (
+	"cni/etcd"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"k8s.io/klog"
+	"strings"
+)
+
+// the reasons of the events posted against pods
+const (
+	EventNetworkReady       = "NetworkReady"
+	EventNetworkNotFound    = "NetworkNotFound"
+	EventNetworkSelection   = "NetworkSelectionFailed"
+	EventNetworkForbidden   = "NetworkForbidden"
+	EventAddressExhausted   = "AddressExhausted"
+	EventQuotaExceeded      = "QuotaExceeded"
+	EventAddressConflict    = "AddressConflict"
+	EventAddressUnavailable = "AddressUnavailable"
+	EventInterfaceFailed    = "InterfaceSetupFailed"
+	EventRolledBack         = "NetworkRolledBack"
+	EventSetupFailed        = "NetworkSetupFailed"
+)
+
+const eventComponent = "tinycni"
+
+// eventReason names the failure of err, fallback when it carries no ipam
+// error code.
+func eventReason(err error, fallback string) string {
+	cniErr, ok := err.(*types.Error)
+	if !ok {
+		return fallback
+	}
+	switch cniErr.Code {
+	case ipam.ErrNetworkNotFound:
+		return EventNetworkNotFound
+	case ipam.ErrNoFreeAddress:
+		return EventAddressExhausted
+	case ipam.ErrQuotaExceeded:
+		return EventQuotaExceeded
+	case ipam.ErrAddressConflict:
+		return EventAddressConflict
+	case ipam.ErrNetworkForbidden:
+		return EventNetworkForbidden
+	case ipam.ErrAddressUnavailable:
+		return EventAddressUnavailable
+	}
+	return fallback
+}
+
+// podRef is the reference events of a pod are posted against, kubectl
+// describe matches them by uid, so a uid the runtime did not pass is looked
+// up.
+func (hostgw *HostGatewayCNI) podRef(ns, name, uid string) k8s.ObjectReference {
+	if uid == "" && hostgw.k8sClient != nil {
+		pod, _, err := hostgw.k8sClient.GetPod(ns, name)
+		if err != nil {
+			klog.Warningf("failed to get the uid of pod %s/%s for its events, err is %v", ns, name, err)
+		}
+		uid = pod.MetaData.UID
+	}
+	return k8s.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: ns, Name: name, UID: uid}
+}
+
+// describeEths lists the interfaces of eths for an event message.
+func describeEths(eths []etcd.PodEth) string {
+	var parts []string
+	for _, eth := range eths {
+		var ips []string
+		for _, fixedIp := range eth.FixedIps {
+			ips = append(ips, fixedIp.Ipaddress)
+		}
+		parts = append(parts, fmt.Sprintf("%s on network %s with %s", eth.IfName, eth.NetworkCrd, strings.Join(ips, ",")))
+	}
+	return strings.Join(parts, ", ")
+}
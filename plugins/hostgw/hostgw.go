@@ -3,9 +3,11 @@ package hostgw
 import (
 	"cni/cni"
 	"cni/consts"
+	"cni/datastore"
 	"cni/etcd"
 	"cni/ipam"
 	"cni/skel"
+	"cni/utils/dad"
 	"cni/utils/k8s"
 	"cni/utils/utils"
 	"crypto/rand"
@@ -25,35 +27,72 @@ import (
 
 const MODE = consts.MODE_HOST_GW
 const (
-	NETWORK     = "tinycni.io/network"
+	NETWORK     = k8s.NetworkAnnotation
+	TENANT      = "tinycni.io/tenant"
 	HostVethMac = "ee:ee:ee:ee:ee:ee"
+	defaultMTU  = 1500
 )
 
+// defaultGateway is answered by proxy arp of the host veth when the subnet has
+// no gateway of its own.
+var defaultGateway = net.IPv4(169, 254, 1, 1)
+
 type HostGatewayCNI struct {
-	k8sClient  *k8s.Client
-	etcdClient *etcd.EtcdClient
+	k8sClient *k8s.Client
+	store     datastore.Datastore
+	recorder  *k8s.EventRecorder
+}
+
+func (hostgw *HostGatewayCNI) GetMode() string {
+	return MODE
 }
 
-func (hostgw *HostGatewayCNI) GetNetconf(ns, name string) (string, error) {
-	lables, annos, err := hostgw.k8sClient.GetPodAnnoAndLabels(ns, name)
+func (hostgw *HostGatewayCNI) initDatastore(conf *cni.PluginConf) error {
+	if hostgw.store != nil {
+		return nil
+	}
+	store, err := datastore.New(datastore.Config{Type: conf.Datastore.GetType(), Scope: conf.Datastore.GetScope()}, datastore.Clients{
+		Etcd: func() (*etcd.EtcdClient, error) {
+			return etcd.GetEtcdClient(conf.Datastore.GetEtcd())
+		},
+		K8s: func() (*k8s.Client, error) {
+			if err := hostgw.initK8sClient(); err != nil {
+				return nil, err
+			}
+			return hostgw.k8sClient, nil
+		},
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
-	if networkName, ok := annos[NETWORK]; ok {
-		if networkName != "" {
-			return networkName, nil
-		} else {
-			return "", fmt.Errorf("wrong network")
-		}
-	} else if networkName, ok := lables[NETWORK]; ok {
-		if networkName != "" {
-			return networkName, nil
-		} else {
-			return "", fmt.Errorf("wrong network")
-		}
+	hostgw.store = store
+	return nil
+}
+
+func (hostgw *HostGatewayCNI) initK8sClient() error {
+	if hostgw.k8sClient != nil {
+		return nil
+	}
+	k8sClient, err := k8s.NewHostClient()
+	if err != nil {
+		return err
 	}
-	return "", fmt.Errorf("no network find")
+	hostgw.k8sClient = k8sClient
+	nodeName, _ := os.Hostname()
+	hostgw.recorder = k8s.NewEventRecorder(k8sClient, eventComponent, nodeName)
+	return nil
 }
+
+// GetTenant returns the tenant a namespace is labelled with, namespaces
+// without the label only count against namespace quotas.
+func (hostgw *HostGatewayCNI) GetTenant(ns string) (string, error) {
+	labels, _, err := hostgw.k8sClient.GetNamespaceAnnoAndLabels(ns)
+	if err != nil {
+		return "", err
+	}
+	return labels[TENANT], nil
+}
+
 func (hostgw *HostGatewayCNI) MakeArgsMap(args string) (map[string]string, error) {
 	argsMap := make(map[string]string)
 	pairs := strings.Split(args, ";")
@@ -156,6 +195,13 @@ func configureSysctls(hostVethName string, hasIPv4, hasIPv6 bool) error {
 }
 
 func SetupVethPair(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu int, netNs ns.NetNS) (*types100.Interface, *types100.Interface, error) {
+	return setupVeth(ifName, podMac, hostVethName, podIp, podGw, mtu, 0, netNs)
+}
+
+// setupVeth wires one interface of a pod, table 0 gives it the default route
+// of the pod, any other table routes it by source address, see
+// addPolicyRoutes.
+func setupVeth(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu, table int, netNs ns.NetNS) (*types100.Interface, *types100.Interface, error) {
 	hostinterface := &types100.Interface{}
 	continterface := &types100.Interface{}
 	// 创建vethpair，配置容器ip，默认路由，mtu
@@ -171,6 +217,10 @@ func SetupVethPair(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu
 		if err != nil {
 			return err
 		}
+		// only the host side comes up with the pair
+		if err := netlink.LinkSetUp(contlink); err != nil {
+			return err
+		}
 
 		err = netlink.AddrAdd(contlink, &netlink.Addr{IPNet: &podIp.IPNet})
 		if err != nil {
@@ -183,10 +233,14 @@ func SetupVethPair(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu
 			defaultNet.IP = net.IPv6zero
 		}
 		if podGw.IP == nil {
-			podGw.IP = net.IPv4(169, 254, 1, 1)
+			podGw.IP = defaultGateway
+		}
+		if table != 0 {
+			err = addPolicyRoutes(contlink, podIp, podGw.IP, table)
+		} else {
+			defaultRoute := &types.Route{Dst: defaultNet, GW: podGw.IP}
+			err = ip.AddRoute(&defaultRoute.Dst, defaultRoute.GW, contlink)
 		}
-		defaultRoute := &types.Route{Dst: defaultNet, GW: podGw.IP}
-		err = ip.AddRoute(&defaultRoute.Dst, defaultRoute.GW, contlink)
 		if err != nil {
 			return err
 		}
@@ -228,8 +282,9 @@ func SetupVethPair(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu
 		podIPNet.Mask = net.CIDRMask(128, 128)
 		hasIpv6 = true
 	}
-	defaultRoute := &types.Route{Dst: podIPNet, GW: podGw.IP}
-	err = ip.AddRoute(&defaultRoute.Dst, defaultRoute.GW, hostlink)
+	// the pod address sits on the veth, the gateway of the pod is no address
+	// of the host to route through
+	err = ip.AddRoute(&podIPNet, nil, hostlink)
 	if err != nil {
 		return hostinterface, continterface, err
 	}
@@ -240,41 +295,345 @@ func SetupVethPair(ifName, podMac, hostVethName string, podIp, podGw ip.IP, mtu
 	return hostinterface, continterface, err
 }
 
-func (hostgw *HostGatewayCNI) BootStrap(args *skel.CmdArgs, conf cni.PluginConf) (*types100.Result, error) {
-	//ipam.Init(conf.Subnet, nil)
+// hostVethName names the host side of the i-th interface of a container, the
+// "x" keeps those of extra interfaces apart from the first one.
+func hostVethName(containerId string, i int) string {
+	if i == 0 {
+		return "tiny" + containerId[:utils.Min(11, len(containerId))]
+	}
+	suffix := fmt.Sprintf("x%d", i)
+	return "tiny" + containerId[:utils.Min(11-len(suffix), len(containerId))] + suffix
+}
+
+// attachedInterface is an interface ADD wired into the pod.
+type attachedInterface struct {
+	eth        etcd.PodEth
+	host, cont *types100.Interface
+	allocation *ipam.Allocation
+}
+
+func (hostgw *HostGatewayCNI) BootStrap(args *skel.CmdArgs, conf *cni.PluginConf) (*types100.Result, error) {
+	if err := hostgw.initDatastore(conf); err != nil {
+		return nil, err
+	}
+	if err := hostgw.initK8sClient(); err != nil {
+		return nil, err
+	}
 	argsMap, err := hostgw.MakeArgsMap(args.Args)
 	if err != nil {
 		return nil, err
 	}
 	podNamespace := argsMap["K8S_POD_NAMESPACE"]
 	podName := argsMap["K8S_POD_NAME"]
-	network, err := hostgw.GetNetconf(podNamespace, podName)
+	ref := hostgw.podRef(podNamespace, podName, argsMap["K8S_POD_UID"])
+	result, pod, reason, err := hostgw.bootStrap(args, conf, ref)
 	if err != nil {
+		hostgw.recorder.Eventf(ref, k8s.EventTypeWarning, reason, "%v", err)
 		return nil, err
 	}
+	hostgw.recorder.Eventf(ref, k8s.EventTypeNormal, EventNetworkReady, "attached %s", describeEths(pod.PodEths))
+	return result, nil
+}
+
+// bootStrap wires the pod of ref, on failure reason names what went wrong for
+// the event of the pod.
+func (hostgw *HostGatewayCNI) bootStrap(args *skel.CmdArgs, conf *cni.PluginConf, ref k8s.ObjectReference) (*types100.Result, *etcd.Pod, string, error) {
+	podNamespace, podName := ref.Namespace, ref.Name
+	attachments, err := hostgw.GetAttachments(conf, podNamespace, podName, args.IfName)
+	if err != nil {
+		return nil, nil, EventNetworkSelection, err
+	}
+	tenant, err := hostgw.GetTenant(podNamespace)
+	if err != nil {
+		return nil, nil, EventSetupFailed, err
+	}
+	nodeName, _ := os.Hostname()
 	result := &types100.Result{
 		CNIVersion: conf.CNIVersion,
 	}
-	podIp, gwIp, err := ipam.AllocationIpFromNetwork(network)
+	podNs, err := ns.GetNS(args.Netns)
 	if err != nil {
 		klog.Error(err)
+		return nil, nil, EventSetupFailed, err
+	}
+	defer podNs.Close()
+	pod := &etcd.Pod{
+		Name:        podName,
+		NameSpace:   podNamespace,
+		ContainerId: args.ContainerID,
+		Node:        nodeName,
 	}
-	ifmac := GeneratePortRandomMacAddress()
-	podNs, err := ns.GetNS(podNamespace)
+	// undo what is wired so far when a later interface fails
+	detachAll := func(cause string) {
+		if len(pod.PodEths) == 0 {
+			return
+		}
+		for _, eth := range pod.PodEths {
+			hostgw.detach(podNs, eth)
+			hostgw.release(eth.NetworkCrd, args.ContainerID)
+		}
+		hostgw.recorder.Eventf(ref, k8s.EventTypeWarning, EventRolledBack, "released %s after %s", describeEths(pod.PodEths), cause)
+	}
+	for i, attachment := range attachments {
+		allocateArgs := &ipam.AllocateArgs{
+			Network:     attachment.Network,
+			NameSpace:   podNamespace,
+			PodName:     podName,
+			ContainerId: args.ContainerID,
+			Tenant:      tenant,
+			Node:        nodeName,
+			Mode:        MODE,
+			IP:          attachment.IP,
+		}
+		table := 0
+		if i > 0 {
+			table = policyTableBase + i
+		}
+		attached, err := hostgw.attach(conf, allocateArgs, attachment, hostVethName(args.ContainerID, i), table, podNs)
+		if err != nil {
+			klog.Errorf("failed to attach %s of pod %s/%s to network %s, err is %v", attachment.IfName, podNamespace, podName, attachment.Network, err)
+			detachAll(fmt.Sprintf("%s on network %s failed", attachment.IfName, attachment.Network))
+			return nil, nil, eventReason(err, EventInterfaceFailed), err
+		}
+		pod.PodEths = append(pod.PodEths, attached.eth)
+		result.Interfaces = append(result.Interfaces, attached.host, attached.cont)
+		result.IPs = append(result.IPs, &types100.IPConfig{
+			Interface: types100.Int(len(result.Interfaces) - 1),
+			Address:   attached.allocation.IP.IPNet,
+			Gateway:   attached.allocation.Gateway.IP,
+		})
+	}
+	if err := datastore.PutPod(hostgw.store, *pod); err != nil {
+		detachAll("the pod record could not be written")
+		return nil, nil, EventSetupFailed, err
+	}
+	hostgw.annotatePod(*pod)
+	return result, pod, "", nil
+}
+
+// attach allocates an address of the network of attachment and wires it into
+// the pod as attachment.IfName, an address found in use on the wire is marked
+// as conflict and the next one tried. Nothing is left behind on failure.
+func (hostgw *HostGatewayCNI) attach(conf *cni.PluginConf, args *ipam.AllocateArgs, attachment NetworkAttachment, hostVeth string, table int, podNs ns.NetNS) (*attachedInterface, error) {
+	var allocation *ipam.Allocation
+	var hostinterface, continterface *types100.Interface
+	for attempt := 0; ; attempt++ {
+		var err error
+		allocation, err = hostgw.allocate(conf, args)
+		if err != nil {
+			return nil, err
+		}
+		ifmac := attachment.Mac
+		if ifmac == "" {
+			ifmac = GeneratePortRandomMacAddress()
+		}
+		conflict, err := hostgw.probe(conf, allocation.IP)
+		if err != nil {
+			hostgw.release(args.Network, args.ContainerId)
+			return nil, err
+		}
+		if !conflict.Conflict {
+			mtu := allocation.MTU
+			if mtu == 0 {
+				mtu = defaultMTU
+			}
+			hostinterface, continterface, err = setupVeth(attachment.IfName, ifmac, hostVeth, allocation.IP, allocation.Gateway, mtu, table, podNs)
+			if err != nil {
+				hostgw.teardown(podNs, attachment.IfName)
+				hostgw.release(args.Network, args.ContainerId)
+				return nil, err
+			}
+			break
+		}
+		if err := ipam.MarkIpConflict(hostgw.store, args.Network, args.ContainerId, conflict.HardwareAddr); err != nil {
+			hostgw.release(args.Network, args.ContainerId)
+			return nil, err
+		}
+		// a requested address is not traded for another one
+		if args.IP != "" || attempt >= conf.DAD.GetRetries() {
+			return nil, ipam.NewAddressConflictError(args.Network, allocation.IP.IP.String(), attempt+1)
+		}
+	}
+	gateway := allocation.Gateway.IP
+	if gateway == nil {
+		gateway = defaultGateway
+	}
+	return &attachedInterface{
+		eth: etcd.PodEth{
+			NetworkCrd: args.Network,
+			SubnetName: allocation.Subnet,
+			Mac:        continterface.Mac,
+			IfName:     attachment.IfName,
+			HostVeth:   hostVeth,
+			FixedIps: []etcd.FixedIp{{
+				SubnetId:  allocation.Subnet,
+				Ipaddress: allocation.IP.IP.String(),
+				GatewayIP: gateway.String(),
+			}},
+		},
+		host:       hostinterface,
+		cont:       continterface,
+		allocation: allocation,
+	}, nil
+}
+
+func (hostgw *HostGatewayCNI) allocate(conf *cni.PluginConf, args *ipam.AllocateArgs) (*ipam.Allocation, error) {
+	if conf.WarmPool != nil && conf.WarmPool.Enabled && args.IP == "" {
+		pool := ipam.NewWarmPool(hostgw.store, args.Network, args.Node, conf.WarmPool.Dir)
+		allocation, err := pool.Take(args)
+		if err != nil || allocation != nil {
+			return allocation, err
+		}
+		klog.Infof("no address of network %s taken from the warm pool, fall back to allocation", args.Network)
+	}
+	return ipam.AllocationIpFromNetwork(hostgw.store, args)
+}
+
+// probe checks podIp on the uplink of the node before it is wired, the pod
+// veth only reaches this host which answers every address with proxy_arp.
+func (hostgw *HostGatewayCNI) probe(conf *cni.PluginConf, podIp ip.IP) (dad.Result, error) {
+	if conf.DAD == nil || !conf.DAD.Enabled {
+		return dad.Result{}, nil
+	}
+	if podIp.IP.To4() == nil {
+		klog.V(4).Infof("skip probing %s, only ipv4 addresses are probed", podIp.IP)
+		return dad.Result{}, nil
+	}
+	uplink, err := dad.Uplink(podIp.IP)
 	if err != nil {
-		klog.Error(err)
+		return dad.Result{}, fmt.Errorf("failed to find the uplink to probe %s on: %v", podIp.IP, err)
+	}
+	return dad.Probe(uplink, podIp.IP, conf.DAD.GetTimeout())
+}
+
+func (hostgw *HostGatewayCNI) teardown(podNs ns.NetNS, ifName string) {
+	err := podNs.Do(func(_ ns.NetNS) error {
+		return ip.DelLinkByName(ifName)
+	})
+	if err != nil && err != ip.ErrLinkNotFound {
+		klog.Errorf("failed to delete %s, err is %v", ifName, err)
+	}
+}
+
+// detach removes an interface of the pod together with its policy rules.
+func (hostgw *HostGatewayCNI) detach(podNs ns.NetNS, eth etcd.PodEth) {
+	err := podNs.Do(func(_ ns.NetNS) error {
+		for _, fixedIp := range eth.FixedIps {
+			if addr := net.ParseIP(fixedIp.Ipaddress); addr != nil {
+				delPolicyRules(addr)
+			}
+		}
+		return ip.DelLinkByName(eth.IfName)
+	})
+	if err != nil && err != ip.ErrLinkNotFound {
+		klog.Errorf("failed to delete %s, err is %v", eth.IfName, err)
+	}
+}
+
+func (hostgw *HostGatewayCNI) release(network, containerId string) {
+	if err := ipam.ReleaseIpFromNetwork(hostgw.store, network, containerId); err != nil {
+		klog.Errorf("failed to release ip of container %s, err is %v", containerId, err)
+	}
+}
+
+func (hostgw *HostGatewayCNI) Unmount(args *skel.CmdArgs, conf *cni.PluginConf) error {
+	if err := hostgw.initDatastore(conf); err != nil {
+		return err
+	}
+	// without a pod record only args.IfName is known and every network has to
+	// be searched for the addresses
+	eths := []etcd.PodEth{{IfName: args.IfName}}
+	networks := []string{""}
+	podNamespace, podName := "", ""
+	if pod, err := datastore.GetPodByContainerId(hostgw.store, args.ContainerID); err == nil {
+		podNamespace, podName = pod.NameSpace, pod.Name
+		if len(pod.PodEths) > 0 {
+			eths, networks = pod.PodEths, nil
+			for _, eth := range pod.PodEths {
+				networks = append(networks, eth.NetworkCrd)
+			}
+		}
+	} else if argsMap, err := hostgw.MakeArgsMap(args.Args); err == nil {
+		podNamespace, podName = argsMap["K8S_POD_NAMESPACE"], argsMap["K8S_POD_NAME"]
+	}
+	if args.Netns != "" {
+		podNs, err := ns.GetNS(args.Netns)
+		if err != nil {
+			// the netns may already be gone, the addresses must be released anyway
+			klog.Warningf("failed to open %s, err is %v", args.Netns, err)
+		} else {
+			for _, eth := range eths {
+				hostgw.detach(podNs, eth)
+			}
+			podNs.Close()
+		}
 	}
-	hostVethName := "tiny" + args.ContainerID[:utils.Min(11, len(args.ContainerID))]
-	hostinterface, continterface, err := SetupVethPair(args.IfName, ifmac, hostVethName, podIp, gwIp, 1500, podNs)
+	for _, network := range networks {
+		if err := ipam.ReleaseIpFromNetwork(hostgw.store, network, args.ContainerID); err != nil {
+			return err
+		}
+	}
+	if err := datastore.DeletePodByContainerId(hostgw.store, args.ContainerID); err != nil {
+		return err
+	}
+	if podName != "" {
+		if err := hostgw.initK8sClient(); err != nil {
+			klog.Warningf("cannot reach k8s to remove the network annotations of pod %s/%s, err is %v", podNamespace, podName, err)
+			return nil
+		}
+		hostgw.unannotatePod(podNamespace, podName, args.ContainerID)
+	}
+	return nil
+}
+
+func (hostgw *HostGatewayCNI) Check(args *skel.CmdArgs, conf *cni.PluginConf) error {
+	if err := hostgw.initDatastore(conf); err != nil {
+		return err
+	}
+	pod, err := datastore.GetPodByContainerId(hostgw.store, args.ContainerID)
 	if err != nil {
-		klog.Error(err)
+		return err
 	}
-	result.Interfaces = []*types100.Interface{hostinterface, continterface}
-	podIpconfig := &types100.IPConfig{
-		Interface: types100.Int(1),
-		Address:   podIp.IPNet,
-		Gateway:   gwIp.IP,
+	for _, eth := range pod.PodEths {
+		if eth.IfName != args.IfName {
+			continue
+		}
+		return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return checkPodEth(eth)
+		})
+	}
+	return fmt.Errorf("pod %s/%s has no interface %s", pod.NameSpace, pod.Name, args.IfName)
+}
+
+// checkPodEth compares an interface of the current netns with its record.
+func checkPodEth(eth etcd.PodEth) error {
+	link, err := netlink.LinkByName(eth.IfName)
+	if err != nil {
+		return err
+	}
+	if mac := link.Attrs().HardwareAddr.String(); mac != eth.Mac {
+		return fmt.Errorf("interface %s has mac %s, expected %s", eth.IfName, mac, eth.Mac)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, fixedIp := range eth.FixedIps {
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.String() == fixedIp.Ipaddress {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("interface %s lost its address %s", eth.IfName, fixedIp.Ipaddress)
+		}
+	}
+	return nil
+}
+
+func init() {
+	if err := cni.GetCNIManager().Register(&HostGatewayCNI{}); err != nil {
+		klog.Errorf("failed to register %s cni, err is %v", MODE, err)
 	}
-	result.IPs = []*types100.IPConfig{podIpconfig}
-	return result, nil
 }
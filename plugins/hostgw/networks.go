@@ -0,0 +1,70 @@
+package hostgw
+
+import (
+	"cni/cni"
+	"cni/utils/k8s"
+	"fmt"
+)
+
+// NETWORKS lists the networks a pod joins beyond its first one, see
+// k8s.NetworksAnnotation.
+const NETWORKS = k8s.NetworksAnnotation
+
+// NetworkAttachment is one interface of a pod and the network behind it, IP
+// and Mac are empty unless the pod asked for them.
+type NetworkAttachment struct {
+	Network string
+	IfName  string
+	IP      string
+	Mac     string
+}
+
+// GetAttachments lists the interfaces of a pod: ifName on the network of
+// GetNetconf, then one per entry of the NETWORKS annotation, named net1,
+// net2 and so on unless the entry names it.
+func (hostgw *HostGatewayCNI) GetAttachments(conf *cni.PluginConf, ns, name, ifName string) ([]NetworkAttachment, error) {
+	labels, annos, err := hostgw.k8sClient.GetPodAnnoAndLabels(ns, name)
+	if err != nil {
+		return nil, err
+	}
+	network, err := hostgw.GetNetconf(conf, ns, name, labels, annos)
+	if err != nil {
+		return nil, err
+	}
+	selections, err := k8s.ParseNetworkSelections(annos[NETWORKS])
+	if err != nil {
+		return nil, err
+	}
+	attachments := []NetworkAttachment{{Network: network, IfName: ifName}}
+	networks := map[string]bool{network: true}
+	ifNames := map[string]bool{ifName: true}
+	for _, selection := range selections {
+		if networks[selection.Name] {
+			return nil, fmt.Errorf("pod %s/%s joins network %s more than once", ns, name, selection.Name)
+		}
+		networks[selection.Name] = true
+		if selection.Interface != "" {
+			if ifNames[selection.Interface] {
+				return nil, fmt.Errorf("interface name %s of network %s is taken", selection.Interface, selection.Name)
+			}
+			ifNames[selection.Interface] = true
+		}
+		attachments = append(attachments, NetworkAttachment{
+			Network: selection.Name,
+			IfName:  selection.Interface,
+			IP:      selection.IP(),
+			Mac:     selection.Mac,
+		})
+	}
+	next := 1
+	for i := range attachments {
+		for attachments[i].IfName == "" {
+			if candidate := fmt.Sprintf("net%d", next); !ifNames[candidate] {
+				attachments[i].IfName = candidate
+				ifNames[candidate] = true
+			}
+			next++
+		}
+	}
+	return attachments, nil
+}
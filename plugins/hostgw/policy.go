@@ -0,0 +1,88 @@
+package hostgw
+
+import (
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+	"net"
+)
+
+// the routing table of the i-th extra interface of a pod is policyTableBase+i,
+// the rule selecting it has the same priority
+const policyTableBase = 100
+
+func hostBits(addr net.IP) (int, int) {
+	if addr.To4() != nil {
+		return netlink.FAMILY_V4, 32
+	}
+	return netlink.FAMILY_V6, 128
+}
+
+// addPolicyRoutes makes everything sent from podIp leave on link, through a
+// table of its own that a rule on the source address selects. Extra
+// interfaces get no default route in the main table, without the rule replies
+// to traffic that came in on them would leave on the first interface.
+func addPolicyRoutes(link netlink.Link, podIp ip.IP, gateway net.IP, table int) error {
+	family, bits := hostBits(podIp.IP)
+	index := link.Attrs().Index
+	routes := []*netlink.Route{{
+		LinkIndex: index,
+		Dst:       &net.IPNet{IP: podIp.IP.Mask(podIp.Mask), Mask: podIp.Mask},
+		Src:       podIp.IP,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+	}}
+	if gatewayFamily, _ := hostBits(gateway); gatewayFamily == family {
+		defaultNet := &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, bits)}
+		if family == netlink.FAMILY_V4 {
+			defaultNet.IP = net.IPv4zero.To4()
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: index,
+			Dst:       &net.IPNet{IP: gateway, Mask: net.CIDRMask(bits, bits)},
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		}, &netlink.Route{
+			LinkIndex: index,
+			Dst:       defaultNet,
+			Gw:        gateway,
+			Table:     table,
+		})
+	} else {
+		klog.Warningf("gateway %s does not fit %s, table %d routes only its subnet", gateway, podIp.IP, table)
+	}
+	for _, route := range routes {
+		if err := netlink.RouteReplace(route); err != nil {
+			return err
+		}
+	}
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Src = &net.IPNet{IP: podIp.IP, Mask: net.CIDRMask(bits, bits)}
+	rule.Table = table
+	rule.Priority = table
+	return netlink.RuleAdd(rule)
+}
+
+// delPolicyRules removes the rules addPolicyRoutes added for addr, the routes
+// of the table go with the link.
+func delPolicyRules(addr net.IP) {
+	family, bits := hostBits(addr)
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		klog.Warningf("failed to list the rules of %s, err is %v", addr, err)
+		return
+	}
+	for i := range rules {
+		src := rules[i].Src
+		if src == nil || !src.IP.Equal(addr) {
+			continue
+		}
+		if ones, _ := src.Mask.Size(); ones != bits {
+			continue
+		}
+		if err := netlink.RuleDel(&rules[i]); err != nil {
+			klog.Warningf("failed to delete the rule of %s, err is %v", addr, err)
+		}
+	}
+}
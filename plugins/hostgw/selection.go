@@ -0,0 +1,60 @@
+package hostgw
+
+import (
+	"cni/cni"
+	"cni/ipam"
+	"fmt"
+	"k8s.io/klog"
+	"strings"
+)
+
+// GetNetconf picks the network of a pod from its labels and annotations, the
+// first of: the annotation of the pod, its label, the annotation of its
+// namespace, the network whose pod selector matches its labels, the
+// defaultNetwork of the netconf.
+func (hostgw *HostGatewayCNI) GetNetconf(conf *cni.PluginConf, ns, name string, labels, annos map[string]string) (string, error) {
+	network, source, err := hostgw.selectNetwork(conf, ns, name, labels, annos)
+	if err != nil {
+		return "", err
+	}
+	klog.Infof("pod %s/%s joins network %s, taken from the %s", ns, name, network, source)
+	return network, nil
+}
+
+func (hostgw *HostGatewayCNI) selectNetwork(conf *cni.PluginConf, ns, name string, labels, annos map[string]string) (string, string, error) {
+	if networkName, ok := annos[NETWORK]; ok {
+		return namedNetwork(networkName, "pod annotation")
+	}
+	if networkName, ok := labels[NETWORK]; ok {
+		return namedNetwork(networkName, "pod label")
+	}
+	_, nsAnnos, err := hostgw.k8sClient.GetNamespaceAnnoAndLabels(ns)
+	if err != nil {
+		return "", "", err
+	}
+	if networkName, ok := nsAnnos[NETWORK]; ok {
+		return namedNetwork(networkName, "annotation of namespace "+ns)
+	}
+	selected, err := ipam.SelectNetworks(hostgw.store, labels)
+	if err != nil {
+		return "", "", err
+	}
+	switch len(selected) {
+	case 0:
+	case 1:
+		return selected[0], "pod selector of the network", nil
+	default:
+		return "", "", fmt.Errorf("the labels of pod %s/%s match the pod selectors of networks %s, set %s to choose one", ns, name, strings.Join(selected, ", "), NETWORK)
+	}
+	if conf.DefaultNetwork != "" {
+		return conf.DefaultNetwork, "defaultNetwork of the netconf", nil
+	}
+	return "", "", fmt.Errorf("no network for pod %s/%s: set %s on the pod or its namespace, give a network a matching pod selector or set defaultNetwork in the netconf", ns, name, NETWORK)
+}
+
+func namedNetwork(networkName, source string) (string, string, error) {
+	if networkName == "" {
+		return "", "", fmt.Errorf("empty network in the %s %s", source, NETWORK)
+	}
+	return networkName, source, nil
+}
@@ -190,7 +190,7 @@ func PluginMainWithError(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versio
 func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) {
 	if e := PluginMainWithError(cmdAdd, cmdCheck, cmdDel, versionInfo, about); e != nil {
 		if err := e.Print(); err != nil {
-			klog.Errorf("Error write in error Json to stdout : ", err)
+			klog.Errorf("Error write in error Json to stdout : %v", err)
 		}
 		os.Exit(1)
 	}
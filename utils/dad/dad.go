@@ -0,0 +1,154 @@
+package dad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+	// probes sent per RFC 5227, the answers are collected until the timeout
+	probeNum = 3
+)
+
+// Result tells whether an address is already used by someone else on the
+// link, HardwareAddr is the mac that answered for it when known.
+type Result struct {
+	Conflict     bool
+	HardwareAddr string
+}
+
+// Uplink returns the link of the default route for the family of addr, the
+// segment a duplicate of a routed pod address would show up on.
+func Uplink(addr net.IP) (string, error) {
+	family := netlink.FAMILY_V6
+	if addr.To4() != nil {
+		family = netlink.FAMILY_V4
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("no default route for %s", addr)
+}
+
+// Probe sends RFC 5227 ARP probes for addr out of ifName, it must be called
+// inside the netns of the link. Only ipv4 addresses can be probed.
+func Probe(ifName string, addr net.IP, timeout time.Duration) (Result, error) {
+	v4 := addr.To4()
+	if v4 == nil {
+		return Result{}, fmt.Errorf("cannot probe %s, only ipv4 addresses are probed", addr)
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return Result{}, err
+	}
+	return arpProbe(link, v4, timeout)
+}
+
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
+
+func arpPacket(srcMac net.HardwareAddr, target net.IP) []byte {
+	buf := new(bytes.Buffer)
+	// ethernet, ipv4, hardware and protocol address length, request
+	_ = binary.Write(buf, binary.BigEndian, []uint16{1, syscall.ETH_P_IP})
+	buf.Write([]byte{6, 4})
+	_ = binary.Write(buf, binary.BigEndian, uint16(arpRequest))
+	buf.Write(srcMac)
+	// a probe carries 0.0.0.0 as sender so no neighbour cache gets polluted
+	buf.Write(net.IPv4zero.To4())
+	buf.Write(make([]byte, 6))
+	buf.Write(target)
+	return buf.Bytes()
+}
+
+func arpProbe(link netlink.Link, target net.IP, timeout time.Duration) (Result, error) {
+	srcMac := link.Attrs().HardwareAddr
+	if len(srcMac) != 6 {
+		return Result{}, fmt.Errorf("link %s has no ethernet address", link.Attrs().Name)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return Result{}, err
+	}
+	defer syscall.Close(fd)
+	sockAddr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+	}
+	if err := syscall.Bind(fd, sockAddr); err != nil {
+		return Result{}, err
+	}
+	broadcast := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	tv := syscall.NsecToTimeval((timeout / probeNum).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return Result{}, err
+	}
+	packet := arpPacket(srcMac, target)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 128)
+	for i := 0; i < probeNum; i++ {
+		if err := syscall.Sendto(fd, packet, 0, broadcast); err != nil {
+			return Result{}, err
+		}
+		for roundEnd := time.Now().Add(timeout / probeNum); time.Now().Before(roundEnd) && time.Now().Before(deadline); {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+					break
+				}
+				return Result{}, err
+			}
+			if mac, ok := answersFor(buf[:n], target, srcMac); ok {
+				return Result{Conflict: true, HardwareAddr: mac.String()}, nil
+			}
+		}
+	}
+	return Result{}, nil
+}
+
+// answersFor reports whether packet is an ARP reply from target, or a probe
+// or announcement of target sent by another host.
+func answersFor(packet []byte, target net.IP, ownMac net.HardwareAddr) (net.HardwareAddr, bool) {
+	if len(packet) < 28 {
+		return nil, false
+	}
+	op := binary.BigEndian.Uint16(packet[6:8])
+	senderMac := net.HardwareAddr(packet[8:14])
+	senderIp := net.IP(packet[14:18])
+	targetIp := net.IP(packet[24:28])
+	if bytes.Equal(senderMac, ownMac) {
+		return nil, false
+	}
+	switch op {
+	case arpReply:
+		return senderMac, senderIp.Equal(target)
+	case arpRequest:
+		return senderMac, senderIp.Equal(target) || (senderIp.Equal(net.IPv4zero) && targetIp.Equal(target))
+	}
+	return nil, false
+}
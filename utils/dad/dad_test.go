@@ -0,0 +1,70 @@
+package dad
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var (
+	ownMac   = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	otherMac = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	target   = net.ParseIP("10.10.0.7").To4()
+)
+
+// arp builds an ethernet ipv4 ARP packet.
+func arp(op byte, senderMac net.HardwareAddr, senderIp, targetIp net.IP) []byte {
+	packet := []byte{0, 1, 8, 0, 6, 4, 0, op}
+	packet = append(packet, senderMac...)
+	packet = append(packet, senderIp.To4()...)
+	packet = append(packet, make([]byte, 6)...)
+	return append(packet, targetIp.To4()...)
+}
+
+func TestArpPacket(t *testing.T) {
+	packet := arpPacket(ownMac, target)
+	want := arp(arpRequest, ownMac, net.IPv4zero, target)
+	if !bytes.Equal(packet, want) {
+		t.Errorf("arpPacket = % x, want % x", packet, want)
+	}
+	// our own probe coming back is no conflict
+	if _, ok := answersFor(packet, target, ownMac); ok {
+		t.Error("answersFor took our own probe for a conflict")
+	}
+}
+
+func TestAnswersFor(t *testing.T) {
+	other := net.ParseIP("10.10.0.9")
+	tests := []struct {
+		name     string
+		packet   []byte
+		conflict bool
+	}{
+		{"reply from target", arp(arpReply, otherMac, target, net.IPv4zero), true},
+		{"reply from another address", arp(arpReply, otherMac, other, target), false},
+		{"announcement of target", arp(arpRequest, otherMac, target, target), true},
+		{"probe of target by another host", arp(arpRequest, otherMac, net.IPv4zero, target), true},
+		{"probe of another address", arp(arpRequest, otherMac, net.IPv4zero, other), false},
+		{"request for target from an owned address", arp(arpRequest, otherMac, other, target), false},
+		{"reply sent by us", arp(arpReply, ownMac, target, other), false},
+		{"unknown operation", arp(3, otherMac, target, target), false},
+		{"short packet", arp(arpReply, otherMac, target, target)[:27], false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mac, conflict := answersFor(test.packet, target, ownMac)
+			if conflict != test.conflict {
+				t.Fatalf("answersFor = %v, want %v", conflict, test.conflict)
+			}
+			if conflict && mac.String() != otherMac.String() {
+				t.Errorf("answersFor mac = %s, want %s", mac, otherMac)
+			}
+		})
+	}
+}
+
+func TestProbeRejectsIpv6(t *testing.T) {
+	if _, err := Probe("eth0", net.ParseIP("fd00::7"), 0); err == nil {
+		t.Error("Probe of an ipv6 address succeeded")
+	}
+}
@@ -2,59 +2,160 @@ package k8s
 
 import (
 	"cni/utils/rest"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"github.com/emicklei/go-restful"
 	"io/ioutil"
 	"k8s.io/klog"
-
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Client struct {
 	*rest.Client
 	Token string
+	// TokenFile replaces Token whenever the file changes
+	TokenFile string
+	Username  string
+	Password  string
+	// Namespace is the namespace of the kubeconfig context or service account
+	Namespace string
+
+	tokenLock    sync.Mutex
+	tokenModTime time.Time
 }
 
+// NewClient connects with the kubeconfig of the flags when one is given,
+// else with the server, certificates and token of the flags.
 func NewClient(conf *Flags) (*Client, error) {
-	if strings.HasPrefix(conf.K8sApiServer, "https") {
-		token := ""
-		ca, err := ioutil.ReadFile(conf.K8sCA)
+	if conf.InCluster {
+		config, err := InClusterConfig()
 		if err != nil {
-			return nil, fmt.Errorf("failed to read k8s ca file: %v", err)
+			return nil, err
 		}
-		caPool := x509.NewCertPool()
-		caPool.AppendCertsFromPEM(ca)
-		tlsCfg := &tls.Config{RootCAs: caPool}
-		cert, err := tls.LoadX509KeyPair(conf.K8sCert, conf.K8sKey)
+		return NewClientFromConfig(config)
+	}
+	if conf.Kubeconfig != "" {
+		config, err := LoadKubeConfig(conf.Kubeconfig, conf.Context)
 		if err != nil {
-			if conf.K8sToken == "" {
-				return nil, fmt.Errorf("failed to load the client certificates and missing auth token :%v", err)
+			return nil, err
+		}
+		return NewClientFromConfig(config)
+	}
+	config := &RestConfig{Host: conf.K8sApiServer, Token: conf.K8sToken, TokenFile: conf.K8sTokenFile}
+	var err error
+	if conf.K8sCA != "" {
+		if config.CAData, err = ioutil.ReadFile(conf.K8sCA); err != nil {
+			return nil, fmt.Errorf("failed to read k8s ca file: %v", err)
+		}
+	}
+	if conf.K8sCert != "" && conf.K8sKey != "" {
+		if config.CertData, err = ioutil.ReadFile(conf.K8sCert); err != nil {
+			return nil, fmt.Errorf("failed to read k8s cert file: %v", err)
+		}
+		if config.KeyData, err = ioutil.ReadFile(conf.K8sKey); err != nil {
+			return nil, fmt.Errorf("failed to read k8s key file: %v", err)
+		}
+	}
+	return NewClientFromConfig(config)
+}
+
+func NewClientFromConfig(config *RestConfig) (*Client, error) {
+	c := &Client{
+		Token:     config.Token,
+		TokenFile: config.TokenFile,
+		Username:  config.Username,
+		Password:  config.Password,
+		Namespace: config.Namespace,
+	}
+	if strings.HasPrefix(config.Host, "https") {
+		tlsCfg := &tls.Config{ServerName: config.TLSServerName, InsecureSkipVerify: config.Insecure}
+		if len(config.CAData) > 0 {
+			caPool := x509.NewCertPool()
+			if !caPool.AppendCertsFromPEM(config.CAData) {
+				return nil, fmt.Errorf("no certificate found in the k8s ca")
+			}
+			tlsCfg.RootCAs = caPool
+		}
+		if len(config.CertData) > 0 || len(config.KeyData) > 0 {
+			cert, err := tls.X509KeyPair(config.CertData, config.KeyData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the k8s client certificate: %v", err)
 			}
-			token = conf.K8sToken
-		} else {
 			tlsCfg.Certificates = []tls.Certificate{cert}
-			tlsCfg.BuildNameToCertificate()
+		} else if c.Token == "" && c.TokenFile == "" && c.Username == "" {
+			return nil, fmt.Errorf("no client certificate, token or basic auth to access %s", config.Host)
 		}
-		transport := &http.Transport{TLSClientConfig: tlsCfg}
-		client := &http.Client{Transport: transport}
-		c := &Client{Client: rest.NewClient(client, conf.K8sApiServer), Token: token}
-		return c, nil
-	} else if strings.HasPrefix(conf.K8sApiServer, "http") {
-		c := &Client{Client: rest.NewClient(http.DefaultClient, conf.K8sApiServer)}
-		return c, nil
+		transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg}
+		c.Client = rest.NewClient(&http.Client{Transport: transport}, config.Host)
+	} else if strings.HasPrefix(config.Host, "http") {
+		c.Client = rest.NewClient(http.DefaultClient, config.Host)
 	} else {
-		return nil, fmt.Errorf("only http or https is supported ofr apiserver,get %s", conf.K8sApiServer)
+		return nil, fmt.Errorf("only http or https is supported ofr apiserver,get %s", config.Host)
+	}
+	if c.TokenFile != "" {
+		if _, err := c.token(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// NewHostClient connects with the service account inside a pod, else with
+// the kubeconfig of the node the plugin runs on.
+func NewHostClient() (*Client, error) {
+	config, err := HostConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewClientFromConfig(config)
+}
+
+// token reads TokenFile again when it changed since the last request.
+func (c *Client) token() (string, error) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	if c.TokenFile == "" {
+		return c.Token, nil
+	}
+	info, err := os.Stat(c.TokenFile)
+	if err != nil {
+		if c.Token != "" {
+			klog.Warningf("failed to stat token file %s, keep the last token, err is %v", c.TokenFile, err)
+			return c.Token, nil
+		}
+		return "", fmt.Errorf("failed to read k8s token file: %v", err)
+	}
+	if c.Token != "" && info.ModTime().Equal(c.tokenModTime) {
+		return c.Token, nil
+	}
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read k8s token file: %v", err)
 	}
+	c.Token, c.tokenModTime = strings.TrimSpace(string(data)), info.ModTime()
+	return c.Token, nil
 }
 
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Content-Type", restful.MIME_JSON)
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", restful.MIME_JSON)
+	}
 	req.Header.Set("Accept", restful.MIME_JSON)
-	if c.Token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	token, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
 	}
 	resp, err := c.Client.Do(req)
 	if err != nil {
@@ -63,9 +164,11 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// CheckResponse turns a response outside of 2xx into an *rest.APIError with
+// the reason and message of its Status.
 func (c *Client) CheckResponse(method string, path string, body interface{}, resp *http.Response) (*http.Response, error) {
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		return resp, rest.NewBadResponseError(method, path, body, http.StatusText(resp.StatusCode))
+	if rest.IsBadResponse(resp) {
+		return resp, rest.NewAPIError(method, path, resp)
 	}
 	return resp, nil
 }
@@ -73,6 +176,10 @@ func (c *Client) Request(method string, path string, body interface{}, respObj i
 	return rest.Request(c, method, path, body, respObj)
 }
 
+func (c *Client) RequestContext(ctx context.Context, method string, path string, body interface{}, respObj interface{}) (int, error) {
+	return rest.RequestContext(ctx, c, method, path, body, respObj)
+}
+
 func (c *Client) GetVersion() (Version, error) {
 	var ver Version
 	if code, err := c.Request("GET", "/version", nil, &ver); err != nil {
@@ -92,7 +199,7 @@ func (c *Client) GetNodeList(req *restful.Request, resp *restful.Response) {
 		rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
 		return
 	}
-	klog.Infof("get k8s nodes : %+v , code : %v", nodeList, code)
+	klog.V(4).Infof("get %d k8s nodes, code : %v", len(nodeList.Items), code)
 	nodeListResp = NodeList{
 		Kind:       nodeList.Kind,
 		APIVersion: nodeList.APIVersion,
@@ -108,12 +215,20 @@ func (c *Client) GetNodeList(req *restful.Request, resp *restful.Response) {
 		}
 		node.Status.Conditions = conditions
 		nodeListResp.Items = append(nodeListResp.Items, node)
-		klog.Infof("node condition is %+v", node.Status.Conditions)
+		klog.V(4).Infof("node condition is %+v", node.Status.Conditions)
 	}
 	_ = resp.WriteAsJson(nodeListResp)
 	return
 }
 
+func (c *Client) GetNode(name string) (Node, error) {
+	var node Node
+	if _, err := c.Request("GET", fmt.Sprintf("/api/v1/nodes/%s", name), nil, &node); err != nil {
+		return node, err
+	}
+	return node, nil
+}
+
 func (c *Client) GetPodAnnoAndLabels(ns, name string) (PodLabels, PodAnnotations, error) {
 	podUrl := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", ns, name)
 	var pod Pod
@@ -122,6 +237,14 @@ func (c *Client) GetPodAnnoAndLabels(ns, name string) (PodLabels, PodAnnotations
 	}
 	return pod.MetaData.Labels, pod.MetaData.Annotations, nil
 }
+func (c *Client) GetNamespaceAnnoAndLabels(name string) (map[string]string, map[string]string, error) {
+	nsUrl := fmt.Sprintf("/api/v1/namespaces/%s", name)
+	var namespace Namespace
+	if _, err := c.Request("GET", nsUrl, nil, &namespace); err != nil {
+		return nil, nil, err
+	}
+	return namespace.MetaData.Labels, namespace.MetaData.Annotations, nil
+}
 func (c *Client) GetPodList(req *restful.Request, resp *restful.Response) {
 	var podList PodList
 
@@ -141,7 +264,7 @@ func (c *Client) GetPodList(req *restful.Request, resp *restful.Response) {
 			podListResp.Items = append(podListResp.Items, pod)
 		}
 	}
-	klog.Infof("get k8s pods : %+v , code : %v", podList, code)
+	klog.V(4).Infof("get %d k8s pods, code : %v", len(podList.Items), code)
 	_ = resp.WriteAsJson(podListResp)
 	return
 }
@@ -226,7 +349,7 @@ func (c *Client) GetEndPointList(req *restful.Request, resp *restful.Response) {
 		rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
 		return
 	}
-	klog.Infof("get k8s endpoints : %+v , code : %v", endpointsList, code)
+	klog.V(4).Infof("get %d k8s endpoints, code : %v", len(endpointsList.Items), code)
 	_ = resp.WriteAsJson(endpointsList)
 	return
 }
@@ -239,7 +362,7 @@ func (c *Client) GetServiceList(req *restful.Request, resp *restful.Response) {
 		rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
 		return
 	}
-	klog.Infof("get k8s services : %+v , code : %v", serviceList, code)
+	klog.V(4).Infof("get %d k8s services, code : %v", len(serviceList.Items), code)
 	var endpointsList EndpointsList
 	code, err = c.Request("GET", "/api/v1/endpoints", nil, &endpointsList)
 	if err != nil {
@@ -247,7 +370,7 @@ func (c *Client) GetServiceList(req *restful.Request, resp *restful.Response) {
 		rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
 		return
 	}
-	klog.Infof("get k8s endpoints : %+v , code : %v", endpointsList, code)
+	klog.V(4).Infof("get %d k8s endpoints, code : %v", len(endpointsList.Items), code)
 	serviceRespList.Kind = serviceList.Kind
 	serviceRespList.ApiVersion = serviceList.ApiVersion
 	for _, service := range serviceList.Items {
@@ -273,7 +396,75 @@ func (c *Client) GetNetworkCrdList(req *restful.Request, resp *restful.Response)
 		rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
 		return
 	}
-	klog.Infof("get k8s networkCrd : %+v , code : %v", networkCrdList, code)
+	klog.V(4).Infof("get %d k8s networkCrds, code : %v", len(networkCrdList.Items), code)
 	_ = resp.WriteAsJson(networkCrdList)
 	return
 }
+
+// the datastore shard accessors return the http code, the kubernetes datastore
+// tells a missing shard and a lost update apart by it
+func (c *Client) GetDatastoreShard(name string) (DatastoreShard, int, error) {
+	var shard DatastoreShard
+	code, err := c.Request("GET", fmt.Sprintf("%s/%s", DatastoreShardsPath, name), nil, &shard)
+	return shard, code, err
+}
+
+// ListDatastoreShards lists the shards of shardKind and shardGroup, either
+// may be empty to match every shard.
+func (c *Client) ListDatastoreShards(shardKind, shardGroup string) (DatastoreShardList, error) {
+	var list DatastoreShardList
+	var selector []string
+	if shardKind != "" {
+		selector = append(selector, DatastoreShardLabel+"="+shardKind)
+	}
+	if shardGroup != "" {
+		selector = append(selector, DatastoreShardGroupLabel+"="+shardGroup)
+	}
+	path := DatastoreShardsPath
+	if len(selector) > 0 {
+		path = fmt.Sprintf("%s?labelSelector=%s", path, url.QueryEscape(strings.Join(selector, ",")))
+	}
+	_, err := c.Request("GET", path, nil, &list)
+	return list, err
+}
+
+func (c *Client) CreateDatastoreShard(shard *DatastoreShard) (int, error) {
+	shard.APIVersion = TinyCniGroupVersion
+	shard.Kind = DatastoreShardKind
+	return c.Request("POST", DatastoreShardsPath, shard, shard)
+}
+
+// UpdateDatastoreShard fails with 409 when shard changed since its
+// resourceVersion was read.
+func (c *Client) UpdateDatastoreShard(shard *DatastoreShard) (int, error) {
+	shard.APIVersion = TinyCniGroupVersion
+	shard.Kind = DatastoreShardKind
+	return c.Request("PUT", fmt.Sprintf("%s/%s", DatastoreShardsPath, shard.MetaData.Name), shard, shard)
+}
+
+func (c *Client) ListNetworks() (NetworkList, error) {
+	var list NetworkList
+	_, err := c.Request("GET", NetworksPath, nil, &list)
+	return list, err
+}
+
+func (c *Client) GetNetwork(name string) (Network, int, error) {
+	var network Network
+	code, err := c.Request("GET", fmt.Sprintf("%s/%s", NetworksPath, name), nil, &network)
+	return network, code, err
+}
+
+// UpdateNetwork writes the metadata and spec of network, its status is left
+// alone by the status subresource. Like UpdateNetworkStatus it fails with 409
+// when network changed since its resourceVersion was read.
+func (c *Client) UpdateNetwork(network *Network) (int, error) {
+	network.APIVersion = TinyCniGroupVersion
+	network.Kind = NetworkKind
+	return c.Request("PUT", fmt.Sprintf("%s/%s", NetworksPath, network.MetaData.Name), network, network)
+}
+
+func (c *Client) UpdateNetworkStatus(network *Network) (int, error) {
+	network.APIVersion = TinyCniGroupVersion
+	network.Kind = NetworkKind
+	return c.Request("PUT", fmt.Sprintf("%s/%s/status", NetworksPath, network.MetaData.Name), network, network)
+}
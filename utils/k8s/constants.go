@@ -6,3 +6,41 @@ const (
 	ValuePath    = "networkinfo"
 	AbsolutePath = BasePath + "/" + ValuePath
 )
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+	// NetworkStatusAnnotation is the annotation of the network plumbing
+	// working group that multus and its users read
+	NetworkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+	// NetworkInfoAnnotation adds what tinycni knows beyond network-status
+	NetworkInfoAnnotation = "tinycni.io/network-info"
+)
+
+const (
+	TinyCniGroupVersion = "tinycni.io/v1"
+	DatastoreShardKind  = "DatastoreShard"
+	DatastoreShardsPath = "/apis/" + TinyCniGroupVersion + "/datastoreshards"
+	DatastoreShardLabel = "tinycni.io/shard-kind"
+	// DatastoreShardGroupLabel holds the network, or the namespace for pods,
+	// of a shard
+	DatastoreShardGroupLabel = "tinycni.io/shard-group"
+	NetworkKind              = "Network"
+	NetworksPath             = "/apis/" + TinyCniGroupVersion + "/networks"
+	// NetworkFinalizer holds a Network back until its addresses are released
+	// and its records are gone from the datastore
+	NetworkFinalizer = "tinycni.io/network"
+)
+
+// the conditions of a Network
+const (
+	NetworkConditionValid = "Valid"
+	NetworkConditionReady = "Ready"
+	ConditionTrue         = "True"
+	ConditionFalse        = "False"
+)
+
+const (
+	AdmissionAPIVersion = "admission.k8s.io/v1"
+	AdmissionReviewKind = "AdmissionReview"
+)
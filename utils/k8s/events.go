@@ -0,0 +1,181 @@
+package k8s
+
+import (
+	"cni/utils/rest"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+const (
+	// eventTimeout bounds the writes of one event, an event is never worth
+	// holding up the work it reports on
+	eventTimeout = 3 * time.Second
+	// eventRefreshInterval is how often a repeated event is written at most,
+	// repeats in between are dropped
+	eventRefreshInterval = 10 * time.Second
+	// eventBurst and eventTokenInterval bound the events of one process
+	eventBurst         = 25
+	eventTokenInterval = 10 * time.Second
+	maxEventMessage    = 1024
+)
+
+type ObjectReference struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	UID        string `json:"uid,omitempty"`
+}
+
+type EventSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+// Event is a core/v1 Event.
+type Event struct {
+	APIVersion         string          `json:"apiVersion"`
+	Kind               string          `json:"kind"`
+	MetaData           EventMeta       `json:"metadata"`
+	InvolvedObject     ObjectReference `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             EventSource     `json:"source"`
+	FirstTimestamp     string          `json:"firstTimestamp,omitempty"`
+	LastTimestamp      string          `json:"lastTimestamp,omitempty"`
+	Count              int32           `json:"count,omitempty"`
+	ReportingComponent string          `json:"reportingComponent,omitempty"`
+	ReportingInstance  string          `json:"reportingInstance,omitempty"`
+}
+
+type EventMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+func PodReference(pod *Pod) ObjectReference {
+	return ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: pod.MetaData.NameSpace, Name: pod.MetaData.Name, UID: pod.MetaData.UID}
+}
+
+// EventRecorder posts Events for the objects tinycni works on. The same
+// event of the same object is collapsed into one Event whose count grows,
+// it is named after a hash of what it reports so that the short lived plugin
+// processes of a node find the Event of the one before. A repeat within
+// eventRefreshInterval of the last write is dropped and every process posts
+// at most eventBurst events at once, one more every eventTokenInterval.
+// Failures are logged only.
+type EventRecorder struct {
+	client    *Client
+	component string
+	host      string
+
+	lock     sync.Mutex
+	tokens   float64
+	refilled time.Time
+}
+
+func NewEventRecorder(client *Client, component, host string) *EventRecorder {
+	return &EventRecorder{client: client, component: component, host: host, tokens: eventBurst, refilled: time.Now()}
+}
+
+func (r *EventRecorder) takeToken() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	r.tokens += float64(now.Sub(r.refilled)) / float64(eventTokenInterval)
+	if r.tokens > eventBurst {
+		r.tokens = eventBurst
+	}
+	r.refilled = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// eventName is stable for one event of one object.
+func (r *EventRecorder) eventName(ref ObjectReference, eventType, reason, message string) string {
+	h := fnv.New64a()
+	for _, part := range []string{ref.Kind, ref.UID, eventType, reason, message, r.component, r.host} {
+		_, _ = h.Write([]byte(part))
+		_, _ = h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s.%x", ref.Name, h.Sum64())
+}
+
+// Eventf reports an event of ref, eventType is EventTypeNormal or
+// EventTypeWarning and reason a short UpperCamelCase word.
+func (r *EventRecorder) Eventf(ref ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil || r.client == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	if !r.takeToken() {
+		klog.Warningf("too many events, drop %s %s of %s/%s: %s", eventType, reason, ref.Namespace, ref.Name, message)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if err := r.record(ctx, ref, eventType, reason, message); err != nil {
+		klog.Errorf("failed to post event %s of %s/%s, err is %v", reason, ref.Namespace, ref.Name, err)
+	}
+}
+
+func (r *EventRecorder) record(ctx context.Context, ref ObjectReference, eventType, reason, message string) error {
+	name := r.eventName(ref, eventType, reason, message)
+	path := fmt.Sprintf("/api/v1/namespaces/%s/events", ref.Namespace)
+	now := time.Now().UTC()
+	var event Event
+	_, err := r.client.RequestContext(ctx, "GET", path+"/"+name, nil, &event)
+	if err != nil && !rest.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if last, err := time.Parse(time.RFC3339, event.LastTimestamp); err == nil && now.Sub(last) < eventRefreshInterval {
+			return nil
+		}
+		event.Count++
+		event.LastTimestamp = now.Format(time.RFC3339)
+		_, err = r.client.RequestContext(ctx, "PUT", path+"/"+name, &event, nil)
+		// a lost update was written by a process reporting the same event
+		if rest.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	event = Event{
+		APIVersion:         "v1",
+		Kind:               "Event",
+		MetaData:           EventMeta{Name: name, Namespace: ref.Namespace},
+		InvolvedObject:     ref,
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             EventSource{Component: r.component, Host: r.host},
+		FirstTimestamp:     now.Format(time.RFC3339),
+		LastTimestamp:      now.Format(time.RFC3339),
+		Count:              1,
+		ReportingComponent: r.component,
+		ReportingInstance:  r.host,
+	}
+	_, err = r.client.RequestContext(ctx, "POST", path, &event, nil)
+	if rest.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEvents keeps the events of the default namespace.
+type fakeEvents struct {
+	lock    sync.Mutex
+	events  map[string]Event
+	methods []string
+}
+
+func (f *fakeEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.methods = append(f.methods, r.Method)
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/default/events"), "/")
+	var event Event
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name = event.MetaData.Name
+	}
+	_, exists := f.events[name]
+	switch {
+	case r.Method == http.MethodGet && !exists:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"kind": "Status", "reason": "NotFound", "code": 404}`))
+		return
+	case r.Method == http.MethodGet:
+		event = f.events[name]
+	case r.Method == http.MethodPost && exists:
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"kind": "Status", "reason": "AlreadyExists", "code": 409}`))
+		return
+	default:
+		f.events[name] = event
+	}
+	_ = json.NewEncoder(w).Encode(event)
+}
+
+func (f *fakeEvents) take() (map[string]Event, []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	events := make(map[string]Event, len(f.events))
+	for name, event := range f.events {
+		events[name] = event
+	}
+	methods := f.methods
+	f.methods = nil
+	return events, methods
+}
+
+// age moves the timestamps of every event back by d.
+func (f *fakeEvents) age(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for name, event := range f.events {
+		for _, timestamp := range []*string{&event.FirstTimestamp, &event.LastTimestamp} {
+			at, _ := time.Parse(time.RFC3339, *timestamp)
+			*timestamp = at.Add(-d).Format(time.RFC3339)
+		}
+		f.events[name] = event
+	}
+}
+
+func newTestRecorder(t *testing.T) (*EventRecorder, *fakeEvents) {
+	t.Helper()
+	fake := &fakeEvents{events: make(map[string]Event)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := NewClientFromConfig(&RestConfig{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEventRecorder(client, "tinycni", "node-1"), fake
+}
+
+var testRef = ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "web-0", UID: "6f1e2c1a"}
+
+func TestEventName(t *testing.T) {
+	r := &EventRecorder{component: "tinycni", host: "node-1"}
+	name := r.eventName(testRef, EventTypeWarning, "AllocationFailed", "no free address")
+	if !strings.HasPrefix(name, "web-0.") {
+		t.Errorf("eventName = %s, want it to start with the name of the object", name)
+	}
+	if again := r.eventName(testRef, EventTypeWarning, "AllocationFailed", "no free address"); again != name {
+		t.Errorf("eventName of the same event = %s, want %s", again, name)
+	}
+	other := testRef
+	other.UID = "0a9b8c7d"
+	for what, differs := range map[string]string{
+		"message":  r.eventName(testRef, EventTypeWarning, "AllocationFailed", "quota exceeded"),
+		"reason":   r.eventName(testRef, EventTypeWarning, "ReleaseFailed", "no free address"),
+		"type":     r.eventName(testRef, EventTypeNormal, "AllocationFailed", "no free address"),
+		"object":   r.eventName(other, EventTypeWarning, "AllocationFailed", "no free address"),
+		"host":     (&EventRecorder{component: "tinycni", host: "node-2"}).eventName(testRef, EventTypeWarning, "AllocationFailed", "no free address"),
+		"boundary": r.eventName(testRef, EventTypeWarning, "AllocationFailedn", "o free address"),
+	} {
+		if differs == name {
+			t.Errorf("another %s gives the same name %s", what, name)
+		}
+	}
+}
+
+func TestEventRecorderCollapsesRepeats(t *testing.T) {
+	r, fake := newTestRecorder(t)
+	r.Eventf(testRef, EventTypeWarning, "AllocationFailed", "network %s is full", "net1")
+	events, methods := fake.take()
+	if len(events) != 1 || strings.Join(methods, ",") != "GET,POST" {
+		t.Fatalf("first event wrote %v with %v, want one POST", events, methods)
+	}
+	name := r.eventName(testRef, EventTypeWarning, "AllocationFailed", "network net1 is full")
+	event := events[name]
+	if event.Count != 1 || event.Message != "network net1 is full" || event.InvolvedObject != testRef ||
+		event.Source.Component != "tinycni" || event.Source.Host != "node-1" || event.FirstTimestamp == "" {
+		t.Errorf("event = %+v", event)
+	}
+
+	// a repeat right away is dropped
+	r.Eventf(testRef, EventTypeWarning, "AllocationFailed", "network %s is full", "net1")
+	if events, methods := fake.take(); events[name].Count != 1 || strings.Join(methods, ",") != "GET" {
+		t.Errorf("repeat wrote count %d with %v, want it dropped", events[name].Count, methods)
+	}
+
+	// a later one of another process counts up the same event
+	fake.age(time.Minute)
+	other := NewEventRecorder(r.client, "tinycni", "node-1")
+	other.Eventf(testRef, EventTypeWarning, "AllocationFailed", "network %s is full", "net1")
+	events, methods = fake.take()
+	if len(events) != 1 || events[name].Count != 2 || strings.Join(methods, ",") != "GET,PUT" {
+		t.Errorf("later repeat wrote %v with %v, want count 2", events, methods)
+	}
+	if events[name].FirstTimestamp == events[name].LastTimestamp {
+		t.Errorf("the last timestamp of the repeat is the first one %s", events[name].FirstTimestamp)
+	}
+
+	// long messages are cut
+	r.Eventf(testRef, EventTypeNormal, "Allocated", "%s", strings.Repeat("a", 2*maxEventMessage))
+	events, _ = fake.take()
+	if len(events) != 2 {
+		t.Fatalf("%d events, want another one for another reason", len(events))
+	}
+	for _, event := range events {
+		if event.Reason == "Allocated" && (len(event.Message) != maxEventMessage || !strings.HasSuffix(event.Message, "...")) {
+			t.Errorf("message of %d bytes, want it cut to %d", len(event.Message), maxEventMessage)
+		}
+	}
+}
+
+func TestEventRecorderTokenBucket(t *testing.T) {
+	r, fake := newTestRecorder(t)
+	for i := 0; i < eventBurst+5; i++ {
+		r.Eventf(testRef, EventTypeNormal, "Allocated", "allocated 10.10.0.%d", i)
+	}
+	if events, _ := fake.take(); len(events) != eventBurst {
+		t.Errorf("%d events posted at once, want the burst of %d", len(events), eventBurst)
+	}
+	// tokens come back one per interval up to the burst
+	r.lock.Lock()
+	r.refilled = r.refilled.Add(-2 * eventTokenInterval)
+	r.lock.Unlock()
+	if !r.takeToken() || !r.takeToken() || r.takeToken() {
+		t.Error("want two tokens back after two intervals")
+	}
+	r.lock.Lock()
+	r.refilled = r.refilled.Add(-100 * eventTokenInterval)
+	r.lock.Unlock()
+	taken := 0
+	for r.takeToken() {
+		taken++
+	}
+	if taken != eventBurst {
+		t.Errorf("%d tokens after a long pause, want the burst of %d", taken, eventBurst)
+	}
+}
+
+func TestEventRecorderWithoutClient(t *testing.T) {
+	var r *EventRecorder
+	r.Eventf(testRef, EventTypeNormal, "Allocated", "allocated %s", "10.10.0.2")
+	NewEventRecorder(nil, "tinycni", "node-1").Eventf(testRef, EventTypeNormal, "Allocated", "allocated %s", "10.10.0.2")
+}
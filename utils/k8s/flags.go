@@ -12,6 +12,10 @@ type Flags struct {
 	K8sKey       string `json:"k8s_key"`
 	K8sCert      string `json:"k8s_cert"`
 	K8sToken     string `json:"k8s_token"`
+	K8sTokenFile string `json:"k8s_token_file"`
+	Kubeconfig   string `json:"kubeconfig"`
+	Context      string `json:"context"`
+	InCluster    bool   `json:"in_cluster"`
 }
 
 func NewK8sFlags() *Flags {
@@ -21,6 +25,9 @@ func NewK8sFlags() *Flags {
 		K8sKey:       "",
 		K8sCert:      "",
 		K8sToken:     "",
+		K8sTokenFile: "",
+		Kubeconfig:   "",
+		Context:      "",
 	}
 }
 func (f *Flags) AddFlags(fs *pflag.FlagSet) {
@@ -29,14 +36,27 @@ func (f *Flags) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&f.K8sCert, "k8s-cert", f.K8sCert, "The TLS cert file used to access the k8s api server")
 	fs.StringVar(&f.K8sKey, "k8s-key", f.K8sKey, "The TLS key file used to access the k8s api server")
 	fs.StringVar(&f.K8sToken, "k8s-token", f.K8sToken, "The bearer token used to access the k8s api server")
+	fs.StringVar(&f.K8sTokenFile, "k8s-token-file", f.K8sTokenFile, "The file holding the bearer token, read again when it changes")
+	fs.StringVar(&f.Kubeconfig, "kubeconfig", f.Kubeconfig, "The kubeconfig used to access the k8s api server, it takes precedence over the other k8s flags")
+	fs.StringVar(&f.Context, "context", f.Context, "The kubeconfig context to use, defaults to its current-context")
+	fs.BoolVar(&f.InCluster, "k8s-in-cluster", f.InCluster, "Access the k8s api server with the service account of the pod")
 }
 
 func (f *Flags) ValidateFlags() error {
 	var allErrStrs []string
+	if f.InCluster && f.Kubeconfig != "" {
+		return fmt.Errorf("--k8s-in-cluster and --kubeconfig are exclusive")
+	}
+	if f.InCluster || f.Kubeconfig != "" {
+		return nil
+	}
+	if f.Context != "" {
+		allErrStrs = append(allErrStrs, "--context needs --kubeconfig")
+	}
 	if strings.HasPrefix(f.K8sApiServer, "https") {
 		if f.K8sCA == "" {
 			allErrStrs = append(allErrStrs, "empty k8s ca")
-		} else if f.K8sToken == "" && !(f.K8sCert != "" && f.K8sKey != "") {
+		} else if f.K8sToken == "" && f.K8sTokenFile == "" && !(f.K8sCert != "" && f.K8sKey != "") {
 			allErrStrs = append(allErrStrs, "empty k8s token and empty cert or key")
 		}
 	} else if !strings.HasPrefix(f.K8sApiServer, "http") {
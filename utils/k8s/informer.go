@@ -0,0 +1,456 @@
+package k8s
+
+import (
+	"cni/utils/rest"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	informerRetryInterval = 2 * time.Second
+	// informerPageSize is the limit of one LIST page
+	informerPageSize = 500
+	// informerWatchTimeout makes the api server end a watch that saw nothing,
+	// the next one starts from the last resourceVersion
+	informerWatchTimeout = 5 * time.Minute
+)
+
+// the types of the events of a WATCH
+const (
+	WatchAdded    = "ADDED"
+	WatchModified = "MODIFIED"
+	WatchDeleted  = "DELETED"
+	WatchBookmark = "BOOKMARK"
+	WatchError    = "ERROR"
+)
+
+// ResourceEventHandler is told about the objects of an informer, a nil func
+// is skipped. Objects are what the newObject of the informer returned, they
+// are shared with the cache and must not be changed.
+type ResourceEventHandler struct {
+	OnAdd    func(obj interface{})
+	OnUpdate func(oldObj, obj interface{})
+	OnDelete func(obj interface{})
+}
+
+// ListMeta is the metadata of a list, Continue is set while more pages follow.
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Continue        string `json:"continue,omitempty"`
+}
+
+type listPage struct {
+	MetaData ListMeta          `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type objectMeta struct {
+	MetaData struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+}
+
+// errGone is a resourceVersion or continue token the api server no longer
+// keeps, the informer has to list again.
+type errGone struct {
+	message string
+}
+
+func (e errGone) Error() string {
+	return e.message
+}
+
+type cachedObject struct {
+	resourceVersion string
+	obj             interface{}
+}
+
+// Informer keeps a local copy of the objects of a kubernetes resource. It
+// lists page by page and then watches from the listed resourceVersion, a
+// broken watch resumes from the last resourceVersion it saw and an expired one
+// (410 Gone) lists again, reporting what changed in between to the handlers.
+// Objects are cached by namespace/name, by name for cluster resources.
+type Informer struct {
+	client    *Client
+	path      string
+	query     url.Values
+	newObject func() interface{}
+
+	lock            sync.RWMutex
+	items           map[string]cachedObject
+	resourceVersion string
+	synced          bool
+	syncedCh        chan struct{}
+	handlers        []ResourceEventHandler
+}
+
+// NewInformer follows the collection at path, /api/v1/pods for instance,
+// selectors go into query as labelSelector and fieldSelector. newObject
+// returns a pointer the items are decoded into.
+func (c *Client) NewInformer(path string, query url.Values, newObject func() interface{}) *Informer {
+	if query == nil {
+		query = url.Values{}
+	}
+	return &Informer{
+		client:    c,
+		path:      path,
+		query:     query,
+		newObject: newObject,
+		items:     make(map[string]cachedObject),
+		syncedCh:  make(chan struct{}),
+	}
+}
+
+// NewPodInformer follows the pods of every namespace, those of one node when
+// nodeName is set. The objects are *Pod.
+func (c *Client) NewPodInformer(nodeName string) *Informer {
+	query := url.Values{}
+	if nodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+nodeName)
+	}
+	return c.NewInformer("/api/v1/pods", query, func() interface{} { return &Pod{} })
+}
+
+// NewNodeInformer follows the nodes, the objects are *Node.
+func (c *Client) NewNodeInformer() *Informer {
+	return c.NewInformer("/api/v1/nodes", nil, func() interface{} { return &Node{} })
+}
+
+// NewServiceInformer follows the services, the objects are *Service.
+func (c *Client) NewServiceInformer() *Informer {
+	return c.NewInformer("/api/v1/services", nil, func() interface{} { return &Service{} })
+}
+
+// NewEndpointsInformer follows the endpoints, the objects are *Endpoint.
+func (c *Client) NewEndpointsInformer() *Informer {
+	return c.NewInformer("/api/v1/endpoints", nil, func() interface{} { return &Endpoint{} })
+}
+
+// NewNetworkInformer follows the Network custom resources, the objects are
+// *Network.
+func (c *Client) NewNetworkInformer() *Informer {
+	return c.NewInformer(NetworksPath, nil, func() interface{} { return &Network{} })
+}
+
+// AddHandler registers h, it only sees the changes after it was added.
+func (i *Informer) AddHandler(h ResourceEventHandler) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.handlers = append(i.handlers, h)
+}
+
+func (i *Informer) HasSynced() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.synced
+}
+
+// WaitForSync blocks until the first list is in the cache, it returns false
+// when ctx is done first.
+func (i *Informer) WaitForSync(ctx context.Context) bool {
+	select {
+	case <-i.syncedCh:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ResourceVersion is the resourceVersion the cache is up to date with.
+func (i *Informer) ResourceVersion() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.resourceVersion
+}
+
+// Get returns the object of key, namespace/name or the name of a cluster
+// resource.
+func (i *Informer) Get(key string) (interface{}, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	item, ok := i.items[key]
+	return item.obj, ok
+}
+
+func (i *Informer) List() []interface{} {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	objs := make([]interface{}, 0, len(i.items))
+	for _, item := range i.items {
+		objs = append(objs, item.obj)
+	}
+	return objs
+}
+
+// Run keeps the cache up to date until ctx is done.
+func (i *Informer) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := i.relist(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			klog.Errorf("failed to list %s, err is %v", i.path, err)
+			if !sleepCtx(ctx, informerRetryInterval) {
+				return
+			}
+			continue
+		}
+		for ctx.Err() == nil {
+			start := time.Now()
+			err := i.watch(ctx)
+			if _, gone := err.(errGone); gone {
+				klog.Warningf("watch of %s expired at resourceVersion %s, list again", i.path, i.ResourceVersion())
+				break
+			}
+			if err != nil && ctx.Err() == nil {
+				klog.Errorf("watch of %s broke at resourceVersion %s, err is %v", i.path, i.ResourceVersion(), err)
+			}
+			// a watch the api server closes at once must not turn into a
+			// busy loop
+			if (err != nil || time.Since(start) < time.Second) && !sleepCtx(ctx, informerRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func objectKey(meta *objectMeta) string {
+	if meta.MetaData.Namespace == "" {
+		return meta.MetaData.Name
+	}
+	return meta.MetaData.Namespace + "/" + meta.MetaData.Name
+}
+
+// decode returns the key and the cached form of raw.
+func (i *Informer) decode(raw json.RawMessage) (string, cachedObject, error) {
+	var meta objectMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return "", cachedObject{}, err
+	}
+	obj := i.newObject()
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return "", cachedObject{}, err
+	}
+	return objectKey(&meta), cachedObject{resourceVersion: meta.MetaData.ResourceVersion, obj: obj}, nil
+}
+
+// get sends a GET of the collection with query and returns the open
+// response, a 410 is returned as errGone.
+func (i *Informer) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	path := i.path + "?" + query.Encode()
+	req, err := i.client.PrepareRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := i.client.CheckResponse("GET", path, nil, resp); err != nil {
+		resp.Body.Close()
+		if rest.IsGone(err) {
+			return nil, errGone{message: err.Error()}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// list reads every page of the collection, a continue token that expired
+// while paging starts the list over.
+func (i *Informer) list(ctx context.Context) (map[string]cachedObject, string, error) {
+	for {
+		items := make(map[string]cachedObject)
+		query := url.Values{}
+		for key, values := range i.query {
+			query[key] = values
+		}
+		query.Set("limit", fmt.Sprint(informerPageSize))
+		var err error
+		var resourceVersion string
+		for {
+			var resp *http.Response
+			if resp, err = i.get(ctx, query); err != nil {
+				break
+			}
+			var page listPage
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			if err != nil {
+				err = fmt.Errorf("failed to decode a page of %s: %v", i.path, err)
+				break
+			}
+			for _, raw := range page.Items {
+				key, item, err := i.decode(raw)
+				if err != nil {
+					klog.Errorf("skip an item of %s, err is %v", i.path, err)
+					continue
+				}
+				items[key] = item
+			}
+			resourceVersion = page.MetaData.ResourceVersion
+			if page.MetaData.Continue == "" {
+				return items, resourceVersion, nil
+			}
+			query.Set("continue", page.MetaData.Continue)
+		}
+		if _, gone := err.(errGone); gone {
+			klog.Warningf("the continue token of %s expired, list from the first page again", i.path)
+			continue
+		}
+		return nil, "", err
+	}
+}
+
+// relist replaces the cache with a fresh list and reports the difference.
+func (i *Informer) relist(ctx context.Context) error {
+	items, resourceVersion, err := i.list(ctx)
+	if err != nil {
+		return err
+	}
+	i.lock.Lock()
+	old := i.items
+	i.items = items
+	i.resourceVersion = resourceVersion
+	handlers := i.handlers
+	first := !i.synced
+	i.synced = true
+	i.lock.Unlock()
+	for key, item := range items {
+		oldItem, ok := old[key]
+		if !ok {
+			dispatch(handlers, WatchAdded, nil, item.obj)
+		} else if oldItem.resourceVersion != item.resourceVersion {
+			dispatch(handlers, WatchModified, oldItem.obj, item.obj)
+		}
+	}
+	for key, oldItem := range old {
+		if _, ok := items[key]; !ok {
+			dispatch(handlers, WatchDeleted, oldItem.obj, nil)
+		}
+	}
+	if first {
+		close(i.syncedCh)
+	}
+	return nil
+}
+
+// watch applies events from the resourceVersion of the cache until the watch
+// ends, bookmarks move the resourceVersion on while nothing changes.
+func (i *Informer) watch(ctx context.Context) error {
+	query := url.Values{}
+	for key, values := range i.query {
+		query[key] = values
+	}
+	query.Set("watch", "true")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", i.ResourceVersion())
+	query.Set("timeoutSeconds", fmt.Sprint(int(informerWatchTimeout/time.Second)))
+	resp, err := i.get(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		switch event.Type {
+		case WatchAdded, WatchModified, WatchDeleted:
+			i.apply(event)
+		case WatchBookmark:
+			var meta objectMeta
+			if err := json.Unmarshal(event.Object, &meta); err == nil && meta.MetaData.ResourceVersion != "" {
+				i.lock.Lock()
+				i.resourceVersion = meta.MetaData.ResourceVersion
+				i.lock.Unlock()
+			}
+		case WatchError:
+			var status Status
+			_ = json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return errGone{message: fmt.Sprintf("410 Gone: %s", status.Message)}
+			}
+			return fmt.Errorf("watch error %d %s: %s", status.Code, status.Reason, status.Message)
+		default:
+			klog.Warningf("skip watch event of unknown type %q on %s", event.Type, i.path)
+		}
+	}
+}
+
+func (i *Informer) apply(event watchEvent) {
+	key, item, err := i.decode(event.Object)
+	if err != nil {
+		klog.Errorf("skip a %s event of %s, err is %v", event.Type, i.path, err)
+		return
+	}
+	i.lock.Lock()
+	oldItem, existed := i.items[key]
+	if event.Type == WatchDeleted {
+		delete(i.items, key)
+	} else {
+		i.items[key] = item
+	}
+	if item.resourceVersion != "" {
+		i.resourceVersion = item.resourceVersion
+	}
+	handlers := i.handlers
+	i.lock.Unlock()
+	switch {
+	case event.Type == WatchDeleted:
+		if existed {
+			dispatch(handlers, WatchDeleted, oldItem.obj, nil)
+		}
+	case existed:
+		dispatch(handlers, WatchModified, oldItem.obj, item.obj)
+	default:
+		dispatch(handlers, WatchAdded, nil, item.obj)
+	}
+}
+
+func dispatch(handlers []ResourceEventHandler, eventType string, oldObj, obj interface{}) {
+	for _, h := range handlers {
+		switch eventType {
+		case WatchDeleted:
+			if h.OnDelete != nil {
+				h.OnDelete(oldObj)
+			}
+		case WatchModified:
+			if h.OnUpdate != nil {
+				h.OnUpdate(oldObj, obj)
+			}
+		default:
+			if h.OnAdd != nil {
+				h.OnAdd(obj)
+			}
+		}
+	}
+}
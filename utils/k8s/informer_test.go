@@ -0,0 +1,251 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCollection serves a collection two items per page and a watch that
+// sends what the test puts on events, an empty event ends the watch.
+type fakeCollection struct {
+	lock            sync.Mutex
+	items           []string
+	resourceVersion string
+	// expireContinue answers the next continue token with 410
+	expireContinue bool
+	lists          []url.Values
+	watches        []url.Values
+	events         chan string
+}
+
+func podJSON(name, resourceVersion string) string {
+	return fmt.Sprintf(`{"metadata": {"name": %q, "namespace": "default", "resourceVersion": %q}}`, name, resourceVersion)
+}
+
+func (f *fakeCollection) set(resourceVersion string, items ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.items, f.resourceVersion = items, resourceVersion
+}
+
+func (f *fakeCollection) requests() ([]url.Values, []url.Values) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]url.Values(nil), f.lists...), append([]url.Values(nil), f.watches...)
+}
+
+func writeGone(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusGone)
+	_, _ = w.Write([]byte(`{"kind": "Status", "code": 410, "reason": "Expired", "message": "too old resource version"}`))
+}
+
+func (f *fakeCollection) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("watch") == "true" {
+		f.lock.Lock()
+		f.watches = append(f.watches, query)
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-f.events:
+				if event == "" {
+					return
+				}
+				_, _ = w.Write([]byte(event + "\n"))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lists = append(f.lists, query)
+	token := query.Get("continue")
+	if token != "" && f.expireContinue {
+		f.expireContinue = false
+		writeGone(w)
+		return
+	}
+	start, _ := strconv.Atoi(token)
+	end, next := start+2, ""
+	if end < len(f.items) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(f.items)
+	}
+	fmt.Fprintf(w, `{"metadata": {"resourceVersion": %q, "continue": %q}, "items": [%s]}`,
+		f.resourceVersion, next, strings.Join(f.items[start:end], ","))
+}
+
+// recorder keeps what the handlers of an informer were told, as
+// "ADDED default/a".
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) handler() ResourceEventHandler {
+	record := func(eventType string, obj interface{}) {
+		pod := obj.(*Pod)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.events = append(r.events, eventType+" "+pod.MetaData.NameSpace+"/"+pod.MetaData.Name)
+	}
+	return ResourceEventHandler{
+		OnAdd:    func(obj interface{}) { record(WatchAdded, obj) },
+		OnUpdate: func(_, obj interface{}) { record(WatchModified, obj) },
+		OnDelete: func(obj interface{}) { record(WatchDeleted, obj) },
+	}
+}
+
+// take returns the events since the last take, sorted.
+func (r *recorder) take() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := r.events
+	r.events = nil
+	sort.Strings(events)
+	return events
+}
+
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func keys(informer *Informer) string {
+	var keys []string
+	for _, obj := range informer.List() {
+		pod := obj.(*Pod)
+		keys = append(keys, pod.MetaData.Name+"@"+pod.MetaData.ResourceVersion)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func TestInformer(t *testing.T) {
+	fake := &fakeCollection{events: make(chan string)}
+	fake.set("3", podJSON("a", "1"), podJSON("b", "2"), podJSON("c", "3"))
+	fake.expireContinue = true
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := NewClientFromConfig(&RestConfig{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	informer := client.NewPodInformer("node-1")
+	events := &recorder{}
+	informer.AddHandler(events.handler())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go informer.Run(ctx)
+	if !informer.WaitForSync(ctx) {
+		t.Fatal("informer never synced")
+	}
+
+	// the expired continue token starts the list over
+	lists, _ := fake.requests()
+	var tokens []string
+	for _, query := range lists {
+		tokens = append(tokens, query.Get("continue"))
+		if query.Get("limit") != strconv.Itoa(informerPageSize) || query.Get("fieldSelector") != "spec.nodeName=node-1" {
+			t.Errorf("list query = %v, want the page size and the node selector", query)
+		}
+	}
+	if strings.Join(tokens, ",") != ",2,,2" {
+		t.Errorf("continue tokens = %q, want the first page again after the expired one", tokens)
+	}
+	if got := keys(informer); got != "a@1 b@2 c@3" || informer.ResourceVersion() != "3" {
+		t.Errorf("cache = %s at %s, want every page at 3", got, informer.ResourceVersion())
+	}
+	if got := events.take(); strings.Join(got, ",") != "ADDED default/a,ADDED default/b,ADDED default/c" {
+		t.Errorf("events of the list = %v", got)
+	}
+	if _, ok := informer.Get("default/a"); !ok {
+		t.Error("Get(default/a) found nothing")
+	}
+
+	// the watch starts from the listed resourceVersion, bookmarks move it on
+	eventually(t, "the watch", func() bool {
+		_, watches := fake.requests()
+		return len(watches) == 1
+	})
+	_, watches := fake.requests()
+	if rv := watches[0].Get("resourceVersion"); rv != "3" || watches[0].Get("allowWatchBookmarks") != "true" {
+		t.Errorf("watch query = %v, want bookmarks from 3", watches[0])
+	}
+	for _, event := range []string{
+		`{"type": "ADDED", "object": ` + podJSON("d", "4") + `}`,
+		`{"type": "MODIFIED", "object": ` + podJSON("a", "5") + `}`,
+		`{"type": "DELETED", "object": ` + podJSON("b", "6") + `}`,
+		`{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "9"}}}`,
+	} {
+		fake.events <- event
+	}
+	eventually(t, "the bookmark", func() bool { return informer.ResourceVersion() == "9" })
+	if got := keys(informer); got != "a@5 c@3 d@4" {
+		t.Errorf("cache after the watch = %s", got)
+	}
+	if got := events.take(); strings.Join(got, ",") != "ADDED default/d,DELETED default/b,MODIFIED default/a" {
+		t.Errorf("events of the watch = %v", got)
+	}
+
+	// an expired watch lists again and reports what it missed
+	fake.set("11", podJSON("a", "5"), podJSON("c", "10"), podJSON("e", "11"))
+	fake.events <- `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "reason": "Expired"}}`
+	eventually(t, "the watch after the relist", func() bool {
+		_, watches := fake.requests()
+		return len(watches) == 2
+	})
+	_, watches = fake.requests()
+	if rv := watches[1].Get("resourceVersion"); rv != "11" {
+		t.Errorf("watch after the relist starts from %s, want 11", rv)
+	}
+	if got := keys(informer); got != "a@5 c@10 e@11" {
+		t.Errorf("cache after the relist = %s", got)
+	}
+	if got := events.take(); strings.Join(got, ",") != "ADDED default/e,DELETED default/d,MODIFIED default/c" {
+		t.Errorf("events of the relist = %v", got)
+	}
+}
+
+func TestInformerDecodesWatchEvents(t *testing.T) {
+	informer := (&Client{}).NewPodInformer("")
+	events := &recorder{}
+	informer.AddHandler(events.handler())
+	for _, raw := range []string{
+		`{"type": "MODIFIED", "object": ` + podJSON("a", "1") + `}`,
+		`{"type": "DELETED", "object": ` + podJSON("missing", "2") + `}`,
+		`{"type": "ADDED", "object": "not a pod"}`,
+	} {
+		var event watchEvent
+		if err := json.Unmarshal([]byte(raw), &event); err != nil {
+			t.Fatal(err)
+		}
+		informer.apply(event)
+	}
+	// an update of an unknown object is an add, a delete of one is dropped
+	if got := events.take(); strings.Join(got, ",") != "ADDED default/a" {
+		t.Errorf("events = %v", got)
+	}
+	if informer.ResourceVersion() != "2" {
+		t.Errorf("resourceVersion = %s, want the one of the last decoded event", informer.ResourceVersion())
+	}
+}
@@ -0,0 +1,228 @@
+package k8s
+
+import (
+	"cni/consts"
+	"cni/utils/path"
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestConfig is how to reach and authenticate to one api server, key
+// material is only ever held in memory.
+type RestConfig struct {
+	Host          string
+	TLSServerName string
+	Insecure      bool
+	CAData        []byte
+	CertData      []byte
+	KeyData       []byte
+	Token         string
+	// TokenFile is read again when it changes, service account tokens rotate
+	TokenFile string
+	Username  string
+	Password  string
+	Namespace string
+}
+
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			TLSServerName            string `yaml:"tls-server-name"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// expandHome resolves a leading ~ to the home directory.
+func expandHome(file string) string {
+	if file != "~" && !strings.HasPrefix(file, "~/") {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return file
+	}
+	return filepath.Join(home, strings.TrimPrefix(file, "~"))
+}
+
+// KubeConfigPath is the first of $KUBECONFIG, admin.conf, kubelet.conf and
+// ~/.kube/config that exists, or "" when there is none.
+func KubeConfigPath() string {
+	var candidates []string
+	if env := os.Getenv(consts.KUBECONFIG_ENV); env != "" {
+		candidates = append(candidates, filepath.SplitList(env)...)
+	}
+	candidates = append(candidates, consts.KUBE_CONF_ADMIN_DEFAULT_PATH, consts.KUBELET_CONFIG_DEFAULT_PATH, consts.KUBE_LOCAL_DEFAULT_PATH)
+	for _, candidate := range candidates {
+		if candidate = expandHome(candidate); path.PathExists(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readData returns inline base64 data, or else the file it names relative to
+// the kubeconfig in dir.
+func readData(data, file, dir string) ([]byte, error) {
+	if data != "" {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode inline data: %v", err)
+		}
+		return decoded, nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(resolvePath(file, dir))
+}
+
+func resolvePath(file, dir string) string {
+	file = expandHome(file)
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// LoadKubeConfig reads the kubeconfig at file for context, "" selects its
+// current-context.
+func LoadKubeConfig(file, context string) (*RestConfig, error) {
+	file = expandHome(file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig %s: %v", file, err)
+	}
+	var conf kubeConfig
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %v", file, err)
+	}
+	if context == "" {
+		context = conf.CurrentContext
+	}
+	if context == "" && len(conf.Contexts) == 1 {
+		context = conf.Contexts[0].Name
+	}
+	if context == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no current-context, choose one of its contexts", file)
+	}
+	dir := filepath.Dir(file)
+	config := &RestConfig{}
+	var clusterName, userName string
+	found := false
+	for _, c := range conf.Contexts {
+		if c.Name == context {
+			clusterName, userName, config.Namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", context, file)
+	}
+	found = false
+	for _, c := range conf.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		config.Host = c.Cluster.Server
+		config.TLSServerName = c.Cluster.TLSServerName
+		config.Insecure = c.Cluster.InsecureSkipTLSVerify
+		if config.CAData, err = readData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, dir); err != nil {
+			return nil, fmt.Errorf("failed to read ca of cluster %s: %v", clusterName, err)
+		}
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q of context %q not found in kubeconfig %s", clusterName, context, file)
+	}
+	for _, u := range conf.Users {
+		if u.Name != userName {
+			continue
+		}
+		if config.CertData, err = readData(u.User.ClientCertificateData, u.User.ClientCertificate, dir); err != nil {
+			return nil, fmt.Errorf("failed to read client certificate of user %s: %v", userName, err)
+		}
+		if config.KeyData, err = readData(u.User.ClientKeyData, u.User.ClientKey, dir); err != nil {
+			return nil, fmt.Errorf("failed to read client key of user %s: %v", userName, err)
+		}
+		config.Token = u.User.Token
+		config.TokenFile = resolvePath(u.User.TokenFile, dir)
+		config.Username, config.Password = u.User.Username, u.User.Password
+		break
+	}
+	if config.Host == "" {
+		return nil, fmt.Errorf("cluster %q in kubeconfig %s has no server", clusterName, file)
+	}
+	return config, nil
+}
+
+// InClusterConfig authenticates as the service account of the pod, it fails
+// outside of a pod.
+func InClusterConfig() (*RestConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	tokenFile := filepath.Join(consts.KUBE_SERVICE_ACCOUNT_PATH, "token")
+	if !path.PathExists(tokenFile) {
+		return nil, fmt.Errorf("service account token %s is missing", tokenFile)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(consts.KUBE_SERVICE_ACCOUNT_PATH, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account ca: %v", err)
+	}
+	namespace, _ := ioutil.ReadFile(filepath.Join(consts.KUBE_SERVICE_ACCOUNT_PATH, "namespace"))
+	return &RestConfig{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		CAData:    ca,
+		TokenFile: tokenFile,
+		Namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// HostConfig is the config of the node the plugin runs on: the service
+// account inside a pod, else the first kubeconfig KubeConfigPath finds.
+func HostConfig() (*RestConfig, error) {
+	if config, err := InClusterConfig(); err == nil {
+		return config, nil
+	}
+	file := KubeConfigPath()
+	if file == "" {
+		return nil, fmt.Errorf("cannot find k8s authentication info, set $%s or run in a pod", consts.KUBECONFIG_ENV)
+	}
+	return LoadKubeConfig(file, "")
+}
@@ -0,0 +1,264 @@
+package k8s
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seen is what the test api server learned of the last request.
+type seen struct {
+	lock          sync.Mutex
+	authorization string
+	commonName    string
+}
+
+// newTlsApiServer answers /version over tls and records how the client
+// authenticated.
+func newTlsApiServer(t *testing.T) (*httptest.Server, *seen) {
+	t.Helper()
+	last := &seen{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last.lock.Lock()
+		defer last.lock.Unlock()
+		last.authorization, last.commonName = r.Header.Get("Authorization"), ""
+		if len(r.TLS.PeerCertificates) > 0 {
+			last.commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "22"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, last
+}
+
+// selfSigned returns a pem client certificate of name and its key.
+func selfSigned(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeKubeConfig writes a kubeconfig for server with a context per way to
+// authenticate, the credentials of the -file users lie next to it.
+func writeKubeConfig(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	inlineCert, inlineKey := selfSigned(t, "inline")
+	fileCert, fileKey := selfSigned(t, "file")
+	writeFile(t, dir, "ca.crt", ca)
+	writeFile(t, dir, "client.crt", fileCert)
+	writeFile(t, dir, "client.key", fileKey)
+	writeFile(t, dir, "token", []byte("file-token\n"))
+	b64 := base64.StdEncoding.EncodeToString
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: token
+clusters:
+- name: inline-ca
+  cluster:
+    server: %[1]s
+    certificate-authority-data: %[2]s
+- name: file-ca
+  cluster:
+    server: %[1]s
+    certificate-authority: ca.crt
+- name: untrusted
+  cluster:
+    server: %[1]s
+- name: no-server
+  cluster:
+    certificate-authority: ca.crt
+users:
+- name: token
+  user:
+    token: inline-token
+- name: token-file
+  user:
+    tokenFile: token
+- name: cert-inline
+  user:
+    client-certificate-data: %[3]s
+    client-key-data: %[4]s
+- name: cert-file
+  user:
+    client-certificate: client.crt
+    client-key: %[5]s
+- name: basic
+  user:
+    username: admin
+    password: secret
+contexts:
+- name: token
+  context: {cluster: inline-ca, user: token, namespace: kube-system}
+- name: token-file
+  context: {cluster: file-ca, user: token-file}
+- name: cert-inline
+  context: {cluster: file-ca, user: cert-inline}
+- name: cert-file
+  context: {cluster: inline-ca, user: cert-file}
+- name: basic
+  context: {cluster: inline-ca, user: basic}
+- name: untrusted
+  context: {cluster: untrusted, user: token}
+- name: no-server
+  context: {cluster: no-server, user: token}
+- name: missing-cluster
+  context: {cluster: gone, user: token}
+`, server.URL, b64(ca), b64(inlineCert), b64(inlineKey), filepath.Join(dir, "client.key"))
+	file := filepath.Join(dir, "config")
+	writeFile(t, dir, "config", []byte(config))
+	return file
+}
+
+func TestLoadKubeConfig(t *testing.T) {
+	server, last := newTlsApiServer(t)
+	file := writeKubeConfig(t, server)
+	tests := []struct {
+		context       string
+		authorization string
+		commonName    string
+		namespace     string
+	}{
+		{context: "", authorization: "Bearer inline-token", namespace: "kube-system"},
+		{context: "token-file", authorization: "Bearer file-token"},
+		{context: "cert-inline", commonName: "inline"},
+		{context: "cert-file", commonName: "file"},
+		{context: "basic", authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))},
+	}
+	for _, test := range tests {
+		t.Run("context "+test.context, func(t *testing.T) {
+			config, err := LoadKubeConfig(file, test.context)
+			if err != nil {
+				t.Fatalf("LoadKubeConfig: %v", err)
+			}
+			if config.Host != server.URL || config.Namespace != test.namespace {
+				t.Errorf("host, namespace = %s, %q, want %s, %q", config.Host, config.Namespace, server.URL, test.namespace)
+			}
+			client, err := NewClientFromConfig(config)
+			if err != nil {
+				t.Fatalf("NewClientFromConfig: %v", err)
+			}
+			if version, err := client.GetVersion(); err != nil || version.Minor != "22" {
+				t.Fatalf("GetVersion = %+v, %v", version, err)
+			}
+			last.lock.Lock()
+			defer last.lock.Unlock()
+			if last.authorization != test.authorization || last.commonName != test.commonName {
+				t.Errorf("server saw authorization %q and certificate %q, want %q and %q",
+					last.authorization, last.commonName, test.authorization, test.commonName)
+			}
+		})
+	}
+}
+
+func TestLoadKubeConfigFails(t *testing.T) {
+	server, _ := newTlsApiServer(t)
+	file := writeKubeConfig(t, server)
+	tests := []struct {
+		context string
+		want    string
+	}{
+		{"unknown", `context "unknown" not found`},
+		{"missing-cluster", `cluster "gone" of context "missing-cluster" not found`},
+		{"no-server", `cluster "no-server" in kubeconfig ` + file + ` has no server`},
+	}
+	for _, test := range tests {
+		t.Run(test.context, func(t *testing.T) {
+			if _, err := LoadKubeConfig(file, test.context); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadKubeConfig = %v, want %q", err, test.want)
+			}
+		})
+	}
+	// a cluster without ca trusts the system roots only
+	if config, err := LoadKubeConfig(file, "untrusted"); err != nil || config.CAData != nil {
+		t.Errorf("LoadKubeConfig = %+v, %v, want no ca", config, err)
+	}
+}
+
+func TestLoadKubeConfigContextSelection(t *testing.T) {
+	dir := t.TempDir()
+	cluster := "clusters:\n- name: c\n  cluster: {server: http://127.0.0.1:6443}\n"
+	tests := []struct {
+		name    string
+		config  string
+		context string
+		want    string
+	}{
+		{
+			name:   "single context without current-context",
+			config: cluster + "contexts:\n- name: only\n  context: {cluster: c, namespace: only}\n",
+			want:   "only",
+		},
+		{
+			name:    "context flag over current-context",
+			config:  cluster + "current-context: a\ncontexts:\n- name: a\n  context: {cluster: c, namespace: a}\n- name: b\n  context: {cluster: c, namespace: b}\n",
+			context: "b",
+			want:    "b",
+		},
+		{
+			name:   "no current-context among many",
+			config: cluster + "contexts:\n- name: a\n  context: {cluster: c}\n- name: b\n  context: {cluster: c}\n",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("config-%d", i)
+			writeFile(t, dir, name, []byte(test.config))
+			config, err := LoadKubeConfig(filepath.Join(dir, name), test.context)
+			if test.want == "" {
+				if err == nil || !strings.Contains(err.Error(), "has no current-context") {
+					t.Errorf("LoadKubeConfig = %+v, %v, want no current-context", config, err)
+				}
+				return
+			}
+			if err != nil || config.Namespace != test.want {
+				t.Errorf("LoadKubeConfig = %+v, %v, want context %s", config, err, test.want)
+			}
+		})
+	}
+}
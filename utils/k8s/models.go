@@ -1,5 +1,7 @@
 package k8s
 
+import "encoding/json"
+
 type Version struct {
 	Major    string `json:"major"`
 	Minor    string `json:"minor"`
@@ -14,9 +16,16 @@ type NodeList struct {
 
 type Node struct {
 	MetaData NodeMeta   `json:"metadata"`
+	Spec     NodeSpec   `json:"spec"`
 	Status   NodeStatus `json:"status"`
 }
 
+type NodeSpec struct {
+	PodCIDR       string   `json:"podCIDR,omitempty"`
+	PodCIDRs      []string `json:"podCIDRs,omitempty"`
+	Unschedulable bool     `json:"unschedulable,omitempty"`
+}
+
 type NodeMeta struct {
 	Name              string `json:"name,omitempty"`
 	UID               string `json:"uid,omitempty"`
@@ -95,6 +104,19 @@ type PodMeta struct {
 type PodAnnotations map[string]string
 type PodLabels map[string]string
 
+type Namespace struct {
+	MetaData NamespaceMeta `json:"metadata"`
+}
+
+type NamespaceMeta struct {
+	Name              string            `json:"name,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
 type PatchPodReq []PatchPod
 type PatchPod struct {
 	Op    string      `json:"op"`
@@ -107,6 +129,35 @@ type NetworkInfo struct {
 	SgIds  []string `json:"sg_ids"`
 	QosId  string   `json:"qos_id"`
 }
+
+// NetworkStatus is one entry of NetworkStatusAnnotation.
+type NetworkStatus struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Mac       string   `json:"mac,omitempty"`
+	Default   bool     `json:"default,omitempty"`
+	Gateway   []string `json:"gateway,omitempty"`
+}
+
+// PodNetworkInfo is the value of NetworkInfoAnnotation, ContainerId tells
+// which sandbox wrote it.
+type PodNetworkInfo struct {
+	ContainerId string             `json:"containerId"`
+	Node        string             `json:"node"`
+	Interfaces  []PodInterfaceInfo `json:"interfaces"`
+}
+
+type PodInterfaceInfo struct {
+	IfName   string   `json:"ifName"`
+	HostVeth string   `json:"hostVeth,omitempty"`
+	Mac      string   `json:"mac"`
+	Network  string   `json:"network"`
+	Subnet   string   `json:"subnet"`
+	IPs      []string `json:"ips"`
+	Gateway  string   `json:"gateway,omitempty"`
+}
+
 type PodStatus struct {
 	PodIP  string `json:"podIP"`
 	Phase  string `json:"phase"`
@@ -230,3 +281,165 @@ type ServicePort struct {
 	TargetPort interface{} `json:"targetPort,omitempty"`
 	NodePort   uint16      `json:"nodePort,omitempty"`
 }
+
+// DatastoreShard is a tinycni.io/v1 custom resource holding the records of
+// one shard of the kubernetes datastore, see deploy/crds.
+type DatastoreShard struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	MetaData   DatastoreShardMeta `json:"metadata"`
+	Spec       DatastoreShardSpec `json:"spec"`
+}
+
+type DatastoreShardList struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Items      []DatastoreShard `json:"items"`
+}
+
+type DatastoreShardMeta struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+type DatastoreShardSpec struct {
+	Entries map[string]DatastoreEntry `json:"entries,omitempty"`
+	// Seq numbers the last commit the shard applied, or made on the commit
+	// shard
+	Seq int64 `json:"seq,omitempty"`
+	// Journal holds the writes of the last commit on the commit shard until
+	// they are applied, a nil entry deletes its key
+	Journal map[string]*DatastoreEntry `json:"journal,omitempty"`
+}
+
+type DatastoreEntry struct {
+	Value string `json:"value"`
+	// RFC 3339, entries past it are treated as deleted
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// Network is the tinycni.io/v1 custom resource of a network, see deploy/crds.
+// The network controller of tinycnid writes its spec to the datastore and
+// reports the use of its addresses in its status.
+type Network struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	MetaData   NetworkMeta           `json:"metadata"`
+	Spec       NetworkSpec           `json:"spec"`
+	Status     NetworkResourceStatus `json:"status,omitempty"`
+}
+
+type NetworkList struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Items      []Network `json:"items"`
+}
+
+type NetworkMeta struct {
+	Name              string            `json:"name"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	DeletionTimestamp string            `json:"deletionTimestamp,omitempty"`
+	Finalizers        []string          `json:"finalizers,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+type NetworkSpec struct {
+	Mode      string            `json:"mode,omitempty"`
+	MTU       int               `json:"mtu,omitempty"`
+	Subnets   []NetworkSubnet   `json:"subnets"`
+	Isolation *NetworkIsolation `json:"isolation,omitempty"`
+	// PodSelector matches the labels of the pods that name no network
+	PodSelector map[string]string `json:"podSelector,omitempty"`
+}
+
+type NetworkSubnet struct {
+	Name        string   `json:"name"`
+	CIDR        string   `json:"cidr"`
+	Gateway     string   `json:"gateway,omitempty"`
+	BlockSize   int      `json:"blockSize,omitempty"`
+	BlockSource string   `json:"blockSource,omitempty"`
+	Reserved    []string `json:"reserved,omitempty"`
+}
+
+type NetworkIsolation struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	Tenants    []string `json:"tenants,omitempty"`
+}
+
+// NetworkResourceStatus is the status of a Network, not to be mixed up with
+// the NetworkStatus entries of the pod annotation.
+type NetworkResourceStatus struct {
+	ObservedGeneration int64                 `json:"observedGeneration,omitempty"`
+	Size               int64                 `json:"size"`
+	Allocated          int64                 `json:"allocated"`
+	Reserved           int64                 `json:"reserved"`
+	Conflict           int64                 `json:"conflict"`
+	Free               int64                 `json:"free"`
+	Subnets            []NetworkSubnetStatus `json:"subnets,omitempty"`
+	Conditions         []NetworkCondition    `json:"conditions,omitempty"`
+}
+
+type NetworkSubnetStatus struct {
+	Name      string `json:"name"`
+	CIDR      string `json:"cidr"`
+	Size      int64  `json:"size"`
+	Allocated int64  `json:"allocated"`
+	Reserved  int64  `json:"reserved"`
+	Conflict  int64  `json:"conflict"`
+	Free      int64  `json:"free"`
+}
+
+type NetworkCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+}
+
+// AdmissionReview is the admission.k8s.io/v1 request and answer of a webhook,
+// only the fields tinycni reads or writes.
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      GroupVersionKind `json:"kind"`
+	Name      string           `json:"name,omitempty"`
+	Namespace string           `json:"namespace,omitempty"`
+	Operation string           `json:"operation"`
+	Object    json.RawMessage  `json:"object,omitempty"`
+}
+
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type AdmissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Status  *AdmissionStatus `json:"status,omitempty"`
+}
+
+type AdmissionStatus struct {
+	Code    int32  `json:"code,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status is the body the api server answers failures with, a WATCH sends it
+// as the object of an ERROR event.
+type Status struct {
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
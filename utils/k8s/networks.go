@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// NetworkAnnotation names the network of the first interface of a pod, as
+	// annotation or label of the pod or annotation of its namespace
+	NetworkAnnotation = "tinycni.io/network"
+	// NetworksAnnotation lists the networks a pod joins beyond its first one,
+	// either as json, [{"name": "storage", "interface": "net1", "ips":
+	// ["10.1.0.5"], "mac": "de:ad:be:ef:00:01"}], or as short form,
+	// "storage,mgmt@net5"
+	NetworksAnnotation = "tinycni.io/networks"
+)
+
+// NetworkSelection is one entry of NetworksAnnotation.
+type NetworkSelection struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Mac       string   `json:"mac,omitempty"`
+}
+
+// IP is the address the entry asks for without the prefix length, which is
+// the one of the subnet, or "".
+func (s NetworkSelection) IP() string {
+	if len(s.IPs) == 0 {
+		return ""
+	}
+	return strings.SplitN(s.IPs[0], "/", 2)[0]
+}
+
+func ValidIfName(name string) bool {
+	return name != "" && len(name) <= 15 && name != "." && name != ".." && !strings.ContainsAny(name, "/: \t\n")
+}
+
+// ParseNetworkSelections reads NetworksAnnotation and checks every entry on
+// its own, whether the networks exist is left to the caller.
+func ParseNetworkSelections(value string) ([]NetworkSelection, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	var selections []NetworkSelection
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &selections); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", NetworksAnnotation, err)
+		}
+	} else {
+		for _, entry := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "@", 2)
+			selection := NetworkSelection{Name: parts[0]}
+			if len(parts) == 2 {
+				selection.Interface = parts[1]
+			}
+			selections = append(selections, selection)
+		}
+	}
+	for i, selection := range selections {
+		if selection.Name == "" {
+			return nil, fmt.Errorf("entry %d of the %s annotation has no network name", i+1, NetworksAnnotation)
+		}
+		if selection.Interface != "" && !ValidIfName(selection.Interface) {
+			return nil, fmt.Errorf("interface name %q of network %s is invalid, it takes up to 15 characters without '/', ':' or spaces", selection.Interface, selection.Name)
+		}
+		if len(selection.IPs) > 1 {
+			return nil, fmt.Errorf("network %s asks for %d ips, an interface takes one", selection.Name, len(selection.IPs))
+		}
+		if ip := selection.IP(); len(selection.IPs) == 1 && net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip %q for network %s", selection.IPs[0], selection.Name)
+		}
+		if selection.Mac != "" {
+			mac, err := net.ParseMAC(selection.Mac)
+			if err != nil || len(mac) != 6 || mac[0]&1 == 1 {
+				return nil, fmt.Errorf("invalid mac %q for network %s, it must be a unicast ethernet address", selection.Mac, selection.Name)
+			}
+			selections[i].Mac = mac.String()
+		}
+	}
+	return selections, nil
+}
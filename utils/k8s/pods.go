@@ -0,0 +1,109 @@
+package k8s
+
+import (
+	"cni/utils/rest"
+	"fmt"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+)
+
+// annotationPatchRetries bounds how often a patch is rebuilt after the pod
+// changed under it.
+const annotationPatchRetries = 5
+
+func (c *Client) GetPod(ns, name string) (Pod, int, error) {
+	var pod Pod
+	code, err := c.Request("GET", fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", ns, name), nil, &pod)
+	return pod, code, err
+}
+
+// PatchPod applies a json patch to the pod.
+func (c *Client) PatchPod(ns, name string, patch PatchPodReq) (int, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", ns, name)
+	req, err := c.PrepareRequest("PATCH", path, patch)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	req.Header.Set("Content-Type", JSONPatchType)
+	resp, err := c.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer resp.Body.Close()
+	if _, err := c.CheckResponse("PATCH", path, patch, resp); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
+
+// escapePointer escapes an annotation key for a json pointer, its / would
+// split the path.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// annotationPatch sets the annotations with a value and removes those mapped
+// to "", the test on resourceVersion fails the patch if the pod changed since
+// it was read.
+func annotationPatch(pod *Pod, annotations map[string]string) PatchPodReq {
+	patch := PatchPodReq{{Op: "test", Path: "/metadata/resourceVersion", Value: pod.MetaData.ResourceVersion}}
+	if pod.MetaData.Annotations == nil {
+		set := make(map[string]string)
+		for key, value := range annotations {
+			if value != "" {
+				set[key] = value
+			}
+		}
+		if len(set) == 0 {
+			return nil
+		}
+		return append(patch, PatchPod{Op: AddOption, Path: BasePath, Value: set})
+	}
+	for key, value := range annotations {
+		_, exists := pod.MetaData.Annotations[key]
+		switch {
+		case value != "":
+			patch = append(patch, PatchPod{Op: AddOption, Path: BasePath + "/" + escapePointer(key), Value: value})
+		case exists:
+			patch = append(patch, PatchPod{Op: "remove", Path: BasePath + "/" + escapePointer(key)})
+		}
+	}
+	if len(patch) == 1 {
+		return nil
+	}
+	return patch
+}
+
+// UpdatePodAnnotations sets or, for an empty value, removes annotations of a
+// pod. keep is asked with the current pod before every attempt, returning
+// false leaves the pod alone. A pod that is gone is not an error.
+func (c *Client) UpdatePodAnnotations(ns, name string, annotations map[string]string, keep func(pod *Pod) bool) error {
+	for attempt := 0; ; attempt++ {
+		pod, _, err := c.GetPod(ns, name)
+		if rest.IsNotFound(err) {
+			klog.Infof("pod %s/%s is gone, skip its annotations", ns, name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if keep != nil && !keep(&pod) {
+			return nil
+		}
+		patch := annotationPatch(&pod, annotations)
+		if patch == nil {
+			return nil
+		}
+		_, err = c.PatchPod(ns, name, patch)
+		switch {
+		case err == nil, rest.IsNotFound(err):
+			return nil
+		// a failed test op is 422, a lost update 409
+		case (rest.IsConflict(err) || rest.IsInvalid(err)) && attempt < annotationPatchRetries:
+			klog.Infof("pod %s/%s changed while patching its annotations, retry", ns, name)
+		default:
+			return err
+		}
+	}
+}
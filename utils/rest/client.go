@@ -2,7 +2,9 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/emicklei/go-restful"
 	"io"
@@ -10,11 +12,14 @@ import (
 	"k8s.io/klog"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type Client struct {
 	Client  *http.Client
 	BaseURL string
+	// Retry bounds the attempts of Request, zero fields take the defaults
+	Retry RetryPolicy
 }
 
 func NewClient(client *http.Client, baseURL string) *Client {
@@ -26,47 +31,86 @@ type BaseClient interface {
 	Request(method string, path string, body interface{}, respObj interface{}) (int, error)
 	PrepareRequest(method string, path string, body interface{}) (*http.Request, error)
 	CheckResponse(method string, path string, body interface{}, resp *http.Response) (*http.Response, error)
+	RetryPolicy() RetryPolicy
 }
 
-func Request(c BaseClient, method string, path string, body interface{}, respObj interface{}) (code int, err error) {
-	code = http.StatusInternalServerError
-	klog.Infof("body is %+v", body)
+func Request(c BaseClient, method string, path string, body interface{}, respObj interface{}) (int, error) {
+	return RequestContext(context.Background(), c, method, path, body, respObj)
+}
+
+// RequestContext sends the request until it succeeds, fails for good, runs
+// out of attempts or ctx is done. Failures are *APIError for a response
+// outside of 2xx, see IsNotFound and its siblings, the code is the one of the
+// last response or 500 when there was none.
+func RequestContext(ctx context.Context, c BaseClient, method string, path string, body interface{}, respObj interface{}) (int, error) {
+	policy := c.RetryPolicy().withDefaults()
+	for attempt := 0; ; attempt++ {
+		code, err := requestOnce(ctx, c, policy.Timeout, method, path, body, respObj)
+		if err == nil || attempt+1 >= policy.Attempts || ctx.Err() != nil || !retriable(method, err) {
+			return code, err
+		}
+		wait := policy.backoff(attempt)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+			if wait > policy.MaxRetryAfter {
+				wait = policy.MaxRetryAfter
+			}
+		}
+		klog.Warningf("attempt %d of %s %s failed, retry in %v, err is %v", attempt+1, method, path, wait, err)
+		select {
+		case <-ctx.Done():
+			return code, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func requestOnce(ctx context.Context, c BaseClient, timeout time.Duration, method string, path string, body interface{}, respObj interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	req, err := c.PrepareRequest(method, path, body)
-	klog.Infof("req is %+v", req)
 	if err != nil {
-		return
+		return http.StatusInternalServerError, err
 	}
-	resp, err := c.Do(req)
+	resp, err := c.Do(req.WithContext(ctx))
 	if err != nil {
-		return
+		return http.StatusInternalServerError, err
+	}
+	defer resp.Body.Close()
+	if _, err := c.CheckResponse(method, path, body, resp); err != nil {
+		klog.V(4).Infof("%s %s answered %d, err is %v", method, path, resp.StatusCode, err)
+		return resp.StatusCode, err
 	}
-	klog.Infof("resp is %+v", resp)
-	resp, err = c.CheckResponse(method, path, body, resp)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if resp != nil {
-			code = resp.StatusCode
-		}
-		return
+		return resp.StatusCode, err
 	}
-	defer resp.Body.Close()
-	if respObj != nil {
-		var respBody []byte
-		respBody, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return
-		}
-		if err = json.Unmarshal(respBody, respObj); err != nil {
-			err = NewJsonDecodingError(respBody, respObj, err)
-			return
+	klog.V(4).Infof("%s %s answered %d: %s", method, path, resp.StatusCode, Redact(respBody))
+	if respObj != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, respObj); err != nil {
+			return resp.StatusCode, NewJsonDecodingError(respBody, respObj, err)
 		}
 	}
 	return resp.StatusCode, nil
 }
+
 func (c *Client) Request(method string, path string, body interface{}, respObj interface{}) (int, error) {
 	return Request(c, method, path, body, respObj)
 }
+
+func (c *Client) RequestContext(ctx context.Context, method string, path string, body interface{}, respObj interface{}) (int, error) {
+	return RequestContext(ctx, c, method, path, body, respObj)
+}
+
+func (c *Client) RetryPolicy() RetryPolicy {
+	return c.Retry
+}
+
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Content-Type", restful.MIME_JSON)
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", restful.MIME_JSON)
+	}
 	req.Header.Set("Accept", restful.MIME_JSON)
 	resp, err := c.Client.Do(req)
 	if err != nil {
@@ -75,41 +119,29 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 func (c *Client) PrepareRequest(method string, path string, body interface{}) (*http.Request, error) {
-	klog.Infof("method is %v,path is %v, body is %+v, body is nil : %v", method, path, body, body == nil)
 	absPath := URLJoin(c.BaseURL, path)
-	klog.Infof("absPath is %v", absPath)
 	var reqBody io.Reader
-	if body == nil {
-		reqBody = nil
-	} else {
+	if body != nil {
 		jsonStr, err := json.Marshal(body)
 		if err != nil {
 			return nil, NewJsonEncodingError(body, err)
 		}
-		klog.Infof("jsonStr body : %s", jsonStr)
+		klog.V(4).Infof("%s %s with body %s", method, absPath, Redact(jsonStr))
 		reqBody = bytes.NewReader(jsonStr)
-		klog.Infof("reqBody body : %s", reqBody)
+	} else {
+		klog.V(4).Infof("%s %s", method, absPath)
 	}
 	req, err := http.NewRequest(method, absPath, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new http request ;method %s,path %s,body %v,error is %v", method, absPath, body, err)
+		return nil, fmt.Errorf("failed to create new http request ;method %s,path %s,error is %v", method, absPath, err)
 	}
 	return req, nil
 }
+
+// CheckResponse turns a response outside of 2xx into an *APIError.
 func (c *Client) CheckResponse(method string, path string, body interface{}, resp *http.Response) (*http.Response, error) {
 	if IsBadResponse(resp) {
-		var errorResp ErrorResp
-		respBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return resp, err
-		}
-		if method == http.MethodDelete {
-			return resp, NewBadResponseError(method, path, body, http.StatusText(resp.StatusCode))
-		}
-		if err := json.Unmarshal(respBody, &errorResp); err != nil {
-			return resp, NewJsonDecodingError(respBody, errorResp, err)
-		}
-		return resp, NewBadResponseError(method, path, body, errorResp.Error.Message)
+		return resp, NewAPIError(method, path, resp)
 	}
 	return resp, nil
 }
@@ -1,9 +1,11 @@
 package rest
 
 const (
+	StatusBadRequest          = "BadRequest"
 	StatusUnauthorized        = "Unauthorized"
 	StatusForbidden           = "StatusForbidden"
 	StatusNotFound            = "NotFound"
+	StatusConflict            = "Conflict"
 	StatusInternalServerError = "InternalServerError"
 )
 
@@ -1,11 +1,20 @@
 package rest
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/emicklei/go-restful"
+	"io"
+	"io/ioutil"
 	"k8s.io/klog"
+	"net/http"
+	"time"
 )
 
+// maxErrorBody bounds what is read of the body of a failed response
+const maxErrorBody = 64 * 1024
+
 type JsonDecodingError struct {
 	Data []byte
 	V    interface{}
@@ -38,23 +47,105 @@ func NewJsonEncodingError(v interface{}, err error) JsonEncodingError {
 	}
 }
 
-type BadResponseError struct {
-	Method       string
-	Path         string
-	Body         interface{}
-	ErrorMessage string
+// APIError is a response outside of 2xx, Reason and Message come from the
+// kubernetes Status or the ErrorResp in the body when it has one.
+type APIError struct {
+	Method  string
+	Path    string
+	Code    int
+	Reason  string
+	Message string
+	// RetryAfter is the Retry-After of the response, 0 without one
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = http.StatusText(e.Code)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Code, reason)
+	}
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.Code, reason, e.Message)
 }
 
-func (bs BadResponseError) Error() string {
-	return fmt.Sprintf("Bad Response from request method %s url %s body %v : %s", bs.Method, bs.Path, bs.Body, bs.ErrorMessage)
+// errorBody decodes both the Status of kubernetes and ErrorResp.
+type errorBody struct {
+	Kind    string        `json:"kind"`
+	Reason  string        `json:"reason"`
+	Message string        `json:"message"`
+	Error   ErrorRespBody `json:"error"`
 }
-func NewBadResponseError(method string, path string, body interface{}, message string) BadResponseError {
-	return BadResponseError{
-		Method:       method,
-		Path:         path,
-		Body:         body,
-		ErrorMessage: message,
+
+// NewAPIError reads the body of a failed response, a body that is neither a
+// Status nor an ErrorResp leaves the message empty.
+func NewAPIError(method, path string, resp *http.Response) *APIError {
+	apiErr := &APIError{Method: method, Path: path, Code: resp.StatusCode, RetryAfter: retryAfter(resp)}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var body errorBody
+	if err := json.Unmarshal(data, &body); err == nil {
+		apiErr.Reason, apiErr.Message = body.Reason, body.Message
+		if apiErr.Message == "" {
+			apiErr.Reason, apiErr.Message = body.Error.Code, body.Error.Message
+		}
 	}
+	return apiErr
+}
+
+// StatusCode is the http code of an APIError in err, 0 for other errors.
+func StatusCode(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+func hasReason(err error, reason string) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Reason == reason
+}
+
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsConflict is a lost update, a create of an existing object is told apart
+// by IsAlreadyExists.
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict && !IsAlreadyExists(err)
+}
+
+func IsAlreadyExists(err error) bool {
+	return StatusCode(err) == http.StatusConflict && hasReason(err, "AlreadyExists")
+}
+
+func IsUnauthorized(err error) bool {
+	return StatusCode(err) == http.StatusUnauthorized
+}
+
+func IsForbidden(err error) bool {
+	return StatusCode(err) == http.StatusForbidden
+}
+
+// IsInvalid is a request the server refused to apply, a failed test op of a
+// json patch among others.
+func IsInvalid(err error) bool {
+	return StatusCode(err) == http.StatusUnprocessableEntity
+}
+
+// IsGone is an expired resourceVersion or continue token.
+func IsGone(err error) bool {
+	return StatusCode(err) == http.StatusGone
+}
+
+func IsTooManyRequests(err error) bool {
+	return StatusCode(err) == http.StatusTooManyRequests
+}
+
+func IsServerError(err error) bool {
+	return StatusCode(err) >= http.StatusInternalServerError
 }
 
 type ErrorResp struct {
@@ -66,11 +157,11 @@ type ErrorRespBody struct {
 }
 
 func WriteError(resp *restful.Response, statusCode int, ErrCode, message string) {
-	errorRespBody := ErrorRespBody{
+	errorResp := ErrorResp{Error: ErrorRespBody{
 		Code:    ErrCode,
 		Message: message,
-	}
-	if err := resp.WriteHeaderAndJson(statusCode, errorRespBody, restful.MIME_JSON); err != nil {
+	}}
+	if err := resp.WriteHeaderAndJson(statusCode, errorResp, restful.MIME_JSON); err != nil {
 		klog.Error(err)
 	}
 }
@@ -0,0 +1,117 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func response(code int, body string, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: code, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    *http.Response
+		reason  string
+		message string
+		text    string
+	}{
+		{
+			name:    "kubernetes status",
+			resp:    response(409, `{"kind": "Status", "reason": "AlreadyExists", "message": "networks \"net1\" already exists"}`, nil),
+			reason:  "AlreadyExists",
+			message: `networks "net1" already exists`,
+			text:    `POST /things: 409 AlreadyExists: networks "net1" already exists`,
+		},
+		{
+			name:    "error response",
+			resp:    response(404, `{"error": {"code": "NotFound", "message": "network net1 does not exist"}}`, nil),
+			reason:  "NotFound",
+			message: "network net1 does not exist",
+			text:    "POST /things: 404 NotFound: network net1 does not exist",
+		},
+		{
+			name: "plain body",
+			resp: response(502, "<html>bad gateway</html>", nil),
+			text: "POST /things: 502 Bad Gateway",
+		},
+		{
+			name: "empty body",
+			resp: response(500, "", nil),
+			text: "POST /things: 500 Internal Server Error",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := NewAPIError("POST", "/things", test.resp)
+			if err.Code != test.resp.StatusCode || err.Reason != test.reason || err.Message != test.message {
+				t.Errorf("NewAPIError = %+v, want reason %q and message %q", err, test.reason, test.message)
+			}
+			if err.Error() != test.text {
+				t.Errorf("Error() = %q, want %q", err.Error(), test.text)
+			}
+		})
+	}
+	withRetry := NewAPIError("GET", "/things", response(429, "", http.Header{"Retry-After": []string{"7"}}))
+	if withRetry.RetryAfter != 7*time.Second {
+		t.Errorf("RetryAfter = %v, want 7s", withRetry.RetryAfter)
+	}
+}
+
+// TestWriteError reads what WriteError writes back with NewAPIError.
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	resp := restful.NewResponse(recorder)
+	resp.SetRequestAccepts(restful.MIME_JSON)
+	WriteError(resp, http.StatusConflict, "Conflict", "subnet subnet1 exists")
+	err := NewAPIError("POST", "/subnets", recorder.Result())
+	if err.Code != http.StatusConflict || err.Reason != "Conflict" || err.Message != "subnet subnet1 exists" {
+		t.Errorf("NewAPIError of WriteError = %+v", err)
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	conflict := &APIError{Code: http.StatusConflict, Reason: "Conflict"}
+	exists := &APIError{Code: http.StatusConflict, Reason: "AlreadyExists"}
+	tests := []struct {
+		name string
+		is   func(error) bool
+		yes  []error
+		no   []error
+	}{
+		{"IsConflict", IsConflict, []error{conflict, fmt.Errorf("update: %w", conflict), &APIError{Code: 409}}, []error{exists, errors.New("409")}},
+		{"IsAlreadyExists", IsAlreadyExists, []error{exists, fmt.Errorf("create: %w", exists)}, []error{conflict, &APIError{Code: 400, Reason: "AlreadyExists"}}},
+		{"IsNotFound", IsNotFound, []error{&APIError{Code: 404}}, []error{&APIError{Code: 410}, nil}},
+		{"IsGone", IsGone, []error{&APIError{Code: 410}}, []error{&APIError{Code: 404}}},
+		{"IsUnauthorized", IsUnauthorized, []error{&APIError{Code: 401}}, []error{&APIError{Code: 403}}},
+		{"IsForbidden", IsForbidden, []error{&APIError{Code: 403}}, []error{&APIError{Code: 401}}},
+		{"IsInvalid", IsInvalid, []error{&APIError{Code: 422}}, []error{&APIError{Code: 400}}},
+		{"IsTooManyRequests", IsTooManyRequests, []error{&APIError{Code: 429}}, []error{&APIError{Code: 503}}},
+		{"IsServerError", IsServerError, []error{&APIError{Code: 500}, &APIError{Code: 503}}, []error{&APIError{Code: 499}, errors.New("500")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, err := range test.yes {
+				if !test.is(err) {
+					t.Errorf("%s(%v) = false", test.name, err)
+				}
+			}
+			for _, err := range test.no {
+				if test.is(err) {
+					t.Errorf("%s(%v) = true", test.name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxLoggedBody bounds what a log line shows of a body
+const maxLoggedBody = 512
+
+// sensitiveKeys are masked in logged bodies wherever they appear
+var sensitiveKeys = []string{"token", "password", "secret", "key", "cert", "authorization", "credential"}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if sensitive(key) {
+				value[key] = "<redacted>"
+			} else {
+				value[key] = redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redactValue(value[i])
+		}
+	}
+	return v
+}
+
+// Redact renders a body for the logs: sensitive fields are masked and the
+// result is cut to a few hundred bytes. A body that is not json is only
+// described by its size.
+func Redact(body []byte) string {
+	if len(body) == 0 {
+		return "<empty>"
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(redactValue(v)); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	data := bytes.TrimSpace(buf.Bytes())
+	if len(data) > maxLoggedBody {
+		return fmt.Sprintf("%s...<%d bytes>", data[:maxLoggedBody], len(body))
+	}
+	return string(data)
+}
@@ -0,0 +1,43 @@
+package rest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	long := fmt.Sprintf(`{"data":%q}`, strings.Repeat("x", 2*maxLoggedBody))
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty", "", "<empty>"},
+		{"not json", "hello", "<5 bytes>"},
+		{"plain fields", `{"name": "net1", "mtu": 1450}`, `{"mtu":1450,"name":"net1"}`},
+		{
+			name: "sensitive fields",
+			body: `{"token": "t", "Password": "p", "clientKeyData": "k", "name": "a<b>"}`,
+			want: `{"Password":"<redacted>","clientKeyData":"<redacted>","name":"a<b>","token":"<redacted>"}`,
+		},
+		{
+			name: "nested fields",
+			body: `{"users": [{"name": "admin", "user": {"client-certificate-data": "c", "username": "u"}}]}`,
+			want: `{"users":[{"name":"admin","user":{"client-certificate-data":"<redacted>","username":"u"}}]}`,
+		},
+		{
+			name: "sensitive object",
+			body: `{"secret": {"data": "d"}, "items": ["token"]}`,
+			want: `{"items":["token"],"secret":"<redacted>"}`,
+		},
+		{"long body", long, long[:maxLoggedBody] + fmt.Sprintf("...<%d bytes>", len(long))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Redact([]byte(test.body)); got != test.want {
+				t.Errorf("Redact = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
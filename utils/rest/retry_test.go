@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}.withDefaults()
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if wait := policy.backoff(attempt); wait < want/2 || wait > want {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, wait, want/2, want)
+			}
+		}
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name   string
+		err    error
+		get    bool
+		create bool
+	}{
+		{"server error", &APIError{Code: http.StatusInternalServerError}, true, false},
+		{"unavailable", &APIError{Code: http.StatusServiceUnavailable}, true, false},
+		{"unavailable with retry-after", &APIError{Code: http.StatusServiceUnavailable, RetryAfter: time.Second}, true, true},
+		{"too many requests", &APIError{Code: http.StatusTooManyRequests}, true, true},
+		{"not found", &APIError{Code: http.StatusNotFound}, false, false},
+		{"conflict", &APIError{Code: http.StatusConflict}, false, false},
+		{"forbidden", &APIError{Code: http.StatusForbidden}, false, false},
+		{"wrapped server error", fmt.Errorf("sync: %w", &APIError{Code: http.StatusBadGateway}), true, false},
+		{"network error", netErr, true, false},
+		{"timeout", context.DeadlineExceeded, true, false},
+		{"canceled", context.Canceled, false, false},
+		{"other error", errors.New("bad body"), false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for method, want := range map[string]bool{
+				http.MethodGet:    test.get,
+				http.MethodPut:    test.get,
+				http.MethodDelete: test.get,
+				http.MethodPost:   test.create,
+				http.MethodPatch:  test.create,
+			} {
+				if got := retriable(method, test.err); got != want {
+					t.Errorf("retriable(%s) = %v, want %v", method, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"3", 3 * time.Second, 3 * time.Second},
+		{"-1", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.value != "" {
+			resp.Header.Set("Retry-After", test.value)
+		}
+		if got := retryAfter(resp); got < test.min || got > test.max {
+			t.Errorf("retryAfter(%q) = %v, want between %v and %v", test.value, got, test.min, test.max)
+		}
+	}
+}
+
+// scripted answers the requests with codes in turn, then with 200.
+type scripted struct {
+	lock       sync.Mutex
+	codes      []int
+	retryAfter string
+	calls      int
+}
+
+func (s *scripted) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	if len(s.codes) == 0 {
+		_, _ = w.Write([]byte(`{"ok": true}`))
+		return
+	}
+	code := s.codes[0]
+	s.codes = s.codes[1:]
+	if s.retryAfter != "" {
+		w.Header().Set("Retry-After", s.retryAfter)
+	}
+	w.WriteHeader(code)
+}
+
+func TestRequestRetries(t *testing.T) {
+	fast := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond, MaxRetryAfter: 10 * time.Millisecond}
+	tests := []struct {
+		name       string
+		method     string
+		codes      []int
+		retryAfter string
+		code       int
+		calls      int
+	}{
+		{"get after server errors", http.MethodGet, []int{500, 502}, "", 200, 3},
+		{"get out of attempts", http.MethodGet, []int{500, 500, 500, 500}, "", 500, 3},
+		{"post on a server error", http.MethodPost, []int{500}, "", 500, 1},
+		{"post told to come back, capped", http.MethodPost, []int{429, 503}, "3600", 200, 3},
+		{"not found", http.MethodGet, []int{404}, "", 404, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &scripted{codes: test.codes, retryAfter: test.retryAfter}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			client := NewClient(ts.Client(), ts.URL)
+			client.Retry = fast
+			start := time.Now()
+			var resp struct {
+				OK bool `json:"ok"`
+			}
+			code, err := client.Request(test.method, "/things", nil, &resp)
+			if code != test.code || (err == nil) != (test.code == 200) || (err == nil && !resp.OK) {
+				t.Errorf("Request = %d, %v, want %d", code, err, test.code)
+			}
+			if err != nil && StatusCode(err) != test.code {
+				t.Errorf("StatusCode(%v) = %d, want %d", err, StatusCode(err), test.code)
+			}
+			if server.calls != test.calls {
+				t.Errorf("%d calls, want %d", server.calls, test.calls)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Request took %v, the retry-after is not capped", elapsed)
+			}
+		})
+	}
+}
+
+func TestRequestStopsWithContext(t *testing.T) {
+	server := &scripted{codes: []int{500, 500, 500}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client := NewClient(ts.Client(), ts.URL)
+	client.Retry = RetryPolicy{Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if code, err := client.RequestContext(ctx, http.MethodGet, "/things", nil, nil); code != 500 || err == nil {
+		t.Errorf("RequestContext = %d, %v, want the 500 of the last attempt", code, err)
+	}
+	if server.calls != 1 {
+		t.Errorf("%d calls, want 1 before the context ended", server.calls)
+	}
+}
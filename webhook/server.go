@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"cni/utils/k8s"
+	"cni/utils/rest"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+)
+
+const (
+	ValidatePodsPath = "/validate/pods"
+	HealthzPath      = "/healthz"
+)
+
+// NewContainer serves the admission reviews of the api server, the caller
+// adds TLS, see cmd/tinycni-webhook.
+func NewContainer(v *Validator) *restful.Container {
+	container := restful.NewContainer()
+	ws := new(restful.WebService)
+	ws.Route(ws.POST(ValidatePodsPath).To(v.reviewPod).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON))
+	ws.Route(ws.GET(HealthzPath).To(func(req *restful.Request, resp *restful.Response) {
+		_, _ = resp.Write([]byte("ok"))
+	}))
+	container.Add(ws)
+	return container
+}
+
+func (v *Validator) reviewPod(req *restful.Request, resp *restful.Response) {
+	var review k8s.AdmissionReview
+	if err := req.ReadEntity(&review); err != nil || review.Request == nil {
+		rest.WriteError(resp, http.StatusBadRequest, rest.StatusBadRequest, fmt.Sprintf("expected an %s %s", k8s.AdmissionAPIVersion, k8s.AdmissionReviewKind))
+		return
+	}
+	request := review.Request
+	answer := &k8s.AdmissionResponse{UID: request.UID, Allowed: true}
+	var pod k8s.Pod
+	if err := json.Unmarshal(request.Object, &pod); err != nil {
+		answer.Allowed = false
+		answer.Status = &k8s.AdmissionStatus{Code: http.StatusBadRequest, Reason: "BadRequest", Message: fmt.Sprintf("failed to read the pod: %v", err)}
+	} else {
+		problems, err := v.ValidatePod(&pod)
+		if err != nil {
+			// the failurePolicy of the webhook configuration decides
+			klog.Errorf("failed to validate pod %s/%s, err is %v", request.Namespace, podName(request, &pod), err)
+			rest.WriteError(resp, http.StatusInternalServerError, rest.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(problems) > 0 {
+			klog.Infof("denied pod %s/%s: %s", request.Namespace, podName(request, &pod), strings.Join(problems, "; "))
+			answer.Allowed = false
+			answer.Status = &k8s.AdmissionStatus{
+				Code:    http.StatusUnprocessableEntity,
+				Reason:  "Invalid",
+				Message: "tinycni: " + strings.Join(problems, "; "),
+			}
+		}
+	}
+	_ = resp.WriteAsJson(k8s.AdmissionReview{
+		APIVersion: k8s.AdmissionAPIVersion,
+		Kind:       k8s.AdmissionReviewKind,
+		Response:   answer,
+	})
+}
+
+// podName names the pod in the logs, a pod to be created from a generateName
+// has none yet.
+func podName(request *k8s.AdmissionRequest, pod *k8s.Pod) string {
+	if request.Name != "" {
+		return request.Name
+	}
+	if pod.MetaData.Name != "" {
+		return pod.MetaData.Name
+	}
+	return "(unnamed)"
+}
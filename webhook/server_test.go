@@ -0,0 +1,269 @@
+package webhook
+
+import (
+	"bytes"
+	"cni/etcd"
+	"cni/etcd/etcdtest"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves a validator whose datastore holds the networks
+// net1, storage, with 10.30.0.5 in use, and full, without a free address.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ds, _, err := etcdtest.NewDatastore()
+	if err != nil {
+		t.Fatalf("failed to start the etcd datastore: %v", err)
+	}
+	t.Cleanup(func() { _ = ds.Close() })
+	for name, cidr := range map[string]string{"net1": "10.10.0.0/24", "full": "10.20.0.0/30", "storage": "10.30.0.0/24"} {
+		network := &etcd.NetworkCrd{Name: name, Subnets: []etcd.Subnet{{Name: "subnet1", CIDR: cidr}}}
+		if err := ipam.CreateNetworkCrd(ds, network); err != nil {
+			t.Fatalf("CreateNetworkCrd(%s): %v", name, err)
+		}
+	}
+	allocations := []*ipam.AllocateArgs{
+		{Network: "full", NameSpace: "default", PodName: "a", ContainerId: "c1", Node: "node-1"},
+		{Network: "full", NameSpace: "default", PodName: "b", ContainerId: "c2", Node: "node-1"},
+		{Network: "storage", NameSpace: "default", PodName: "c", ContainerId: "c3", Node: "node-1", IP: "10.30.0.5"},
+	}
+	for _, args := range allocations {
+		if _, err := ipam.AllocationIpFromNetwork(ds, args); err != nil {
+			t.Fatalf("AllocationIpFromNetwork(%s): %v", args.PodName, err)
+		}
+	}
+	server := httptest.NewServer(NewContainer(NewValidator(ds)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testPod(annotations, labels map[string]string) k8s.Pod {
+	pod := k8s.Pod{}
+	pod.MetaData.Name = "web-0"
+	pod.MetaData.NameSpace = "default"
+	pod.MetaData.Annotations = annotations
+	pod.MetaData.Labels = labels
+	return pod
+}
+
+func post(t *testing.T, server *httptest.Server, body []byte) *http.Response {
+	t.Helper()
+	resp, err := http.Post(server.URL+ValidatePodsPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", ValidatePodsPath, err)
+	}
+	return resp
+}
+
+// review sends object in an admission review and returns the answer.
+func review(t *testing.T, server *httptest.Server, object interface{}) *k8s.AdmissionResponse {
+	t.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(k8s.AdmissionReview{
+		APIVersion: k8s.AdmissionAPIVersion,
+		Kind:       k8s.AdmissionReviewKind,
+		Request: &k8s.AdmissionRequest{
+			UID:       "6f1e2c1a",
+			Kind:      k8s.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: "CREATE",
+			Object:    raw,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := post(t, server, body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("review answered %d: %s", resp.StatusCode, data)
+	}
+	var answer k8s.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatalf("failed to decode the answer: %v", err)
+	}
+	if answer.APIVersion != k8s.AdmissionAPIVersion || answer.Kind != k8s.AdmissionReviewKind || answer.Response == nil {
+		t.Fatalf("answer = %+v, want an %s %s with a response", answer, k8s.AdmissionAPIVersion, k8s.AdmissionReviewKind)
+	}
+	if answer.Response.UID != "6f1e2c1a" {
+		t.Errorf("answer uid = %q, want the one of the request", answer.Response.UID)
+	}
+	return answer.Response
+}
+
+func TestReviewAllowsPod(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name string
+		pod  k8s.Pod
+	}{
+		{"no network", testPod(nil, nil)},
+		{"network annotation", testPod(map[string]string{k8s.NetworkAnnotation: "net1"}, nil)},
+		{"network label", testPod(nil, map[string]string{k8s.NetworkAnnotation: "net1"})},
+		{"more networks", testPod(map[string]string{
+			k8s.NetworkAnnotation:  "net1",
+			k8s.NetworksAnnotation: "storage@net1",
+		}, nil)},
+		{"free requested ip", testPod(map[string]string{
+			k8s.NetworksAnnotation: `[{"name": "storage", "interface": "net1", "ips": ["10.30.0.6/24"]}]`,
+		}, nil)},
+		{"host network", func() k8s.Pod {
+			pod := testPod(map[string]string{k8s.NetworkAnnotation: "missing"}, nil)
+			pod.Spec.HostNetwork = true
+			return pod
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			answer := review(t, server, test.pod)
+			if !answer.Allowed || answer.Status != nil {
+				t.Errorf("answer = %+v, want allowed", answer)
+			}
+		})
+	}
+}
+
+func TestReviewDeniesPod(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		want        string
+	}{
+		{
+			name:        "empty network annotation",
+			annotations: map[string]string{k8s.NetworkAnnotation: " "},
+			want:        "the tinycni.io/network annotation is empty",
+		},
+		{
+			name:   "empty network label",
+			labels: map[string]string{k8s.NetworkAnnotation: ""},
+			want:   "the tinycni.io/network label is empty",
+		},
+		{
+			name:        "unknown network",
+			annotations: map[string]string{k8s.NetworkAnnotation: "missing"},
+			want:        `network "missing" does not exist`,
+		},
+		{
+			name:        "unknown additional network",
+			annotations: map[string]string{k8s.NetworksAnnotation: "net1,missing@net2"},
+			want:        `network "missing" does not exist`,
+		},
+		{
+			name:        "full network",
+			annotations: map[string]string{k8s.NetworkAnnotation: "full"},
+			want:        `network "full" has no free address left, subnets in use: subnet1 2/2`,
+		},
+		{
+			name:        "malformed networks annotation",
+			annotations: map[string]string{k8s.NetworksAnnotation: `[{"name": "storage"`},
+			want:        "invalid tinycni.io/networks annotation",
+		},
+		{
+			name:        "network joined twice",
+			annotations: map[string]string{k8s.NetworkAnnotation: "net1", k8s.NetworksAnnotation: "storage,net1"},
+			want:        `network "net1" is joined more than once`,
+		},
+		{
+			name:        "interface name used twice",
+			annotations: map[string]string{k8s.NetworksAnnotation: "net1@net5,storage@net5"},
+			want:        `interface name "net5" is used by more than one network`,
+		},
+		{
+			name:        "invalid interface name",
+			annotations: map[string]string{k8s.NetworksAnnotation: "storage@net/1"},
+			want:        `interface name "net/1" of network storage is invalid`,
+		},
+		{
+			name:        "requested ip outside the subnets",
+			annotations: map[string]string{k8s.NetworksAnnotation: `[{"name": "storage", "ips": ["10.99.0.1"]}]`},
+			want:        "address 10.99.0.1 of network storage cannot be allocated; it lies in no subnet of the network",
+		},
+		{
+			name:        "requested ip in use",
+			annotations: map[string]string{k8s.NetworksAnnotation: `[{"name": "storage", "ips": ["10.30.0.5"]}]`},
+			want:        "address 10.30.0.5 of network storage cannot be allocated; it is already in use",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			answer := review(t, server, testPod(test.annotations, test.labels))
+			if answer.Allowed || answer.Status == nil {
+				t.Fatalf("answer = %+v, want denied", answer)
+			}
+			if answer.Status.Code != http.StatusUnprocessableEntity || answer.Status.Reason != "Invalid" {
+				t.Errorf("status = %d %s, want %d Invalid", answer.Status.Code, answer.Status.Reason, http.StatusUnprocessableEntity)
+			}
+			if !strings.HasPrefix(answer.Status.Message, "tinycni: ") || !strings.Contains(answer.Status.Message, test.want) {
+				t.Errorf("message = %q, want it to contain %q", answer.Status.Message, test.want)
+			}
+		})
+	}
+}
+
+func TestReviewReportsEveryProblem(t *testing.T) {
+	server := newTestServer(t)
+	answer := review(t, server, testPod(map[string]string{
+		k8s.NetworkAnnotation:  "missing",
+		k8s.NetworksAnnotation: "missing,full@net1,storage@net1",
+	}, nil))
+	if answer.Allowed || answer.Status == nil {
+		t.Fatalf("answer = %+v, want denied", answer)
+	}
+	want := `tinycni: network "missing" does not exist; network "missing" is joined more than once; ` +
+		`network "full" has no free address left, subnets in use: subnet1 2/2; ` +
+		`interface name "net1" is used by more than one network`
+	if answer.Status.Message != want {
+		t.Errorf("message = %q, want %q", answer.Status.Message, want)
+	}
+}
+
+func TestReviewDeniesUnreadablePod(t *testing.T) {
+	server := newTestServer(t)
+	answer := review(t, server, "not a pod")
+	if answer.Allowed || answer.Status == nil || answer.Status.Code != http.StatusBadRequest || answer.Status.Reason != "BadRequest" {
+		t.Errorf("answer = %+v, want denied as a bad request", answer)
+	}
+}
+
+func TestReviewRejectsMalformedReview(t *testing.T) {
+	server := newTestServer(t)
+	for name, body := range map[string]string{
+		"not json":   "{",
+		"no request": `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := post(t, server, []byte(body))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	server := newTestServer(t)
+	resp, err := http.Get(server.URL + HealthzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Errorf("healthz = %d %q, want 200 ok", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"cni/datastore"
+	"cni/etcd"
+	"cni/ipam"
+	"cni/utils/k8s"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"strings"
+)
+
+// Validator checks the network annotations of a pod against the datastore
+// before the pod is created, so that a typo fails at kubectl apply and not
+// at sandbox creation on the node.
+type Validator struct {
+	store datastore.Datastore
+}
+
+func NewValidator(store datastore.Datastore) *Validator {
+	return &Validator{store: store}
+}
+
+// ValidatePod returns every problem of the network annotations of pod, nil
+// when it may be admitted. Pods that name no network are left to the
+// fallbacks of the plugin.
+func (v *Validator) ValidatePod(pod *k8s.Pod) ([]string, error) {
+	if pod.Spec.HostNetwork {
+		return nil, nil
+	}
+	var problems []string
+	networks := make(map[string]*etcd.NetworkCrd)
+	// network looks a network up once, a missing one is reported at its
+	// first mention only
+	network := func(name string) (*etcd.NetworkCrd, bool, error) {
+		if crd, ok := networks[name]; ok {
+			return crd, crd != nil, nil
+		}
+		crd, err := ipam.GetNetwork(v.store, name)
+		if ipam.IsNetworkNotFound(err) {
+			networks[name] = nil
+			problems = append(problems, fmt.Sprintf("network %q does not exist", name))
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		networks[name] = crd
+		return crd, true, nil
+	}
+
+	primary, source := pod.MetaData.Annotations[k8s.NetworkAnnotation], "annotation"
+	if _, ok := pod.MetaData.Annotations[k8s.NetworkAnnotation]; !ok {
+		primary, source = pod.MetaData.Labels[k8s.NetworkAnnotation], "label"
+		if _, ok := pod.MetaData.Labels[k8s.NetworkAnnotation]; !ok {
+			source = ""
+		}
+	}
+	if source != "" {
+		if strings.TrimSpace(primary) == "" {
+			problems = append(problems, fmt.Sprintf("the %s %s is empty", k8s.NetworkAnnotation, source))
+		} else if crd, ok, err := network(primary); err != nil {
+			return nil, err
+		} else if ok {
+			if err := v.checkFree(crd, &problems); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	selections, err := k8s.ParseNetworkSelections(pod.MetaData.Annotations[k8s.NetworksAnnotation])
+	if err != nil {
+		return append(problems, err.Error()), nil
+	}
+	seen := map[string]bool{}
+	if source != "" && primary != "" {
+		seen[primary] = true
+	}
+	ifNames := map[string]bool{}
+	for _, selection := range selections {
+		if seen[selection.Name] {
+			problems = append(problems, fmt.Sprintf("network %q is joined more than once", selection.Name))
+			continue
+		}
+		seen[selection.Name] = true
+		if selection.Interface != "" {
+			if ifNames[selection.Interface] {
+				problems = append(problems, fmt.Sprintf("interface name %q is used by more than one network", selection.Interface))
+			}
+			ifNames[selection.Interface] = true
+		}
+		crd, ok, err := network(selection.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if ip := selection.IP(); ip != "" {
+			if err := ipam.CheckRequestedIp(v.store, crd, ip); err != nil {
+				if _, unavailable := err.(*types.Error); !unavailable {
+					return nil, err
+				}
+				problems = append(problems, err.Error())
+			}
+			continue
+		}
+		if err := v.checkFree(crd, &problems); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// checkFree reports a network without a free address left.
+func (v *Validator) checkFree(network *etcd.NetworkCrd, problems *[]string) error {
+	usage, err := ipam.GetNetworkUsage(v.store, network)
+	if err != nil {
+		return err
+	}
+	if usage.Free > 0 {
+		return nil
+	}
+	var subnets []string
+	for _, subnet := range usage.Subnets {
+		subnets = append(subnets, fmt.Sprintf("%s %d/%d", subnet.Name, subnet.Allocated+subnet.Reserved+subnet.Conflict, subnet.Size))
+	}
+	*problems = append(*problems, fmt.Sprintf("network %q has no free address left, subnets in use: %s", network.Name, strings.Join(subnets, ", ")))
+	return nil
+}